@@ -0,0 +1,381 @@
+package ivmsesman
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SessionBuffer is implemented by the session stores which can keep the changes of a request in memory
+// and write them at once (write-behind), instead of a store round trip on every Set, Get and Delete.
+// MWManager buffers the session of the request and saves it after the handler returns. The session is
+// shared by the concurrent requests of the session; the changes made with the context of a request are
+// kept apart, so a request discarding or failing to save its changes leaves the others' alone.
+type SessionBuffer interface {
+	// Buffer makes Set and Delete change the session in memory only, tracking the changed keys, and Get
+	// record the access without a write. The calls nest - the session is buffered until every Buffer
+	// call is matched by Release.
+	Buffer(ctx context.Context)
+
+	// Save writes the changed keys and the last access time in a single write
+	Save(ctx context.Context) error
+
+	// Release saves the session and ends the buffering started by the matching Buffer call. The changes of
+	// the request not written, e.g. as the save failed, are dropped.
+	Release(ctx context.Context) error
+
+	// Discard drops the changes not saved yet, e.g. of a destroyed session, and the ones to come of the request
+	Discard(ctx context.Context)
+}
+
+// SessionWriter are the writes of a provider session using WriteBehind
+type SessionWriter interface {
+	// WriteValues writes the values and removes the deletes keys of the session, refreshing its last access time
+	WriteValues(ctx context.Context, values map[string]interface{}, deletes []string) error
+
+	// WriteAccess rewrites the last access time of the session
+	WriteAccess(ctx context.Context) error
+
+	// TouchDue reports if a read at the unix time now rewrites the last access time accessed
+	TouchDue(accessed, now int64) bool
+}
+
+// WriteBehind is the write-behind state of a provider session implementing SessionBuffer, shared by the
+// providers writing the changed keys of a session in a single update. Its lock guards the values of the
+// session too, as the session is shared by the concurrent requests of the session. The session calls Init
+// before it is used.
+type WriteBehind struct {
+	mu       sync.Mutex
+	w        SessionWriter
+	accessed *int64
+	buffered int
+	// requests are the changes of the requests served by MWManager buffering the session, shared the ones
+	// made without the context of such a request
+	requests map[*requestBuffered]*pending
+	shared   pending
+}
+
+// pending are the changes of a buffered session not written yet
+type pending struct {
+	dirty   map[string]interface{}
+	touched bool
+	// refs counts the Buffer calls of the request not released yet; discarded drops its changes
+	refs      int
+	discarded bool
+}
+
+// keep records the change of the key, unless the changes are discarded
+func (p *pending) keep(key string, value interface{}) {
+	if p.discarded {
+		return
+	}
+	if p.dirty == nil {
+		p.dirty = make(map[string]interface{})
+	}
+	p.dirty[key] = value
+}
+
+// restore records again the changes of a failed write not overwritten meanwhile
+func (p *pending) restore(dirty map[string]interface{}) {
+	for k, v := range dirty {
+		if _, ok := p.dirty[k]; !ok {
+			p.keep(k, v)
+		}
+	}
+	p.touched = !p.discarded
+}
+
+// deletedValue marks a key deleted in the changes of a buffered session
+type deletedValue struct{}
+
+// Init sets the writes of the session and its last access time, updated by the writes
+func (wb *WriteBehind) Init(w SessionWriter, accessed *int64) {
+	wb.w, wb.accessed = w, accessed
+}
+
+// Lock locks the session values
+func (wb *WriteBehind) Lock() {
+	wb.mu.Lock()
+}
+
+// Unlock unlocks the session values
+func (wb *WriteBehind) Unlock() {
+	wb.mu.Unlock()
+}
+
+// request returns the changes of the request of ctx buffering the session, nil when ctx is not the context
+// of such a request. The caller holds the lock.
+func (wb *WriteBehind) request(ctx context.Context) *pending {
+	rb, _ := ctx.Value(bufferKey{}).(*requestBuffered)
+	return wb.requests[rb]
+}
+
+// pendingOf returns the changes the change made with ctx belongs to. The caller holds the lock.
+func (wb *WriteBehind) pendingOf(ctx context.Context) *pending {
+	if p := wb.request(ctx); p != nil {
+		return p
+	}
+	return &wb.shared
+}
+
+// Set runs apply, the change of the key in the session values, under the lock. The change is written
+// right away unless the session is buffered.
+func (wb *WriteBehind) Set(ctx context.Context, key string, value interface{}, apply func()) error {
+	return wb.change(ctx, key, value, apply)
+}
+
+// Delete runs apply, the removal of the key from the session values, under the lock. The removal is
+// written right away unless the session is buffered.
+func (wb *WriteBehind) Delete(ctx context.Context, key string, apply func()) error {
+	return wb.change(ctx, key, deletedValue{}, apply)
+}
+
+func (wb *WriteBehind) change(ctx context.Context, key string, value interface{}, apply func()) error {
+
+	wb.mu.Lock()
+	apply()
+	if wb.buffered > 0 {
+		wb.pendingOf(ctx).keep(key, value)
+		wb.mu.Unlock()
+		return nil
+	}
+	wb.mu.Unlock()
+
+	now := time.Now().Unix()
+	values, deletes := splitChanges(map[string]interface{}{key: value})
+	if err := wb.w.WriteValues(ctx, values, deletes); err != nil {
+		return err
+	}
+	wb.accessedAt(now)
+	return nil
+}
+
+// Touch rewrites the last access time, at most once per touch interval of the provider. The concurrent
+// and the following reads of the session within the interval do not write; the buffered session records
+// the access for Save.
+func (wb *WriteBehind) Touch(ctx context.Context) {
+
+	now := time.Now().Unix()
+	wb.mu.Lock()
+	if wb.buffered > 0 {
+		if p := wb.pendingOf(ctx); !p.discarded {
+			p.touched = true
+		}
+		wb.mu.Unlock()
+		return
+	}
+	if !wb.w.TouchDue(*wb.accessed, now) {
+		wb.mu.Unlock()
+		return
+	}
+	*wb.accessed = now
+	wb.mu.Unlock()
+
+	_ = wb.w.WriteAccess(ctx)
+}
+
+// Buffer keeps the changes of the session in memory until Save or Release. The changes made with the
+// context of the request served by MWManager, ctx, are tracked apart from the other requests'.
+func (wb *WriteBehind) Buffer(ctx context.Context) {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	wb.buffered++
+	rb, ok := ctx.Value(bufferKey{}).(*requestBuffered)
+	if !ok {
+		return
+	}
+	if wb.requests == nil {
+		wb.requests = make(map[*requestBuffered]*pending)
+	}
+	p := wb.requests[rb]
+	if p == nil {
+		p = &pending{}
+		wb.requests[rb] = p
+	}
+	p.refs++
+}
+
+// Save writes the changed values and the time accessed of the session in a single update: the changes of
+// the request of ctx and the ones made without a request. A request which discarded its changes writes nothing.
+func (wb *WriteBehind) Save(ctx context.Context) error {
+
+	now := time.Now().Unix()
+	wb.mu.Lock()
+	own := wb.request(ctx)
+	if own == nil {
+		own = &pending{}
+	}
+	if own.discarded {
+		wb.mu.Unlock()
+		return nil
+	}
+
+	changes := make(map[string]interface{}, len(wb.shared.dirty)+len(own.dirty))
+	for k, v := range wb.shared.dirty {
+		changes[k] = v
+	}
+	for k, v := range own.dirty {
+		changes[k] = v
+	}
+	touched := wb.shared.touched || own.touched
+	shared, dirty := wb.shared.dirty, own.dirty
+	wb.shared.dirty, wb.shared.touched = nil, false
+	own.dirty, own.touched = nil, false
+	if len(changes) == 0 && (!touched || !wb.w.TouchDue(*wb.accessed, now)) {
+		wb.mu.Unlock()
+		return nil
+	}
+	wb.mu.Unlock()
+
+	values, deletes := splitChanges(changes)
+	if err := wb.w.WriteValues(ctx, values, deletes); err != nil {
+		// keep the changes not overwritten meanwhile for the next save
+		wb.mu.Lock()
+		wb.shared.restore(shared)
+		own.restore(dirty)
+		wb.mu.Unlock()
+		return err
+	}
+
+	wb.accessedAt(now)
+	return nil
+}
+
+// Release saves the session and ends the buffering started by the matching Buffer call. The changes of the
+// request not written are dropped, and the ones made without a request once the session is no longer buffered.
+func (wb *WriteBehind) Release(ctx context.Context) error {
+
+	err := wb.Save(ctx)
+
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	rb, _ := ctx.Value(bufferKey{}).(*requestBuffered)
+	if p := wb.requests[rb]; p != nil {
+		if p.refs--; p.refs <= 0 {
+			delete(wb.requests, rb)
+		}
+	}
+	if wb.buffered > 0 {
+		wb.buffered--
+	}
+	if wb.buffered == 0 {
+		wb.requests, wb.shared = nil, pending{}
+	}
+	return err
+}
+
+// Discard drops the changes of the request of ctx not saved yet and the ones it makes until its release.
+// Without a request it drops the changes made without one.
+func (wb *WriteBehind) Discard(ctx context.Context) {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	if p := wb.request(ctx); p != nil {
+		p.dirty, p.touched, p.discarded = nil, false, true
+		return
+	}
+	wb.shared = pending{}
+}
+
+// accessedAt records the last access time written with the session values
+func (wb *WriteBehind) accessedAt(now int64) {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	if now > *wb.accessed {
+		*wb.accessed = now
+	}
+}
+
+// splitChanges returns the values set and the keys deleted of the changes
+func splitChanges(changes map[string]interface{}) (map[string]interface{}, []string) {
+
+	values := make(map[string]interface{}, len(changes))
+	var deletes []string
+	for k, v := range changes {
+		if _, ok := v.(deletedValue); ok {
+			deletes = append(deletes, k)
+		} else {
+			values[k] = v
+		}
+	}
+	return values, deletes
+}
+
+// bufferOf returns the write-behind view of the session store, if it supports it
+func bufferOf(ss SessionStore) (SessionBuffer, bool) {
+	if sa, ok := ss.(storeAdapter); ok {
+		ss = sa.SessionStore
+	}
+	sb, ok := ss.(SessionBuffer)
+	return sb, ok
+}
+
+// bufferKey is the context key of the session buffered for the request served by MWManager
+type bufferKey struct{}
+
+// requestBuffered is the session buffered for the request served by MWManager
+type requestBuffered struct {
+	ss SessionStore
+	sb SessionBuffer
+
+	// detached is set once the session left its id, regenerated or destroyed by the request. The session of
+	// the request context is not swapped, so its later reads and changes are dropped instead of written
+	// under the old id.
+	detached atomic.Bool
+}
+
+// detach drops the changes of the request not saved yet and the ones to come. ctx is the context of the request.
+func (rb *requestBuffered) detach(ctx context.Context) {
+	rb.detached.Store(true)
+	rb.sb.Discard(ctx)
+}
+
+// requestBuffer returns the buffered session sid of the request served by MWManager, if any
+func requestBuffer(ctx context.Context, sid string) (*requestBuffered, bool) {
+	rb, ok := ctx.Value(bufferKey{}).(*requestBuffered)
+	if !ok || rb.detached.Load() || rb.ss.SessionID() != sid {
+		return nil, false
+	}
+	return rb, true
+}
+
+// Save writes the buffered changes of the session right away, e.g. before a handler redirects the client
+// to a service reading the session. It does nothing for the stores writing every change.
+func (sm *Sesman) Save(ctx context.Context, ss SessionStore) error {
+
+	sb, ok := bufferOf(ss)
+	if !ok {
+		return nil
+	}
+
+	start := time.Now()
+	err := sb.Save(ctx)
+	sm.metrics.observe("Save", start, err)
+	if err != nil {
+		return fmt.Errorf("unable to save session id %v, error %v", ss.SessionID(), err)
+	}
+	return nil
+}
+
+// release saves the session buffered for the request served by MWManager, unless the request detached it
+// from its id. The request may be canceled already, so the save does not depend on its cancellation.
+func (sm *Sesman) release(ctx context.Context, rb *requestBuffered) {
+
+	if rb.detached.Load() {
+		// nothing is left to write, the release only ends the buffering
+		rb.sb.Discard(ctx)
+	}
+
+	start := time.Now()
+	err := rb.sb.Release(context.WithoutCancel(ctx))
+	sm.metrics.observe("Save", start, err)
+	if err != nil {
+		sm.logger().ErrorContext(ctx, "unable to save the session changes of the request",
+			slog.Any("sid", Sensitive(rb.ss.SessionID())), slog.Any("error", err))
+	}
+}
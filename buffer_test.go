@@ -0,0 +1,149 @@
+package ivmsesman
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// recordingWriter records the writes of a WriteBehind session
+type recordingWriter struct {
+	writes   []map[string]interface{}
+	deletes  [][]string
+	accesses int
+	fail     error
+	touch    int64
+}
+
+func (w *recordingWriter) WriteValues(ctx context.Context, values map[string]interface{}, deletes []string) error {
+	if w.fail != nil {
+		return w.fail
+	}
+	sort.Strings(deletes)
+	w.writes, w.deletes = append(w.writes, values), append(w.deletes, deletes)
+	return nil
+}
+
+func (w *recordingWriter) WriteAccess(ctx context.Context) error {
+	w.accesses++
+	return nil
+}
+
+func (w *recordingWriter) TouchDue(accessed, now int64) bool {
+	return ExpiryPolicy{Touch: w.touch}.TouchDue(accessed, now)
+}
+
+func TestWriteBehind(t *testing.T) {
+	ctx := context.Background()
+
+	var accessed int64
+	values := map[string]interface{}{"state": "New", "old": 1}
+	w := &recordingWriter{touch: 60}
+	var wb WriteBehind
+	wb.Init(w, &accessed)
+
+	// not buffered, every change is written and a read rewrites the zero access time
+	if err := wb.Set(ctx, "state", "Auth", func() { values["state"] = "Auth" }); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(w.writes) != 1 || accessed == 0 {
+		t.Fatalf("expected the change written with the access time, got %v at %d", w.writes, accessed)
+	}
+
+	wb.Buffer(ctx)
+	_ = wb.Set(ctx, "uid", "u1", func() { values["uid"] = "u1" })
+	_ = wb.Delete(ctx, "old", func() { delete(values, "old") })
+	wb.Touch(ctx)
+	if len(w.writes) != 1 || w.accesses != 0 {
+		t.Fatalf("expected the buffered changes kept in memory, got %v and %d accesses", w.writes, w.accesses)
+	}
+	if _, ok := values["old"]; ok || values["uid"] != "u1" {
+		t.Errorf("expected the changes applied to the values, got %v", values)
+	}
+
+	// a failed save keeps the changes for the next one
+	w.fail = errors.New("store down")
+	if err := wb.Save(ctx); err == nil {
+		t.Fatal("expected the error of the write")
+	}
+	w.fail = nil
+	if err := wb.Release(ctx); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(w.writes) != 2 || !reflect.DeepEqual(w.writes[1], map[string]interface{}{"uid": "u1"}) || !reflect.DeepEqual(w.deletes[1], []string{"old"}) {
+		t.Errorf("expected the changes written in a single update, got %v and %v", w.writes, w.deletes)
+	}
+
+	// released, the changes are written again; within the touch interval a read does not write
+	wb.Touch(ctx)
+	_ = wb.Delete(ctx, "uid", func() { delete(values, "uid") })
+	if len(w.writes) != 3 || w.accesses != 0 {
+		t.Errorf("expected the delete written and no access write, got %v and %d accesses", w.writes, w.accesses)
+	}
+
+	wb.Buffer(ctx)
+	_ = wb.Set(ctx, "state", "Gone", func() { values["state"] = "Gone" })
+	wb.Discard(ctx)
+	if err := wb.Release(ctx); err != nil || len(w.writes) != 3 {
+		t.Errorf("expected the discarded changes not written, got %v, %v", w.writes, err)
+	}
+}
+
+func TestWriteBehindRequests(t *testing.T) {
+	ctx := context.Background()
+
+	var accessed int64
+	var mu sync.Mutex
+	values := map[string]interface{}{}
+	w := &recordingWriter{}
+	var wb WriteBehind
+	wb.Init(w, &accessed)
+
+	// two requests served by MWManager share the session
+	ctxA := context.WithValue(ctx, bufferKey{}, &requestBuffered{})
+	ctxB := context.WithValue(ctx, bufferKey{}, &requestBuffered{})
+	wb.Buffer(ctxA)
+	wb.Buffer(ctxB)
+
+	var wg sync.WaitGroup
+	for _, r := range []struct {
+		ctx context.Context
+		key string
+	}{{ctxA, "a"}, {ctxB, "b"}} {
+		wg.Add(1)
+		go func(ctx context.Context, key string) {
+			defer wg.Done()
+			_ = wb.Set(ctx, key, "v", func() { mu.Lock(); values[key] = "v"; mu.Unlock() })
+		}(r.ctx, r.key)
+	}
+	wg.Wait()
+
+	// A destroys the session, its changes are dropped but not the ones of B
+	wb.Discard(ctxA)
+	_ = wb.Set(ctxA, "a2", "v", func() {})
+	if err := wb.Release(ctxA); err != nil || len(w.writes) != 0 {
+		t.Fatalf("expected nothing written by the discarding request, got %v, %v", w.writes, err)
+	}
+	if err := wb.Release(ctxB); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(w.writes) != 1 || !reflect.DeepEqual(w.writes[0], map[string]interface{}{"b": "v"}) {
+		t.Errorf("expected only the changes of B written, got %v", w.writes)
+	}
+
+	// the changes of a failed save are dropped with the release of the request
+	wb.Buffer(ctxA)
+	_ = wb.Set(ctxA, "c", "v", func() {})
+	w.fail = errors.New("store down")
+	if err := wb.Release(ctxA); err == nil {
+		t.Fatal("expected the error of the write")
+	}
+	w.fail = nil
+	wb.Buffer(ctxB)
+	if err := wb.Release(ctxB); err != nil || len(w.writes) != 1 {
+		t.Errorf("expected the failed changes not written by a later request, got %v, %v", w.writes, err)
+	}
+}
@@ -0,0 +1,55 @@
+package ivmsesman
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// sessionWriter saves the session of a client side repository in the response, right before
+// the headers are written or when the handler returns without writing the response
+type sessionWriter struct {
+	http.ResponseWriter
+	r     *http.Request
+	repo  ClientSideRepository
+	log   *slog.Logger
+	sid   string
+	saved bool
+}
+
+// save writes the session once. The cookies can not be set after the headers are sent.
+func (sw *sessionWriter) save() {
+	if sw.saved || sw.sid == "" {
+		return
+	}
+	sw.saved = true
+
+	if err := sw.repo.Save(sw.ResponseWriter, sw.r, sw.sid); err != nil {
+		sw.log.ErrorContext(sw.r.Context(), "unable to save the client side session",
+			slog.Any("sid", Sensitive(sw.sid)), slog.Any("error", err))
+	}
+}
+
+// WriteHeader saves the session before the headers are sent
+func (sw *sessionWriter) WriteHeader(code int) {
+	sw.save()
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+// Write saves the session before the first write sends the headers
+func (sw *sessionWriter) Write(b []byte) (int, error) {
+	sw.save()
+	return sw.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher
+func (sw *sessionWriter) Flush() {
+	sw.save()
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the original writer for http.ResponseController
+func (sw *sessionWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
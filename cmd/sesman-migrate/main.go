@@ -0,0 +1,200 @@
+// Command sesman-migrate copies the live sessions and the blacklist from a session store to another,
+// keeping the session ids, the times and the values, and verifies the copy.
+//
+//	sesman-migrate -from redis://localhost:6379/0 -to postgres://user@db/app -checkpoint copy.json -verify
+//
+// The stores are given by URI:
+//
+//	disk:///var/lib/app/sessions.log       the log file of the disk provider
+//	redis://[:password@]host:port[/db]     Redis, ?prefix= sets the key prefix
+//	firestore://project                    Firestore, ?collection= and ?blacklist= set the collection names
+//	postgres://...                         PostgreSQL through the pgx driver
+//	sqlite:path                            SQLite through the go-sqlite3 driver, ?_busy_timeout= and the other
+//	                                       driver parameters pass through
+//
+// The SQL stores take ?table_prefix= for the prefix of the table names; the schema of a SQL target is
+// migrated before the copy. The go-sqlite3 driver needs cgo, a build with CGO_ENABLED=0 supports no SQLite.
+//
+// The exit status is 1 on an error and 2 when the verification finds differences.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	_ "github.com/jackc/pgx/v5/stdlib"
+
+	"github.com/dasiyes/ivmsesman"
+	"github.com/dasiyes/ivmsesman/migrate"
+	"github.com/dasiyes/ivmsesman/providers/disk"
+	firestoredb "github.com/dasiyes/ivmsesman/providers/firestore"
+	"github.com/dasiyes/ivmsesman/providers/redis"
+	"github.com/dasiyes/ivmsesman/providers/sqldb"
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	code := run(ctx, os.Args[1:], os.Stderr)
+	stop()
+	os.Exit(code)
+}
+
+// run runs the command with the arguments and returns its exit status
+func run(ctx context.Context, args []string, stderr io.Writer) int {
+
+	fs := flag.NewFlagSet("sesman-migrate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	from := fs.String("from", "", "URI of the session store to copy from")
+	to := fs.String("to", "", "URI of the session store to copy to")
+	dryRun := fs.Bool("dry-run", false, "read the source and count what would be copied, writing nothing")
+	cp := fs.String("checkpoint", "", "file recording the progress, a copy started again resumes after it")
+	verify := fs.Bool("verify", false, "compare the stores after the copy")
+	verifyOnly := fs.Bool("verify-only", false, "compare the stores without copying")
+	batch := fs.Int("batch", 500, "number of sessions written at once")
+	idle := fs.Int64("idle", 3600, "idle timeout of the sessions in seconds, the sessions idle longer are not copied")
+	absolute := fs.Int64("absolute", 0, "absolute timeout of the sessions in seconds, zero is not enforced")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *from == "" || *to == "" {
+		fmt.Fprintln(stderr, "sesman-migrate: -from and -to are required")
+		fs.Usage()
+		return 1
+	}
+
+	log := slog.New(slog.NewTextHandler(stderr, nil))
+	policy := ivmsesman.ExpiryPolicy{Idle: *idle, Absolute: *absolute}
+
+	src, closeSrc, err := open(ctx, *from, policy)
+	if err != nil {
+		log.Error("can not open the source", slog.Any("err", err))
+		return 1
+	}
+	defer closeSrc()
+	dst, closeDst, err := open(ctx, *to, policy)
+	if err != nil {
+		log.Error("can not open the target", slog.Any("err", err))
+		return 1
+	}
+	defer closeDst()
+
+	opts := migrate.Options{BatchSize: *batch, DryRun: *dryRun, Checkpoint: *cp, Logger: log}
+
+	if !*verifyOnly {
+		if m, ok := dst.(*sqldb.SessionProvider); ok && !*dryRun {
+			if err := m.Migrate(ctx); err != nil {
+				log.Error("can not migrate the schema of the target", slog.Any("err", err))
+				return 1
+			}
+		}
+		if _, err := migrate.Copy(ctx, src, dst, opts); err != nil {
+			log.Error("copy failed", slog.Any("err", err))
+			return 1
+		}
+	}
+
+	if *verify || *verifyOnly {
+		report, err := migrate.Verify(ctx, src, dst, opts)
+		if err != nil {
+			log.Error("verification failed", slog.Any("err", err))
+			return 1
+		}
+		for _, d := range report.Differences {
+			log.Warn("difference", slog.Any("id", ivmsesman.Sensitive(d.ID)), slog.String("reason", d.Reason))
+		}
+		if !report.OK() {
+			return 2
+		}
+	}
+	return 0
+}
+
+// open returns the session repository of the URI and the func releasing it
+func open(ctx context.Context, uri string, policy ivmsesman.ExpiryPolicy) (ivmsesman.SessionRepository, func() error, error) {
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid store URI %q, err: %v", uri, err)
+	}
+	q := u.Query()
+
+	var repo ivmsesman.SessionRepository
+	var release func() error
+	switch u.Scheme {
+	case "disk":
+		path := u.Path
+		if u.Opaque != "" {
+			path = u.Opaque
+		}
+		pder, err := disk.New(disk.Options{Path: path, Maxlifetime: policy.Idle})
+		if err != nil {
+			return nil, nil, err
+		}
+		repo, release = pder, pder.Close
+
+	case "redis":
+		opts := redis.Options{Addr: u.Host, Prefix: q.Get("prefix"), Maxlifetime: policy.Idle}
+		if pw, ok := u.User.Password(); ok {
+			opts.Password = pw
+		}
+		if db := strings.Trim(u.Path, "/"); db != "" {
+			if opts.DB, err = strconv.Atoi(db); err != nil {
+				return nil, nil, fmt.Errorf("invalid redis database %q", db)
+			}
+		}
+		pder := redis.New(opts)
+		repo, release = pder, pder.Close
+
+	case "firestore":
+		client, err := firestore.NewClient(ctx, u.Host)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error while creating firestore client: %v", err)
+		}
+		pder, err := firestoredb.New(client, firestoredb.Options{Collection: q.Get("collection"), Blacklist: q.Get("blacklist")})
+		if err != nil {
+			client.Close()
+			return nil, nil, err
+		}
+		repo, release = pder, client.Close
+
+	case "postgres", "postgresql", "sqlite":
+		// the table prefix is an option of the provider, not of the driver
+		prefix := q.Get("table_prefix")
+		q.Del("table_prefix")
+		u.RawQuery = q.Encode()
+
+		driver, dsn, dialect := "pgx", u.String(), sqldb.Postgres
+		if u.Scheme == "sqlite" {
+			driver, dsn, dialect = "sqlite3", strings.TrimPrefix(u.String(), "sqlite:"), sqldb.SQLite
+		}
+		db, err := sql.Open(driver, dsn)
+		if err != nil {
+			return nil, nil, fmt.Errorf("err while opening %v, err: %v", u.Scheme, err)
+		}
+		pder, err := sqldb.New(db, sqldb.Options{Dialect: dialect, TablePrefix: prefix, Maxlifetime: policy.Idle})
+		if err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+		repo, release = pder, db.Close
+
+	default:
+		return nil, nil, errors.New("unknown store URI scheme " + strconv.Quote(u.Scheme))
+	}
+
+	if eps, ok := repo.(ivmsesman.ExpiryPolicySetter); ok {
+		eps.SetExpiryPolicy(policy)
+	}
+	return repo, release, nil
+}
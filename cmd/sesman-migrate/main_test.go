@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dasiyes/ivmsesman"
+	"github.com/dasiyes/ivmsesman/providers/disk"
+)
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	from, to := filepath.Join(dir, "from.log"), filepath.Join(dir, "to.log")
+
+	src, err := disk.New(disk.Options{Path: from})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	now := time.Now().Unix()
+	if err := src.ImportSessions(ctx, []ivmsesman.SessionRecord{
+		{ID: "a", CreatedAt: now, TimeAccessed: now, Values: map[string]interface{}{"state": "Visited"}},
+		{ID: "b", CreatedAt: now, TimeAccessed: now, Values: map[string]interface{}{"state": "New"}},
+	}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	src.Close()
+
+	var stderr bytes.Buffer
+	if code := run(ctx, []string{"-from", "disk://" + from, "-to", "disk://" + to, "-verify-only"}, &stderr); code != 2 {
+		t.Errorf("expected exit status 2 verifying an empty target, got %d: %s", code, stderr.String())
+	}
+	if code := run(ctx, []string{"-from", "disk://" + from, "-to", "disk://" + to, "-verify"}, &stderr); code != 0 {
+		t.Errorf("expected exit status 0 after the copy, got %d: %s", code, stderr.String())
+	}
+	if code := run(ctx, []string{"-from", "disk://" + from, "-to", "memcache://localhost"}, &stderr); code != 1 {
+		t.Errorf("expected exit status 1 for an unknown store, got %d", code)
+	}
+	if code := run(ctx, []string{"-from", "disk://" + from}, &stderr); code != 1 {
+		t.Errorf("expected exit status 1 without a target, got %d", code)
+	}
+
+	dst, err := disk.New(disk.Options{Path: to})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer dst.Close()
+	if n := dst.ActiveSessions(); n != 2 {
+		t.Errorf("expected 2 sessions copied, got %d", n)
+	}
+}
@@ -0,0 +1,6 @@
+//go:build cgo
+
+package main
+
+// the go-sqlite3 driver registers itself as "sqlite3"; it is a cgo package
+import _ "github.com/mattn/go-sqlite3"
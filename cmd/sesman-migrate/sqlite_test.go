@@ -0,0 +1,55 @@
+//go:build cgo
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dasiyes/ivmsesman"
+	"github.com/dasiyes/ivmsesman/providers/disk"
+)
+
+func TestRunSQLite(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	from := filepath.Join(dir, "from.log")
+	to := "sqlite:" + filepath.Join(dir, "to.db") + "?_busy_timeout=5000&table_prefix=app_"
+
+	src, err := disk.New(disk.Options{Path: from})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	now := time.Now().Unix()
+	if err := src.ImportSessions(ctx, []ivmsesman.SessionRecord{
+		{ID: "a", CreatedAt: now, TimeAccessed: now, Values: map[string]interface{}{"state": "Visited", "n": int64(1)}},
+		{ID: "b", CreatedAt: now, TimeAccessed: now, Values: map[string]interface{}{"state": "New"}},
+	}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	src.Close()
+
+	var stderr bytes.Buffer
+	if code := run(ctx, []string{"-from", "disk://" + from, "-to", to, "-verify"}, &stderr); code != 0 {
+		t.Fatalf("expected exit status 0 after the copy, got %d: %s", code, stderr.String())
+	}
+
+	dst, release, err := open(ctx, to, ivmsesman.ExpiryPolicy{Idle: 3600})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer release()
+	if n := dst.ActiveSessions(); n != 2 {
+		t.Errorf("expected 2 sessions copied, got %d", n)
+	}
+	ss, err := dst.FindOrCreate("a")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if v := ss.Get("n"); v != int64(1) {
+		t.Errorf("expected the values copied, got %v", v)
+	}
+}
@@ -0,0 +1,343 @@
+package ivmsesman
+
+import (
+	"context"
+)
+
+// SessionRepositoryContext is a SessionRepository which accepts a context on every operation.
+// The context carries the request cancellation, deadline and trace values down to the store.
+type SessionRepositoryContext interface {
+	SessionRepository
+	RepositoryOperationsContext
+}
+
+// RepositoryOperationsContext are the context-aware operations of a SessionRepositoryContext. A provider
+// implementing only them gets the SessionRepository methods by embedding Background.
+type RepositoryOperationsContext interface {
+	// NewSessionContext will initiate a new session and return its object
+	NewSessionContext(ctx context.Context, sid string) (SessionStore, error)
+
+	// FindOrCreateContext will search the repository for a session id and if not found will create a new one with the given id
+	FindOrCreateContext(ctx context.Context, sid string) (SessionStore, error)
+
+	// ExistsContext will check the session storage for a session id
+	ExistsContext(ctx context.Context, sid string) bool
+
+	// ActiveSessionsContext will return the number of the active sessions in the session store
+	ActiveSessionsContext(ctx context.Context) int
+
+	// DestroySIDContext will delete a session from the repository
+	DestroySIDContext(ctx context.Context, sid string) error
+
+	// SessionGCContext will clean the expired sessions
+	SessionGCContext(ctx context.Context, maxLifeTime int64)
+
+	// UpdateTimeAccessedContext will refresh the time when the session has been last time accessed
+	UpdateTimeAccessedContext(ctx context.Context, sid string) error
+
+	// UpdateSessionStateContext will update the state value with one provided
+	UpdateSessionStateContext(ctx context.Context, sid string, state string) error
+
+	// UpdateCodeVerifierContext will update the code verifier (cove) value assigned to the session id
+	UpdateCodeVerifierContext(ctx context.Context, sid, cove string) error
+
+	// SaveCodeChallengeAndMethodContext - at step2 of AuthorizationCode flow
+	SaveCodeChallengeAndMethodContext(ctx context.Context, sid, coch, mth, code, ru string) error
+
+	// FlushContext will delete all data
+	FlushContext(ctx context.Context) error
+
+	// GetAuthCodeContext will return the authorization code for a session, if it is InAuth and the code did not expire.
+	GetAuthCodeContext(ctx context.Context, sid string) map[string]string
+
+	// UpdateAuthSessionContext - update state, access and refresh tokens values for auth session
+	UpdateAuthSessionContext(ctx context.Context, sid, at, rt, uid string) error
+
+	// BlacklistingContext adds the ip to the blacklist
+	BlacklistingContext(ctx context.Context, ip, path string, data interface{})
+
+	// IsIPExistInBLContext will check the black list
+	IsIPExistInBLContext(ctx context.Context, ip string) bool
+
+	// BLCleanContext is a support function to clean the Blacklist on regular base
+	BLCleanContext(ctx context.Context)
+}
+
+// Background implements SessionRepository for the callers which do not have a context. Each method runs
+// its context-aware counterpart of Repo with context.Background(). A provider embeds it and points it to
+// itself in its constructor:
+//
+//	pder := &SessionProvider{...}
+//	pder.Background = ivmsesman.Background{Repo: pder}
+type Background struct {
+	Repo RepositoryOperationsContext
+}
+
+// NewSession creates a new session value in the store with sid as a key
+func (b Background) NewSession(sid string) (SessionStore, error) {
+	return b.Repo.NewSessionContext(context.Background(), sid)
+}
+
+// FindOrCreate will first search the store for a session value with provided sid. If not not found, a new session value will be created and stored in the session store
+func (b Background) FindOrCreate(sid string) (SessionStore, error) {
+	return b.Repo.FindOrCreateContext(context.Background(), sid)
+}
+
+// Exists check by sid if a session data exists in the session store
+func (b Background) Exists(sid string) bool {
+	return b.Repo.ExistsContext(context.Background(), sid)
+}
+
+// ActiveSessions returns the number of currently active sessions in the session store
+func (b Background) ActiveSessions() int {
+	return b.Repo.ActiveSessionsContext(context.Background())
+}
+
+// DestroySID will remove a session data from the storage
+func (b Background) DestroySID(sid string) error {
+	return b.Repo.DestroySIDContext(context.Background(), sid)
+}
+
+// SessionGC cleans all expired sessions
+func (b Background) SessionGC(maxlifetime int64) {
+	b.Repo.SessionGCContext(context.Background(), maxlifetime)
+}
+
+// UpdateTimeAccessed will update the time accessed value with now()
+func (b Background) UpdateTimeAccessed(sid string) error {
+	return b.Repo.UpdateTimeAccessedContext(context.Background(), sid)
+}
+
+// UpdateSessionState will update the state value with one provided
+func (b Background) UpdateSessionState(sid string, state string) error {
+	return b.Repo.UpdateSessionStateContext(context.Background(), sid, state)
+}
+
+// UpdateCodeVerifier will update the code verifier (cove) value assigned to the session id
+func (b Background) UpdateCodeVerifier(sid, cove string) error {
+	return b.Repo.UpdateCodeVerifierContext(context.Background(), sid, cove)
+}
+
+// SaveCodeChallengeAndMethod - at step2 of AuthorizationCode flow
+func (b Background) SaveCodeChallengeAndMethod(sid, coch, mth, code, ru string) error {
+	return b.Repo.SaveCodeChallengeAndMethodContext(context.Background(), sid, coch, mth, code, ru)
+}
+
+// Flush will delete all elements for sessions data
+func (b Background) Flush() error {
+	return b.Repo.FlushContext(context.Background())
+}
+
+// GetAuthCode will return the authorization code for a session, if it is InAuth
+func (b Background) GetAuthCode(sid string) map[string]string {
+	return b.Repo.GetAuthCodeContext(context.Background(), sid)
+}
+
+// UpdateAuthSession - update state, access and refresh tokens values for auth session
+func (b Background) UpdateAuthSession(sid, at, rt, uid string) error {
+	return b.Repo.UpdateAuthSessionContext(context.Background(), sid, at, rt, uid)
+}
+
+// Blacklisting adds the @ip to the blacklist with the @path and @data
+func (b Background) Blacklisting(ip, path string, data interface{}) {
+	b.Repo.BlacklistingContext(context.Background(), ip, path, data)
+}
+
+// IsIPExistInBL returns boolean result for the @ip being or not in the blacklist
+func (b Background) IsIPExistInBL(ip string) bool {
+	return b.Repo.IsIPExistInBLContext(context.Background(), ip)
+}
+
+// BLClean - cleaning the blacklist
+func (b Background) BLClean() {
+	b.Repo.BLCleanContext(context.Background())
+}
+
+// SessionStoreContext is a SessionStore which accepts a context on the value operations
+type SessionStoreContext interface {
+	SessionStore
+
+	// SetContext a session key-value
+	SetContext(ctx context.Context, key, value interface{}) error
+
+	// GetContext the session value by its key
+	GetContext(ctx context.Context, key interface{}) interface{}
+
+	// DeleteContext the session by its key
+	DeleteContext(ctx context.Context, key interface{}) error
+}
+
+// WithContext returns the context-aware view of the repository. Providers which do not
+// implement SessionRepositoryContext are adapted - the context is checked for cancellation
+// before the call and then dropped.
+func WithContext(repo SessionRepository) SessionRepositoryContext {
+	if rc, ok := repo.(SessionRepositoryContext); ok {
+		return rc
+	}
+	return repositoryAdapter{repo}
+}
+
+// underlying returns the repository behind the metrics instrumentation and the context adapter, where the
+// optional interfaces are implemented
+func underlying(repo SessionRepositoryContext) SessionRepository {
+	if ir, ok := repo.(instrumentedRepository); ok {
+		repo = ir.SessionRepositoryContext
+	}
+	if ra, ok := repo.(repositoryAdapter); ok {
+		return ra.SessionRepository
+	}
+	return repo
+}
+
+// StoreWithContext returns the context-aware view of the session store
+func StoreWithContext(ss SessionStore) SessionStoreContext {
+	if sc, ok := ss.(SessionStoreContext); ok {
+		return sc
+	}
+	return storeAdapter{ss}
+}
+
+// repositoryAdapter adapts a SessionRepository to SessionRepositoryContext
+type repositoryAdapter struct {
+	SessionRepository
+}
+
+func (ra repositoryAdapter) NewSessionContext(ctx context.Context, sid string) (SessionStore, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ss, err := ra.NewSession(sid)
+	if err != nil || ss == nil {
+		return ss, err
+	}
+	return StoreWithContext(ss), nil
+}
+
+func (ra repositoryAdapter) FindOrCreateContext(ctx context.Context, sid string) (SessionStore, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ss, err := ra.FindOrCreate(sid)
+	if err != nil || ss == nil {
+		return ss, err
+	}
+	return StoreWithContext(ss), nil
+}
+
+func (ra repositoryAdapter) ExistsContext(ctx context.Context, sid string) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	return ra.Exists(sid)
+}
+
+func (ra repositoryAdapter) ActiveSessionsContext(ctx context.Context) int {
+	return ra.ActiveSessions()
+}
+
+func (ra repositoryAdapter) DestroySIDContext(ctx context.Context, sid string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ra.DestroySID(sid)
+}
+
+func (ra repositoryAdapter) SessionGCContext(ctx context.Context, maxLifeTime int64) {
+	if ctx.Err() != nil {
+		return
+	}
+	ra.SessionGC(maxLifeTime)
+}
+
+func (ra repositoryAdapter) UpdateTimeAccessedContext(ctx context.Context, sid string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ra.UpdateTimeAccessed(sid)
+}
+
+func (ra repositoryAdapter) UpdateSessionStateContext(ctx context.Context, sid string, state string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ra.UpdateSessionState(sid, state)
+}
+
+func (ra repositoryAdapter) UpdateCodeVerifierContext(ctx context.Context, sid, cove string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ra.UpdateCodeVerifier(sid, cove)
+}
+
+func (ra repositoryAdapter) SaveCodeChallengeAndMethodContext(ctx context.Context, sid, coch, mth, code, ru string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ra.SaveCodeChallengeAndMethod(sid, coch, mth, code, ru)
+}
+
+func (ra repositoryAdapter) FlushContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ra.Flush()
+}
+
+func (ra repositoryAdapter) GetAuthCodeContext(ctx context.Context, sid string) map[string]string {
+	if ctx.Err() != nil {
+		return map[string]string{}
+	}
+	return ra.GetAuthCode(sid)
+}
+
+func (ra repositoryAdapter) UpdateAuthSessionContext(ctx context.Context, sid, at, rt, uid string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ra.UpdateAuthSession(sid, at, rt, uid)
+}
+
+func (ra repositoryAdapter) BlacklistingContext(ctx context.Context, ip, path string, data interface{}) {
+	if ctx.Err() != nil {
+		return
+	}
+	ra.Blacklisting(ip, path, data)
+}
+
+func (ra repositoryAdapter) IsIPExistInBLContext(ctx context.Context, ip string) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	return ra.IsIPExistInBL(ip)
+}
+
+func (ra repositoryAdapter) BLCleanContext(ctx context.Context) {
+	if ctx.Err() != nil {
+		return
+	}
+	ra.BLClean()
+}
+
+// storeAdapter adapts a SessionStore to SessionStoreContext
+type storeAdapter struct {
+	SessionStore
+}
+
+func (sa storeAdapter) SetContext(ctx context.Context, key, value interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return sa.Set(key, value)
+}
+
+func (sa storeAdapter) GetContext(ctx context.Context, key interface{}) interface{} {
+	return sa.Get(key)
+}
+
+func (sa storeAdapter) DeleteContext(ctx context.Context, key interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return sa.Delete(key)
+}
@@ -0,0 +1,135 @@
+package ivmsesman
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidCookie will be returned when the session cookie value fails the signature verification or decryption
+var ErrInvalidCookie = errors.New("invalid session cookie")
+
+// minSigningKeyLen is the minimal length of a HMAC-SHA256 signing key
+const minSigningKeyLen = 32
+
+// Keyring holds the keys protecting the cookie values. The first key of each kind is the current
+// one, used for new values. The rest are previous keys which are still accepted, allowing rotation
+// without invalidating the issued cookies.
+type Keyring struct {
+	signing    [][]byte
+	encryption []cipher.AEAD
+}
+
+// NewKeyring creates a keyring with HMAC-SHA256 signing keys (at least 32 bytes each) and optional
+// AES-GCM encryption keys (16, 24 or 32 bytes each). At least one signing key is required.
+func NewKeyring(signingKeys, encryptionKeys [][]byte) (*Keyring, error) {
+
+	if len(signingKeys) == 0 {
+		return nil, errors.New("keyring needs at least one signing key")
+	}
+
+	kr := &Keyring{}
+	for i, k := range signingKeys {
+		if len(k) < minSigningKeyLen {
+			return nil, fmt.Errorf("signing key #%d is shorter than %d bytes", i, minSigningKeyLen)
+		}
+		kr.signing = append(kr.signing, append([]byte(nil), k...))
+	}
+
+	for i, k := range encryptionKeys {
+		block, err := aes.NewCipher(k)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key #%d: %v", i, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key #%d: %v", i, err)
+		}
+		kr.encryption = append(kr.encryption, aead)
+	}
+	return kr, nil
+}
+
+// Encrypted reports if the keyring encrypts the values
+func (kr *Keyring) Encrypted() bool {
+	return len(kr.encryption) > 0
+}
+
+// Encode protects the value of the cookie with the current keys. The cookie name is bound
+// to the result, so a value can not be replayed under another cookie name.
+func (kr *Keyring) Encode(name string, value []byte) (string, error) {
+
+	payload := value
+	if kr.Encrypted() {
+		aead := kr.encryption[0]
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return "", fmt.Errorf("unable to generate nonce: %v", err)
+		}
+		payload = aead.Seal(nonce, nonce, value, []byte(name))
+	}
+
+	enc := base64.RawURLEncoding.EncodeToString(payload)
+	mac := sign(kr.signing[0], name, enc)
+	return enc + "." + base64.RawURLEncoding.EncodeToString(mac), nil
+}
+
+// Decode verifies the signature and decrypts the cookie value, trying the current and the previous keys.
+// ErrInvalidCookie is returned for tampered, forged or malformed values.
+func (kr *Keyring) Decode(name, encoded string) ([]byte, error) {
+
+	i := strings.LastIndexByte(encoded, '.')
+	if i < 0 {
+		return nil, ErrInvalidCookie
+	}
+	enc := encoded[:i]
+	mac, err := base64.RawURLEncoding.DecodeString(encoded[i+1:])
+	if err != nil {
+		return nil, ErrInvalidCookie
+	}
+
+	valid := false
+	for _, k := range kr.signing {
+		if hmac.Equal(mac, sign(k, name, enc)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, ErrInvalidCookie
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil {
+		return nil, ErrInvalidCookie
+	}
+	if !kr.Encrypted() {
+		return payload, nil
+	}
+
+	for _, aead := range kr.encryption {
+		ns := aead.NonceSize()
+		if len(payload) < ns {
+			return nil, ErrInvalidCookie
+		}
+		if value, err := aead.Open(nil, payload[:ns], payload[ns:], []byte(name)); err == nil {
+			return value, nil
+		}
+	}
+	return nil, ErrInvalidCookie
+}
+
+// sign computes the HMAC-SHA256 of the cookie name and value
+func sign(key []byte, name, value string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(name))
+	h.Write([]byte{'|'})
+	h.Write([]byte(value))
+	return h.Sum(nil)
+}
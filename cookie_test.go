@@ -0,0 +1,90 @@
+package ivmsesman
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+var (
+	signingKey1    = bytes.Repeat([]byte("a"), 32)
+	signingKey2    = bytes.Repeat([]byte("b"), 32)
+	encryptionKey1 = bytes.Repeat([]byte("c"), 32)
+	encryptionKey2 = bytes.Repeat([]byte("d"), 16)
+)
+
+func TestKeyringRoundTrip(t *testing.T) {
+
+	for _, enc := range [][][]byte{nil, {encryptionKey1}} {
+		kr, err := NewKeyring([][]byte{signingKey1}, enc)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+
+		v, err := kr.Encode("ivmid", []byte("sid-1"))
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if kr.Encrypted() == strings.Contains(v, "c2lkLTE") {
+			t.Errorf("Unexpected encoded value %v for encrypted=%v", v, kr.Encrypted())
+		}
+
+		got, err := kr.Decode("ivmid", v)
+		if err != nil || string(got) != "sid-1" {
+			t.Errorf("Expected sid-1, got %q, %v", got, err)
+		}
+		if _, err := kr.Decode("other", v); err != ErrInvalidCookie {
+			t.Errorf("Expected ErrInvalidCookie for another cookie name, got %v", err)
+		}
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+
+	old, _ := NewKeyring([][]byte{signingKey1}, [][]byte{encryptionKey1})
+	v, err := old.Encode("ivmid", []byte("sid-1"))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	rotated, _ := NewKeyring([][]byte{signingKey2, signingKey1}, [][]byte{encryptionKey2, encryptionKey1})
+	if got, err := rotated.Decode("ivmid", v); err != nil || string(got) != "sid-1" {
+		t.Errorf("Expected the previous keys to be accepted, got %q, %v", got, err)
+	}
+
+	retired, _ := NewKeyring([][]byte{signingKey2}, [][]byte{encryptionKey2})
+	if _, err := retired.Decode("ivmid", v); err != ErrInvalidCookie {
+		t.Errorf("Expected ErrInvalidCookie for retired keys, got %v", err)
+	}
+}
+
+func TestKeyringTamper(t *testing.T) {
+
+	kr, _ := NewKeyring([][]byte{signingKey1}, nil)
+	v, _ := kr.Encode("ivmid", []byte("sid-1"))
+
+	for _, tampered := range []string{
+		"",
+		"sid-1",
+		"c2lkLTI" + v[strings.LastIndexByte(v, '.'):],
+		v[:len(v)-2] + "AA",
+		v + "A",
+	} {
+		if _, err := kr.Decode("ivmid", tampered); err != ErrInvalidCookie {
+			t.Errorf("Expected ErrInvalidCookie for %q, got %v", tampered, err)
+		}
+	}
+}
+
+func TestNewKeyringErrors(t *testing.T) {
+
+	if _, err := NewKeyring(nil, nil); err == nil {
+		t.Errorf("Expected error for missing signing key")
+	}
+	if _, err := NewKeyring([][]byte{[]byte("short")}, nil); err == nil {
+		t.Errorf("Expected error for short signing key")
+	}
+	if _, err := NewKeyring([][]byte{signingKey1}, [][]byte{[]byte("bad")}); err == nil {
+		t.Errorf("Expected error for invalid encryption key")
+	}
+}
@@ -0,0 +1,174 @@
+package ivmsesman
+
+import (
+	"context"
+	"time"
+)
+
+// EventType is the kind of a session lifecycle event
+type EventType int
+
+const (
+	// SessionCreated - a new session was issued to a client
+	SessionCreated EventType = iota + 1
+
+	// SessionAuthenticated - an `InAuth` session became `Authed` under a new id (SessionAuth)
+	SessionAuthenticated
+
+	// SessionStateChanged - the state of a session changed (ChangeState)
+	SessionStateChanged
+
+	// SessionRegenerated - a session moved under a new id, keeping its data (Regenerate, RenewalTimeout)
+	SessionRegenerated
+
+	// SessionDestroyed - a session was removed on request (Destroy)
+	SessionDestroyed
+
+	// SessionExpired - a session was removed past its idle or absolute timeout, by the session manager or the
+	// repository (SessionGC or a read)
+	SessionExpired
+
+	// SessionEvicted - a session was removed by a bounded repository to make room for a new one
+	SessionEvicted
+)
+
+// String returns the name of the event type
+func (t EventType) String() string {
+	switch t {
+	case SessionCreated:
+		return "created"
+	case SessionAuthenticated:
+		return "authenticated"
+	case SessionStateChanged:
+		return "state_changed"
+	case SessionRegenerated:
+		return "regenerated"
+	case SessionDestroyed:
+		return "destroyed"
+	case SessionExpired:
+		return "expired"
+	case SessionEvicted:
+		return "evicted"
+	default:
+		return ""
+	}
+}
+
+// The reasons of the events
+const (
+	ReasonDestroyed       = "destroyed"
+	ReasonRenewal         = "renewal"
+	ReasonRegenerate      = "regenerate"
+	ReasonAbsoluteTimeout = "absolute_timeout"
+	ReasonTimeout         = "timeout"
+	ReasonCapacity        = "capacity"
+)
+
+// Event is a change in the lifecycle of a session
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// SessionID is the id of the session, the new one when the session moved under a new id
+	SessionID string
+	// OldSessionID is the previous id of a session moved under a new id
+	OldSessionID string
+
+	OldState string
+	NewState string
+	UserID   string
+	Reason   string
+}
+
+// EventSink receives the session lifecycle events. It is called synchronously while the session manager
+// holds the lock of the session, so it must return quickly and must not call the session manager.
+type EventSink interface {
+	HandleEvent(ctx context.Context, e Event)
+}
+
+// EventSinkFunc is a func used as EventSink
+type EventSinkFunc func(ctx context.Context, e Event)
+
+// HandleEvent calls f(ctx, e)
+func (f EventSinkFunc) HandleEvent(ctx context.Context, e Event) {
+	f(ctx, e)
+}
+
+// ExpiryListenerSetter is implemented by the repositories reporting the sessions they remove as expired,
+// in SessionGC or when an expired session is read.
+type ExpiryListenerSetter interface {
+	SetExpiryListener(fn func(ctx context.Context, sid string))
+}
+
+// EvictionListenerSetter is implemented by the bounded repositories reporting the sessions they evict
+// to make room for new ones
+type EvictionListenerSetter interface {
+	SetEvictionListener(fn func(ctx context.Context, sid string))
+}
+
+// AddEventSink registers a sink for the session lifecycle events
+func (sm *Sesman) AddEventSink(s EventSink) {
+	sm.evlock.Lock()
+	defer sm.evlock.Unlock()
+
+	sm.sinks = append(sm.sinks, s)
+}
+
+// observed reports if an event sink is registered, so the event details costing a repository
+// call are read only when needed
+func (sm *Sesman) observed() bool {
+	sm.evlock.RLock()
+	defer sm.evlock.RUnlock()
+
+	return len(sm.sinks) > 0
+}
+
+// emit sends the event to the registered sinks
+func (sm *Sesman) emit(ctx context.Context, e Event) {
+
+	switch e.Type {
+	case SessionExpired:
+		sm.metrics.expired.Add(1)
+	case SessionEvicted:
+		sm.metrics.evicted.Add(1)
+	}
+	sm.publish(ctx, e)
+
+	sm.evlock.RLock()
+	sinks := sm.sinks
+	sm.evlock.RUnlock()
+
+	if len(sinks) == 0 {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for _, s := range sinks {
+		s.HandleEvent(ctx, e)
+	}
+}
+
+// expiredByRepository is the expiry listener set on the repository
+func (sm *Sesman) expiredByRepository(ctx context.Context, sid string) {
+	sm.emit(ctx, Event{Type: SessionExpired, SessionID: sid, Reason: ReasonTimeout})
+}
+
+// evictedByRepository is the eviction listener set on the repository
+func (sm *Sesman) evictedByRepository(ctx context.Context, sid string) {
+	sm.emit(ctx, Event{Type: SessionEvicted, SessionID: sid, Reason: ReasonCapacity})
+}
+
+// sessionState returns the state of the session sid, if it exists. The caller holds the lock of sid.
+func (sm *Sesman) sessionState(ctx context.Context, sid string) string {
+
+	if !sm.sessions.ExistsContext(ctx, sid) {
+		return ""
+	}
+	ss, err := sm.sessions.FindOrCreateContext(ctx, sid)
+	if err != nil {
+		return ""
+	}
+	state, _ := StoreWithContext(ss).GetContext(ctx, "state").(string)
+	return state
+}
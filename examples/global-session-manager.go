@@ -1,14 +1,14 @@
 package main
 
-// the _ will invoke the init func at import time
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
 	"text/template"
 
 	"github.com/dasiyes/ivmsesman"
-	_ "github.com/dasiyes/ivmsesman/providers/inmem"
+	"github.com/dasiyes/ivmsesman/providers/inmem"
 )
 
 var globalSesMan *ivmsesman.Sesman
@@ -21,15 +21,19 @@ func main() {
 		Maxlifetime: 3600,
 	}
 
-	// Create a new Session Manager
-	globalSesMan, err = ivmsesman.NewSesman(ivmsesman.Memory, cfg)
+	// Create a new Session Manager with its own memory session store
+	globalSesMan, err = ivmsesman.NewSesmanWithRepository(inmem.New(), cfg)
 	if err != nil {
 		fmt.Printf("Unable to initiate valid session manager %q", err)
 		os.Exit(1)
 	}
 
-	// Running sessions GC in a separate routine
-	go globalSesMan.GC()
+	// Running sessions GC in the background until the session manager is closed
+	if err = globalSesMan.Start(context.Background()); err != nil {
+		fmt.Printf("Unable to start the session GC %q", err)
+		os.Exit(1)
+	}
+	defer globalSesMan.Close()
 
 }
 
@@ -0,0 +1,58 @@
+package ivmsesman
+
+import (
+	"time"
+)
+
+// ExpiryPolicy holds the session timeouts in seconds. A zero timeout is not enforced.
+type ExpiryPolicy struct {
+	// Idle is the time a session expires after its last access
+	Idle int64
+	// Absolute is the time a session expires after its creation, regardless of the activity
+	Absolute int64
+	// Touch is the time the last access time of a session is kept before it is rewritten on a read. The
+	// sessions expire up to Touch seconds before their idle timeout. Zero rewrites it once per second.
+	Touch int64
+}
+
+// Expired reports if a session created and last accessed at the unix times is expired at now.
+// Sessions with unknown (zero) creation time are not subject to the absolute timeout.
+func (p ExpiryPolicy) Expired(createdAt, accessedAt, now int64) bool {
+	if p.Idle > 0 && accessedAt+p.Idle < now {
+		return true
+	}
+	if p.Absolute > 0 && createdAt > 0 && createdAt+p.Absolute < now {
+		return true
+	}
+	return false
+}
+
+// TouchDue reports if the last access time of a session accessed at the unix time is to be rewritten at now
+func (p ExpiryPolicy) TouchDue(accessedAt, now int64) bool {
+	return accessedAt+p.Touch < now
+}
+
+// ExpiryPolicySetter is implemented by the repositories enforcing the session timeouts on every read,
+// so an expired session is not found even before SessionGC removes it. The session manager sets the
+// policy from its configuration. A zero timeout keeps the provider's own default.
+type ExpiryPolicySetter interface {
+	SetExpiryPolicy(p ExpiryPolicy)
+}
+
+// SessionCreatedAt is implemented by the session stores carrying their creation time
+type SessionCreatedAt interface {
+	// GetCreatedAt will return the time the session was created
+	GetCreatedAt() time.Time
+}
+
+// CreatedAt returns the creation time of the session, if it carries one, looking through the context
+// adapter of WithContext
+func CreatedAt(ss SessionStore) (time.Time, bool) {
+	if sa, ok := ss.(storeAdapter); ok {
+		ss = sa.SessionStore
+	}
+	if c, ok := ss.(SessionCreatedAt); ok {
+		return c.GetCreatedAt(), true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,52 @@
+package ivmsesman
+
+import (
+	"testing"
+)
+
+func TestExpiryPolicyExpired(t *testing.T) {
+
+	const now = int64(10000)
+	cases := []struct {
+		name     string
+		policy   ExpiryPolicy
+		created  int64
+		accessed int64
+		want     bool
+	}{
+		{"no timeouts", ExpiryPolicy{}, 1, 1, false},
+		{"idle not passed", ExpiryPolicy{Idle: 60}, now - 100, now - 60, false},
+		{"idle passed", ExpiryPolicy{Idle: 60}, now - 100, now - 61, true},
+		{"absolute not passed", ExpiryPolicy{Idle: 60, Absolute: 100}, now - 100, now, false},
+		{"absolute passed", ExpiryPolicy{Idle: 60, Absolute: 100}, now - 101, now, true},
+		{"unknown creation time", ExpiryPolicy{Absolute: 100}, 0, now, false},
+	}
+
+	for _, c := range cases {
+		if got := c.policy.Expired(c.created, c.accessed, now); got != c.want {
+			t.Errorf("%s: expected %v, got %v", c.name, c.want, got)
+		}
+	}
+}
+
+func TestExpiryPolicyTouchDue(t *testing.T) {
+
+	const now = int64(10000)
+	cases := []struct {
+		name     string
+		policy   ExpiryPolicy
+		accessed int64
+		want     bool
+	}{
+		{"same second", ExpiryPolicy{}, now, false},
+		{"previous second", ExpiryPolicy{}, now - 1, true},
+		{"within the interval", ExpiryPolicy{Touch: 30}, now - 30, false},
+		{"past the interval", ExpiryPolicy{Touch: 30}, now - 31, true},
+	}
+
+	for _, c := range cases {
+		if got := c.policy.TouchDue(c.accessed, now); got != c.want {
+			t.Errorf("%s: expected %v, got %v", c.name, c.want, got)
+		}
+	}
+}
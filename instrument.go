@@ -0,0 +1,121 @@
+package ivmsesman
+
+import (
+	"context"
+	"time"
+)
+
+// instrumentedRepository records the latency and the errors of the repository operations in the metrics
+type instrumentedRepository struct {
+	SessionRepositoryContext
+	m *Metrics
+}
+
+func (ir instrumentedRepository) NewSessionContext(ctx context.Context, sid string) (SessionStore, error) {
+	start := time.Now()
+	ss, err := ir.SessionRepositoryContext.NewSessionContext(ctx, sid)
+	ir.m.observe("NewSession", start, err)
+	return ss, err
+}
+
+func (ir instrumentedRepository) FindOrCreateContext(ctx context.Context, sid string) (SessionStore, error) {
+	start := time.Now()
+	ss, err := ir.SessionRepositoryContext.FindOrCreateContext(ctx, sid)
+	ir.m.observe("FindOrCreate", start, err)
+	return ss, err
+}
+
+func (ir instrumentedRepository) ExistsContext(ctx context.Context, sid string) bool {
+	start := time.Now()
+	ok := ir.SessionRepositoryContext.ExistsContext(ctx, sid)
+	ir.m.observe("Exists", start, nil)
+	return ok
+}
+
+func (ir instrumentedRepository) ActiveSessionsContext(ctx context.Context) int {
+	start := time.Now()
+	n := ir.SessionRepositoryContext.ActiveSessionsContext(ctx)
+	ir.m.observe("ActiveSessions", start, nil)
+	return n
+}
+
+func (ir instrumentedRepository) DestroySIDContext(ctx context.Context, sid string) error {
+	start := time.Now()
+	err := ir.SessionRepositoryContext.DestroySIDContext(ctx, sid)
+	ir.m.observe("DestroySID", start, err)
+	return err
+}
+
+func (ir instrumentedRepository) SessionGCContext(ctx context.Context, maxLifeTime int64) {
+	start := time.Now()
+	ir.SessionRepositoryContext.SessionGCContext(ctx, maxLifeTime)
+	ir.m.observe("SessionGC", start, nil)
+}
+
+func (ir instrumentedRepository) UpdateTimeAccessedContext(ctx context.Context, sid string) error {
+	start := time.Now()
+	err := ir.SessionRepositoryContext.UpdateTimeAccessedContext(ctx, sid)
+	ir.m.observe("UpdateTimeAccessed", start, err)
+	return err
+}
+
+func (ir instrumentedRepository) UpdateSessionStateContext(ctx context.Context, sid string, state string) error {
+	start := time.Now()
+	err := ir.SessionRepositoryContext.UpdateSessionStateContext(ctx, sid, state)
+	ir.m.observe("UpdateSessionState", start, err)
+	return err
+}
+
+func (ir instrumentedRepository) UpdateCodeVerifierContext(ctx context.Context, sid, cove string) error {
+	start := time.Now()
+	err := ir.SessionRepositoryContext.UpdateCodeVerifierContext(ctx, sid, cove)
+	ir.m.observe("UpdateCodeVerifier", start, err)
+	return err
+}
+
+func (ir instrumentedRepository) SaveCodeChallengeAndMethodContext(ctx context.Context, sid, coch, mth, code, ru string) error {
+	start := time.Now()
+	err := ir.SessionRepositoryContext.SaveCodeChallengeAndMethodContext(ctx, sid, coch, mth, code, ru)
+	ir.m.observe("SaveCodeChallengeAndMethod", start, err)
+	return err
+}
+
+func (ir instrumentedRepository) FlushContext(ctx context.Context) error {
+	start := time.Now()
+	err := ir.SessionRepositoryContext.FlushContext(ctx)
+	ir.m.observe("Flush", start, err)
+	return err
+}
+
+func (ir instrumentedRepository) GetAuthCodeContext(ctx context.Context, sid string) map[string]string {
+	start := time.Now()
+	ac := ir.SessionRepositoryContext.GetAuthCodeContext(ctx, sid)
+	ir.m.observe("GetAuthCode", start, nil)
+	return ac
+}
+
+func (ir instrumentedRepository) UpdateAuthSessionContext(ctx context.Context, sid, at, rt, uid string) error {
+	start := time.Now()
+	err := ir.SessionRepositoryContext.UpdateAuthSessionContext(ctx, sid, at, rt, uid)
+	ir.m.observe("UpdateAuthSession", start, err)
+	return err
+}
+
+func (ir instrumentedRepository) BlacklistingContext(ctx context.Context, ip, path string, data interface{}) {
+	start := time.Now()
+	ir.SessionRepositoryContext.BlacklistingContext(ctx, ip, path, data)
+	ir.m.observe("Blacklisting", start, nil)
+}
+
+func (ir instrumentedRepository) IsIPExistInBLContext(ctx context.Context, ip string) bool {
+	start := time.Now()
+	ok := ir.SessionRepositoryContext.IsIPExistInBLContext(ctx, ip)
+	ir.m.observe("IsIPExistInBL", start, nil)
+	return ok
+}
+
+func (ir instrumentedRepository) BLCleanContext(ctx context.Context) {
+	start := time.Now()
+	ir.SessionRepositoryContext.BLCleanContext(ctx)
+	ir.m.observe("BLClean", start, nil)
+}
@@ -0,0 +1,95 @@
+// Package provutil holds the helpers shared by the session store providers.
+package provutil
+
+import (
+	"container/heap"
+	"encoding/json"
+	"net"
+	"sort"
+)
+
+// BLQuarantine is the period (in seconds) a blacklisted ip stays in the blacklist before being reviewed for cleaning - 3 days
+const BLQuarantine = int64(259200)
+
+// NativeReverseDNSLookup will return `true` when the reverse DNS name of the
+// IP resolves back to the same IP (sign for a legit address such as a good bot).
+// The method described [on developers.google.com](https://developers.google.com/search/docs/advanced/crawling/verifying-googlebot)
+func NativeReverseDNSLookup(ip string) bool {
+
+	addrs, err := net.LookupAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		ips, err := net.LookupIP(addr)
+		if err != nil {
+			continue
+		}
+		for _, ipr := range ips {
+			if ipr.String() == ip {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NormalizeNumbers converts the json.Number values to int64 or float64
+func NormalizeNumbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = NormalizeNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = NormalizeNumbers(e)
+		}
+	}
+	return v
+}
+
+// SmallestIDs keeps the n smallest of the ids added to it, in a heap with the greatest at the top
+type SmallestIDs struct {
+	n   int
+	ids []string
+}
+
+// NewSmallestIDs returns an empty set keeping the n smallest ids
+func NewSmallestIDs(n int) *SmallestIDs {
+	return &SmallestIDs{n: n}
+}
+
+func (s *SmallestIDs) Len() int           { return len(s.ids) }
+func (s *SmallestIDs) Less(i, j int) bool { return s.ids[i] > s.ids[j] }
+func (s *SmallestIDs) Swap(i, j int)      { s.ids[i], s.ids[j] = s.ids[j], s.ids[i] }
+func (s *SmallestIDs) Push(x interface{}) { s.ids = append(s.ids, x.(string)) }
+func (s *SmallestIDs) Pop() interface{} {
+	id := s.ids[len(s.ids)-1]
+	s.ids = s.ids[:len(s.ids)-1]
+	return id
+}
+
+// Add keeps the id when it is one of the n smallest so far
+func (s *SmallestIDs) Add(id string) {
+	if len(s.ids) < s.n {
+		heap.Push(s, id)
+		return
+	}
+	if s.n > 0 && id < s.ids[0] {
+		s.ids[0] = id
+		heap.Fix(s, 0)
+	}
+}
+
+// Sorted returns the ids kept in ascending order
+func (s *SmallestIDs) Sorted() []string {
+	sort.Strings(s.ids)
+	return s.ids
+}
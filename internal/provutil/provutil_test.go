@@ -0,0 +1,31 @@
+package provutil
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeNumbers(t *testing.T) {
+
+	v := map[string]interface{}{
+		"n": json.Number("42"),
+		"f": json.Number("1.5"),
+		"l": []interface{}{json.Number("7"), "s"},
+	}
+	want := map[string]interface{}{"n": int64(42), "f": 1.5, "l": []interface{}{int64(7), "s"}}
+	if got := NormalizeNumbers(v); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestSmallestIDs(t *testing.T) {
+
+	s := NewSmallestIDs(3)
+	for _, id := range []string{"e", "b", "f", "a", "d", "c"} {
+		s.Add(id)
+	}
+	if got := s.Sorted(); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("expected the 3 smallest ids, got %v", got)
+	}
+}
@@ -0,0 +1,144 @@
+package ivmsesman
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// Invalidation tells the session managers of a service the sessions changed by one of them
+type Invalidation struct {
+	// Origin is the id of the session manager publishing the invalidation
+	Origin string
+	// SessionIDs are the ids of the changed sessions
+	SessionIDs []string
+	// All invalidates every session, e.g. when the bus may have lost invalidations
+	All bool
+}
+
+// InvalidationBus broadcasts the invalidations between the session managers of a service, so the copies of
+// a session kept by a replica (cache.SessionProvider) are dropped when another replica changes it.
+type InvalidationBus interface {
+	// Publish sends the invalidation to all subscribers
+	Publish(ctx context.Context, inv Invalidation) error
+
+	// Subscribe registers fn for the invalidations published by all session managers, its own included.
+	// The returned func ends the subscription.
+	Subscribe(fn func(ctx context.Context, inv Invalidation)) (func(), error)
+}
+
+// Invalidator is implemented by the repositories keeping copies of the sessions, which the session manager
+// drops when an invalidation arrives from the InvalidationBus. A repository holding the only copy of its
+// sessions, e.g. the memory provider shared by the managers of a process, must not implement it.
+type Invalidator interface {
+	// Invalidate drops the copies of the sessions
+	Invalidate(sids ...string)
+
+	// InvalidateAll drops the copies of all sessions
+	InvalidateAll()
+}
+
+// subscribe registers the session manager on the invalidation bus of the configuration, if any
+func (sm *Sesman) subscribe() error {
+
+	bus := sm.cfg.InvalidationBus
+	if bus == nil {
+		return nil
+	}
+	sm.origin = sm.sessionID()
+
+	unsubscribe, err := bus.Subscribe(sm.invalidated)
+	if err != nil {
+		return err
+	}
+	sm.unsubscribe = unsubscribe
+	return nil
+}
+
+// invalidated drops the copies of the sessions changed by another session manager
+func (sm *Sesman) invalidated(ctx context.Context, inv Invalidation) {
+
+	if inv.Origin == sm.origin {
+		return
+	}
+	iv, ok := underlying(sm.sessions).(Invalidator)
+	if !ok {
+		return
+	}
+	if inv.All {
+		iv.InvalidateAll()
+		return
+	}
+	iv.Invalidate(inv.SessionIDs...)
+}
+
+// publish sends the sessions changed by the event to the other session managers. The sessions expired
+// by the repository are not published - every replica checks the timeouts of its copies - nor the ones
+// evicted from the memory of a replica.
+func (sm *Sesman) publish(ctx context.Context, e Event) {
+
+	switch {
+	case sm.cfg.InvalidationBus == nil:
+		return
+	case e.Type == SessionCreated, e.Type == SessionEvicted:
+		return
+	case e.Type == SessionExpired && e.Reason == ReasonTimeout:
+		return
+	}
+
+	inv := Invalidation{Origin: sm.origin, SessionIDs: []string{e.SessionID}}
+	if e.OldSessionID != "" {
+		inv.SessionIDs = append(inv.SessionIDs, e.OldSessionID)
+	}
+	if err := sm.cfg.InvalidationBus.Publish(context.WithoutCancel(ctx), inv); err != nil {
+		sm.logger().ErrorContext(ctx, "unable to publish the session invalidation",
+			slog.Any("sid", Sensitive(e.SessionID)), slog.Any("error", err))
+	}
+}
+
+// LocalBus is an InvalidationBus delivering the invalidations to the subscribers in the process, e.g. to
+// several session managers over one store or in tests
+type LocalBus struct {
+	mu   sync.RWMutex
+	subs map[int]func(ctx context.Context, inv Invalidation)
+	next int
+}
+
+// NewLocalBus creates an in-process invalidation bus
+func NewLocalBus() *LocalBus {
+	return &LocalBus{subs: make(map[int]func(ctx context.Context, inv Invalidation))}
+}
+
+// Publish calls the subscribers with the invalidation
+func (b *LocalBus) Publish(ctx context.Context, inv Invalidation) error {
+
+	b.mu.RLock()
+	subs := make([]func(ctx context.Context, inv Invalidation), 0, len(b.subs))
+	for _, fn := range b.subs {
+		subs = append(subs, fn)
+	}
+	b.mu.RUnlock()
+
+	for _, fn := range subs {
+		fn(ctx, inv)
+	}
+	return nil
+}
+
+// Subscribe registers fn for the published invalidations
+func (b *LocalBus) Subscribe(fn func(ctx context.Context, inv Invalidation)) (func(), error) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.next
+	b.next++
+	b.subs[id] = fn
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		delete(b.subs, id)
+	}, nil
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"sync"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/segmentio/ksuid"
+	"golang.org/x/sync/singleflight"
 )
 
 // Key to use when setting the request ID.
@@ -20,6 +22,9 @@ type ctxKeySessionObj int
 // RequestIDKey is the key that holds the unique request ID in a request context.
 const SessionObjKey ctxKeySessionObj = 0
 
+// renewedAtKey is the session value holding the unix time the session id was last renewed
+const renewedAtKey = "renewed_at"
+
 //
 // TODO: Review the session manager design to match the guidlines from (https://cheatsheetseries.owasp.org/cheatsheets/Session_Management_Cheat_Sheet.html)
 // The stored information can include the client IP address, User-Agent, e-mail, username, user ID, role, privilege level, access rights, language preferences, account ID, current state, last login, session timeouts, and other internal session details.
@@ -27,9 +32,19 @@ const SessionObjKey ctxKeySessionObj = 0
 
 // Sesman is the session manager object to be used for managing sessions
 type Sesman struct {
-	sessions SessionRepository
-	lock     sync.Mutex
+	sessions SessionRepositoryContext
+	locks    sidLocks
+	lookups  singleflight.Group
 	cfg      *SesCfg
+	keyring  *Keyring
+	log      *slog.Logger
+	metrics  *Metrics
+	evlock   sync.RWMutex
+	sinks    []EventSink
+	sched    scheduler
+	// origin identifies the session manager on the invalidation bus
+	origin      string
+	unsubscribe func()
 }
 
 // SesCfg configures the session that will be created
@@ -39,6 +54,50 @@ type SesCfg struct {
 	VisitCookieName string
 	ProjectID       string
 	BLCleanInterval int64
+
+	// GCInterval is the time in seconds between the session GC runs started by Sesman.Start. Zero uses Maxlifetime.
+	GCInterval int64
+	// SnapshotInterval is the time in seconds between the snapshots of a Snapshotter repository (inmem with
+	// a SnapshotPath) taken by Sesman.Start. Zero takes only the final snapshot on Sesman.Close.
+	SnapshotInterval int64
+	// SchedulerJitter spreads the background job runs by up to this fraction of their interval, so the
+	// instances of a service do not hit the store at once. Zero uses 0.1 and a negative value disables it.
+	SchedulerJitter float64
+
+	// CookieKeys are the HMAC-SHA256 keys signing the session cookie - the current key first, followed by
+	// the previous keys still accepted. When empty the session id is written in the cookie as it is.
+	CookieKeys [][]byte
+	// CookieEncryptionKeys are the optional AES-GCM keys encrypting the session cookie, ordered as CookieKeys.
+	// They require CookieKeys.
+	CookieEncryptionKeys [][]byte
+
+	// StrictSessionID stops the session manager from adopting a session id from the request cookie which is
+	// unknown to the repository. A new server generated id and cookie are issued instead (session fixation).
+	StrictSessionID bool
+
+	// AbsoluteTimeout is the time in seconds a session expires after its creation, regardless of the activity.
+	// Maxlifetime is the idle timeout. Zero disables the absolute timeout.
+	AbsoluteTimeout int64
+	// RenewalTimeout is the time in seconds after which the session id is renewed, keeping the session data.
+	// Zero disables the renewal. It requires a repository implementing SessionRegenerator.
+	RenewalTimeout int64
+	// TouchInterval is the time in seconds the last access time of a session is kept before a read rewrites
+	// it, saving a store write per request. The sessions may expire up to TouchInterval seconds before
+	// Maxlifetime, so it must be shorter. Zero rewrites it at most once per second.
+	TouchInterval int64
+
+	// Logger receives the events of the session manager and its repository. Nil uses slog.Default().
+	Logger *slog.Logger
+	// LogSensitive logs the session ids and tokens as they are. By default they are redacted.
+	LogSensitive bool
+
+	// Metrics collects the session counters and the repository latencies. Nil creates a new set for the
+	// session manager, see Sesman.MetricsHandler.
+	Metrics *Metrics
+
+	// InvalidationBus broadcasts the sessions changed by the session manager to the other replicas of the
+	// service, which drop their copies of them from a repository implementing Invalidator.
+	InvalidationBus InvalidationBus
 }
 
 type ssProvider int
@@ -68,6 +127,7 @@ func (ssp ssProvider) String() string {
 	}
 }
 
+// providers is the registry used by NewSesman. Prefer NewSesmanWithRepository, which does not depend on it.
 var providers = make(map[string]SessionRepository)
 
 // Custom key for session obj in the request context
@@ -83,7 +143,60 @@ func NewSesman(ssProvider ssProvider, cfg *SesCfg) (*Sesman, error) {
 	if cfg == nil || cfg.CookieName == "" || cfg.ProjectID == "" {
 		return nil, fmt.Errorf("Sesman: Missing or invalid Session Manager Configuration")
 	}
-	return &Sesman{sessions: provider, cfg: cfg}, nil
+	return newSesman(provider, cfg)
+}
+
+// NewSesmanWithRepository will create a new Session Manager on top of the repository. Each Sesman
+// owns its repository, so several managers can run in one process against different stores.
+func NewSesmanWithRepository(repo SessionRepository, cfg *SesCfg) (*Sesman, error) {
+	if repo == nil {
+		return nil, fmt.Errorf("Sesman: Missing session repository")
+	}
+	if cfg == nil || cfg.CookieName == "" {
+		return nil, fmt.Errorf("Sesman: Missing or invalid Session Manager Configuration")
+	}
+	return newSesman(repo, cfg)
+}
+
+// newSesman creates the session manager from a validated configuration
+func newSesman(repo SessionRepository, cfg *SesCfg) (*Sesman, error) {
+
+	m := cfg.Metrics
+	if m == nil {
+		m = NewMetrics()
+	}
+	if cfg.TouchInterval < 0 || (cfg.TouchInterval > 0 && cfg.TouchInterval >= cfg.Maxlifetime) {
+		return nil, fmt.Errorf("Sesman: touch interval %v must be shorter than the max lifetime %v", cfg.TouchInterval, cfg.Maxlifetime)
+	}
+	sm := &Sesman{sessions: instrumentedRepository{WithContext(repo), m}, cfg: cfg, log: newLogger(cfg), metrics: m}
+
+	if len(cfg.CookieKeys) > 0 {
+		kr, err := NewKeyring(cfg.CookieKeys, cfg.CookieEncryptionKeys)
+		if err != nil {
+			return nil, fmt.Errorf("Sesman: invalid cookie keys: %v", err)
+		}
+		sm.keyring = kr
+	} else if len(cfg.CookieEncryptionKeys) > 0 {
+		return nil, fmt.Errorf("Sesman: cookie encryption keys require cookie signing keys")
+	}
+
+	if ls, ok := repo.(LoggerSetter); ok && sm.log != nil {
+		ls.SetLogger(sm.log)
+	}
+	if eps, ok := repo.(ExpiryPolicySetter); ok {
+		eps.SetExpiryPolicy(sm.expiryPolicy())
+	}
+	if els, ok := repo.(ExpiryListenerSetter); ok {
+		els.SetExpiryListener(sm.expiredByRepository)
+	}
+	if els, ok := repo.(EvictionListenerSetter); ok {
+		els.SetEvictionListener(sm.evictedByRepository)
+	}
+	sm.restore(repo)
+	if err := sm.subscribe(); err != nil {
+		return nil, fmt.Errorf("Sesman: unable to subscribe to the invalidation bus: %v", err)
+	}
+	return sm, nil
 }
 
 // SessionRepository interface for the session storage
@@ -97,9 +210,7 @@ type SessionRepository interface {
 	//Exists will check the session storage for a session id
 	Exists(sid string) bool
 
-	// FindAll will return slice of all active sessions
-	// TODO: FindAll could be expensive. Think if there is a real use-case about it
-	// FindAll() []*SessionStore
+	// The sessions are listed a page at a time by the repositories implementing SessionLister
 
 	//ActiveSessions will return the number of the active sessions in the session store
 	ActiveSessions() int
@@ -164,6 +275,32 @@ type SessionStore interface {
 	// SessionRelease(w http.ResponseWriter)
 }
 
+// SessionRegenerator is implemented by the repositories which can move a session under a new id
+type SessionRegenerator interface {
+	// RegenerateContext moves the data of the session oldsid to the new session newsid and removes oldsid
+	RegenerateContext(ctx context.Context, oldsid, newsid string) (SessionStore, error)
+}
+
+// SessionFinder is implemented by the repositories which can look a session up without creating it. The
+// strict session ids (SesCfg.StrictSessionID) rely on it: an ExistsContext followed by FindOrCreateContext
+// would create again, under the id supplied by the client, a session expiring between the two calls.
+type SessionFinder interface {
+	// FindContext returns the session sid, or ErrInvalidSessionID when the repository does not hold it
+	FindContext(ctx context.Context, sid string) (SessionStore, error)
+}
+
+// ClientSideRepository is implemented by the repositories keeping the whole session in the client instead
+// of a server store, e.g. in cookies. The session manager binds the session carried by the request to the
+// repository while the request is served and saves it back in the response before the headers are written.
+type ClientSideRepository interface {
+	// Load binds the session sid carried by the request and reports if it was found valid
+	Load(r *http.Request, sid string) bool
+
+	// Save writes the bound session sid in the response and releases it. A destroyed or unknown
+	// session removes the session carried by the request.
+	Save(w http.ResponseWriter, r *http.Request, sid string) error
+}
+
 // RegisterProvider registers a new provider of session storage for the session management.
 func RegisterProvider(name ssProvider, provider SessionRepository) {
 
@@ -191,58 +328,196 @@ func (sm *Sesman) sessionID() string {
 	return sid.String()
 }
 
-// SessionManager allocate (existing session id) or create a new session if it does not exists for validating user oprations
+// SessionManager allocate (existing session id) or create a new session if it does not exists for validating user oprations.
+// The concurrent requests of a session share the lookup in the repository and the requests of other sessions are not blocked.
 func (sm *Sesman) SessionManager(w http.ResponseWriter, r *http.Request) (SessionStore, error) {
 
-	sm.lock.Lock()
-	defer sm.lock.Unlock()
-
 	var session SessionStore
+	ctx := r.Context()
 
-	// [ ]: remove after debug
-	fmt.Printf("searching for cookie name: [%s]\n", sm.cfg.CookieName)
-	cookie, err := r.Cookie(sm.cfg.CookieName)
+	sid, err := sm.cookieSID(r)
+	cs, clientSide := underlying(sm.sessions).(ClientSideRepository)
+	if err == nil && clientSide {
+		cs.Load(r, sid)
+	}
+
+	if err == nil {
 
-	if err == http.ErrNoCookie {
+		session, err = sm.find(ctx, sid, sm.cfg.StrictSessionID)
+		if err == ErrStoreFull {
+			sm.metrics.refused.Add(1)
+			return nil, err
+		}
+		if err != nil && err != ErrInvalidSessionID {
+			return nil, fmt.Errorf("unable to acquire the session id %v , error %v", sid, err)
+		}
+
+		if session != nil && sm.expired(session) {
+			// the repository does not enforce the absolute timeout
+			unlock := sm.locks.lock(sid)
+			if sm.sessions.DestroySIDContext(ctx, sid) == nil {
+				sm.emit(ctx, Event{Type: SessionExpired, SessionID: sid, Reason: ReasonAbsoluteTimeout})
+			}
+			unlock()
+			session = nil
+		} else if session != nil {
+			if session, err = sm.renew(ctx, w, session); err != nil {
+				return nil, err
+			}
+		}
+	}
 
-		sid := sm.sessionID()
+	if session == nil {
 
-		// TODO: remove after debug
-		fmt.Printf("[SessionManager-1] generated sid: %v\n", sid)
+		// a missing cookie, one failing the verification, an expired session or (in strict mode) an
+		// unknown id never reaches the session store
+		sid = sm.sessionID()
 
-		session, err = sm.sessions.NewSession(sid)
+		session, err = sm.sessions.NewSessionContext(ctx, sid)
+		if err == ErrStoreFull {
+			sm.metrics.refused.Add(1)
+			return nil, err
+		}
 		if err != nil {
 			return nil, fmt.Errorf("error creating a new session: %v", err)
 		}
+		sm.metrics.created.Add(1)
+		sm.logger().DebugContext(ctx, "new session created", slog.Any("sid", Sensitive(sid)))
+		if sm.observed() {
+			state, _ := StoreWithContext(session).GetContext(ctx, "state").(string)
+			sm.emit(ctx, Event{Type: SessionCreated, SessionID: sid, NewState: state})
+		}
 
-		// TODO: remove after debug
-		fmt.Printf("[SessionManager-2] session ID: %v\n", session.SessionID())
+		if err = sm.setSessionCookie(w, sid); err != nil {
+			return nil, err
+		}
+	}
 
-		cookie := http.Cookie{
-			Name:     sm.cfg.CookieName,
-			Value:    url.QueryEscape(sid),
-			Path:     "/",
-			HttpOnly: true,
-			Secure:   true,
-			SameSite: http.SameSiteStrictMode,
-			MaxAge:   int(sm.cfg.Maxlifetime)}
+	// outside of MWManager the client side session can only be saved as it is now
+	if _, ok := w.(*sessionWriter); clientSide && !ok {
+		if err = cs.Save(w, r, session.SessionID()); err != nil {
+			return nil, fmt.Errorf("unable to save the session id %v , error %v", sid, err)
+		}
+	}
 
-		http.SetCookie(w, &cookie)
+	return session, nil
+}
+
+// expiryPolicy returns the session timeouts of the configuration
+func (sm *Sesman) expiryPolicy() ExpiryPolicy {
+	return ExpiryPolicy{Idle: sm.cfg.Maxlifetime, Absolute: sm.cfg.AbsoluteTimeout, Touch: sm.cfg.TouchInterval}
+}
 
-	} else {
+// expired checks the absolute timeout of the session returned by the repository. The idle timeout
+// can not be checked here, as finding the session refreshes its last access time.
+func (sm *Sesman) expired(ss SessionStore) bool {
+
+	c, ok := CreatedAt(ss)
+	if !ok || sm.cfg.AbsoluteTimeout <= 0 {
+		return false
+	}
+	now := time.Now().Unix()
+	return ExpiryPolicy{Absolute: sm.cfg.AbsoluteTimeout}.Expired(c.Unix(), now, now)
+}
 
+// renew moves the session under a new id once the renewal timeout passed since its id was issued.
+// When a concurrent request of the session renewed it first, the session is returned as it is.
+func (sm *Sesman) renew(ctx context.Context, w http.ResponseWriter, ss SessionStore) (SessionStore, error) {
+
+	if sm.cfg.RenewalTimeout <= 0 {
+		return ss, nil
+	}
+	if _, ok := underlying(sm.sessions).(SessionRegenerator); !ok {
+		return ss, nil
+	}
+
+	issued, ok := StoreWithContext(ss).GetContext(ctx, renewedAtKey).(int64)
+	if !ok {
+		c, ok := CreatedAt(ss)
+		if !ok {
+			return ss, nil
+		}
+		issued = c.Unix()
+	}
+
+	now := time.Now().Unix()
+	if issued+sm.cfg.RenewalTimeout > now {
+		return ss, nil
+	}
+
+	unlock := sm.locks.lock(ss.SessionID())
+	defer unlock()
+
+	if !sm.sessions.ExistsContext(ctx, ss.SessionID()) {
+		return ss, nil
+	}
+	ns, err := sm.regenerate(ctx, ss.SessionID())
+	if err == ErrRegenerateNotSupported {
+		return ss, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = StoreWithContext(ns).SetContext(ctx, renewedAtKey, now); err != nil {
+		return nil, fmt.Errorf("unable to save the renewal time of session id %v, error %v", ns.SessionID(), err)
+	}
+	sm.emit(ctx, Event{Type: SessionRegenerated, SessionID: ns.SessionID(), OldSessionID: ss.SessionID(), Reason: ReasonRenewal})
+	if err = sm.setSessionCookie(w, ns.SessionID()); err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+// cookieSID returns the session id carried by the session cookie of the request. ErrUnknownSessionID is
+// returned when the cookie is missing or empty and ErrInvalidCookie when its value fails the verification.
+func (sm *Sesman) cookieSID(r *http.Request) (string, error) {
+
+	cookie, err := r.Cookie(sm.cfg.CookieName)
+	if err != nil || cookie.Value == "" {
+		return "", ErrUnknownSessionID
+	}
+
+	if sm.keyring == nil {
 		sid, err := url.QueryUnescape(cookie.Value)
 		if err != nil {
-			return nil, fmt.Errorf("unable to unescape the session id, error %v", err)
+			return "", ErrInvalidCookie
 		}
+		return sid, nil
+	}
 
-		session, err = sm.sessions.FindOrCreate(sid)
-		if err != nil {
-			return nil, fmt.Errorf("unable to acquire the session id %v , error %v", sid, err)
+	sid, err := sm.keyring.Decode(sm.cfg.CookieName, cookie.Value)
+	if err != nil || len(sid) == 0 {
+		return "", ErrInvalidCookie
+	}
+	return string(sid), nil
+}
+
+// setSessionCookie writes the session cookie carrying the session id
+func (sm *Sesman) setSessionCookie(w http.ResponseWriter, sid string) error {
+
+	value := url.QueryEscape(sid)
+	if sm.keyring != nil {
+		var err error
+		if value, err = sm.keyring.Encode(sm.cfg.CookieName, []byte(sid)); err != nil {
+			return fmt.Errorf("unable to encode the session cookie: %v", err)
 		}
 	}
 
-	return session, nil
+	cookie := http.Cookie{
+		Name:     sm.cfg.CookieName,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   int(sm.cfg.Maxlifetime)}
+
+	http.SetCookie(w, &cookie)
+
+	if sw, ok := w.(*sessionWriter); ok {
+		sw.sid = sid
+	}
+	return nil
 }
 
 // MWManager - is a Middleware Handler that proxy the Session Manager
@@ -253,25 +528,51 @@ func (sm *Sesman) MWManager(next http.Handler) http.Handler {
 		w.Header().Set("X-XSS-Protection", "1; mode=block")
 		w.Header().Set("X-Frame-Options", "deny")
 
+		if cs, ok := underlying(sm.sessions).(ClientSideRepository); ok {
+			sw := &sessionWriter{ResponseWriter: w, r: r, repo: cs, log: sm.logger()}
+			defer sw.save()
+			w = sw
+		}
+
 		session, err := sm.SessionManager(w, r)
+		if err == ErrStoreFull {
+			// the store refuses new sessions under pressure, the client can retry later
+			w.Header().Set("Retry-After", storeFullRetryAfter)
+			sm.logger().WarnContext(r.Context(), "refusing the request, the session store is full")
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
 		if err != nil || session == nil {
 			w.Header().Set("Connection", "close")
-			fmt.Printf("[Error] dropping the request due to session management error: %v\n", err)
+			sm.logger().ErrorContext(r.Context(), "dropping the request due to session management error", slog.Any("error", err))
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
 
-		sesStateValue := session.Get("state").(string)
+		ctx := r.Context()
+		ctx = context.WithValue(ctx, SessionObjKey, session)
+
+		// the changes of the request are written at once when the handler returns
+		if sb, ok := bufferOf(session); ok {
+			rb := &requestBuffered{ss: session, sb: sb}
+			ctx = context.WithValue(ctx, bufferKey{}, rb)
+			sb.Buffer(ctx)
+			defer sm.release(ctx, rb)
+		}
+
+		sesStateValue, _ := StoreWithContext(session).GetContext(ctx, "state").(string)
 		r.Header.Set("X-Session-State", sesStateValue)
 
-		ctx := r.Context()
 		rid := middleware.GetReqID(ctx)
 
-		ctx = context.WithValue(ctx, SessionObjKey, session)
+		if sw, ok := w.(*sessionWriter); ok {
+			sw.sid = session.SessionID()
+		}
 
-		// TODO: remove after debug
-		sid := session.SessionID()
-		fmt.Printf("[mw MWManager] request id [%s] session id [%v], with session state [%v] found in the request\n", rid, sid, sesStateValue)
+		sm.logger().DebugContext(ctx, "session found in the request",
+			slog.String("request_id", rid),
+			slog.Any("sid", Sensitive(session.SessionID())),
+			slog.String("state", sesStateValue))
 
 		if sesStateValue != "Authed" {
 			// Delete previously set ia cookie
@@ -284,42 +585,75 @@ func (sm *Sesman) MWManager(next http.Handler) http.Handler {
 
 // ActiveSessions will return the number of the active sessions in the session store
 func (sm *Sesman) ActiveSessions() int {
-	return sm.sessions.ActiveSessions()
+	return sm.sessions.ActiveSessionsContext(context.Background())
 }
 
 // UpdateCodeVerifier will update the code verifier (cove) value assigned to the session id
 func (sm *Sesman) UpdateCodeVerifier(sid, cove string) error {
-	return sm.sessions.UpdateCodeVerifier(sid, cove)
+	return sm.UpdateCodeVerifierContext(context.Background(), sid, cove)
+}
+
+// UpdateCodeVerifierContext is UpdateCodeVerifier with a context
+func (sm *Sesman) UpdateCodeVerifierContext(ctx context.Context, sid, cove string) error {
+	return sm.sessions.UpdateCodeVerifierContext(ctx, sid, cove)
 }
 
 // SaveACA - at step2 of AuthorizationCode flow save Athorization Code Attributes
 func (sm *Sesman) SaveACA(sid, coch, mth, code, ru string) error {
-	return sm.sessions.SaveCodeChallengeAndMethod(sid, coch, mth, code, ru)
+	return sm.SaveACAContext(context.Background(), sid, coch, mth, code, ru)
+}
+
+// SaveACAContext is SaveACA with a context
+func (sm *Sesman) SaveACAContext(ctx context.Context, sid, coch, mth, code, ru string) error {
+	if err := sm.sessions.SaveCodeChallengeAndMethodContext(ctx, sid, coch, mth, code, ru); err != nil {
+		return err
+	}
+	sm.metrics.state("InAuth")
+	return nil
 }
 
 // GetSessionAuthCode will return the authorization code for a session, if it is InAuth
 func (sm *Sesman) GetAuthCode(sid string) map[string]string {
-	return sm.sessions.GetAuthCode(sid)
+	return sm.GetAuthCodeContext(context.Background(), sid)
+}
+
+// GetAuthCodeContext is GetAuthCode with a context
+func (sm *Sesman) GetAuthCodeContext(ctx context.Context, sid string) map[string]string {
+	return sm.sessions.GetAuthCodeContext(ctx, sid)
 }
 
 // Blacklisting the ip from the func argument
 func (sm *Sesman) AddBlacklisting(ip, path string, data interface{}) {
-	sm.sessions.Blacklisting(ip, path, data)
+	sm.AddBlacklistingContext(context.Background(), ip, path, data)
+}
+
+// AddBlacklistingContext is AddBlacklisting with a context
+func (sm *Sesman) AddBlacklistingContext(ctx context.Context, ip, path string, data interface{}) {
+	sm.sessions.BlacklistingContext(ctx, ip, path, data)
 }
 
 // IsBlackListed - checks if the ip is blacklisted
 func (sm *Sesman) IsBlackListed(ip string) bool {
-	return sm.sessions.IsIPExistInBL(ip)
+	return sm.IsBlackListedContext(context.Background(), ip)
+}
+
+// IsBlackListedContext is IsBlackListed with a context
+func (sm *Sesman) IsBlackListedContext(ctx context.Context, ip string) bool {
+	if !sm.sessions.IsIPExistInBLContext(ctx, ip) {
+		return false
+	}
+	sm.metrics.blacklistHits.Add(1)
+	return true
 }
 
 // GetAuthSessAT - will extract the value of the attribute sent in the func
 func (sm *Sesman) GetAuthSessAT(ctx context.Context, val_att string) string {
 	if ctx == nil {
-		fmt.Printf("\n...nil context!\n")
+		sm.logger().Warn("GetAuthSessAT called with nil context")
 		return ""
 	}
 	if sess, ok := ctx.Value(SessionObjKey).(SessionStore); ok {
-		var at = sess.Get(val_att).(string)
+		at, _ := StoreWithContext(sess).GetContext(ctx, val_att).(string)
 		return at
 	}
 	return ""
@@ -328,24 +662,21 @@ func (sm *Sesman) GetAuthSessAT(ctx context.Context, val_att string) string {
 // GetAuthSessionAttribute - will use the request to get the session id (either context or the session cookie) and return the requested session's attribute
 func (sm *Sesman) GetAuthSessionAttribute(r *http.Request, att_name string) (atrb interface{}, err error) {
 
-	cookie, err := r.Cookie(sm.cfg.CookieName)
-	if err != nil || cookie.Value == "" {
-		return nil, ErrUnknownSessionID
+	sid, err := sm.cookieSID(r)
+	if err != nil {
+		return nil, err
 	}
 
-	sm.lock.Lock()
-	defer sm.lock.Unlock()
-
-	if !sm.sessions.Exists(cookie.Value) {
-		return nil, ErrInvalidSessionID
+	ctx := r.Context()
+	ses, errs := sm.find(ctx, sid, true)
+	if errs == ErrInvalidSessionID {
+		return nil, errs
 	}
-
-	ses, errs := sm.sessions.FindOrCreate(cookie.Value)
 	if errs != nil {
-		return nil, fmt.Errorf("unable to find session id %s, error: %v", cookie.Value, errs)
+		return nil, fmt.Errorf("unable to find session id %s, error: %v", sid, errs)
 	}
 
-	return ses.Get(att_name), nil
+	return StoreWithContext(ses).GetContext(ctx, att_name), nil
 }
 
 // GetLastAccessedAt will return the seconds since Epoch when the session was lastly accessed.
@@ -357,18 +688,31 @@ func (sm *Sesman) GetLastAccessedAt() int64 {
 // Destroy sessionid
 func (sm *Sesman) Destroy(w http.ResponseWriter, r *http.Request) {
 
-	cookie, err := r.Cookie(sm.cfg.CookieName)
-	if err != nil || cookie.Value == "" {
+	sid, err := sm.cookieSID(r)
+	if err == ErrUnknownSessionID {
 		return
 	}
 
-	sm.lock.Lock()
-	defer sm.lock.Unlock()
+	unlock := sm.locks.lock(sid)
+	defer unlock()
 
-	_ = sm.sessions.DestroySID(cookie.Value)
+	if err == nil {
+		ctx := r.Context()
+		var state string
+		if sm.observed() {
+			state = sm.sessionState(ctx, sid)
+		}
+		if rb, ok := requestBuffer(ctx, sid); ok {
+			rb.detach(ctx)
+		}
+		if sm.sessions.DestroySIDContext(ctx, sid) == nil {
+			sm.metrics.destroyed.Add(1)
+			sm.emit(ctx, Event{Type: SessionDestroyed, SessionID: sid, OldState: state, Reason: ReasonDestroyed})
+		}
+	}
 	expiration := time.Now()
 
-	cookie = &http.Cookie{
+	cookie := &http.Cookie{
 		Name:     sm.cfg.CookieName,
 		Path:     "/",
 		HttpOnly: true,
@@ -380,57 +724,45 @@ func (sm *Sesman) Destroy(w http.ResponseWriter, r *http.Request) {
 	http.SetCookie(w, cookie)
 }
 
-// GC is a global clean for expired sessions. It needs to be started in the calling func
-//
-// Example:
+// GC cleans the expired sessions right away and then every GCInterval seconds in the background, until Close.
 //
-//	func init() {
-//		go globalSessions.GC()
-//	}
-//
-// The GC makes full use of the timer function in the time package. It automatically calls GC when the session times out, ensuring that all sessions are usable during maxLifeTime.
-// TODO: A similar solution can be used to count online users.
+// Deprecated: use Start, which runs the blacklist cleaning as well and stops with its context.
 func (sm *Sesman) GC() {
-
-	sm.lock.Lock()
-	defer sm.lock.Unlock()
-
-	// TODO: find a way to prevent app crashing with panic
-	sm.sessions.SessionGC(sm.cfg.Maxlifetime)
-	time.AfterFunc(time.Duration(sm.cfg.Maxlifetime), func() { sm.GC() })
+	if err := sm.schedule(context.Background(), true, sm.gcJob()); err != nil {
+		sm.logger().Warn("session GC not started", slog.Any("error", err))
+	}
 }
 
-// BLC is a support function to clean the blacklist collection in FireStore on regular RunServer
+// BLC cleans the blacklist right away and then every BLCleanInterval seconds in the background, until Close.
+//
+// Deprecated: use Start, which runs the session GC as well and stops with its context.
 func (sm *Sesman) BLC() {
-
-	sm.sessions.BLClean()
-	intv := time.Duration(sm.cfg.BLCleanInterval) * time.Second
-	time.AfterFunc(intv, func() {
-		fmt.Printf("started at: %v, with interval: %v\n", time.Now(), intv)
-		sm.BLC()
-	})
+	if sm.cfg.BLCleanInterval <= 0 {
+		sm.sessions.BLCleanContext(context.Background())
+		return
+	}
+	if err := sm.schedule(context.Background(), true, sm.blcJob()); err != nil {
+		sm.logger().Warn("blacklist cleaning not started", slog.Any("error", err))
+	}
 }
 
 // Exists will check the session repository for a session by its id and return the result as bool
 func (sm *Sesman) Exists(w http.ResponseWriter, r *http.Request) (bool, error) {
 
-	cookie, err := r.Cookie(sm.cfg.CookieName)
-	if err != nil || cookie.Value == "" {
-		return false, ErrUnknownSessionID
+	sid, err := sm.cookieSID(r)
+	if err != nil {
+		return false, err
 	}
 
-	sm.lock.Lock()
-	defer sm.lock.Unlock()
-
-	return sm.sessions.Exists(cookie.Value), nil
+	return sm.exists(r.Context(), sid), nil
 }
 
 // Change state will be using the custom request header X-Session-State to handle the state defined by other services like API gateway and auth-service
 func (sm *Sesman) ChangeState(w http.ResponseWriter, r *http.Request) (bool, error) {
 
-	cookie, err := r.Cookie(sm.cfg.CookieName)
-	if err != nil || cookie.Value == "" {
-		return false, ErrUnknownSessionID
+	sid, err := sm.cookieSID(r)
+	if err != nil {
+		return false, err
 	}
 
 	var stateVal = r.Header.Get("X-Session-State")
@@ -438,61 +770,152 @@ func (sm *Sesman) ChangeState(w http.ResponseWriter, r *http.Request) (bool, err
 		return false, fmt.Errorf("missing not empty value for the new state in the request custome header x-session-state")
 	}
 
-	sm.lock.Lock()
-	defer sm.lock.Unlock()
+	unlock := sm.locks.lock(sid)
+	defer unlock()
 
-	err = sm.sessions.UpdateSessionState(cookie.Value, stateVal)
+	ctx := r.Context()
+	var oldState string
+	if sm.observed() {
+		oldState = sm.sessionState(ctx, sid)
+	}
+
+	err = sm.sessions.UpdateSessionStateContext(ctx, sid, stateVal)
 	if err != nil {
 		return false, err
 	}
 
-	fmt.Printf("Session id %v state MSUT be changed to %v\n", cookie.Value, stateVal)
+	sm.metrics.state(stateVal)
+	sm.emit(ctx, Event{Type: SessionStateChanged, SessionID: sid, OldState: oldState, NewState: stateVal})
+	sm.logger().DebugContext(r.Context(), "session state changed", slog.Any("sid", Sensitive(sid)), slog.String("state", stateVal))
 	return true, nil
 }
 
 // SessionAuth changes an existing session in state "InAuth" to a new id and state "Authed"
 func (sm *Sesman) SessionAuth(w http.ResponseWriter, r *http.Request, at, rt, uid string) error {
 
-	cookie, err := r.Cookie(sm.cfg.CookieName)
-	if err != nil || cookie.Value == "" {
-		return ErrUnknownSessionID
+	sid, err := sm.cookieSID(r)
+	if err != nil {
+		return err
 	}
 
-	sm.lock.Lock()
-	defer sm.lock.Unlock()
+	unlock := sm.locks.lock(sid)
+	defer unlock()
 
-	if !sm.sessions.Exists(cookie.Value) {
+	ctx := r.Context()
+	if !sm.sessions.ExistsContext(ctx, sid) {
 		return ErrInvalidSessionID
 	}
 
-	err = sm.sessions.DestroySID(cookie.Value)
+	var oldState string
+	if sm.observed() {
+		oldState = sm.sessionState(ctx, sid)
+	}
+
+	var nsid string
+	ss, err := sm.regenerate(ctx, sid)
+	switch {
+	case err == nil:
+		nsid = ss.SessionID()
+
+	case err != ErrRegenerateNotSupported:
+		return fmt.Errorf("error regenerating the `InAuth` session: %s", err.Error())
+
+	default:
+
+		err = sm.sessions.DestroySIDContext(ctx, sid)
+		if err != nil {
+			return fmt.Errorf("error distroying the old `InAuth` session: %s", err.Error())
+		}
+
+		nsid = sm.sessionID()
+		_, err = sm.sessions.NewSessionContext(ctx, nsid)
+		if err != nil {
+			return fmt.Errorf("error creating Authed session: %s", err.Error())
+		}
+		sm.metrics.destroyed.Add(1)
+		sm.metrics.created.Add(1)
+	}
+
+	err = sm.sessions.UpdateAuthSessionContext(ctx, nsid, at, rt, uid)
 	if err != nil {
-		return fmt.Errorf("error distroying the old `InAuth` session: %s", err.Error())
+		return fmt.Errorf("error updating Authed session: %s", err.Error())
 	}
+	sm.metrics.state("Authed")
+	sm.emit(ctx, Event{Type: SessionAuthenticated, SessionID: nsid, OldSessionID: sid, OldState: oldState, NewState: "Authed", UserID: uid})
 
-	nsid := sm.sessionID()
-	_, err = sm.sessions.NewSession(nsid)
+	return sm.setSessionCookie(w, nsid)
+}
+
+// Regenerate moves the session of the request under a new server generated id, keeping the session data,
+// and sets the cookie with the new id. Call it whenever the privileges of the session change.
+func (sm *Sesman) Regenerate(w http.ResponseWriter, r *http.Request) (SessionStore, error) {
+
+	sid, err := sm.cookieSID(r)
 	if err != nil {
-		return fmt.Errorf("error creating Authed session: %s", err.Error())
+		return nil, err
 	}
 
-	err = sm.sessions.UpdateAuthSession(nsid, at, rt, uid)
+	unlock := sm.locks.lock(sid)
+	defer unlock()
+
+	ctx := r.Context()
+	if !sm.sessions.ExistsContext(ctx, sid) {
+		return nil, ErrInvalidSessionID
+	}
+
+	ss, err := sm.regenerate(ctx, sid)
 	if err != nil {
-		return fmt.Errorf("error updating Authed session: %s", err.Error())
+		return nil, err
 	}
+	sm.emit(ctx, Event{Type: SessionRegenerated, SessionID: ss.SessionID(), OldSessionID: sid, Reason: ReasonRegenerate})
 
-	nsCookie := http.Cookie{
-		Name:     sm.cfg.CookieName,
-		Value:    url.QueryEscape(nsid),
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   true,
-		SameSite: http.SameSiteStrictMode,
-		MaxAge:   int(sm.cfg.Maxlifetime)}
+	if err = sm.setSessionCookie(w, ss.SessionID()); err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
 
-	http.SetCookie(w, &nsCookie)
+// regenerate moves the session sid under a new id. The caller holds the lock of sid.
+func (sm *Sesman) regenerate(ctx context.Context, sid string) (SessionStore, error) {
 
-	return nil
+	rg, ok := underlying(sm.sessions).(SessionRegenerator)
+	if !ok {
+		return nil, ErrRegenerateNotSupported
+	}
+
+	// the session moves with the changes of the request made so far
+	rb, buffered := requestBuffer(ctx, sid)
+	if buffered {
+		if err := rb.sb.Save(ctx); err != nil {
+			return nil, fmt.Errorf("unable to save session id %v before regenerating it, error %v", sid, err)
+		}
+	}
+
+	start := time.Now()
+	ss, err := rg.RegenerateContext(ctx, sid, sm.sessionID())
+	if err == ErrRegenerateNotSupported {
+		// a decorating repository, e.g. a cache, over a repository not implementing SessionRegenerator
+		return nil, err
+	}
+	sm.metrics.observe("Regenerate", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("unable to regenerate session id %v, error %v", sid, err)
+	}
+	if buffered {
+		rb.detach(ctx)
+	}
+	sm.metrics.regenerated.Add(1)
+	return StoreWithContext(ss), nil
+}
+
+// Metrics returns the metrics of the session manager
+func (sm *Sesman) Metrics() *Metrics {
+	return sm.metrics
+}
+
+// MetricsHandler serves the metrics of the session manager in the Prometheus text exposition format
+func (sm *Sesman) MetricsHandler() http.Handler {
+	return sm.metrics.Handler()
 }
 
 // ErrUnknownSessionID  will be returned when a session id is required for a operation but it is missing or wrong value
@@ -500,3 +923,18 @@ var ErrUnknownSessionID = errors.New("unknown session id")
 
 // ErrInvalidSessionID  will be returned when a session id is required for a operation but it does not exists.
 var ErrInvalidSessionID = errors.New("invalid session id")
+
+// ErrStoreFull will be returned by the bounded repositories refusing a new session, and by SessionManager
+// for the request needing one. MWManager responds with 503 Service Unavailable.
+var ErrStoreFull = errors.New("session store is full")
+
+// storeFullRetryAfter is the Retry-After header value (in seconds) of the requests refused as the store is full
+const storeFullRetryAfter = "5"
+
+// ErrFindNotSupported will be returned by the decorating repositories from FindContext when the repository they
+// wrap does not implement SessionFinder.
+var ErrFindNotSupported = errors.New("session repository does not support finding sessions")
+
+// ErrRegenerateNotSupported will be returned by Regenerate when the session repository does not implement SessionRegenerator.
+// A decorating repository returns it from RegenerateContext when the repository it wraps does not.
+var ErrRegenerateNotSupported = errors.New("session repository does not support regenerating session ids")
@@ -89,6 +89,15 @@ func TestNewSessman(t *testing.T) {
 			}
 		})
 
+	t.Run("Touch interval not shorter than max lifetime",
+		func(t *testing.T) {
+
+			_, err := NewSesman(Memory, &SesCfg{CookieName: "ivmid", Maxlifetime: 60, TouchInterval: 60})
+			if err == nil {
+				t.Errorf("Failed to capture expected error!")
+			}
+		})
+
 	t.Run("Valid provider type",
 		func(t *testing.T) {
 			gsm, err := NewSesman(Memory, cfg)
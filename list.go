@@ -0,0 +1,74 @@
+package ivmsesman
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// DefaultListLimit is the number of sessions of a page listed with a zero limit
+const DefaultListLimit = 100
+
+// SessionFilter selects the sessions listed by SessionLister. The zero filter selects all the live sessions.
+type SessionFilter struct {
+	// State selects the sessions in the state, e.g. "Authed". Empty selects all the states
+	State string
+	// UserID selects the sessions of the user, the uid set by UpdateAuthSession. Empty selects all the sessions
+	UserID string
+	// AccessedAfter selects the sessions last accessed at or after the unix time. Zero is unbounded
+	AccessedAfter int64
+	// AccessedBefore selects the sessions last accessed before the unix time. Zero is unbounded
+	AccessedBefore int64
+}
+
+// Match reports if the filter selects the session last accessed at the unix time, in the state and of the user
+func (f SessionFilter) Match(timeAccessed int64, state, userID string) bool {
+	if f.AccessedAfter > 0 && timeAccessed < f.AccessedAfter {
+		return false
+	}
+	if f.AccessedBefore > 0 && timeAccessed >= f.AccessedBefore {
+		return false
+	}
+	if f.State != "" && state != f.State {
+		return false
+	}
+	if f.UserID != "" && userID != f.UserID {
+		return false
+	}
+	return true
+}
+
+// SessionLister is implemented by the repositories which can list their sessions a page at a time, e.g. for
+// an admin tool, instead of loading all of them at once.
+type SessionLister interface {
+	// List returns up to limit live sessions selected by the filter after the cursor, and the cursor of the
+	// next page. An empty cursor starts the listing and an empty next cursor ends it. The cursors are opaque
+	// and only valid with the filter they were returned for. A page may hold fewer sessions than limit
+	// before the last one.
+	List(ctx context.Context, filter SessionFilter, cursor string, limit int) ([]SessionRecord, string, error)
+}
+
+// ErrListNotSupported will be returned by ListSessions when the session repository does not implement SessionLister.
+// A decorating repository returns it from List when the repository it wraps does not.
+var ErrListNotSupported = errors.New("session repository does not support listing sessions")
+
+// ListSessions returns a page of the sessions selected by the filter after the cursor, and the cursor of the
+// next page, empty after the last one. A zero limit lists DefaultListLimit sessions.
+func (sm *Sesman) ListSessions(ctx context.Context, filter SessionFilter, cursor string, limit int) ([]SessionRecord, string, error) {
+
+	l, ok := underlying(sm.sessions).(SessionLister)
+	if !ok {
+		return nil, "", ErrListNotSupported
+	}
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+
+	start := time.Now()
+	sessions, next, err := l.List(ctx, filter, cursor, limit)
+	if err == ErrListNotSupported {
+		return nil, "", err
+	}
+	sm.metrics.observe("List", start, err)
+	return sessions, next, err
+}
@@ -0,0 +1,101 @@
+package ivmsesman
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// lockStripes is the number of mutexes the session ids are spread over
+const lockStripes = 1024
+
+// sidLocks serializes the changes of a session without blocking the other sessions. The session ids
+// are hashed over a fixed set of mutexes, so no lock is ever allocated nor released.
+type sidLocks struct {
+	stripes [lockStripes]sync.Mutex
+}
+
+// lock locks the stripe of the session id and returns its unlock func
+func (l *sidLocks) lock(sid string) func() {
+	m := &l.stripes[stripe(sid)]
+	m.Lock()
+	return m.Unlock
+}
+
+// stripe returns the stripe of the session id (FNV-1a)
+func stripe(sid string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(sid); i++ {
+		h ^= uint32(sid[i])
+		h *= 16777619
+	}
+	return h % lockStripes
+}
+
+// flight runs fn once for the concurrent callers with the same key and shares its result. fn runs
+// with a context which is not canceled with the caller's one, as other callers may wait for it; each
+// caller stops waiting when its own context is done.
+func (sm *Sesman) flight(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+
+	fctx := context.WithoutCancel(ctx)
+	ch := sm.lookups.DoChan(key, func() (interface{}, error) {
+		return fn(fctx)
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		return res.Val, res.Err
+	}
+}
+
+// find returns the session sid from the repository, sharing the lookup between the concurrent requests
+// of the session. With strict set a session unknown to the repository returns ErrInvalidSessionID
+// instead of being created.
+func (sm *Sesman) find(ctx context.Context, sid string, strict bool) (SessionStore, error) {
+
+	key := "find:" + sid
+	if strict {
+		key = "strict:" + sid
+	}
+
+	v, err := sm.flight(ctx, key, func(ctx context.Context) (interface{}, error) {
+		if !strict {
+			return sm.sessions.FindOrCreateContext(ctx, sid)
+		}
+		if f, ok := underlying(sm.sessions).(SessionFinder); ok {
+			start := time.Now()
+			ss, err := f.FindContext(ctx, sid)
+			switch err {
+			case ErrFindNotSupported:
+			case ErrInvalidSessionID:
+				sm.metrics.observe("Find", start, nil)
+				return nil, err
+			default:
+				sm.metrics.observe("Find", start, err)
+				return ss, err
+			}
+		}
+		// the repository cannot look a session up without creating it, a session expiring between the
+		// two calls is created again
+		if !sm.sessions.ExistsContext(ctx, sid) {
+			return nil, ErrInvalidSessionID
+		}
+		return sm.sessions.FindOrCreateContext(ctx, sid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	ss, _ := v.(SessionStore)
+	return ss, nil
+}
+
+// exists checks the repository for the session sid, sharing the lookup between the concurrent requests
+func (sm *Sesman) exists(ctx context.Context, sid string) bool {
+
+	v, err := sm.flight(ctx, "exists:"+sid, func(ctx context.Context) (interface{}, error) {
+		return sm.sessions.ExistsContext(ctx, sid), nil
+	})
+	return err == nil && v.(bool)
+}
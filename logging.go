@@ -0,0 +1,101 @@
+package ivmsesman
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+)
+
+// Sensitive is a log value holding a session id, a token or an authorization code. It is logged
+// redacted, unless the session manager is configured with SesCfg.LogSensitive.
+type Sensitive string
+
+// LogValue implements slog.LogValuer
+func (s Sensitive) LogValue() slog.Value {
+	return slog.StringValue(Redact(string(s)))
+}
+
+// Redact returns a short fingerprint of a secret value. The same value always gets the same
+// fingerprint, so the log lines of a session can still be correlated.
+func Redact(s string) string {
+	if s == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(s))
+	return "redacted:" + hex.EncodeToString(sum[:4])
+}
+
+// LoggerSetter is implemented by the repositories logging their events. The session manager sets
+// its own logger, so the events of the whole package go to the same handler.
+type LoggerSetter interface {
+	SetLogger(l *slog.Logger)
+}
+
+// logger returns the configured logger or the slog default one
+func (sm *Sesman) logger() *slog.Logger {
+	if sm.log != nil {
+		return sm.log
+	}
+	return slog.Default()
+}
+
+// newLogger creates the logger of the session manager from the configuration. A nil logger follows
+// the slog default logger.
+func newLogger(cfg *SesCfg) *slog.Logger {
+	if cfg.Logger == nil && !cfg.LogSensitive {
+		return nil
+	}
+	l := cfg.Logger
+	if l == nil {
+		l = slog.Default()
+	}
+	if cfg.LogSensitive {
+		l = slog.New(revealHandler{l.Handler()})
+	}
+	return l
+}
+
+// revealHandler logs the Sensitive values as they are
+type revealHandler struct {
+	slog.Handler
+}
+
+func (h revealHandler) Handle(ctx context.Context, r slog.Record) error {
+	nr := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		nr.AddAttrs(reveal(a))
+		return true
+	})
+	return h.Handler.Handle(ctx, nr)
+}
+
+func (h revealHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	revealed := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		revealed[i] = reveal(a)
+	}
+	return revealHandler{h.Handler.WithAttrs(revealed)}
+}
+
+func (h revealHandler) WithGroup(name string) slog.Handler {
+	return revealHandler{h.Handler.WithGroup(name)}
+}
+
+// reveal replaces the Sensitive values of the attribute with their plain value
+func reveal(a slog.Attr) slog.Attr {
+	switch a.Value.Kind() {
+	case slog.KindLogValuer:
+		if s, ok := a.Value.Any().(Sensitive); ok {
+			return slog.String(a.Key, string(s))
+		}
+	case slog.KindGroup:
+		group := a.Value.Group()
+		revealed := make([]any, len(group))
+		for i, ga := range group {
+			revealed[i] = reveal(ga)
+		}
+		return slog.Group(a.Key, revealed...)
+	}
+	return a
+}
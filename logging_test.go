@@ -0,0 +1,58 @@
+package ivmsesman
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+
+	r := Redact("my-secret-sid")
+	if strings.Contains(r, "my-secret-sid") || !strings.HasPrefix(r, "redacted:") {
+		t.Errorf("unexpected redacted value %v", r)
+	}
+	if r != Redact("my-secret-sid") {
+		t.Errorf("expected the same fingerprint for the same value")
+	}
+	if r == Redact("another-sid") {
+		t.Errorf("expected different fingerprints for different values")
+	}
+	if Redact("") != "" {
+		t.Errorf("expected empty value for empty input")
+	}
+}
+
+func TestLogSensitive(t *testing.T) {
+
+	cases := []struct {
+		name      string
+		sensitive bool
+		want      string
+	}{
+		{"redacted", false, Redact("my-secret-sid")},
+		{"revealed", true, "my-secret-sid"},
+	}
+
+	for _, c := range cases {
+		var buf bytes.Buffer
+		l := newLogger(&SesCfg{Logger: slog.New(slog.NewTextHandler(&buf, nil)), LogSensitive: c.sensitive})
+
+		l.With(slog.Any("sid", Sensitive("my-secret-sid"))).Info("msg",
+			slog.Any("token", Sensitive("my-secret-sid")),
+			slog.Group("req", slog.Any("sid", Sensitive("my-secret-sid"))))
+
+		out := buf.String()
+		if n := strings.Count(out, c.want); n != 3 {
+			t.Errorf("%s: expected %v logged 3 times, got %d in %v", c.name, c.want, n, out)
+		}
+		if !c.sensitive && strings.Contains(out, "my-secret-sid") {
+			t.Errorf("%s: unexpected plain value in %v", c.name, out)
+		}
+	}
+
+	if newLogger(&SesCfg{}) != nil {
+		t.Errorf("expected nil logger without configuration")
+	}
+}
@@ -0,0 +1,177 @@
+package ivmsesman
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metricsNamespace prefixes the name of every metric
+const metricsNamespace = "ivmsesman_"
+
+// latencyBuckets are the upper bounds in seconds of the repository latency histogram buckets
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// Metrics collects the session lifecycle counters and the latency of the repository operations of a
+// session manager. It is exposed in the Prometheus text format by Sesman.MetricsHandler. ActiveSessions
+// is not part of it, as counting the sessions can scan the whole store.
+type Metrics struct {
+	created       atomic.Uint64
+	destroyed     atomic.Uint64
+	expired       atomic.Uint64
+	regenerated   atomic.Uint64
+	evicted       atomic.Uint64
+	refused       atomic.Uint64
+	blacklistHits atomic.Uint64
+
+	mu     sync.Mutex
+	states map[string]uint64
+	ops    map[string]*opStats
+}
+
+// opStats is the latency histogram and the error count of a repository method
+type opStats struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+	errors  uint64
+}
+
+// NewMetrics creates an empty set of metrics
+func NewMetrics() *Metrics {
+	return &Metrics{states: make(map[string]uint64), ops: make(map[string]*opStats)}
+}
+
+// state counts a transition of a session to the state
+func (m *Metrics) state(state string) {
+	m.mu.Lock()
+	m.states[state]++
+	m.mu.Unlock()
+}
+
+// observe records the duration of the repository method started at start and counts the error, if any
+func (m *Metrics) observe(method string, start time.Time, err error) {
+
+	d := time.Since(start).Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	op, ok := m.ops[method]
+	if !ok {
+		op = &opStats{buckets: make([]uint64, len(latencyBuckets))}
+		m.ops[method] = op
+	}
+	for i, le := range latencyBuckets {
+		if d <= le {
+			op.buckets[i]++
+		}
+	}
+	op.count++
+	op.sum += d
+	if err != nil {
+		op.errors++
+	}
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+
+	counter(cw, "sessions_created_total", "Sessions created.", m.created.Load())
+	counter(cw, "sessions_destroyed_total", "Sessions destroyed by the session manager.", m.destroyed.Load())
+	counter(cw, "sessions_expired_total", "Sessions expired, found by the session manager or reported by the repository.", m.expired.Load())
+	counter(cw, "sessions_regenerated_total", "Session ids regenerated, keeping the session data.", m.regenerated.Load())
+	counter(cw, "sessions_evicted_total", "Sessions evicted by a bounded repository to make room for new ones.", m.evicted.Load())
+	counter(cw, "sessions_refused_total", "New sessions refused by a full repository.", m.refused.Load())
+	counter(cw, "blacklist_hits_total", "Blacklist checks matching the ip.", m.blacklistHits.Load())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	header(cw, "session_state_transitions_total", "Session state changes by the new state.", "counter")
+	for _, s := range sortedKeys(m.states) {
+		fmt.Fprintf(cw, "%ssession_state_transitions_total{state=%s} %d\n", metricsNamespace, quote(s), m.states[s])
+	}
+
+	header(cw, "store_operation_duration_seconds", "Latency of the session repository operations.", "histogram")
+	for _, method := range sortedKeys(m.ops) {
+		op := m.ops[method]
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(cw, "%sstore_operation_duration_seconds_bucket{method=%s,le=\"%s\"} %d\n",
+				metricsNamespace, quote(method), strconv.FormatFloat(le, 'g', -1, 64), op.buckets[i])
+		}
+		fmt.Fprintf(cw, "%sstore_operation_duration_seconds_bucket{method=%s,le=\"+Inf\"} %d\n", metricsNamespace, quote(method), op.count)
+		fmt.Fprintf(cw, "%sstore_operation_duration_seconds_sum{method=%s} %s\n", metricsNamespace, quote(method), strconv.FormatFloat(op.sum, 'g', -1, 64))
+		fmt.Fprintf(cw, "%sstore_operation_duration_seconds_count{method=%s} %d\n", metricsNamespace, quote(method), op.count)
+	}
+
+	header(cw, "store_operation_errors_total", "Session repository operations returning an error.", "counter")
+	for _, method := range sortedKeys(m.ops) {
+		fmt.Fprintf(cw, "%sstore_operation_errors_total{method=%s} %d\n", metricsNamespace, quote(method), m.ops[method].errors)
+	}
+
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, cw.w.Flush()
+}
+
+// Handler serves the metrics in the Prometheus text exposition format
+func (m *Metrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = m.WriteTo(w)
+	})
+}
+
+// header writes the HELP and TYPE lines of a metric
+func header(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s%s %s\n# TYPE %s%s %s\n", metricsNamespace, name, help, metricsNamespace, name, typ)
+}
+
+// counter writes a counter without labels
+func counter(w io.Writer, name, help string, v uint64) {
+	header(w, name, help, "counter")
+	fmt.Fprintf(w, "%s%s %d\n", metricsNamespace, name, v)
+}
+
+// quote escapes a label value
+func quote(v string) string {
+	v = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+	return `"` + v + `"`
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// countingWriter keeps the number of bytes written and the first error
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
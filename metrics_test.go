@@ -0,0 +1,47 @@
+package ivmsesman
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWriteTo(t *testing.T) {
+
+	m := NewMetrics()
+	m.created.Add(2)
+	m.evicted.Add(3)
+	m.state("Authed")
+	m.state(`in"auth`)
+	m.observe("FindOrCreate", time.Now(), nil)
+	m.observe("FindOrCreate", time.Now().Add(-time.Second), errors.New("failed"))
+
+	var buf bytes.Buffer
+	n, err := m.WriteTo(&buf)
+	if err != nil || n != int64(buf.Len()) {
+		t.Fatalf("unexpected result %d, %v for %d bytes", n, err, buf.Len())
+	}
+
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE ivmsesman_sessions_created_total counter",
+		"ivmsesman_sessions_created_total 2",
+		"ivmsesman_sessions_destroyed_total 0",
+		"ivmsesman_sessions_evicted_total 3",
+		"ivmsesman_sessions_refused_total 0",
+		`ivmsesman_session_state_transitions_total{state="Authed"} 1`,
+		`ivmsesman_session_state_transitions_total{state="in\"auth"} 1`,
+		"# TYPE ivmsesman_store_operation_duration_seconds histogram",
+		`ivmsesman_store_operation_duration_seconds_bucket{method="FindOrCreate",le="0.0005"} 1`,
+		`ivmsesman_store_operation_duration_seconds_bucket{method="FindOrCreate",le="2.5"} 2`,
+		`ivmsesman_store_operation_duration_seconds_bucket{method="FindOrCreate",le="+Inf"} 2`,
+		`ivmsesman_store_operation_duration_seconds_count{method="FindOrCreate"} 2`,
+		`ivmsesman_store_operation_errors_total{method="FindOrCreate"} 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("expected line %q in\n%s", line, out)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+// Package migrate copies the live sessions and the blacklist from a session repository to another, keeping
+// the session ids, the times and the values, so the users stay signed in when a service moves to another
+// session store.
+//
+// The source must implement ivmsesman.SessionExporter and the target ivmsesman.SessionImporter, as the
+// memory, disk, Redis, SQL and Firestore providers do. The sessions are read in the order of their ids and
+// written in batches; with a checkpoint file a copy interrupted at any point resumes after the last batch
+// written. Verify compares the two repositories once the copy is done.
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/dasiyes/ivmsesman"
+)
+
+// maxDifferences bounds the differences listed by a verification report
+const maxDifferences = 100
+
+// Options configures a copy or a verification
+type Options struct {
+	// BatchSize is the number of sessions or blacklist entries written at once. Default 500
+	BatchSize int
+	// DryRun reads the source and counts what would be copied, writing nothing to the target nor to the
+	// checkpoint file
+	DryRun bool
+	// Checkpoint is the file recording the progress of the copy. A copy started again with the same file
+	// resumes after the last batch written. Empty disables the checkpoints
+	Checkpoint string
+	// Logger of the progress. Default slog.Default()
+	Logger *slog.Logger
+}
+
+// Report sums up a copy or a verification
+type Report struct {
+	// Sessions is the number of sessions copied (to be copied on a dry run, or compared by Verify)
+	Sessions int
+	// Blacklist is the number of blacklist entries copied (to be copied on a dry run, or compared by Verify)
+	Blacklist int
+	// ResumedAfter is the id of the last session copied by the run the copy resumed
+	ResumedAfter string
+	// Missing is the number of sessions and blacklisted ips of the source not found in the target by Verify
+	Missing int
+	// Mismatched is the number of sessions which differ between the source and the target by Verify
+	Mismatched int
+	// Differences are the first differences found by Verify
+	Differences []Difference
+}
+
+// Difference is a session or a blacklisted ip which differs between the source and the target
+type Difference struct {
+	ID     string
+	Reason string
+}
+
+// OK reports if Verify found no differences
+func (r Report) OK() bool {
+	return r.Missing == 0 && r.Mismatched == 0
+}
+
+// checkpoint is the progress of a copy, saved after every batch written
+type checkpoint struct {
+	// After is the id of the last session written
+	After        string `json:"after"`
+	Sessions     int    `json:"sessions"`
+	SessionsDone bool   `json:"sessions_done"`
+	Blacklist    int    `json:"blacklist"`
+	Done         bool   `json:"done"`
+}
+
+// Copy streams the live sessions and the blacklist from src to dst. The sessions of dst with the same ids
+// are replaced. With Options.Checkpoint a copy completed already copies nothing: remove the file to copy
+// the sessions again.
+func Copy(ctx context.Context, src, dst ivmsesman.SessionRepository, opts Options) (Report, error) {
+
+	opts = withDefaults(opts)
+	log := opts.Logger
+
+	exp, ok := src.(ivmsesman.SessionExporter)
+	if !ok {
+		return Report{}, fmt.Errorf("the source repository %T can not export its sessions", src)
+	}
+	imp, ok := dst.(ivmsesman.SessionImporter)
+	if !ok && !opts.DryRun {
+		return Report{}, fmt.Errorf("the target repository %T can not import sessions", dst)
+	}
+
+	cp, err := readCheckpoint(opts.Checkpoint)
+	if err != nil {
+		return Report{}, err
+	}
+	report := Report{Sessions: cp.Sessions, Blacklist: cp.Blacklist, ResumedAfter: cp.After}
+	if cp.Done {
+		log.InfoContext(ctx, "the copy is complete already", slog.String("checkpoint", opts.Checkpoint))
+		return report, nil
+	}
+	if cp.After != "" {
+		log.InfoContext(ctx, "resuming the copy", slog.Any("after", ivmsesman.Sensitive(cp.After)), slog.Int("sessions", cp.Sessions))
+	}
+
+	// save records the progress, after the batch is written
+	save := func() error {
+		if opts.DryRun {
+			return nil
+		}
+		return writeCheckpoint(opts.Checkpoint, cp)
+	}
+
+	if !cp.SessionsDone {
+		batch := make([]ivmsesman.SessionRecord, 0, opts.BatchSize)
+		flush := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			if !opts.DryRun {
+				if err := imp.ImportSessions(ctx, batch); err != nil {
+					return err
+				}
+			}
+			cp.After = batch[len(batch)-1].ID
+			cp.Sessions += len(batch)
+			batch = batch[:0]
+			log.InfoContext(ctx, "sessions copied", slog.Int("sessions", cp.Sessions), slog.Bool("dry_run", opts.DryRun))
+			return save()
+		}
+
+		err := exp.ExportSessions(ctx, cp.After, func(rec ivmsesman.SessionRecord) error {
+			batch = append(batch, rec)
+			if len(batch) < opts.BatchSize {
+				return nil
+			}
+			return flush()
+		})
+		if err == nil {
+			err = flush()
+		}
+		report.Sessions = cp.Sessions
+		if err != nil {
+			return report, fmt.Errorf("err while copying the sessions, err: %v", err)
+		}
+		cp.SessionsDone = true
+		if err := save(); err != nil {
+			return report, err
+		}
+	}
+
+	// the blacklist is small and copied again as a whole when resumed
+	cp.Blacklist = 0
+	batch := make([]ivmsesman.BlacklistRecord, 0, opts.BatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if !opts.DryRun {
+			if err := imp.ImportBlacklist(ctx, batch); err != nil {
+				return err
+			}
+		}
+		cp.Blacklist += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	err = exp.ExportBlacklist(ctx, func(e ivmsesman.BlacklistRecord) error {
+		batch = append(batch, e)
+		if len(batch) < opts.BatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil {
+		err = flush()
+	}
+	report.Blacklist = cp.Blacklist
+	if err != nil {
+		return report, fmt.Errorf("err while copying the blacklist, err: %v", err)
+	}
+
+	cp.Done = true
+	if err := save(); err != nil {
+		return report, err
+	}
+	log.InfoContext(ctx, "copy complete", slog.Int("sessions", report.Sessions), slog.Int("blacklist", report.Blacklist), slog.Bool("dry_run", opts.DryRun))
+	return report, nil
+}
+
+// Verify compares every live session and blacklisted ip of src with the one of dst. A session differs when
+// its creation time, last access time or values are not the same in dst; the sessions only dst has are
+// not reported. Both repositories must implement ivmsesman.SessionExporter.
+func Verify(ctx context.Context, src, dst ivmsesman.SessionRepository, opts Options) (Report, error) {
+
+	opts = withDefaults(opts)
+
+	sexp, ok := src.(ivmsesman.SessionExporter)
+	if !ok {
+		return Report{}, fmt.Errorf("the source repository %T can not export its sessions", src)
+	}
+	dexp, ok := dst.(ivmsesman.SessionExporter)
+	if !ok {
+		return Report{}, fmt.Errorf("the target repository %T can not export its sessions", dst)
+	}
+
+	var report Report
+	differ := func(id, reason string, missing bool) {
+		if missing {
+			report.Missing++
+		} else {
+			report.Mismatched++
+		}
+		if len(report.Differences) < maxDifferences {
+			report.Differences = append(report.Differences, Difference{ID: id, Reason: reason})
+		}
+	}
+
+	// both repositories export the sessions in the order of the ids, the target ones are read alongside
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	targets := make(chan ivmsesman.SessionRecord, opts.BatchSize)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(targets)
+		errc <- dexp.ExportSessions(ctx, "", func(rec ivmsesman.SessionRecord) error {
+			select {
+			case targets <- rec:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+
+	next, more := <-targets
+	err := sexp.ExportSessions(ctx, "", func(rec ivmsesman.SessionRecord) error {
+		report.Sessions++
+		for more && next.ID < rec.ID {
+			next, more = <-targets
+		}
+		if !more || next.ID != rec.ID {
+			differ(rec.ID, "missing", true)
+			return nil
+		}
+		if reason := compare(rec, next); reason != "" {
+			differ(rec.ID, reason, false)
+		}
+		return nil
+	})
+	cancel()
+	for range targets {
+	}
+	if err != nil {
+		return report, fmt.Errorf("err while reading the source sessions, err: %v", err)
+	}
+	if err := <-errc; err != nil && !errors.Is(err, context.Canceled) {
+		return report, fmt.Errorf("err while reading the target sessions, err: %v", err)
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	ips := make(map[string]bool)
+	if err := dexp.ExportBlacklist(ctx, func(e ivmsesman.BlacklistRecord) error {
+		ips[e.IP] = true
+		return nil
+	}); err != nil {
+		return report, fmt.Errorf("err while reading the target blacklist, err: %v", err)
+	}
+	if err := sexp.ExportBlacklist(ctx, func(e ivmsesman.BlacklistRecord) error {
+		report.Blacklist++
+		if !ips[e.IP] {
+			differ(e.IP, "blacklisted ip missing", true)
+		}
+		return nil
+	}); err != nil {
+		return report, fmt.Errorf("err while reading the source blacklist, err: %v", err)
+	}
+
+	opts.Logger.InfoContext(ctx, "verification complete", slog.Int("sessions", report.Sessions), slog.Int("blacklist", report.Blacklist),
+		slog.Int("missing", report.Missing), slog.Int("mismatched", report.Mismatched))
+	return report, nil
+}
+
+// compare returns why the target copy of a session differs from the source one, empty when they are the same.
+// The values are compared by their JSON, as the stores keep the numbers and the times in different types.
+func compare(src, dst ivmsesman.SessionRecord) string {
+
+	if src.CreatedAt != dst.CreatedAt {
+		return fmt.Sprintf("created at %d, %d in the target", src.CreatedAt, dst.CreatedAt)
+	}
+	if src.TimeAccessed != dst.TimeAccessed {
+		return fmt.Sprintf("last accessed at %d, %d in the target", src.TimeAccessed, dst.TimeAccessed)
+	}
+	sv, err := json.Marshal(src.Values)
+	if err != nil {
+		return fmt.Sprintf("values not comparable: %v", err)
+	}
+	dv, err := json.Marshal(dst.Values)
+	if err != nil {
+		return fmt.Sprintf("values not comparable: %v", err)
+	}
+	if string(sv) != string(dv) {
+		return "values differ"
+	}
+	return ""
+}
+
+// withDefaults returns the options with the defaults set
+func withDefaults(opts Options) Options {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 500
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	return opts
+}
+
+// readCheckpoint reads the checkpoint file. A missing file, or no file, is a copy from the start.
+func readCheckpoint(path string) (checkpoint, error) {
+
+	var cp checkpoint
+	if path == "" {
+		return cp, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cp, nil
+	}
+	if err != nil {
+		return cp, fmt.Errorf("err while reading the checkpoint %v, err: %v", path, err)
+	}
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return cp, fmt.Errorf("err while reading the checkpoint %v, err: %v", path, err)
+	}
+	return cp, nil
+}
+
+// writeCheckpoint writes the checkpoint to a temporary file next to path and renames it over path
+func writeCheckpoint(path string, cp checkpoint) error {
+
+	if path == "" {
+		return nil
+	}
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("err while writing the checkpoint %v, err: %v", path, err)
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("err while writing the checkpoint %v, err: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dasiyes/ivmsesman"
+	"github.com/dasiyes/ivmsesman/providers/disk"
+	"github.com/dasiyes/ivmsesman/providers/inmem"
+)
+
+var quiet = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// source returns a memory provider with n sessions and two blacklisted ips
+func source(t *testing.T, n int) *inmem.SessionStoreProvider {
+	t.Helper()
+
+	now := time.Now().Unix()
+	recs := make([]ivmsesman.SessionRecord, n)
+	for i := range recs {
+		recs[i] = ivmsesman.SessionRecord{
+			ID:           fmt.Sprintf("sid-%03d", i),
+			CreatedAt:    now - 600,
+			TimeAccessed: now - int64(i),
+			Values:       map[string]interface{}{"state": "s" + fmt.Sprint(i), "n": int64(i)},
+		}
+	}
+	src := inmem.New()
+	ctx := context.Background()
+	if err := src.ImportSessions(ctx, recs); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := src.ImportBlacklist(ctx, []ivmsesman.BlacklistRecord{
+		{IP: "10.0.0.1", Created: now, RequestURI: "/a"},
+		{IP: "10.0.0.2", Created: now, RequestURI: "/b"},
+	}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return src
+}
+
+// target returns an empty disk provider, closed at the end of the test
+func target(t *testing.T) *disk.SessionProvider {
+	t.Helper()
+
+	pder, err := disk.New(disk.Options{Path: filepath.Join(t.TempDir(), "sessions.log")})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	t.Cleanup(func() { pder.Close() })
+	return pder
+}
+
+// failing fails the import of the sessions after a number of batches
+type failing struct {
+	*disk.SessionProvider
+	batches int
+}
+
+func (f *failing) ImportSessions(ctx context.Context, sessions []ivmsesman.SessionRecord) error {
+	if f.batches == 0 {
+		return errors.New("connection lost")
+	}
+	f.batches--
+	return f.SessionProvider.ImportSessions(ctx, sessions)
+}
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+	src, dst := source(t, 25), target(t)
+
+	report, err := Copy(ctx, src, dst, Options{BatchSize: 10, Logger: quiet})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if report.Sessions != 25 || report.Blacklist != 2 {
+		t.Errorf("expected 25 sessions and 2 blacklisted ips copied, got %+v", report)
+	}
+
+	report, err = Verify(ctx, src, dst, Options{Logger: quiet})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !report.OK() || report.Sessions != 25 || report.Blacklist != 2 {
+		t.Errorf("expected the copy verified, got %+v", report)
+	}
+
+	ss, err := dst.FindOrCreate("sid-007")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if got := ss.Get("state"); got != "s7" {
+		t.Errorf("expected the state of the session copied, got %v", got)
+	}
+	if !dst.IsIPExistInBL("10.0.0.2") {
+		t.Error("expected the blacklisted ip copied")
+	}
+}
+
+func TestCopyResume(t *testing.T) {
+	ctx := context.Background()
+	src, dst := source(t, 25), target(t)
+	cp := filepath.Join(t.TempDir(), "copy.json")
+
+	_, err := Copy(ctx, src, &failing{SessionProvider: dst, batches: 1}, Options{BatchSize: 10, Checkpoint: cp, Logger: quiet})
+	if err == nil {
+		t.Fatal("expected the copy to fail")
+	}
+	if n := dst.ActiveSessions(); n != 10 {
+		t.Fatalf("expected the first batch copied, got %d sessions", n)
+	}
+
+	// a session of the first batch changed after it was copied is not copied again
+	if err := dst.UpdateSessionState("sid-000", "changed"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	report, err := Copy(ctx, src, dst, Options{BatchSize: 10, Checkpoint: cp, Logger: quiet})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if report.ResumedAfter != "sid-009" || report.Sessions != 25 {
+		t.Errorf("expected the copy resumed after sid-009, got %+v", report)
+	}
+	if n := dst.ActiveSessions(); n != 25 {
+		t.Errorf("expected all the sessions copied, got %d", n)
+	}
+	ss, _ := dst.FindOrCreate("sid-000")
+	if got := ss.Get("state"); got != "changed" {
+		t.Errorf("expected the first batch not copied again, got state %v", got)
+	}
+
+	// the copy is complete, running it again copies nothing
+	if err := src.UpdateSessionState("sid-020", "new"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := Copy(ctx, src, dst, Options{Checkpoint: cp, Logger: quiet}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	ss, _ = dst.FindOrCreate("sid-020")
+	if got := ss.Get("state"); got != "s20" {
+		t.Errorf("expected the complete copy not run again, got state %v", got)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	ctx := context.Background()
+	src, dst := source(t, 5), target(t)
+	cp := filepath.Join(t.TempDir(), "copy.json")
+
+	report, err := Copy(ctx, src, dst, Options{DryRun: true, Checkpoint: cp, Logger: quiet})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if report.Sessions != 5 || report.Blacklist != 2 {
+		t.Errorf("expected 5 sessions and 2 blacklisted ips counted, got %+v", report)
+	}
+	if n := dst.ActiveSessions(); n != 0 {
+		t.Errorf("expected nothing written on a dry run, got %d sessions", n)
+	}
+	if _, err := os.Stat(cp); !os.IsNotExist(err) {
+		t.Errorf("expected no checkpoint written on a dry run, got %v", err)
+	}
+}
+
+func TestVerifyDifferences(t *testing.T) {
+	ctx := context.Background()
+	src, dst := source(t, 5), target(t)
+
+	if _, err := Copy(ctx, src, dst, Options{Logger: quiet}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := dst.DestroySID("sid-001"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := dst.UpdateCodeVerifier("sid-003", "cove"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// a session only the target has is not a difference
+	if _, err := dst.NewSession("sid-999"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	report, err := Verify(ctx, src, dst, Options{Logger: quiet})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if report.Missing != 1 || report.Mismatched != 1 || report.OK() {
+		t.Fatalf("expected one session missing and one mismatched, got %+v", report)
+	}
+	if d := report.Differences; len(d) != 2 || d[0].ID != "sid-001" || d[1].ID != "sid-003" {
+		t.Errorf("expected the differences of sid-001 and sid-003, got %+v", d)
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	var repo ivmsesman.SessionRepository = struct{ ivmsesman.SessionRepository }{inmem.New()}
+
+	if _, err := Copy(context.Background(), repo, target(t), Options{Logger: quiet}); err == nil {
+		t.Error("expected an error for a source which can not export its sessions")
+	}
+	if _, err := Copy(context.Background(), inmem.New(), repo, Options{Logger: quiet}); err == nil {
+		t.Error("expected an error for a target which can not import sessions")
+	}
+}
@@ -0,0 +1,522 @@
+// Package cache implements a session repository keeping the recently used sessions of another repository
+// in the process memory.
+//
+// The cache reads through and writes through: a session missing from the cache is read from the wrapped
+// repository, and every change goes to the wrapped repository before the cache is updated. The session
+// ids missing from the repository are remembered for a short time (negative caching), so the requests
+// carrying unknown ids do not reach the store either. The sessions are kept up to Options.TTL and the
+// least recently used ones are evicted beyond Options.MaxEntries.
+//
+//	client, _ := firestore.NewClient(ctx, projectID)
+//	repo, _ := firestoredb.New(client, firestoredb.Options{})
+//	sm, _ := ivmsesman.NewSesmanWithRepository(cache.New(repo, cache.Options{}), cfg)
+//
+// The cached sessions are shared by the requests of the process. A change made by another instance of the
+// service is seen once the cached session expires, unless an invalidation reaches the cache before.
+package cache
+
+import (
+	"container/list"
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dasiyes/ivmsesman"
+)
+
+// The defaults of the options
+const (
+	defaultMaxEntries  = 10000
+	defaultTTL         = 5 * time.Second
+	defaultNegativeTTL = time.Second
+)
+
+// Options configures the session cache
+type Options struct {
+	// MaxEntries bounds the number of the session ids kept, the least recently used are evicted. Default 10000
+	MaxEntries int
+	// TTL is the time a session is served from the cache before it is read again from the repository. Default 5s
+	TTL time.Duration
+	// NegativeTTL is the time a session id missing from the repository is remembered. Default 1s, a negative
+	// value disables the negative caching.
+	NegativeTTL time.Duration
+}
+
+// Stats reports the use of the cache
+type Stats struct {
+	Hits         uint64
+	Misses       uint64
+	NegativeHits uint64
+	Evictions    uint64
+	Entries      int
+}
+
+// entry is a cached session id. A nil session marks an id missing from the repository.
+type entry struct {
+	sid     string
+	ss      ivmsesman.SessionStore
+	expires time.Time
+}
+
+// SessionProvider is a session repository caching the sessions of the wrapped repository. The cached
+// entries are kept ordered by their last use - the most recent at the front.
+type SessionProvider struct {
+	// Background runs the operations without a context
+	ivmsesman.Background
+
+	repo ivmsesman.SessionRepository
+	next ivmsesman.SessionRepositoryContext
+	opts Options
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	list    *list.List
+	// gen changes with every invalidation, so a session read from the repository meanwhile is not cached
+	gen       uint64
+	policy    ivmsesman.ExpiryPolicy
+	onExpired func(ctx context.Context, sid string)
+	onEvicted func(ctx context.Context, sid string)
+
+	hits, misses, negativeHits, evictions atomic.Uint64
+}
+
+// New creates the cache in front of the repository
+func New(repo ivmsesman.SessionRepository, opts Options) *SessionProvider {
+
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = defaultMaxEntries
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = defaultTTL
+	}
+	if opts.NegativeTTL == 0 {
+		opts.NegativeTTL = defaultNegativeTTL
+	}
+
+	c := &SessionProvider{
+		repo:    repo,
+		next:    ivmsesman.WithContext(repo),
+		opts:    opts,
+		entries: make(map[string]*list.Element),
+		list:    list.New(),
+	}
+	c.Background = ivmsesman.Background{Repo: c}
+	if els, ok := repo.(ivmsesman.ExpiryListenerSetter); ok {
+		els.SetExpiryListener(c.expired)
+	}
+	if els, ok := repo.(ivmsesman.EvictionListenerSetter); ok {
+		els.SetEvictionListener(c.evicted)
+	}
+	return c
+}
+
+// SetLogger sets the logger of the wrapped repository
+func (c *SessionProvider) SetLogger(l *slog.Logger) {
+	if ls, ok := c.repo.(ivmsesman.LoggerSetter); ok {
+		ls.SetLogger(l)
+	}
+}
+
+// SetExpiryPolicy sets the timeouts checked on the cached sessions and passes them to the wrapped repository
+func (c *SessionProvider) SetExpiryPolicy(p ivmsesman.ExpiryPolicy) {
+
+	c.mu.Lock()
+	c.policy = p
+	c.mu.Unlock()
+
+	if eps, ok := c.repo.(ivmsesman.ExpiryPolicySetter); ok {
+		eps.SetExpiryPolicy(p)
+	}
+}
+
+// SetExpiryListener sets the func called with the id of every session the wrapped repository removes as expired
+func (c *SessionProvider) SetExpiryListener(fn func(ctx context.Context, sid string)) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.onExpired = fn
+}
+
+// SetEvictionListener sets the func called with the id of every session the wrapped repository evicts to make room
+func (c *SessionProvider) SetEvictionListener(fn func(ctx context.Context, sid string)) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.onEvicted = fn
+}
+
+// evicted is the eviction listener set on the wrapped repository
+func (c *SessionProvider) evicted(ctx context.Context, sid string) {
+
+	c.Invalidate(sid)
+
+	c.mu.Lock()
+	fn := c.onEvicted
+	c.mu.Unlock()
+
+	if fn != nil {
+		fn(ctx, sid)
+	}
+}
+
+// expired is the expiry listener set on the wrapped repository
+func (c *SessionProvider) expired(ctx context.Context, sid string) {
+
+	c.Invalidate(sid)
+
+	c.mu.Lock()
+	fn := c.onExpired
+	c.mu.Unlock()
+
+	if fn != nil {
+		fn(ctx, sid)
+	}
+}
+
+// Stats returns the use of the cache
+func (c *SessionProvider) Stats() Stats {
+
+	c.mu.Lock()
+	n := c.list.Len()
+	c.mu.Unlock()
+
+	return Stats{
+		Hits:         c.hits.Load(),
+		Misses:       c.misses.Load(),
+		NegativeHits: c.negativeHits.Load(),
+		Evictions:    c.evictions.Load(),
+		Entries:      n,
+	}
+}
+
+// Invalidate drops the cached sessions ids, so they are read from the repository on their next use
+func (c *SessionProvider) Invalidate(sids ...string) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	for _, sid := range sids {
+		if el, ok := c.entries[sid]; ok {
+			c.remove(el)
+		}
+	}
+}
+
+// InvalidateAll drops all cached session ids
+func (c *SessionProvider) InvalidateAll() {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	c.entries = make(map[string]*list.Element)
+	c.list.Init()
+}
+
+// lookup returns the cached entry of the session id, if it did not expire, with the generation of the
+// cache to store the entry read from the repository with
+func (c *SessionProvider) lookup(sid string) (*entry, bool, uint64) {
+
+	c.mu.Lock()
+	el, ok := c.entries[sid]
+	if !ok {
+		defer c.mu.Unlock()
+		return nil, false, c.gen
+	}
+	e := el.Value.(*entry)
+	now := time.Now()
+	if now.After(e.expires) {
+		defer c.mu.Unlock()
+		c.remove(el)
+		return nil, false, c.gen
+	}
+	c.list.MoveToFront(el)
+	policy := c.policy
+	c.mu.Unlock()
+
+	// the session is checked without the lock, as the repository may report expired sessions holding its own
+	if e.ss == nil || !sessionExpired(policy, e.ss, now.Unix()) {
+		return e, true, c.generation()
+	}
+	c.drop(e)
+	return nil, false, c.generation()
+}
+
+// sessionExpired checks the cached session against the expiry policy
+func sessionExpired(p ivmsesman.ExpiryPolicy, ss ivmsesman.SessionStore, now int64) bool {
+
+	var created int64
+	if c, ok := ivmsesman.CreatedAt(ss); ok {
+		created = c.Unix()
+	}
+	return p.Expired(created, ss.GetLTA().Unix(), now)
+}
+
+// drop removes the cached entry, unless it was replaced meanwhile
+func (c *SessionProvider) drop(e *entry) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[e.sid]; ok && el.Value == e {
+		c.remove(el)
+	}
+}
+
+// store caches the session read from the repository (nil for a missing id), unless the cache was
+// invalidated since gen
+func (c *SessionProvider) store(sid string, ss ivmsesman.SessionStore, gen uint64) {
+
+	ttl := c.opts.TTL
+	if ss == nil {
+		ttl = c.opts.NegativeTTL
+	}
+	if ttl < 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+	e := &entry{sid: sid, ss: ss, expires: time.Now().Add(ttl)}
+	if el, ok := c.entries[sid]; ok {
+		el.Value = e
+		c.list.MoveToFront(el)
+		return
+	}
+	c.entries[sid] = c.list.PushFront(e)
+	for c.list.Len() > c.opts.MaxEntries {
+		c.remove(c.list.Back())
+		c.evictions.Add(1)
+	}
+}
+
+// remove drops the cached entry. The caller holds the lock.
+func (c *SessionProvider) remove(el *list.Element) {
+	delete(c.entries, el.Value.(*entry).sid)
+	c.list.Remove(el)
+}
+
+// generation returns the generation of the cache
+func (c *SessionProvider) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.gen
+}
+
+// NewSessionContext creates the session in the wrapped repository and caches it
+func (c *SessionProvider) NewSessionContext(ctx context.Context, sid string) (ivmsesman.SessionStore, error) {
+
+	c.Invalidate(sid)
+	gen := c.generation()
+
+	ss, err := c.next.NewSessionContext(ctx, sid)
+	if err != nil {
+		return nil, err
+	}
+	c.store(sid, ss, gen)
+	return ss, nil
+}
+
+// FindOrCreateContext returns the cached session or reads it from the wrapped repository, creating it when missing
+func (c *SessionProvider) FindOrCreateContext(ctx context.Context, sid string) (ivmsesman.SessionStore, error) {
+
+	e, ok, gen := c.lookup(sid)
+	if ok && e.ss != nil {
+		c.hits.Add(1)
+		return e.ss, nil
+	}
+	c.misses.Add(1)
+
+	ss, err := c.next.FindOrCreateContext(ctx, sid)
+	if err != nil {
+		return nil, err
+	}
+	c.store(sid, ss, gen)
+	return ss, nil
+}
+
+// FindContext returns the cached session or reads it from the wrapped repository without creating it. A missing
+// session is cached as such. It returns ivmsesman.ErrFindNotSupported when the wrapped repository does not
+// implement ivmsesman.SessionFinder.
+func (c *SessionProvider) FindContext(ctx context.Context, sid string) (ivmsesman.SessionStore, error) {
+
+	f, ok := c.repo.(ivmsesman.SessionFinder)
+	if !ok {
+		return nil, ivmsesman.ErrFindNotSupported
+	}
+
+	e, ok, gen := c.lookup(sid)
+	if ok {
+		if e.ss == nil {
+			c.negativeHits.Add(1)
+			return nil, ivmsesman.ErrInvalidSessionID
+		}
+		c.hits.Add(1)
+		return e.ss, nil
+	}
+	c.misses.Add(1)
+
+	ss, err := f.FindContext(ctx, sid)
+	if err == ivmsesman.ErrInvalidSessionID {
+		c.store(sid, nil, gen)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.store(sid, ss, gen)
+	return ss, nil
+}
+
+// ExistsContext checks the cache and then the wrapped repository for the session id
+func (c *SessionProvider) ExistsContext(ctx context.Context, sid string) bool {
+
+	e, ok, gen := c.lookup(sid)
+	if ok {
+		if e.ss == nil {
+			c.negativeHits.Add(1)
+			return false
+		}
+		c.hits.Add(1)
+		return true
+	}
+	c.misses.Add(1)
+
+	if c.next.ExistsContext(ctx, sid) {
+		return true
+	}
+	if ctx.Err() == nil {
+		c.store(sid, nil, gen)
+	}
+	return false
+}
+
+// ActiveSessionsContext returns the number of the sessions in the wrapped repository
+func (c *SessionProvider) ActiveSessionsContext(ctx context.Context) int {
+	return c.next.ActiveSessionsContext(ctx)
+}
+
+// DestroySIDContext removes the session from the wrapped repository and the cache
+func (c *SessionProvider) DestroySIDContext(ctx context.Context, sid string) error {
+	defer c.Invalidate(sid)
+	return c.next.DestroySIDContext(ctx, sid)
+}
+
+// SessionGCContext cleans the expired sessions of the wrapped repository and drops them from the cache
+func (c *SessionProvider) SessionGCContext(ctx context.Context, maxlifetime int64) {
+
+	c.next.SessionGCContext(ctx, maxlifetime)
+
+	c.mu.Lock()
+	entries := make([]*entry, 0, c.list.Len())
+	for el := c.list.Front(); el != nil; el = el.Next() {
+		if e := el.Value.(*entry); e.ss != nil {
+			entries = append(entries, e)
+		}
+	}
+	policy := c.policy
+	c.mu.Unlock()
+
+	now := time.Now().Unix()
+	for _, e := range entries {
+		if e.ss.GetLTA().Unix()+maxlifetime < now || sessionExpired(policy, e.ss, now) {
+			c.drop(e)
+		}
+	}
+}
+
+// UpdateTimeAccessedContext refreshes the last access time in the wrapped repository
+func (c *SessionProvider) UpdateTimeAccessedContext(ctx context.Context, sid string) error {
+	return c.next.UpdateTimeAccessedContext(ctx, sid)
+}
+
+// UpdateSessionStateContext updates the state in the wrapped repository and drops the cached session
+func (c *SessionProvider) UpdateSessionStateContext(ctx context.Context, sid string, state string) error {
+	defer c.Invalidate(sid)
+	return c.next.UpdateSessionStateContext(ctx, sid, state)
+}
+
+// UpdateCodeVerifierContext updates the code verifier in the wrapped repository and drops the cached session
+func (c *SessionProvider) UpdateCodeVerifierContext(ctx context.Context, sid, cove string) error {
+	defer c.Invalidate(sid)
+	return c.next.UpdateCodeVerifierContext(ctx, sid, cove)
+}
+
+// SaveCodeChallengeAndMethodContext saves the code challenge in the wrapped repository and drops the cached session
+func (c *SessionProvider) SaveCodeChallengeAndMethodContext(ctx context.Context, sid, coch, mth, code, ru string) error {
+	defer c.Invalidate(sid)
+	return c.next.SaveCodeChallengeAndMethodContext(ctx, sid, coch, mth, code, ru)
+}
+
+// FlushContext deletes all data of the wrapped repository and the cache
+func (c *SessionProvider) FlushContext(ctx context.Context) error {
+	defer c.InvalidateAll()
+	return c.next.FlushContext(ctx)
+}
+
+// GetAuthCodeContext returns the authorization code of the session from the wrapped repository
+func (c *SessionProvider) GetAuthCodeContext(ctx context.Context, sid string) map[string]string {
+	return c.next.GetAuthCodeContext(ctx, sid)
+}
+
+// UpdateAuthSessionContext updates the authenticated session in the wrapped repository and drops the cached session
+func (c *SessionProvider) UpdateAuthSessionContext(ctx context.Context, sid, at, rt, uid string) error {
+	defer c.Invalidate(sid)
+	return c.next.UpdateAuthSessionContext(ctx, sid, at, rt, uid)
+}
+
+// BlacklistingContext adds the ip to the blacklist of the wrapped repository
+func (c *SessionProvider) BlacklistingContext(ctx context.Context, ip, path string, data interface{}) {
+	c.next.BlacklistingContext(ctx, ip, path, data)
+}
+
+// IsIPExistInBLContext checks the blacklist of the wrapped repository
+func (c *SessionProvider) IsIPExistInBLContext(ctx context.Context, ip string) bool {
+	return c.next.IsIPExistInBLContext(ctx, ip)
+}
+
+// BLCleanContext cleans the blacklist of the wrapped repository
+func (c *SessionProvider) BLCleanContext(ctx context.Context) {
+	c.next.BLCleanContext(ctx)
+}
+
+// RegenerateContext moves the session under the new id in the wrapped repository and caches it. It returns
+// ivmsesman.ErrRegenerateNotSupported when the wrapped repository does not implement ivmsesman.SessionRegenerator.
+func (c *SessionProvider) RegenerateContext(ctx context.Context, oldsid, newsid string) (ivmsesman.SessionStore, error) {
+
+	rg, ok := c.repo.(ivmsesman.SessionRegenerator)
+	if !ok {
+		return nil, ivmsesman.ErrRegenerateNotSupported
+	}
+
+	c.Invalidate(oldsid, newsid)
+	ss, err := rg.RegenerateContext(ctx, oldsid, newsid)
+
+	// the old id may have been read meanwhile
+	c.Invalidate(oldsid)
+	if err != nil {
+		return nil, err
+	}
+	c.store(newsid, ss, c.generation())
+	return ss, nil
+}
+
+// List lists the sessions of the wrapped repository, bypassing the cache. It returns
+// ivmsesman.ErrListNotSupported when the wrapped repository does not implement ivmsesman.SessionLister.
+func (c *SessionProvider) List(ctx context.Context, filter ivmsesman.SessionFilter, cursor string, limit int) ([]ivmsesman.SessionRecord, string, error) {
+
+	l, ok := c.repo.(ivmsesman.SessionLister)
+	if !ok {
+		return nil, "", ivmsesman.ErrListNotSupported
+	}
+	return l.List(ctx, filter, cursor, limit)
+}
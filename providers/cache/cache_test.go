@@ -0,0 +1,198 @@
+package cache
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dasiyes/ivmsesman"
+	"github.com/dasiyes/ivmsesman/providers/inmem"
+	"github.com/dasiyes/ivmsesman/sesmantest"
+)
+
+// countingRepo is a memory provider counting the session reads
+type countingRepo struct {
+	*inmem.SessionStoreProvider
+	finds, exists int32
+}
+
+func (r *countingRepo) FindOrCreate(sid string) (ivmsesman.SessionStore, error) {
+	atomic.AddInt32(&r.finds, 1)
+	return r.SessionStoreProvider.FindOrCreate(sid)
+}
+
+func (r *countingRepo) Exists(sid string) bool {
+	atomic.AddInt32(&r.exists, 1)
+	return r.SessionStoreProvider.Exists(sid)
+}
+
+func TestConformance(t *testing.T) {
+	sesmantest.RunConformance(t, func(t *testing.T) ivmsesman.SessionRepository {
+		return New(inmem.New(), Options{})
+	})
+}
+
+func TestReadThrough(t *testing.T) {
+	repo := &countingRepo{SessionStoreProvider: inmem.New()}
+	c := New(repo, Options{})
+
+	if _, err := repo.NewSession("a"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		ss, err := c.FindOrCreate("a")
+		if err != nil || ss.SessionID() != "a" {
+			t.Fatalf("unexpected session %v, error %v", ss, err)
+		}
+		if !c.Exists("a") {
+			t.Errorf("expected session `a` to exist")
+		}
+	}
+	if repo.finds != 1 || repo.exists != 0 {
+		t.Errorf("expected 1 repository read, got %d finds and %d exists", repo.finds, repo.exists)
+	}
+	if st := c.Stats(); st.Hits != 5 || st.Misses != 1 || st.Entries != 1 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+func TestNegativeCaching(t *testing.T) {
+	repo := &countingRepo{SessionStoreProvider: inmem.New()}
+	c := New(repo, Options{NegativeTTL: 50 * time.Millisecond})
+
+	for i := 0; i < 3; i++ {
+		if c.Exists("missing") {
+			t.Errorf("expected session `missing` not to exist")
+		}
+	}
+	if repo.exists != 1 {
+		t.Errorf("expected 1 repository check, got %d", repo.exists)
+	}
+	if st := c.Stats(); st.NegativeHits != 2 {
+		t.Errorf("expected 2 negative hits, got %+v", st)
+	}
+
+	// a session created with the id replaces the negative entry
+	if _, err := c.NewSession("missing"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !c.Exists("missing") {
+		t.Errorf("expected session `missing` to exist once created")
+	}
+
+	// the negative entries expire
+	c.Exists("other")
+	time.Sleep(60 * time.Millisecond)
+	if _, err := repo.NewSession("other"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !c.Exists("other") {
+		t.Errorf("expected the negative entry of `other` expired")
+	}
+
+	// the negative caching can be disabled
+	repo = &countingRepo{SessionStoreProvider: inmem.New()}
+	c = New(repo, Options{NegativeTTL: -1})
+	c.Exists("missing")
+	c.Exists("missing")
+	if repo.exists != 2 {
+		t.Errorf("expected 2 repository checks without negative caching, got %d", repo.exists)
+	}
+}
+
+func TestInvalidation(t *testing.T) {
+	repo := &countingRepo{SessionStoreProvider: inmem.New()}
+	c := New(repo, Options{})
+
+	if _, err := c.NewSession("a"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	for _, change := range []struct {
+		name string
+		fn   func() error
+	}{
+		{"UpdateSessionState", func() error { return c.UpdateSessionState("a", "Visited") }},
+		{"UpdateCodeVerifier", func() error { return c.UpdateCodeVerifier("a", "cove") }},
+		{"SaveCodeChallengeAndMethod", func() error { return c.SaveCodeChallengeAndMethod("a", "coch", "S256", "code", "/") }},
+		{"UpdateAuthSession", func() error { return c.UpdateAuthSession("a", "at", "rt", "uid") }},
+	} {
+		if _, err := c.FindOrCreate("a"); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		finds := repo.finds
+		if err := change.fn(); err != nil {
+			t.Fatalf("%s: unexpected error %v", change.name, err)
+		}
+		if _, err := c.FindOrCreate("a"); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if repo.finds != finds+1 {
+			t.Errorf("%s: expected the session read again from the repository", change.name)
+		}
+	}
+
+	if err := c.DestroySID("a"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if c.Exists("a") {
+		t.Errorf("expected session `a` destroyed")
+	}
+
+	if _, err := c.NewSession("b"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if c.Exists("b") || c.Stats().Entries != 1 {
+		t.Errorf("expected the cache flushed, got %+v", c.Stats())
+	}
+}
+
+func TestEviction(t *testing.T) {
+	repo := &countingRepo{SessionStoreProvider: inmem.New()}
+	c := New(repo, Options{MaxEntries: 2, TTL: 50 * time.Millisecond})
+
+	for _, sid := range []string{"a", "b", "c"} {
+		if _, err := c.NewSession(sid); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if st := c.Stats(); st.Entries != 2 || st.Evictions != 1 {
+		t.Errorf("expected 2 entries after 1 eviction, got %+v", st)
+	}
+
+	// `a` is the least recently used
+	c.FindOrCreate("b")
+	c.FindOrCreate("c")
+	c.FindOrCreate("a")
+	if repo.finds != 1 {
+		t.Errorf("expected only the evicted session read, got %d reads", repo.finds)
+	}
+
+	// the sessions are read again past the TTL
+	time.Sleep(60 * time.Millisecond)
+	c.FindOrCreate("a")
+	if repo.finds != 2 {
+		t.Errorf("expected the session read again past the TTL, got %d reads", repo.finds)
+	}
+}
+
+func TestAbsoluteTimeout(t *testing.T) {
+	c := New(inmem.New(), Options{TTL: time.Minute})
+	c.SetExpiryPolicy(ivmsesman.ExpiryPolicy{Absolute: 1})
+
+	if _, err := c.NewSession("a"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !c.Exists("a") {
+		t.Fatalf("expected session `a` to exist")
+	}
+
+	// the cached session expires, whatever the TTL of the entry
+	time.Sleep(2100 * time.Millisecond)
+	if c.Exists("a") {
+		t.Errorf("expected session `a` past the absolute timeout")
+	}
+}
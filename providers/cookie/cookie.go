@@ -0,0 +1,571 @@
+// Package cookie implements a client side session provider. The whole session is kept in encrypted and
+// authenticated cookies of the client, split in chunks when it does not fit in a single cookie, so there
+// is no server storage.
+//
+// The provider implements ivmsesman.ClientSideRepository and works with Sesman.MWManager, which binds the
+// session of the request to the provider and writes it back in the response:
+//
+//	repo, _ := cookie.New(cookie.Options{SigningKeys: sk, EncryptionKeys: ek})
+//	sm, _ := ivmsesman.NewSesmanWithRepository(repo, cfg)
+//	http.ListenAndServe(addr, sm.MWManager(handler))
+package cookie
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dasiyes/ivmsesman"
+	"github.com/dasiyes/ivmsesman/internal/provutil"
+)
+
+const (
+	// chunkSize is the maximal length of a single cookie value, leaving room for the name and attributes
+	// within the 4096 bytes browsers accept for a cookie
+	chunkSize = 3800
+	// maxChunks is the maximal number of cookies a session is split in
+	maxChunks = 10
+)
+
+// ErrPayloadTooLarge will be returned by Save when the session does not fit in maxChunks cookies
+var ErrPayloadTooLarge = errors.New("session payload is too large for the cookies")
+
+// Options configures the cookie session provider
+type Options struct {
+	// CookieName is the name of the first cookie carrying the session. The next chunks are named
+	// CookieName_1, CookieName_2 and so on. Default "ivmsess"
+	CookieName string
+	// SigningKeys are the HMAC-SHA256 keys authenticating the cookies, the current key first
+	SigningKeys [][]byte
+	// EncryptionKeys are the AES-GCM keys encrypting the cookies, the current key first
+	EncryptionKeys [][]byte
+	// Maxlifetime is the idle timeout of a session in seconds. Default 3600
+	Maxlifetime int64
+	// Path is the path of the cookies. Default "/"
+	Path string
+	// Blacklist is the repository keeping the blacklist, e.g. a Redis provider shared by the instances.
+	// The cookies have no server storage, so without it the ips are not blacklisted
+	Blacklist ivmsesman.SessionRepository
+}
+
+// binding is a session bound to the provider while a request is served
+type binding struct {
+	ss        *Session
+	refs      int
+	destroyed bool
+}
+
+// SessionProvider keeps the sessions in the client cookies. Only the sessions of the requests being
+// served are held in memory.
+type SessionProvider struct {
+	lock      sync.Mutex
+	name      string
+	path      string
+	policy    ivmsesman.ExpiryPolicy
+	keyring   *ivmsesman.Keyring
+	bound     map[string]*binding
+	blacklist ivmsesman.SessionRepository
+	log       *slog.Logger
+	onExpired func(ctx context.Context, sid string)
+}
+
+// New creates a cookie session provider. Both signing and encryption keys are required.
+func New(opts Options) (*SessionProvider, error) {
+
+	if len(opts.EncryptionKeys) == 0 {
+		return nil, errors.New("cookie session provider needs encryption keys")
+	}
+	kr, err := ivmsesman.NewKeyring(opts.SigningKeys, opts.EncryptionKeys)
+	if err != nil {
+		return nil, fmt.Errorf("cookie session provider: %v", err)
+	}
+
+	if opts.CookieName == "" {
+		opts.CookieName = "ivmsess"
+	}
+	if opts.Maxlifetime == 0 {
+		opts.Maxlifetime = 3600
+	}
+	if opts.Path == "" {
+		opts.Path = "/"
+	}
+
+	return &SessionProvider{
+		name:      opts.CookieName,
+		path:      opts.Path,
+		policy:    ivmsesman.ExpiryPolicy{Idle: opts.Maxlifetime},
+		keyring:   kr,
+		bound:     make(map[string]*binding),
+		blacklist: opts.Blacklist,
+	}, nil
+}
+
+// SetLogger sets the logger of the provider events
+func (pder *SessionProvider) SetLogger(l *slog.Logger) {
+	pder.log = l
+}
+
+// logger returns the logger set or the slog default one
+func (pder *SessionProvider) logger() *slog.Logger {
+	if pder.log != nil {
+		return pder.log
+	}
+	return slog.Default()
+}
+
+// SetExpiryPolicy sets the timeouts embedded in the session cookies. It is not safe to call it while the provider is in use.
+func (pder *SessionProvider) SetExpiryPolicy(p ivmsesman.ExpiryPolicy) {
+	if p.Idle > 0 {
+		pder.policy.Idle = p.Idle
+	}
+	pder.policy.Absolute = p.Absolute
+}
+
+// SetExpiryListener sets the func called with the id of every session found expired. It is not safe to
+// call it while the provider is in use.
+func (pder *SessionProvider) SetExpiryListener(fn func(ctx context.Context, sid string)) {
+	pder.onExpired = fn
+}
+
+// reportExpired calls the expiry listener, if set
+func (pder *SessionProvider) reportExpired(ctx context.Context, sid string) {
+	if pder.onExpired != nil {
+		pder.onExpired(ctx, sid)
+	}
+}
+
+// expires returns the unix time the session expires at, if not accessed before
+func (pder *SessionProvider) expires(ss *Session) int64 {
+	exp := ss.TimeAccessed + pder.policy.Idle
+	if pder.policy.Absolute > 0 && ss.CreatedAt+pder.policy.Absolute < exp {
+		exp = ss.CreatedAt + pder.policy.Absolute
+	}
+	return exp
+}
+
+// chunkName returns the cookie name of the i-th chunk
+func (pder *SessionProvider) chunkName(i int) string {
+	if i == 0 {
+		return pder.name
+	}
+	return pder.name + "_" + strconv.Itoa(i)
+}
+
+// Load binds the session sid carried by the request cookies and reports if it was found valid.
+// Tampered, expired or other sessions' cookies are ignored.
+func (pder *SessionProvider) Load(r *http.Request, sid string) bool {
+
+	var buf bytes.Buffer
+	for i := 0; i < maxChunks; i++ {
+		c, err := r.Cookie(pder.chunkName(i))
+		if err != nil {
+			break
+		}
+		buf.WriteString(c.Value)
+	}
+	if buf.Len() == 0 {
+		return false
+	}
+
+	payload, err := pder.keyring.Decode(pder.name, buf.String())
+	if err != nil {
+		return false
+	}
+
+	ss := Session{pder: pder}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&ss); err != nil || ss.Sid != sid {
+		return false
+	}
+	if ss.Expires < time.Now().Unix() {
+		pder.reportExpired(r.Context(), sid)
+		return false
+	}
+	if ss.Value == nil {
+		ss.Value = make(map[string]interface{})
+	}
+	for k, v := range ss.Value {
+		ss.Value[k] = provutil.NormalizeNumbers(v)
+	}
+
+	pder.lock.Lock()
+	defer pder.lock.Unlock()
+
+	if b, ok := pder.bound[sid]; ok {
+		// a concurrent request of the same client holds the session already
+		b.refs++
+		return !b.destroyed
+	}
+	pder.bound[sid] = &binding{ss: &ss, refs: 1}
+	return true
+}
+
+// Save writes the bound session sid in the response cookies and releases it. The chunks of the
+// request cookies not needed anymore are expired.
+func (pder *SessionProvider) Save(w http.ResponseWriter, r *http.Request, sid string) error {
+
+	var payload []byte
+	var maxAge int64
+	var err error
+
+	pder.lock.Lock()
+	if ss, ok := pder.get(sid); ok {
+		ss.Expires = pder.expires(ss)
+		maxAge = ss.Expires - time.Now().Unix()
+		payload, err = json.Marshal(ss)
+	}
+	if b, ok := pder.bound[sid]; ok {
+		if b.refs--; b.refs <= 0 {
+			delete(pder.bound, sid)
+		}
+	}
+	pder.lock.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("unable to encode session id %v, err: %v", sid, err)
+	}
+
+	n := 0
+	if payload != nil {
+		value, err := pder.keyring.Encode(pder.name, payload)
+		if err != nil {
+			return err
+		}
+		n = (len(value) + chunkSize - 1) / chunkSize
+		if n > maxChunks {
+			return ErrPayloadTooLarge
+		}
+		for i := 0; i < n; i++ {
+			end := (i + 1) * chunkSize
+			if end > len(value) {
+				end = len(value)
+			}
+			http.SetCookie(w, pder.cookie(pder.chunkName(i), value[i*chunkSize:end], int(maxAge)))
+		}
+	}
+
+	for i := n; i < maxChunks; i++ {
+		if _, err := r.Cookie(pder.chunkName(i)); err != nil {
+			break
+		}
+		http.SetCookie(w, pder.cookie(pder.chunkName(i), "", -1))
+	}
+	return nil
+}
+
+// cookie returns the cookie of a chunk
+func (pder *SessionProvider) cookie(name, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     pder.path,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   maxAge,
+	}
+}
+
+// NewSession binds a new session with sid as a key
+func (pder *SessionProvider) NewSession(sid string) (ivmsesman.SessionStore, error) {
+
+	pder.lock.Lock()
+	defer pder.lock.Unlock()
+
+	return pder.newSession(sid), nil
+}
+
+// newSession binds a new session, replacing the one bound with the same id. The caller holds the lock.
+func (pder *SessionProvider) newSession(sid string) *Session {
+
+	v := make(map[string]interface{})
+	v["state"] = "New"
+	now := time.Now().Unix()
+	newsess := Session{Sid: sid, CreatedAt: now, TimeAccessed: now, Value: v, pder: pder}
+
+	if b, ok := pder.bound[sid]; ok {
+		b.ss = &newsess
+		b.destroyed = false
+	} else {
+		pder.bound[sid] = &binding{ss: &newsess, refs: 1}
+	}
+	return &newsess
+}
+
+// get returns the bound session. The caller holds the lock.
+func (pder *SessionProvider) get(sid string) (*Session, bool) {
+	b, ok := pder.bound[sid]
+	if !ok || b.destroyed {
+		return nil, false
+	}
+	if pder.policy.Expired(b.ss.CreatedAt, b.ss.TimeAccessed, time.Now().Unix()) {
+		b.destroyed = true
+		pder.reportExpired(context.Background(), sid)
+		return nil, false
+	}
+	return b.ss, true
+}
+
+// FindOrCreate returns the bound session sid. If it is not bound a new session is created.
+func (pder *SessionProvider) FindOrCreate(sid string) (ivmsesman.SessionStore, error) {
+
+	pder.lock.Lock()
+	defer pder.lock.Unlock()
+
+	if ss, ok := pder.get(sid); ok {
+		ss.TimeAccessed = time.Now().Unix()
+		return ss, nil
+	}
+	return pder.newSession(sid), nil
+}
+
+// FindContext returns the bound session sid without creating it, ivmsesman.ErrInvalidSessionID when it is not bound
+func (pder *SessionProvider) FindContext(ctx context.Context, sid string) (ivmsesman.SessionStore, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	pder.lock.Lock()
+	defer pder.lock.Unlock()
+
+	if ss, ok := pder.get(sid); ok {
+		ss.TimeAccessed = time.Now().Unix()
+		return ss, nil
+	}
+	return nil, ivmsesman.ErrInvalidSessionID
+}
+
+// Exists reports if the session sid is bound
+func (pder *SessionProvider) Exists(sid string) bool {
+
+	pder.lock.Lock()
+	defer pder.lock.Unlock()
+
+	_, ok := pder.get(sid)
+	return ok
+}
+
+// ActiveSessions returns the number of the sessions bound by the requests being served
+func (pder *SessionProvider) ActiveSessions() int {
+
+	pder.lock.Lock()
+	defer pder.lock.Unlock()
+
+	n := 0
+	for _, b := range pder.bound {
+		if !b.destroyed {
+			n++
+		}
+	}
+	return n
+}
+
+// DestroySID marks the bound session as destroyed. Save removes its cookies from the client.
+func (pder *SessionProvider) DestroySID(sid string) error {
+
+	pder.lock.Lock()
+	defer pder.lock.Unlock()
+
+	if b, ok := pder.bound[sid]; ok {
+		b.destroyed = true
+	}
+	return nil
+}
+
+// SessionGC releases the bound sessions not accessed for maxlifetime seconds, e.g. the ones of
+// requests which were never saved. The expiry of the client sessions is embedded in their cookies.
+func (pder *SessionProvider) SessionGC(maxlifetime int64) {
+
+	pder.lock.Lock()
+	defer pder.lock.Unlock()
+
+	for sid, b := range pder.bound {
+		if b.ss.TimeAccessed+maxlifetime < time.Now().Unix() {
+			delete(pder.bound, sid)
+		}
+	}
+}
+
+// UpdateTimeAccessed will update the time accessed value with now()
+func (pder *SessionProvider) UpdateTimeAccessed(sid string) error {
+
+	pder.lock.Lock()
+	defer pder.lock.Unlock()
+
+	ss, ok := pder.get(sid)
+	if !ok {
+		return fmt.Errorf("err while updating time accessed for sessions id %v, err: session not found", sid)
+	}
+	ss.TimeAccessed = time.Now().Unix()
+	return nil
+}
+
+// update sets the values of the bound session
+func (pder *SessionProvider) update(sid string, values map[string]interface{}) error {
+
+	pder.lock.Lock()
+	defer pder.lock.Unlock()
+
+	ss, ok := pder.get(sid)
+	if !ok {
+		return fmt.Errorf("session id %v not found", sid)
+	}
+	for k, v := range values {
+		ss.Value[k] = v
+	}
+	ss.TimeAccessed = time.Now().Unix()
+	return nil
+}
+
+// UpdateSessionState will update the state value with one provided
+func (pder *SessionProvider) UpdateSessionState(sid string, state string) error {
+
+	err := pder.update(sid, map[string]interface{}{"state": state})
+	if err != nil {
+		return fmt.Errorf("err while updating `Value.state` for sessions id %v, err: %v", sid, err)
+	}
+	return nil
+}
+
+// UpdateCodeVerifier will update the code verifier (cove) value assigned to the session id
+func (pder *SessionProvider) UpdateCodeVerifier(sid, cove string) error {
+
+	err := pder.update(sid, map[string]interface{}{"code_verifier": cove})
+	if err != nil {
+		return fmt.Errorf("err while updating `Value.code_verifier` for sessions id %v, err: %v", sid, err)
+	}
+	return nil
+}
+
+// SaveCodeChallengeAndMethod - at step2 of AuthorizationCode flow
+func (pder *SessionProvider) SaveCodeChallengeAndMethod(
+	sid, coch, mth, code, ru string) error {
+
+	// set code expiration timestamp
+	ce := time.Now().Unix() + 60
+
+	err := pder.update(sid, map[string]interface{}{
+		"code_challenger":        coch,
+		"code_challenger_method": mth,
+		"auth_code":              code,
+		"code_expire":            ce,
+		"redirect_uri":           ru,
+		"state":                  "InAuth",
+	})
+	if err != nil {
+		return fmt.Errorf("err while updating `Value.code_verifier` for sessions id %v, err: %v", sid, err)
+	}
+	return nil
+}
+
+// GetAuthCode will return the authorization code for a session, if it is InAuth and the code did not expire
+func (pder *SessionProvider) GetAuthCode(sid string) map[string]string {
+
+	pder.lock.Lock()
+	defer pder.lock.Unlock()
+
+	var ac map[string]string = map[string]string{}
+
+	ss, ok := pder.get(sid)
+	if !ok {
+		return ac
+	}
+
+	state, _ := ss.Value["state"].(string)
+	ce, _ := ss.Value["code_expire"].(int64)
+	if state == "InAuth" && ce > time.Now().Unix() {
+		ac["auth_code"], _ = ss.Value["auth_code"].(string)
+		ac["code_challenger"], _ = ss.Value["code_challenger"].(string)
+		ac["code_challenger_method"], _ = ss.Value["code_challenger_method"].(string)
+	}
+	return ac
+}
+
+// UpdateAuthSession - update state, access and refresh tokens values for auth session
+func (pder *SessionProvider) UpdateAuthSession(sid, at, rt, uid string) error {
+
+	err := pder.update(sid, map[string]interface{}{
+		"at":    at,
+		"rt":    rt,
+		"uid":   uid,
+		"state": "Authed",
+	})
+	if err != nil {
+		return fmt.Errorf("err while updating new authenticated session id %v, err: %v", sid, err)
+	}
+	return nil
+}
+
+// RegenerateContext binds the session data under the new session id newsid and releases oldsid
+func (pder *SessionProvider) RegenerateContext(ctx context.Context, oldsid, newsid string) (ivmsesman.SessionStore, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	pder.lock.Lock()
+	defer pder.lock.Unlock()
+
+	ss, ok := pder.get(oldsid)
+	if !ok {
+		return nil, fmt.Errorf("session id %v not found", oldsid)
+	}
+	if _, ok := pder.bound[newsid]; ok {
+		return nil, fmt.Errorf("session id %v already exists", newsid)
+	}
+
+	v := make(map[string]interface{})
+	for k, val := range ss.Value {
+		v[k] = val
+	}
+	newsess := Session{Sid: newsid, CreatedAt: ss.CreatedAt, TimeAccessed: time.Now().Unix(), Value: v, pder: pder}
+
+	b := pder.bound[oldsid]
+	delete(pder.bound, oldsid)
+	pder.bound[newsid] = &binding{ss: &newsess, refs: b.refs}
+	return &newsess, nil
+}
+
+// Flush releases all bound sessions
+func (pder *SessionProvider) Flush() error {
+
+	pder.lock.Lock()
+	defer pder.lock.Unlock()
+
+	pder.bound = make(map[string]*binding)
+	return nil
+}
+
+// Blacklisting adds the @ip to the blacklist of the Options.Blacklist repository
+func (pder *SessionProvider) Blacklisting(ip, path string, data interface{}) {
+	if pder.blacklist == nil {
+		pder.logger().Error("blacklist not supported without Options.Blacklist", slog.String("ip", ip), slog.String("path", path))
+		return
+	}
+	pder.blacklist.Blacklisting(ip, path, data)
+}
+
+// IsIPExistInBL returns boolean result for the @ip being or not in the blacklist of the Options.Blacklist repository
+func (pder *SessionProvider) IsIPExistInBL(ip string) bool {
+	if pder.blacklist == nil {
+		return false
+	}
+	return pder.blacklist.IsIPExistInBL(ip)
+}
+
+// BLClean cleans the blacklist of the Options.Blacklist repository
+func (pder *SessionProvider) BLClean() {
+	if pder.blacklist == nil {
+		return
+	}
+	pder.blacklist.BLClean()
+}
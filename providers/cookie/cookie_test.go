@@ -0,0 +1,276 @@
+package cookie
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dasiyes/ivmsesman"
+	"github.com/dasiyes/ivmsesman/providers/inmem"
+	"github.com/dasiyes/ivmsesman/sesmantest"
+)
+
+var testOptions = Options{
+	SigningKeys:    [][]byte{bytes.Repeat([]byte("s"), 32)},
+	EncryptionKeys: [][]byte{bytes.Repeat([]byte("e"), 32)},
+}
+
+var testCfg = &ivmsesman.SesCfg{
+	CookieName:  "ivmid",
+	Maxlifetime: 3600,
+}
+
+func newTestProvider(t *testing.T, opts Options) *SessionProvider {
+	t.Helper()
+
+	pder, err := New(opts)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return pder
+}
+
+func TestConformance(t *testing.T) {
+	sesmantest.RunConformance(t, func(t *testing.T) ivmsesman.SessionRepository {
+		opts := testOptions
+		opts.Blacklist = inmem.New()
+		return newTestProvider(t, opts)
+	})
+}
+
+func TestBlacklistNotConfigured(t *testing.T) {
+	pder := newTestProvider(t, testOptions)
+
+	pder.Blacklisting("192.0.2.1", "/wp-login.php", nil)
+	pder.BLClean()
+	if pder.IsIPExistInBL("192.0.2.1") {
+		t.Error("expected no blacklist without Options.Blacklist")
+	}
+}
+
+// serve runs the handler behind MWManager with the cookies and returns the response cookies
+func serve(t *testing.T, sm *ivmsesman.Sesman, cookies []*http.Cookie, h http.HandlerFunc) []*http.Cookie {
+	t.Helper()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rr := httptest.NewRecorder()
+	sm.MWManager(h).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rr.Code)
+	}
+	return rr.Result().Cookies()
+}
+
+// merge applies the response cookies to the cookies of the client
+func merge(jar []*http.Cookie, set []*http.Cookie) []*http.Cookie {
+	m := make(map[string]*http.Cookie)
+	for _, c := range jar {
+		m[c.Name] = c
+	}
+	for _, c := range set {
+		if c.MaxAge < 0 {
+			delete(m, c.Name)
+		} else {
+			m[c.Name] = c
+		}
+	}
+	var out []*http.Cookie
+	for _, c := range m {
+		out = append(out, c)
+	}
+	return out
+}
+
+func TestMWManagerRoundTrip(t *testing.T) {
+	pder := newTestProvider(t, testOptions)
+	sm, err := ivmsesman.NewSesmanWithRepository(pder, testCfg)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	var sid string
+	jar := serve(t, sm, nil, func(w http.ResponseWriter, r *http.Request) {
+		ss := r.Context().Value(ivmsesman.SessionObjKey).(ivmsesman.SessionStore)
+		sid = ss.SessionID()
+		_ = ss.Set("username", "alice")
+		_ = ss.Set("visits", 1)
+		w.Write([]byte("ok"))
+	})
+	for _, c := range jar {
+		if c.Name == "ivmsess" && strings.Contains(c.Value, "alice") {
+			t.Errorf("unexpected plain session value in the cookie %v", c.Value)
+		}
+	}
+	if n := pder.ActiveSessions(); n != 0 {
+		t.Errorf("expected the session to be released, got %d bound", n)
+	}
+
+	// the handler does not write the response - the session is saved when it returns
+	jar = merge(jar, serve(t, sm, jar, func(w http.ResponseWriter, r *http.Request) {
+		ss := r.Context().Value(ivmsesman.SessionObjKey).(ivmsesman.SessionStore)
+		if ss.SessionID() != sid {
+			t.Errorf("expected session %v, got %v", sid, ss.SessionID())
+		}
+		if ss.Get("username") != "alice" || ss.Get("visits") != int64(1) {
+			t.Errorf("unexpected values %v %#v", ss.Get("username"), ss.Get("visits"))
+		}
+		_ = ss.Set("visits", 2)
+		if err := sm.SaveACA(sid, "coch", "S256", "code", "/cb"); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	}))
+
+	serve(t, sm, jar, func(w http.ResponseWriter, r *http.Request) {
+		ss := r.Context().Value(ivmsesman.SessionObjKey).(ivmsesman.SessionStore)
+		if ss.Get("visits") != int64(2) || ss.Get("state") != "InAuth" {
+			t.Errorf("unexpected values %#v %v", ss.Get("visits"), ss.Get("state"))
+		}
+		if ac := sm.GetAuthCode(sid); ac["auth_code"] != "code" {
+			t.Errorf("unexpected auth code %v", ac)
+		}
+	})
+}
+
+func TestChunking(t *testing.T) {
+	pder := newTestProvider(t, testOptions)
+	sm, _ := ivmsesman.NewSesmanWithRepository(pder, testCfg)
+
+	big := strings.Repeat("x", 3*chunkSize)
+	jar := serve(t, sm, nil, func(w http.ResponseWriter, r *http.Request) {
+		ss := r.Context().Value(ivmsesman.SessionObjKey).(ivmsesman.SessionStore)
+		_ = ss.Set("big", big)
+	})
+
+	chunks := 0
+	for _, c := range jar {
+		if strings.HasPrefix(c.Name, "ivmsess") {
+			chunks++
+			if len(c.Value) > chunkSize {
+				t.Errorf("chunk %v is longer than %d", c.Name, chunkSize)
+			}
+		}
+	}
+	if chunks < 4 {
+		t.Errorf("expected the session split in at least 4 cookies, got %d", chunks)
+	}
+
+	// shrinking the session expires the chunks not needed anymore
+	set := serve(t, sm, jar, func(w http.ResponseWriter, r *http.Request) {
+		ss := r.Context().Value(ivmsesman.SessionObjKey).(ivmsesman.SessionStore)
+		if ss.Get("big") != big {
+			t.Errorf("expected the big value to be restored from the chunks")
+		}
+		_ = ss.Delete("big")
+	})
+	expired := 0
+	for _, c := range set {
+		if c.MaxAge < 0 {
+			expired++
+		}
+	}
+	if expired != chunks-1 {
+		t.Errorf("expected %d expired chunks, got %d", chunks-1, expired)
+	}
+
+	serve(t, sm, jar, func(w http.ResponseWriter, r *http.Request) {
+		ss := r.Context().Value(ivmsesman.SessionObjKey).(ivmsesman.SessionStore)
+		_ = ss.Set("huge", strings.Repeat("y", (maxChunks+1)*chunkSize))
+	})
+	if n := pder.ActiveSessions(); n != 0 {
+		t.Errorf("expected the session to be released, got %d bound", n)
+	}
+}
+
+func TestInvalidCookies(t *testing.T) {
+	pder := newTestProvider(t, testOptions)
+	sm, _ := ivmsesman.NewSesmanWithRepository(pder, testCfg)
+
+	var sid string
+	jar := serve(t, sm, nil, func(w http.ResponseWriter, r *http.Request) {
+		ss := r.Context().Value(ivmsesman.SessionObjKey).(ivmsesman.SessionStore)
+		sid = ss.SessionID()
+		_ = ss.Set("role", "user")
+	})
+
+	var tampered []*http.Cookie
+	for _, c := range jar {
+		c := *c
+		if c.Name == "ivmsess" {
+			flip := "A"
+			if c.Value[:1] == flip {
+				flip = "B"
+			}
+			c.Value = flip + c.Value[1:]
+		}
+		tampered = append(tampered, &c)
+	}
+	if pder.Load(httptest.NewRequest("GET", "/", nil), sid) {
+		t.Errorf("unexpected session loaded without cookies")
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, c := range tampered {
+		req.AddCookie(c)
+	}
+	if pder.Load(req, sid) {
+		t.Errorf("unexpected session loaded from a tampered cookie")
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	for _, c := range jar {
+		req.AddCookie(c)
+	}
+	if pder.Load(req, "another-sid") {
+		t.Errorf("unexpected session loaded for another session id")
+	}
+
+	expired := newTestProvider(t, Options{SigningKeys: testOptions.SigningKeys, EncryptionKeys: testOptions.EncryptionKeys, Maxlifetime: -1})
+	if _, err := expired.NewSession("old"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	rr := httptest.NewRecorder()
+	if err := expired.Save(rr, httptest.NewRequest("GET", "/", nil), "old"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	req = httptest.NewRequest("GET", "/", nil)
+	for _, c := range rr.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	if expired.Load(req, "old") {
+		t.Errorf("unexpected expired session loaded")
+	}
+}
+
+func TestDestroy(t *testing.T) {
+	pder := newTestProvider(t, testOptions)
+	sm, _ := ivmsesman.NewSesmanWithRepository(pder, testCfg)
+
+	jar := serve(t, sm, nil, func(w http.ResponseWriter, r *http.Request) {})
+
+	set := serve(t, sm, jar, func(w http.ResponseWriter, r *http.Request) {
+		sm.Destroy(w, r)
+	})
+	expired := false
+	for _, c := range set {
+		if c.Name == "ivmsess" {
+			expired = c.MaxAge < 0
+		}
+	}
+	if !expired {
+		t.Errorf("expected the session cookie to be expired, got %v", set)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	if _, err := New(Options{SigningKeys: testOptions.SigningKeys}); err == nil {
+		t.Errorf("expected error for missing encryption keys")
+	}
+	if _, err := New(Options{EncryptionKeys: testOptions.EncryptionKeys}); err == nil {
+		t.Errorf("expected error for missing signing keys")
+	}
+}
@@ -0,0 +1,67 @@
+package cookie
+
+import (
+	"time"
+)
+
+// Session is the session carried by the cookies of a request. Its values are kept in memory
+// while the request is served and written back in the cookies of the response.
+type Session struct {
+	Sid          string                 `json:"sid"`
+	CreatedAt    int64                  `json:"ca"`
+	TimeAccessed int64                  `json:"ta"`
+	Expires      int64                  `json:"exp"`
+	Value        map[string]interface{} `json:"v"`
+
+	pder *SessionProvider
+}
+
+// Set stores the key:value pair in the session
+func (st *Session) Set(key, value interface{}) error {
+	st.pder.lock.Lock()
+	defer st.pder.lock.Unlock()
+
+	st.Value[key.(string)] = value
+	st.TimeAccessed = time.Now().Unix()
+	return nil
+}
+
+// Get will retrieve the session value by the provided key
+func (st *Session) Get(key interface{}) interface{} {
+	st.pder.lock.Lock()
+	defer st.pder.lock.Unlock()
+
+	st.TimeAccessed = time.Now().Unix()
+	if v, ok := st.Value[key.(string)]; ok {
+		return v
+	}
+	return nil
+}
+
+// Delete will remove a session value by the provided key
+func (st *Session) Delete(key interface{}) error {
+	st.pder.lock.Lock()
+	defer st.pder.lock.Unlock()
+
+	delete(st.Value, key.(string))
+	st.TimeAccessed = time.Now().Unix()
+	return nil
+}
+
+// SessionID will retrieve the id of the current session
+func (st *Session) SessionID() string {
+	return st.Sid
+}
+
+// GetCreatedAt will return the time the session was created
+func (st *Session) GetCreatedAt() time.Time {
+	return time.Unix(st.CreatedAt, 0)
+}
+
+// GetLTA will return the LastTimeAccessedAt
+func (st *Session) GetLTA() time.Time {
+	st.pder.lock.Lock()
+	defer st.pder.lock.Unlock()
+
+	return time.Unix(st.TimeAccessed, 0)
+}
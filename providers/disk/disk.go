@@ -0,0 +1,789 @@
+// Package disk implements a durable single-node session store provider in a local file.
+//
+// Every change is appended to a log file as a checksummed record. The provider keeps in memory only the
+// index of the sessions - their times and the position of their last record, ordered by the last time
+// accessed for the expiry - and reads the session values from the file. The log is compacted, rewriting
+// the live records in a new file renamed over it, once most of it is superseded records. A record torn
+// by a crash is dropped when the file is opened again.
+//
+// The repository operations take no context, the file writes are local and not canceled; the session manager
+// adapts them with ivmsesman.WithContext, which checks the context before each of them.
+package disk
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dasiyes/ivmsesman"
+	"github.com/dasiyes/ivmsesman/internal/provutil"
+)
+
+// Options configures the disk session provider
+type Options struct {
+	// Path is the log file of the sessions, created when missing. Required
+	Path string
+	// Maxlifetime is the idle time (in seconds) after which a session expires. Default 3600
+	Maxlifetime int64
+	// SyncWrites syncs the file to the disk after every change. Otherwise a crash of the process loses
+	// nothing, but a crash of the machine may lose the last changes.
+	SyncWrites bool
+	// CompactRatio is the part of the log taken by superseded records which triggers a compaction at the
+	// next SessionGC. Default 0.5
+	CompactRatio float64
+	// CompactMinSize is the size of the log (in bytes) below which it is not compacted. Default 1MiB
+	CompactMinSize int64
+}
+
+// keyEntry indexes a session of the log
+type keyEntry struct {
+	sid          string
+	createdAt    int64
+	timeAccessed int64
+	// state and uid of the session, so List filters the sessions without reading their values
+	state, uid string
+	// off and n locate the last record of the session with its values
+	off int64
+	n   int64
+}
+
+// blacklistEntry is a single ip record in the blacklist
+type blacklistEntry struct {
+	created    int64
+	requestURI string
+	details    interface{}
+	n          int64
+}
+
+// SessionProvider is the DAL holding the methods for the log file operations for the SessionManager.
+// The sessions list is kept ordered by the last time accessed - the most recent at the front.
+type SessionProvider struct {
+	mu        sync.Mutex
+	file      *logFile
+	opts      Options
+	sessions  map[string]*list.Element
+	list      *list.List
+	blacklist map[string]*blacklistEntry
+	// live is the size of the records not superseded yet
+	live int64
+
+	maxlifetime int64
+	absolute    int64
+	touch       int64
+	log         *slog.Logger
+	onExpired   func(ctx context.Context, sid string)
+}
+
+// New opens the log file of the options, creating it when missing, and indexes its sessions
+func New(opts Options) (*SessionProvider, error) {
+
+	if opts.Path == "" {
+		return nil, fmt.Errorf("disk: the path of the session log is required")
+	}
+	if opts.Maxlifetime <= 0 {
+		opts.Maxlifetime = 3600
+	}
+	if opts.CompactRatio <= 0 || opts.CompactRatio >= 1 {
+		opts.CompactRatio = 0.5
+	}
+	if opts.CompactMinSize <= 0 {
+		opts.CompactMinSize = 1 << 20
+	}
+
+	f, err := openLog(opts.Path, opts.SyncWrites)
+	if err != nil {
+		return nil, fmt.Errorf("disk: unable to open the session log: %v", err)
+	}
+	pder := &SessionProvider{
+		file:        f,
+		opts:        opts,
+		sessions:    make(map[string]*list.Element),
+		list:        list.New(),
+		blacklist:   make(map[string]*blacklistEntry),
+		maxlifetime: opts.Maxlifetime,
+	}
+
+	dropped, err := f.replay(pder.apply)
+	if err != nil {
+		f.close()
+		return nil, fmt.Errorf("disk: unable to read the session log: %v", err)
+	}
+	if dropped > 0 {
+		pder.logger().Warn("torn records dropped from the end of the session log", slog.String("path", opts.Path), slog.Int64("bytes", dropped))
+	}
+	pder.sortIndex()
+	return pder, nil
+}
+
+// apply indexes a record of the log read when the file is opened
+func (pder *SessionProvider) apply(e logEntry, off, n int64) {
+
+	switch e.Kind {
+	case kindSession:
+		if element, ok := pder.sessions[e.ID]; ok {
+			pder.live -= element.Value.(*keyEntry).n
+			pder.list.Remove(element)
+		}
+		k := &keyEntry{sid: e.ID, createdAt: e.CreatedAt, timeAccessed: e.TimeAccessed, off: off, n: n}
+		k.state, k.uid = stateOf(e.Values)
+		pder.sessions[e.ID] = pder.list.PushFront(k)
+		pder.live += n
+	case kindTouch:
+		if element, ok := pder.sessions[e.ID]; ok {
+			element.Value.(*keyEntry).timeAccessed = e.TimeAccessed
+			pder.list.MoveToFront(element)
+		}
+	case kindDelete:
+		if element, ok := pder.sessions[e.ID]; ok {
+			pder.live -= element.Value.(*keyEntry).n
+			pder.list.Remove(element)
+			delete(pder.sessions, e.ID)
+		}
+	case kindBlacklist:
+		if b, ok := pder.blacklist[e.ID]; ok {
+			pder.live -= b.n
+		}
+		pder.blacklist[e.ID] = &blacklistEntry{created: e.CreatedAt, requestURI: e.RequestURI, details: e.Details, n: n}
+		pder.live += n
+	case kindUnblacklist:
+		if b, ok := pder.blacklist[e.ID]; ok {
+			pder.live -= b.n
+			delete(pder.blacklist, e.ID)
+		}
+	}
+}
+
+// sortIndex orders the sessions list by the last time accessed, after the log was read. The list is in
+// the order of the last record of every session, which breaks the ties of the same second.
+func (pder *SessionProvider) sortIndex() {
+
+	entries := make([]*keyEntry, 0, len(pder.sessions))
+	for element := pder.list.Back(); element != nil; element = element.Prev() {
+		entries = append(entries, element.Value.(*keyEntry))
+	}
+	sortByAccess(entries)
+
+	pder.list.Init()
+	for _, k := range entries {
+		pder.sessions[k.sid] = pder.list.PushFront(k)
+	}
+}
+
+// SetLogger sets the logger of the provider events
+func (pder *SessionProvider) SetLogger(l *slog.Logger) {
+	pder.log = l
+}
+
+// logger returns the logger set or the slog default one
+func (pder *SessionProvider) logger() *slog.Logger {
+	if pder.log != nil {
+		return pder.log
+	}
+	return slog.Default()
+}
+
+// SetExpiryPolicy sets the timeouts enforced when a session is read. A zero idle timeout keeps
+// Options.Maxlifetime.
+func (pder *SessionProvider) SetExpiryPolicy(p ivmsesman.ExpiryPolicy) {
+
+	pder.mu.Lock()
+	defer pder.mu.Unlock()
+
+	if p.Idle > 0 {
+		pder.maxlifetime = p.Idle
+	}
+	pder.absolute = p.Absolute
+	pder.touch = p.Touch
+}
+
+// SetExpiryListener sets the func called with the id of every session removed as expired
+func (pder *SessionProvider) SetExpiryListener(fn func(ctx context.Context, sid string)) {
+
+	pder.mu.Lock()
+	defer pder.mu.Unlock()
+
+	pder.onExpired = fn
+}
+
+// Close closes the log file. The provider can not be used afterwards.
+func (pder *SessionProvider) Close() error {
+
+	pder.mu.Lock()
+	defer pder.mu.Unlock()
+
+	return pder.file.close()
+}
+
+// policy returns the timeouts of the provider. The caller holds the lock.
+func (pder *SessionProvider) policy() ivmsesman.ExpiryPolicy {
+	return ivmsesman.ExpiryPolicy{Idle: pder.maxlifetime, Absolute: pder.absolute, Touch: pder.touch}
+}
+
+// touchDue reports if the last access time of a session accessed at the unix time is to be rewritten
+func (pder *SessionProvider) touchDue(accessedAt, now int64) bool {
+
+	pder.mu.Lock()
+	defer pder.mu.Unlock()
+
+	return pder.policy().TouchDue(accessedAt, now)
+}
+
+// lookup returns the index entry of a session which is not expired. An expired session is removed.
+// The caller holds the lock.
+func (pder *SessionProvider) lookup(sid string) (*keyEntry, bool) {
+
+	element, ok := pder.sessions[sid]
+	if !ok {
+		return nil, false
+	}
+	k := element.Value.(*keyEntry)
+	if pder.policy().Expired(k.createdAt, k.timeAccessed, time.Now().Unix()) {
+		pder.expire(element)
+		return nil, false
+	}
+	return k, true
+}
+
+// expire removes an expired session and reports it. The caller holds the lock.
+func (pder *SessionProvider) expire(element *list.Element) {
+
+	sid := element.Value.(*keyEntry).sid
+	if err := pder.remove(element); err != nil {
+		pder.logger().Error("unable to remove the expired session", slog.Any("sid", ivmsesman.Sensitive(sid)), slog.Any("error", err))
+		return
+	}
+	if pder.onExpired != nil {
+		pder.onExpired(context.Background(), sid)
+	}
+}
+
+// remove appends the removal of the session of the list element. The caller holds the lock.
+func (pder *SessionProvider) remove(element *list.Element) error {
+
+	k := element.Value.(*keyEntry)
+	if _, _, err := pder.file.append(logEntry{Kind: kindDelete, ID: k.sid}); err != nil {
+		return err
+	}
+	pder.live -= k.n
+	pder.list.Remove(element)
+	delete(pder.sessions, k.sid)
+	return nil
+}
+
+// put appends the session with its values and indexes it as the most recently accessed. The caller holds the lock.
+func (pder *SessionProvider) put(sid string, createdAt, timeAccessed int64, values map[string]interface{}) error {
+
+	off, n, err := pder.file.append(logEntry{Kind: kindSession, ID: sid, CreatedAt: createdAt, TimeAccessed: timeAccessed, Values: values})
+	if err != nil {
+		return err
+	}
+	if element, ok := pder.sessions[sid]; ok {
+		pder.live -= element.Value.(*keyEntry).n
+		pder.list.Remove(element)
+	}
+	k := &keyEntry{sid: sid, createdAt: createdAt, timeAccessed: timeAccessed, off: off, n: n}
+	k.state, k.uid = stateOf(values)
+	pder.sessions[sid] = pder.list.PushFront(k)
+	pder.live += n
+	return nil
+}
+
+// load reads the values of the indexed session. The caller holds the lock.
+func (pder *SessionProvider) load(k *keyEntry) (*Session, error) {
+
+	e, err := pder.file.read(k.off, k.n)
+	if err != nil {
+		return nil, err
+	}
+	if e.Kind != kindSession || e.ID != k.sid {
+		return nil, errCorrupted
+	}
+	if e.Values == nil {
+		e.Values = make(map[string]interface{})
+	}
+	ss := &Session{Sid: k.sid, CreatedAt: k.createdAt, TimeAccessed: k.timeAccessed, Value: e.Values}
+	return ss.bind(pder), nil
+}
+
+// touchEntry appends the last time accessed of the session. The caller holds the lock.
+func (pder *SessionProvider) touchEntry(k *keyEntry, now int64) error {
+
+	if _, _, err := pder.file.append(logEntry{Kind: kindTouch, ID: k.sid, TimeAccessed: now}); err != nil {
+		return err
+	}
+	k.timeAccessed = now
+	pder.list.MoveToFront(pder.sessions[k.sid])
+	return nil
+}
+
+// NewSession creates a new session value in the store with sid as a key
+func (pder *SessionProvider) NewSession(sid string) (ivmsesman.SessionStore, error) {
+
+	pder.mu.Lock()
+	defer pder.mu.Unlock()
+
+	return pder.newSession(sid)
+}
+
+// newSession stores a new session. The caller holds the lock.
+func (pder *SessionProvider) newSession(sid string) (*Session, error) {
+
+	v := map[string]interface{}{"state": "New"}
+	now := time.Now().Unix()
+	if err := pder.put(sid, now, now, v); err != nil {
+		return nil, fmt.Errorf("unable to save in session repository - error: %v", err)
+	}
+	ss := &Session{Sid: sid, CreatedAt: now, TimeAccessed: now, Value: map[string]interface{}{"state": "New"}}
+	return ss.bind(pder), nil
+}
+
+// FindOrCreate will first search the store for a session value with provided sid. If not not found, a new session value will be created and stored in the session store
+func (pder *SessionProvider) FindOrCreate(sid string) (ivmsesman.SessionStore, error) {
+
+	pder.mu.Lock()
+	defer pder.mu.Unlock()
+
+	k, ok := pder.lookup(sid)
+	if !ok {
+		return pder.newSession(sid)
+	}
+	return pder.find(k)
+}
+
+// FindContext returns the session sid without creating it, ivmsesman.ErrInvalidSessionID when the store does not hold it
+func (pder *SessionProvider) FindContext(ctx context.Context, sid string) (ivmsesman.SessionStore, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	pder.mu.Lock()
+	defer pder.mu.Unlock()
+
+	k, ok := pder.lookup(sid)
+	if !ok {
+		return nil, ivmsesman.ErrInvalidSessionID
+	}
+	return pder.find(k)
+}
+
+// find reads the session of the index entry, refreshing its last access when due. The caller holds the lock.
+func (pder *SessionProvider) find(k *keyEntry) (*Session, error) {
+
+	ss, err := pder.load(k)
+	if err != nil {
+		return nil, fmt.Errorf("err while read session id: %v, err: %v", k.sid, err)
+	}
+	if now := time.Now().Unix(); pder.policy().TouchDue(k.timeAccessed, now) {
+		if err := pder.touchEntry(k, now); err != nil {
+			return nil, fmt.Errorf("err while updating time accessed for sessions id %v, err: %v", k.sid, err)
+		}
+		ss.TimeAccessed = now
+	}
+	return ss, nil
+}
+
+// DestroySID will remove a session data from the storage
+func (pder *SessionProvider) DestroySID(sid string) error {
+
+	pder.mu.Lock()
+	defer pder.mu.Unlock()
+
+	element, ok := pder.sessions[sid]
+	if !ok {
+		return nil
+	}
+	return pder.remove(element)
+}
+
+// SessionGC cleans all expired sessions and compacts the log when most of it is superseded records
+func (pder *SessionProvider) SessionGC(maxlifetime int64) {
+
+	pder.mu.Lock()
+	defer pder.mu.Unlock()
+
+	// the list is not ordered by the creation time
+	if pder.absolute > 0 {
+		for sid := range pder.sessions {
+			pder.lookup(sid)
+		}
+	}
+
+	now := time.Now().Unix()
+	for element := pder.list.Back(); element != nil; element = pder.list.Back() {
+		if element.Value.(*keyEntry).timeAccessed+maxlifetime >= now {
+			break
+		}
+		sid := element.Value.(*keyEntry).sid
+		pder.expire(element)
+		if _, ok := pder.sessions[sid]; ok {
+			// the removal failed and was logged
+			break
+		}
+	}
+
+	if pder.file.size > pder.opts.CompactMinSize &&
+		float64(pder.file.size-headerSize-pder.live) > pder.opts.CompactRatio*float64(pder.file.size) {
+		if err := pder.compact(); err != nil {
+			pder.logger().Error("unable to compact the session log", slog.String("path", pder.opts.Path), slog.Any("error", err))
+		}
+	}
+}
+
+// Compact rewrites the log with the live records only
+func (pder *SessionProvider) Compact() error {
+
+	pder.mu.Lock()
+	defer pder.mu.Unlock()
+
+	return pder.compact()
+}
+
+// compact writes the blacklist and the sessions, the least recently accessed first, to a new log file
+// renamed over the current one. The caller holds the lock.
+func (pder *SessionProvider) compact() error {
+
+	path := pder.opts.Path
+	tmp := path + ".compact"
+	_ = os.Remove(tmp)
+	nf, err := openLog(tmp, false)
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		nf.close()
+		os.Remove(tmp)
+		return err
+	}
+
+	// the new positions are applied once the new file replaces the current one
+	type moved struct {
+		k      *keyEntry
+		off, n int64
+	}
+	var sessions []moved
+	blacklist := make(map[string]int64, len(pder.blacklist))
+
+	for ip, b := range pder.blacklist {
+		_, n, err := nf.append(logEntry{Kind: kindBlacklist, ID: ip, CreatedAt: b.created, RequestURI: b.requestURI, Details: b.details})
+		if err != nil {
+			return fail(err)
+		}
+		blacklist[ip] = n
+	}
+	for element := pder.list.Back(); element != nil; element = element.Prev() {
+		k := element.Value.(*keyEntry)
+		e, err := pder.file.read(k.off, k.n)
+		if err != nil {
+			return fail(err)
+		}
+		e.TimeAccessed = k.timeAccessed
+		off, n, err := nf.append(e)
+		if err != nil {
+			return fail(err)
+		}
+		sessions = append(sessions, moved{k, off, n})
+	}
+
+	if err := nf.f.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fail(err)
+	}
+	syncDir(filepath.Dir(path))
+
+	pder.file.close()
+	nf.sync = pder.opts.SyncWrites
+	pder.file = nf
+	pder.live = nf.size - headerSize
+	for _, m := range sessions {
+		m.k.off, m.k.n = m.off, m.n
+	}
+	for ip, n := range blacklist {
+		pder.blacklist[ip].n = n
+	}
+	return nil
+}
+
+// RegenerateContext moves the session data under the new session id newsid and removes oldsid
+func (pder *SessionProvider) RegenerateContext(ctx context.Context, oldsid, newsid string) (ivmsesman.SessionStore, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	pder.mu.Lock()
+	defer pder.mu.Unlock()
+
+	k, ok := pder.lookup(oldsid)
+	if !ok {
+		return nil, fmt.Errorf("session id %v not found", oldsid)
+	}
+	if _, ok := pder.sessions[newsid]; ok {
+		return nil, fmt.Errorf("session id %v already exists", newsid)
+	}
+	ss, err := pder.load(k)
+	if err != nil {
+		return nil, fmt.Errorf("err while regenerating session id %v, err: %v", oldsid, err)
+	}
+
+	now := time.Now().Unix()
+	if err := pder.put(newsid, k.createdAt, now, ss.Value); err != nil {
+		return nil, fmt.Errorf("err while regenerating session id %v, err: %v", oldsid, err)
+	}
+	if err := pder.remove(pder.sessions[oldsid]); err != nil {
+		return nil, fmt.Errorf("err while regenerating session id %v, err: %v", oldsid, err)
+	}
+	ns := &Session{Sid: newsid, CreatedAt: k.createdAt, TimeAccessed: now, Value: ss.Value}
+	return ns.bind(pder), nil
+}
+
+// UpdateTimeAccessed will update the time accessed value with now()
+func (pder *SessionProvider) UpdateTimeAccessed(sid string) error {
+
+	pder.mu.Lock()
+	defer pder.mu.Unlock()
+
+	k, ok := pder.lookup(sid)
+	if !ok {
+		return fmt.Errorf("err while updating time accessed for sessions id %v, err: session not found", sid)
+	}
+	if err := pder.touchEntry(k, time.Now().Unix()); err != nil {
+		return fmt.Errorf("err while updating time accessed for sessions id %v, err: %v", sid, err)
+	}
+	return nil
+}
+
+// update writes the session values and removes the deletes values of an existing session, refreshing its
+// last time accessed
+func (pder *SessionProvider) update(sid string, values map[string]interface{}, deletes ...string) error {
+
+	pder.mu.Lock()
+	defer pder.mu.Unlock()
+
+	k, ok := pder.lookup(sid)
+	if !ok {
+		return fmt.Errorf("session id %v not found", sid)
+	}
+	ss, err := pder.load(k)
+	if err != nil {
+		return err
+	}
+	for key, v := range values {
+		ss.Value[key] = v
+	}
+	for _, key := range deletes {
+		delete(ss.Value, key)
+	}
+	return pder.put(sid, k.createdAt, time.Now().Unix(), ss.Value)
+}
+
+// UpdateSessionState will update the state value with one provided
+func (pder *SessionProvider) UpdateSessionState(sid string, state string) error {
+
+	err := pder.update(sid, map[string]interface{}{"state": state})
+	if err != nil {
+		return fmt.Errorf("err while updating `Value.state` for sessions id %v, err: %v", sid, err)
+	}
+	return nil
+}
+
+// ActiveSessions returns the number of currently active sessions in the session store
+func (pder *SessionProvider) ActiveSessions() int {
+
+	pder.mu.Lock()
+	defer pder.mu.Unlock()
+
+	n := 0
+	now := time.Now().Unix()
+	p := pder.policy()
+	for _, element := range pder.sessions {
+		k := element.Value.(*keyEntry)
+		if !p.Expired(k.createdAt, k.timeAccessed, now) {
+			n++
+		}
+	}
+	return n
+}
+
+// Exists check by sid if a session data exists in the session store
+func (pder *SessionProvider) Exists(sid string) bool {
+
+	pder.mu.Lock()
+	defer pder.mu.Unlock()
+
+	_, ok := pder.lookup(sid)
+	return ok
+}
+
+// Flush will delete all elements for sessions data. The log is rewritten with the blacklist only.
+func (pder *SessionProvider) Flush() error {
+
+	pder.mu.Lock()
+	defer pder.mu.Unlock()
+
+	sessions, entries := pder.sessions, pder.list
+	pder.sessions, pder.list = make(map[string]*list.Element), list.New()
+	if err := pder.compact(); err != nil {
+		pder.sessions, pder.list = sessions, entries
+		return fmt.Errorf("error flushing sessions, err: %v", err)
+	}
+	return nil
+}
+
+// UpdateCodeVerifier will update the code verifier (cove) value assigned to the session id
+func (pder *SessionProvider) UpdateCodeVerifier(sid, cove string) error {
+
+	err := pder.update(sid, map[string]interface{}{"code_verifier": cove})
+	if err != nil {
+		return fmt.Errorf("err while updating `Value.code_verifier` for sessions id %v, err: %v", sid, err)
+	}
+	return nil
+}
+
+// SaveCodeChallengeAndMethod - at step2 of AuthorizationCode flow
+func (pder *SessionProvider) SaveCodeChallengeAndMethod(
+	sid, coch, mth, code, ru string) error {
+
+	// set code expiration timestamp
+	ce := time.Now().Unix() + 60
+
+	err := pder.update(sid, map[string]interface{}{
+		"code_challenger":        coch,
+		"code_challenger_method": mth,
+		"auth_code":              code,
+		"code_expire":            ce,
+		"redirect_uri":           ru,
+		"state":                  "InAuth",
+	})
+	if err != nil {
+		return fmt.Errorf("err while updating `Value.code_verifier` for sessions id %v, err: %v", sid, err)
+	}
+	return nil
+}
+
+// GetAuthCode will return the authorization code for a session, if it is InAuth and the code did not expire
+func (pder *SessionProvider) GetAuthCode(sid string) map[string]string {
+
+	pder.mu.Lock()
+	defer pder.mu.Unlock()
+
+	var ac map[string]string = map[string]string{}
+
+	k, ok := pder.lookup(sid)
+	if !ok {
+		return ac
+	}
+	ss, err := pder.load(k)
+	if err != nil {
+		return ac
+	}
+
+	state, _ := ss.Value["state"].(string)
+	ce, _ := ss.Value["code_expire"].(int64)
+	if state == "InAuth" && ce > time.Now().Unix() {
+		ac["auth_code"], _ = ss.Value["auth_code"].(string)
+		ac["code_challenger"], _ = ss.Value["code_challenger"].(string)
+		ac["code_challenger_method"], _ = ss.Value["code_challenger_method"].(string)
+	}
+	return ac
+}
+
+// UpdateAuthSession - update state, access and refresh tokens values for auth session
+func (pder *SessionProvider) UpdateAuthSession(sid, at, rt, uid string) error {
+
+	err := pder.update(sid, map[string]interface{}{
+		"at":    at,
+		"rt":    rt,
+		"uid":   uid,
+		"state": "Authed",
+	})
+	if err != nil {
+		return fmt.Errorf("err while updating new authenticated session id %v, err: %v", sid, err)
+	}
+	return nil
+}
+
+// Blacklisting adds the @ip to the blacklist with the @path and @data
+func (pder *SessionProvider) Blacklisting(ip, path string, data interface{}) {
+
+	pder.mu.Lock()
+	defer pder.mu.Unlock()
+
+	now := time.Now().Unix()
+	_, n, err := pder.file.append(logEntry{Kind: kindBlacklist, ID: ip, CreatedAt: now, RequestURI: path, Details: data})
+	if err != nil {
+		pder.logger().Error("error adding ip in the blacklist", slog.String("ip", ip), slog.Any("error", err))
+		return
+	}
+	if b, ok := pder.blacklist[ip]; ok {
+		pder.live -= b.n
+	}
+	pder.blacklist[ip] = &blacklistEntry{created: now, requestURI: path, details: data, n: n}
+	pder.live += n
+	pder.logger().Info("ip added in the blacklist", slog.String("ip", ip), slog.String("path", path))
+}
+
+// IsIPExistInBL returns boolean result for the @ip being or not in the blacklist
+func (pder *SessionProvider) IsIPExistInBL(ip string) bool {
+
+	pder.mu.Lock()
+	defer pder.mu.Unlock()
+
+	_, ok := pder.blacklist[ip]
+	return ok
+}
+
+// BLClean - cleaning the blacklist from the ips which passed the quarantine period and are verified as good bots
+func (pder *SessionProvider) BLClean() {
+	docs_cnt := 0
+	del_docs_cnt := 0
+
+	to := time.Now().Unix() - provutil.BLQuarantine
+
+	pder.mu.Lock()
+	var review []string
+	for ip, b := range pder.blacklist {
+		if b.created < to {
+			review = append(review, ip)
+		}
+	}
+	pder.mu.Unlock()
+
+	// the reverse dns lookups run without holding the lock
+	for _, ip := range review {
+		if provutil.NativeReverseDNSLookup(ip) {
+			if err := pder.unblacklist(ip); err != nil {
+				pder.logger().Error("error deleting ip from the blacklist", slog.String("ip", ip), slog.Any("error", err))
+				continue
+			}
+			del_docs_cnt++
+		}
+		docs_cnt++
+	}
+	pder.logger().Info("blacklist clean summary", slog.Int("reviewed", docs_cnt), slog.Int("deleted", del_docs_cnt))
+}
+
+// unblacklist appends the removal of the ip from the blacklist
+func (pder *SessionProvider) unblacklist(ip string) error {
+
+	pder.mu.Lock()
+	defer pder.mu.Unlock()
+
+	b, ok := pder.blacklist[ip]
+	if !ok {
+		return nil
+	}
+	if _, _, err := pder.file.append(logEntry{Kind: kindUnblacklist, ID: ip}); err != nil {
+		return err
+	}
+	pder.live -= b.n
+	delete(pder.blacklist, ip)
+	return nil
+}
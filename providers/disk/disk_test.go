@@ -0,0 +1,233 @@
+package disk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dasiyes/ivmsesman"
+	"github.com/dasiyes/ivmsesman/sesmantest"
+)
+
+// open returns the provider of the log at path, closed at the end of the test
+func open(t *testing.T, path string) *SessionProvider {
+	t.Helper()
+
+	pder, err := New(Options{Path: path})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	t.Cleanup(func() { pder.Close() })
+	return pder
+}
+
+func TestConformance(t *testing.T) {
+	sesmantest.RunConformance(t, func(t *testing.T) ivmsesman.SessionRepository {
+		return open(t, filepath.Join(t.TempDir(), "sessions.log"))
+	})
+}
+
+func TestReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+
+	pder, err := New(Options{Path: path})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for _, sid := range []string{"a", "b", "c"} {
+		if _, err := pder.NewSession(sid); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if err := pder.SaveCodeChallengeAndMethod("a", "coch", "S256", "code", "/"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	ss, _ := pder.FindOrCreate("b")
+	_ = ss.Set("visits", 3)
+	_ = ss.Set("temp", "x")
+	_ = ss.Delete("temp")
+	_ = pder.DestroySID("c")
+	pder.Blacklisting("10.0.0.1", "/wp-admin", map[string]interface{}{"ua": "bot"})
+	if err := pder.Close(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	reopened := open(t, path)
+	if !reopened.Exists("a") || !reopened.Exists("b") || reopened.Exists("c") {
+		t.Errorf("expected sessions `a` and `b` only, got %d sessions", reopened.ActiveSessions())
+	}
+	if ac := reopened.GetAuthCode("a"); ac["auth_code"] != "code" {
+		t.Errorf("expected the auth code kept, got %v", ac)
+	}
+	ss, _ = reopened.FindOrCreate("b")
+	if v := ss.Get("visits"); v != int64(3) {
+		t.Errorf("expected int64 3, got %#v", v)
+	}
+	if v := ss.Get("temp"); v != nil {
+		t.Errorf("expected the deleted value removed, got %#v", v)
+	}
+	if !reopened.IsIPExistInBL("10.0.0.1") {
+		t.Errorf("expected the blacklist kept")
+	}
+
+	// the states of the index are read back from the log
+	page, next, err := reopened.List(context.Background(), ivmsesman.SessionFilter{State: "InAuth"}, "", 10)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(page) != 1 || page[0].ID != "a" || next != "" {
+		t.Errorf("expected the InAuth session `a` listed, got %+v", page)
+	}
+}
+
+func TestTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+
+	pder, _ := New(Options{Path: path})
+	_, _ = pder.NewSession("a")
+	_, _ = pder.NewSession("b")
+	size := pder.file.size
+	pder.Close()
+
+	// half of the last record written before a crash
+	if err := os.Truncate(path, size-10); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	reopened := open(t, path)
+	if !reopened.Exists("a") || reopened.Exists("b") {
+		t.Errorf("expected only the session `a` kept")
+	}
+	if _, err := reopened.NewSession("c"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	reopened.Close()
+
+	again := open(t, path)
+	if !again.Exists("a") || !again.Exists("c") {
+		t.Errorf("expected the sessions appended after the torn record kept")
+	}
+}
+
+func TestCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+
+	pder, err := New(Options{Path: path, CompactMinSize: 1})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	_, _ = pder.NewSession("a")
+	ss, _ := pder.NewSession("b")
+	for i := 0; i < 100; i++ {
+		_ = ss.Set("n", i)
+	}
+	pder.Blacklisting("10.0.0.1", "/", nil)
+	before := pder.file.size
+
+	pder.SessionGC(3600)
+	if pder.file.size >= before/10 {
+		t.Errorf("expected the log compacted, got %d bytes of %d", pder.file.size, before)
+	}
+	if pder.file.size-headerSize != pder.live {
+		t.Errorf("expected only live records, got %d bytes and %d live", pder.file.size, pder.live)
+	}
+	if files, _ := os.ReadDir(filepath.Dir(path)); len(files) != 1 {
+		t.Errorf("expected only the log file, got %v", files)
+	}
+
+	ss, _ = pder.FindOrCreate("b")
+	if v := ss.Get("n"); v != int64(99) {
+		t.Errorf("expected the last value kept, got %#v", v)
+	}
+	_ = ss.Set("n", 100)
+	pder.Close()
+
+	reopened := open(t, path)
+	ss, _ = reopened.FindOrCreate("b")
+	if v := ss.Get("n"); v != int64(100) {
+		t.Errorf("expected the value written after the compaction, got %#v", v)
+	}
+	if !reopened.Exists("a") || !reopened.IsIPExistInBL("10.0.0.1") {
+		t.Errorf("expected the session and the blacklist kept")
+	}
+}
+
+func TestSessionGCIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+	pder := open(t, path)
+
+	var expired []string
+	pder.SetExpiryListener(func(_ context.Context, sid string) { expired = append(expired, sid) })
+
+	for _, sid := range []string{"a", "b", "c"} {
+		_, _ = pder.NewSession(sid)
+	}
+	// `a` idle for 2 minutes, `b` touched after `c`
+	pder.mu.Lock()
+	pder.sessions["a"].Value.(*keyEntry).timeAccessed -= 120
+	pder.list.MoveToBack(pder.sessions["a"])
+	pder.mu.Unlock()
+	_ = pder.UpdateTimeAccessed("b")
+
+	pder.SessionGC(60)
+	if len(expired) != 1 || expired[0] != "a" {
+		t.Errorf("expected only `a` expired, got %v", expired)
+	}
+	if pder.list.Front().Value.(*keyEntry).sid != "b" {
+		t.Errorf("expected `b` as the most recently accessed")
+	}
+	pder.Close()
+
+	// the order of the index is rebuilt from the log
+	reopened := open(t, path)
+	if reopened.list.Front().Value.(*keyEntry).sid != "b" || reopened.list.Len() != 2 {
+		t.Errorf("expected `b` as the most recently accessed of 2 sessions")
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, err := New(Options{}); err == nil {
+		t.Errorf("expected an error for a missing path")
+	}
+
+	path := filepath.Join(dir, "other")
+	if err := os.WriteFile(path, []byte("not a session log"), 0600); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := New(Options{Path: path}); err == nil || !strings.Contains(err.Error(), "not a session log") {
+		t.Errorf("expected an error for a file which is not a session log, got %v", err)
+	}
+
+	path = filepath.Join(dir, "newer")
+	if err := os.WriteFile(path, append([]byte(logMagic), logVersion+1), 0600); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := New(Options{Path: path}); err == nil || !strings.Contains(err.Error(), "unsupported session log version") {
+		t.Errorf("expected an unsupported version error, got %v", err)
+	}
+}
+
+func TestSyncWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+
+	pder, err := New(Options{Path: path, SyncWrites: true, Maxlifetime: 1})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer pder.Close()
+
+	if _, err := pder.NewSession("a"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	pder.mu.Lock()
+	pder.sessions["a"].Value.(*keyEntry).timeAccessed -= 2
+	pder.mu.Unlock()
+	if pder.Exists("a") {
+		t.Errorf("expected the session expired by Options.Maxlifetime")
+	}
+}
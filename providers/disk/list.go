@@ -0,0 +1,51 @@
+package disk
+
+import (
+	"context"
+	"time"
+
+	"github.com/dasiyes/ivmsesman"
+	"github.com/dasiyes/ivmsesman/internal/provutil"
+)
+
+// List returns up to limit live sessions selected by the filter, in the order of the ids. The cursor is the
+// id of the last session of the previous page. The sessions are selected from the index, only the values
+// of the sessions of the page are read from the log.
+func (pder *SessionProvider) List(ctx context.Context, filter ivmsesman.SessionFilter, cursor string, limit int) ([]ivmsesman.SessionRecord, string, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	if limit <= 0 {
+		limit = ivmsesman.DefaultListLimit
+	}
+
+	pder.mu.Lock()
+	now := time.Now().Unix()
+	policy := pder.policy()
+	page := provutil.NewSmallestIDs(limit + 1)
+	for sid, element := range pder.sessions {
+		k := element.Value.(*keyEntry)
+		if sid > cursor && filter.Match(k.timeAccessed, k.state, k.uid) && !policy.Expired(k.createdAt, k.timeAccessed, now) {
+			page.Add(sid)
+		}
+	}
+	pder.mu.Unlock()
+
+	ids, next := page.Sorted(), ""
+	if len(ids) > limit {
+		ids, next = ids[:limit], ids[limit-1]
+	}
+
+	sessions := make([]ivmsesman.SessionRecord, 0, len(ids))
+	for _, sid := range ids {
+		rec, ok, err := pder.record(sid)
+		if err != nil {
+			return nil, "", err
+		}
+		if ok {
+			sessions = append(sessions, rec)
+		}
+	}
+	return sessions, next, nil
+}
@@ -0,0 +1,218 @@
+package disk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/dasiyes/ivmsesman/internal/provutil"
+)
+
+// logMagic and the version byte following it start every log file
+const (
+	logMagic   = "IVMSESMAN-DISK\n"
+	logVersion = byte(1)
+	headerSize = int64(len(logMagic) + 1)
+)
+
+// A record is framed by its payload length and the CRC-32 (Castagnoli) of the payload, both uint32 big
+// endian. The payload is the JSON of a logEntry.
+const (
+	frameSize = 8
+	// maxRecord bounds the payload length read, so a corrupted length is not allocated
+	maxRecord = 16 << 20
+)
+
+// The kinds of the log records
+const (
+	// kindSession is a session with all its values
+	kindSession = "s"
+	// kindTouch is the last time accessed of a session
+	kindTouch = "t"
+	// kindDelete is the removal of a session
+	kindDelete = "d"
+	// kindBlacklist is a blacklist entry
+	kindBlacklist = "b"
+	// kindUnblacklist is the removal of a blacklist entry
+	kindUnblacklist = "u"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errCorrupted is returned when a record does not match its checksum
+var errCorrupted = errors.New("corrupted record")
+
+// logEntry is a record of the log. ID is the session id or the blacklisted ip.
+type logEntry struct {
+	Kind         string                 `json:"k"`
+	ID           string                 `json:"id"`
+	CreatedAt    int64                  `json:"c,omitempty"`
+	TimeAccessed int64                  `json:"a,omitempty"`
+	Values       map[string]interface{} `json:"v,omitempty"`
+	RequestURI   string                 `json:"r,omitempty"`
+	Details      interface{}            `json:"x,omitempty"`
+}
+
+// logFile is the append-only file of the records
+type logFile struct {
+	f    *os.File
+	size int64
+	sync bool
+}
+
+// openLog opens the log file at path, creating it when missing
+func openLog(path string, sync bool) (*logFile, error) {
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	l := &logFile{f: f, size: fi.Size(), sync: sync}
+	if l.size == 0 {
+		if err := l.writeHeader(); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return l, nil
+	}
+
+	header := make([]byte, headerSize)
+	if _, err := f.ReadAt(header, 0); err != nil || string(header[:len(logMagic)]) != logMagic {
+		f.Close()
+		return nil, fmt.Errorf("%s is not a session log file", path)
+	}
+	if header[len(logMagic)] != logVersion {
+		f.Close()
+		return nil, fmt.Errorf("unsupported session log version %d", header[len(logMagic)])
+	}
+	return l, nil
+}
+
+// writeHeader writes the header of an empty log file
+func (l *logFile) writeHeader() error {
+
+	if _, err := l.f.WriteAt(append([]byte(logMagic), logVersion), 0); err != nil {
+		return err
+	}
+	l.size = headerSize
+	if l.sync {
+		return l.f.Sync()
+	}
+	return nil
+}
+
+// append writes the entry at the end of the log and returns its offset and length
+func (l *logFile) append(e logEntry) (int64, int64, error) {
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to encode the record: %v", err)
+	}
+
+	rec := make([]byte, frameSize+len(payload))
+	binary.BigEndian.PutUint32(rec[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.Checksum(payload, crcTable))
+	copy(rec[frameSize:], payload)
+
+	off := l.size
+	if _, err := l.f.WriteAt(rec, off); err != nil {
+		return 0, 0, err
+	}
+	l.size += int64(len(rec))
+	if l.sync {
+		if err := l.f.Sync(); err != nil {
+			return 0, 0, err
+		}
+	}
+	return off, int64(len(rec)), nil
+}
+
+// read returns the entry of the record at the offset and length returned by append
+func (l *logFile) read(off, n int64) (logEntry, error) {
+
+	rec := make([]byte, n)
+	if _, err := l.f.ReadAt(rec, off); err != nil {
+		return logEntry{}, err
+	}
+	return decodeRecord(rec)
+}
+
+// replay calls fn with every record of the log, in the order they were written. A record torn or
+// corrupted by a crash ends the log: it is truncated there and the number of bytes dropped is returned.
+func (l *logFile) replay(fn func(e logEntry, off, n int64)) (int64, error) {
+
+	r := bufio.NewReader(io.NewSectionReader(l.f, headerSize, l.size-headerSize))
+	off := headerSize
+	frame := make([]byte, frameSize)
+	for {
+		if _, err := io.ReadFull(r, frame); err != nil {
+			if err == io.EOF {
+				return 0, nil
+			}
+			break
+		}
+		size := binary.BigEndian.Uint32(frame[0:4])
+		if size > maxRecord {
+			break
+		}
+		rec := make([]byte, frameSize+int(size))
+		copy(rec, frame)
+		if _, err := io.ReadFull(r, rec[frameSize:]); err != nil {
+			break
+		}
+		e, err := decodeRecord(rec)
+		if err != nil {
+			break
+		}
+		fn(e, off, int64(len(rec)))
+		off += int64(len(rec))
+	}
+
+	dropped := l.size - off
+	if err := l.f.Truncate(off); err != nil {
+		return 0, err
+	}
+	l.size = off
+	return dropped, nil
+}
+
+// close closes the file of the log
+func (l *logFile) close() error {
+	return l.f.Close()
+}
+
+// decodeRecord checks the framing and the checksum of the record and decodes its entry
+func decodeRecord(rec []byte) (logEntry, error) {
+
+	if len(rec) < frameSize || int(binary.BigEndian.Uint32(rec[0:4])) != len(rec)-frameSize {
+		return logEntry{}, errCorrupted
+	}
+	payload := rec[frameSize:]
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(rec[4:8]) {
+		return logEntry{}, errCorrupted
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	var e logEntry
+	if err := dec.Decode(&e); err != nil {
+		return logEntry{}, fmt.Errorf("unable to decode the record: %v", err)
+	}
+	for k, v := range e.Values {
+		e.Values[k] = provutil.NormalizeNumbers(v)
+	}
+	e.Details = provutil.NormalizeNumbers(e.Details)
+	return e, nil
+}
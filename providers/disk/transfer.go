@@ -0,0 +1,154 @@
+package disk
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/dasiyes/ivmsesman"
+)
+
+// ExportSessions calls fn with every live session whose id is greater than after, in the order of the ids.
+// The sessions are read one at a time, fn runs without holding the lock.
+func (pder *SessionProvider) ExportSessions(ctx context.Context, after string, fn func(ivmsesman.SessionRecord) error) error {
+
+	pder.mu.Lock()
+	now := time.Now().Unix()
+	p := pder.policy()
+	ids := make([]string, 0, len(pder.sessions))
+	for sid, element := range pder.sessions {
+		k := element.Value.(*keyEntry)
+		if sid > after && !p.Expired(k.createdAt, k.timeAccessed, now) {
+			ids = append(ids, sid)
+		}
+	}
+	pder.mu.Unlock()
+	sort.Strings(ids)
+
+	for _, sid := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rec, ok, err := pder.record(sid)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// record reads the live session
+func (pder *SessionProvider) record(sid string) (ivmsesman.SessionRecord, bool, error) {
+
+	pder.mu.Lock()
+	defer pder.mu.Unlock()
+
+	k, ok := pder.lookup(sid)
+	if !ok {
+		return ivmsesman.SessionRecord{}, false, nil
+	}
+	ss, err := pder.load(k)
+	if err != nil {
+		return ivmsesman.SessionRecord{}, false, fmt.Errorf("err while read session id: %v, err: %v", sid, err)
+	}
+	return ivmsesman.SessionRecord{ID: sid, CreatedAt: k.createdAt, TimeAccessed: k.timeAccessed, Values: ss.Value}, true, nil
+}
+
+// ExportBlacklist calls fn with every blacklisted ip
+func (pder *SessionProvider) ExportBlacklist(ctx context.Context, fn func(ivmsesman.BlacklistRecord) error) error {
+
+	pder.mu.Lock()
+	entries := make([]ivmsesman.BlacklistRecord, 0, len(pder.blacklist))
+	for ip, b := range pder.blacklist {
+		entries = append(entries, ivmsesman.BlacklistRecord{IP: ip, Created: b.created, RequestURI: b.requestURI, Details: b.details})
+	}
+	pder.mu.Unlock()
+
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportSessions appends the sessions, replacing the ones with the same id, and indexes them at their place
+// by the last time accessed. The sessions expired already are left out.
+func (pder *SessionProvider) ImportSessions(ctx context.Context, sessions []ivmsesman.SessionRecord) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// the most recently accessed first, so the list is walked once from the front
+	recs := make([]ivmsesman.SessionRecord, len(sessions))
+	copy(recs, sessions)
+	sort.SliceStable(recs, func(i, j int) bool { return recs[i].TimeAccessed > recs[j].TimeAccessed })
+
+	pder.mu.Lock()
+	defer pder.mu.Unlock()
+
+	now := time.Now().Unix()
+	p := pder.policy()
+	var prev *list.Element
+	for _, r := range recs {
+		if p.Expired(r.CreatedAt, r.TimeAccessed, now) {
+			continue
+		}
+		if err := pder.put(r.ID, r.CreatedAt, r.TimeAccessed, r.Values); err != nil {
+			return fmt.Errorf("err while importing session id %v, err: %v", r.ID, err)
+		}
+
+		// put indexes the session as the most recently accessed
+		imported := pder.sessions[r.ID]
+		element := pder.list.Front()
+		if prev != nil {
+			element = prev
+		}
+		for element != nil && (element == imported || element.Value.(*keyEntry).timeAccessed > r.TimeAccessed) {
+			element = element.Next()
+		}
+		if element == nil {
+			pder.list.MoveToBack(imported)
+		} else {
+			pder.list.MoveBefore(imported, element)
+		}
+		prev = imported
+	}
+	return nil
+}
+
+// ImportBlacklist appends the blacklisted ips, replacing the ones already in the blacklist
+func (pder *SessionProvider) ImportBlacklist(ctx context.Context, entries []ivmsesman.BlacklistRecord) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	pder.mu.Lock()
+	defer pder.mu.Unlock()
+
+	for _, e := range entries {
+		_, n, err := pder.file.append(logEntry{Kind: kindBlacklist, ID: e.IP, CreatedAt: e.Created, RequestURI: e.RequestURI, Details: e.Details})
+		if err != nil {
+			return fmt.Errorf("err while importing the blacklisted ip %v, err: %v", e.IP, err)
+		}
+		if b, ok := pder.blacklist[e.IP]; ok {
+			pder.live -= b.n
+		}
+		pder.blacklist[e.IP] = &blacklistEntry{created: e.Created, requestURI: e.RequestURI, details: e.Details, n: n}
+		pder.live += n
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package disk
+
+import (
+	"os"
+	"sort"
+)
+
+// sortByAccess orders the entries by the last time accessed, the least recent first
+func sortByAccess(entries []*keyEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].timeAccessed < entries[j].timeAccessed
+	})
+}
+
+// stateOf returns the state and the uid of the session values
+func stateOf(values map[string]interface{}) (string, string) {
+	state, _ := values["state"].(string)
+	uid, _ := values["uid"].(string)
+	return state, uid
+}
+
+// syncDir syncs the directory, making a rename in it durable. The errors are ignored - not every
+// platform supports syncing a directory.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	d.Close()
+}
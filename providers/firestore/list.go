@@ -0,0 +1,110 @@
+package firestoredb
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+
+	"github.com/dasiyes/ivmsesman"
+)
+
+// List returns up to limit live sessions selected by the filter with a single query. The state and the user
+// id are equality filters on the session values. With a last access range, or an idle timeout, the sessions
+// are ordered by the last access time and the document id, which needs a composite index for the state or
+// the user id filter; otherwise they are ordered by the document id. The cursor holds the last document of
+// the previous page. The sessions past the absolute timeout are left out of the page.
+func (pder *SessionProvider) List(ctx context.Context, filter ivmsesman.SessionFilter, cursor string, limit int) ([]ivmsesman.SessionRecord, string, error) {
+
+	if limit <= 0 {
+		limit = ivmsesman.DefaultListLimit
+	}
+
+	q := pder.client.Collection(pder.collection).Query
+	if filter.State != "" {
+		q = q.Where("Value.state", "==", filter.State)
+	}
+	if filter.UserID != "" {
+		q = q.Where("Value.uid", "==", filter.UserID)
+	}
+
+	var from int64
+	if pder.policy.Idle > 0 {
+		from = time.Now().Unix() - pder.policy.Idle
+	}
+	if filter.AccessedAfter > from {
+		from = filter.AccessedAfter
+	}
+	byAccess := from > 0 || filter.AccessedBefore > 0
+	if from > 0 {
+		q = q.Where("TimeAccessed", ">=", from)
+	}
+	if filter.AccessedBefore > 0 {
+		q = q.Where("TimeAccessed", "<", filter.AccessedBefore)
+	}
+
+	if byAccess {
+		q = q.OrderBy("TimeAccessed", firestore.Asc).OrderBy(firestore.DocumentID, firestore.Asc)
+		if cursor != "" {
+			accessed, sid, err := parseCursor(cursor)
+			if err != nil {
+				return nil, "", err
+			}
+			q = q.StartAfter(accessed, sid)
+		}
+	} else {
+		q = q.OrderBy(firestore.DocumentID, firestore.Asc)
+		if cursor != "" {
+			q = q.StartAfter(cursor)
+		}
+	}
+
+	// one more document tells if there is a next page
+	iter := q.Limit(limit + 1).Documents(ctx)
+	defer iter.Stop()
+
+	sessions := make([]ivmsesman.SessionRecord, 0, limit)
+	for n := 0; ; n++ {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			return sessions, "", nil
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("err while listing the sessions, err: %v", err)
+		}
+
+		if n == limit {
+			return sessions, cursor, nil
+		}
+
+		var ss Session
+		if err := doc.DataTo(&ss); err != nil {
+			return nil, "", fmt.Errorf("error while converting firstore doc %v to session object: %v", doc.Ref.ID, err)
+		}
+		if byAccess {
+			cursor = strconv.FormatInt(ss.TimeAccessed, 10) + "/" + doc.Ref.ID
+		} else {
+			cursor = doc.Ref.ID
+		}
+		if pder.expired(&ss) {
+			continue
+		}
+		sessions = append(sessions, ivmsesman.SessionRecord{ID: doc.Ref.ID, CreatedAt: ss.CreatedAt, TimeAccessed: ss.TimeAccessed, Values: ss.Value})
+	}
+}
+
+// parseCursor returns the last access time and the document id of a cursor ordered by the last access
+func parseCursor(cursor string) (int64, string, error) {
+
+	accessed, sid, ok := strings.Cut(cursor, "/")
+	if ok {
+		if t, err := strconv.ParseInt(accessed, 10, 64); err == nil {
+			return t, sid, nil
+		}
+	}
+	return 0, "", fmt.Errorf("invalid sessions cursor %q", cursor)
+}
@@ -1,9 +1,14 @@
+// Package firestoredb implements the session store provider on top of the GCP Firestore native mode.
+//
+// Use New with an existing firestore client to create the provider for ivmsesman.NewSesmanWithRepository,
+// or RegisterFromEnv to register it for ivmsesman.NewSesman(ivmsesman.Firestore, cfg).
 package firestoredb
 
 import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"strings"
 	"time"
@@ -12,83 +17,203 @@ import (
 	"google.golang.org/api/iterator"
 
 	"github.com/dasiyes/ivmsesman"
+	"github.com/dasiyes/ivmsesman/internal/provutil"
 )
 
-// TODO [dev]: move the value of `sessions` and `blacklist` in the configuration
-var pder = &SessionProvider{collection: "sessions", blacklist: "blacklist"}
+// Options configures the Firestore session provider
+type Options struct {
+	// Collection is the name of the sessions collection. Default "sessions"
+	Collection string
+	// Blacklist is the name of the blacklist collection. Default "blacklist"
+	Blacklist string
+}
 
 // SessionProvider is the DAL holding the methods for database operations fr the SessionManager
 type SessionProvider struct {
+	// Background runs the operations without a context
+	ivmsesman.Background
+
 	client     *firestore.Client
 	collection string
 	// the name of the collection for the blacklist
 	blacklist string
+	policy    ivmsesman.ExpiryPolicy
+	log       *slog.Logger
+	onExpired func(ctx context.Context, sid string)
+}
+
+// New creates a Firestore session provider using the client. The client is owned by the caller.
+func New(client *firestore.Client, opts Options) (*SessionProvider, error) {
+
+	if client == nil {
+		return nil, errors.New("firestore session provider needs not-nil client")
+	}
+	if opts.Collection == "" {
+		opts.Collection = "sessions"
+	}
+	if opts.Blacklist == "" {
+		opts.Blacklist = "blacklist"
+	}
+	pder := &SessionProvider{client: client, collection: opts.Collection, blacklist: opts.Blacklist}
+	pder.Background = ivmsesman.Background{Repo: pder}
+	return pder, nil
+}
+
+// SetLogger sets the logger of the provider events
+func (pder *SessionProvider) SetLogger(l *slog.Logger) {
+	pder.log = l
 }
 
-// FindOrCreate will first search the store for a session value with provided sid. If not not found, a new session value will be created and stored in the session store
-func (pder *SessionProvider) FindOrCreate(sid string) (ivmsesman.SessionStore, error) {
+// logger returns the logger set or the slog default one
+func (pder *SessionProvider) logger() *slog.Logger {
+	if pder.log != nil {
+		return pder.log
+	}
+	return slog.Default()
+}
+
+// SetExpiryPolicy sets the timeouts checked when a session is read. It is not safe to call it while the provider is in use.
+func (pder *SessionProvider) SetExpiryPolicy(p ivmsesman.ExpiryPolicy) {
+	pder.policy = p
+}
+
+// SetExpiryListener sets the func called with the id of every session removed as expired. It is not safe to
+// call it while the provider is in use.
+func (pder *SessionProvider) SetExpiryListener(fn func(ctx context.Context, sid string)) {
+	pder.onExpired = fn
+}
+
+// reportExpired calls the expiry listener, if set
+func (pder *SessionProvider) reportExpired(ctx context.Context, sid string) {
+	if pder.onExpired != nil {
+		pder.onExpired(ctx, sid)
+	}
+}
+
+// expired reports if the session passed the timeouts of the expiry policy
+func (pder *SessionProvider) expired(ss *Session) bool {
+	return pder.policy.Expired(ss.CreatedAt, ss.TimeAccessed, time.Now().Unix())
+}
+
+// touchDue reports if the last access time of a session accessed at the unix time is to be rewritten
+func (pder *SessionProvider) touchDue(accessedAt, now int64) bool {
+	return pder.policy.TouchDue(accessedAt, now)
+}
+
+// FindOrCreateContext will first search the store for a session value with provided sid. If not not found, a new session value will be created and stored in the session store
+func (pder *SessionProvider) FindOrCreateContext(ctx context.Context, sid string) (ivmsesman.SessionStore, error) {
+
+	ss, err := pder.FindContext(ctx, sid)
+	if err == ivmsesman.ErrInvalidSessionID {
+		pder.logger().DebugContext(ctx, "session not found in the session store, a new session will be created",
+			slog.Any("sid", ivmsesman.Sensitive(sid)))
+		return pder.NewSessionContext(ctx, sid)
+	}
+	return ss, err
+}
+
+// FindContext returns the session sid without creating it, ivmsesman.ErrInvalidSessionID when the store does not
+// hold it. An expired session is removed and reported.
+func (pder *SessionProvider) FindContext(ctx context.Context, sid string) (ivmsesman.SessionStore, error) {
 
 	var ss Session = Session{}
 
-	docses, err := pder.client.Collection(pder.collection).Doc(sid).Get(context.TODO())
+	docses, err := pder.client.Collection(pder.collection).Doc(sid).Get(ctx)
 	if err != nil {
 		if strings.Contains(err.Error(), "Missing or insufficient permissions") {
 			return nil, errors.New("insufficient permissions to read data from the session store")
-		} else {
-			if docses == nil {
-				fmt.Printf("sid: %v was not found in the session store. A new session will be created. Error: %v\n", sid, err)
-				return pder.NewSession(sid)
-			}
-			if strings.Contains(err.Error(), "NotFound") {
-				// Recreate the session with the old sid
-				nss, err := pder.NewSession(sid)
-				if err != nil {
-					return nil, fmt.Errorf("err re-create session id: %v, err: %v", sid, err)
-				}
-				return nss, nil
-
-			} else {
-				return nil, fmt.Errorf("err while read session id: %v, err: %v", sid, err)
-			}
 		}
+		if docses == nil || strings.Contains(err.Error(), "NotFound") {
+			return nil, ivmsesman.ErrInvalidSessionID
+		}
+		return nil, fmt.Errorf("err while read session id: %v, err: %v", sid, err)
 	}
 
 	err = docses.DataTo(&ss)
 	if err != nil {
 		return nil, fmt.Errorf("error while converting firstore doc to session object: %v", err)
 	}
+	if pder.expired(&ss) {
+		if err := pder.DestroySIDContext(ctx, sid); err != nil {
+			return nil, fmt.Errorf("err while removing the expired session id: %v, err: %v", sid, err)
+		}
+		pder.reportExpired(ctx, sid)
+		return nil, ivmsesman.ErrInvalidSessionID
+	}
+	return ss.bind(pder), nil
+}
+
+// RegenerateContext moves the session document of oldsid to the new document newsid in a transaction
+func (pder *SessionProvider) RegenerateContext(ctx context.Context, oldsid, newsid string) (ivmsesman.SessionStore, error) {
 
-	return &ss, nil
+	var ss Session
+	col := pder.client.Collection(pder.collection)
+
+	err := pder.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(col.Doc(oldsid))
+		if err != nil {
+			return err
+		}
+		ss = Session{}
+		if err = doc.DataTo(&ss); err != nil {
+			return err
+		}
+		ss.Sid = newsid
+		ss.TimeAccessed = time.Now().Unix()
+		if err = tx.Create(col.Doc(newsid), &ss); err != nil {
+			return err
+		}
+		return tx.Delete(col.Doc(oldsid))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("err while regenerating session id %v, err: %v", oldsid, err)
+	}
+	return ss.bind(pder), nil
 }
 
-// Destroy will remove a session data from the storage
-func (pder *SessionProvider) DestroySID(sid string) error {
+// DestroySIDContext will remove a session data from the storage
+func (pder *SessionProvider) DestroySIDContext(ctx context.Context, sid string) error {
 
-	_, err := pder.client.Collection(pder.collection).Doc(sid).Delete(context.TODO())
+	_, err := pder.client.Collection(pder.collection).Doc(sid).Delete(ctx)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// SessionGC cleans all expired sessions
-func (pder *SessionProvider) SessionGC(maxlifetime int64) {
+// SessionGCContext cleans all expired sessions
+func (pder *SessionProvider) SessionGCContext(ctx context.Context, maxlifetime int64) {
 
 	if maxlifetime == 0 {
 		maxlifetime = 3600
 	}
-	docs, err := pder.client.Collection(pder.collection).Where("TimeAccessed", "<", (time.Now().Unix() - maxlifetime)).Documents(context.TODO()).GetAll()
+	docs, err := pder.client.Collection(pder.collection).Where("TimeAccessed", "<", (time.Now().Unix() - maxlifetime)).Documents(ctx).GetAll()
 
 	if err != nil {
-		fmt.Printf("error raised while iterate over set of expired sessions: %s", err)
+		pder.logger().ErrorContext(ctx, "error reading the expired sessions", slog.Any("error", err))
 		return
 	}
 
+	if pder.policy.Absolute > 0 {
+		abs, err := pder.client.Collection(pder.collection).Where("CreatedAt", "<", (time.Now().Unix() - pder.policy.Absolute)).Documents(ctx).GetAll()
+		if err != nil {
+			pder.logger().ErrorContext(ctx, "error reading the sessions past the absolute timeout", slog.Any("error", err))
+		}
+		docs = append(docs, abs...)
+	}
+
+	deleted := make(map[string]bool, len(docs))
 	for _, doc := range docs {
-		_, err = doc.Ref.Delete(context.TODO())
+		if deleted[doc.Ref.ID] {
+			continue
+		}
+		_, err = doc.Ref.Delete(ctx)
 		if err != nil {
-			fmt.Printf("error deleting session id %s, err: %s", doc.Ref.ID, err)
+			pder.logger().ErrorContext(ctx, "error deleting expired session", slog.Any("sid", ivmsesman.Sensitive(doc.Ref.ID)), slog.Any("error", err))
+			continue
 		}
+		deleted[doc.Ref.ID] = true
+		pder.reportExpired(ctx, doc.Ref.ID)
 	}
 
 	// DEPRICATED
@@ -102,7 +227,7 @@ func (pder *SessionProvider) SessionGC(maxlifetime int64) {
 	// 		erritr = fmt.Errorf("Error raised while iterate expired sessions: %w", err)
 	// 		break
 	// 	}
-	// 	_, err = doc.Ref.Delete(context.TODO())
+	// 	_, err = doc.Ref.Delete(ctx)
 	// 	if err != nil {
 	// 		erritr = fmt.Errorf("error deleting session id %s, err: %w", doc.Ref.ID, err)
 	// 	}
@@ -112,20 +237,20 @@ func (pder *SessionProvider) SessionGC(maxlifetime int64) {
 	// }
 }
 
-// BLClean - cleaning the Firestore blacklist
-func (pder *SessionProvider) BLClean() {
+// BLCleanContext - cleaning the Firestore blacklist
+func (pder *SessionProvider) BLCleanContext(ctx context.Context) {
 	docs_cnt := 0
 	del_docs_cnt := 0
 
 	// TODO: move the value of `cp` in the configuration
 	// set default value for ip caranteen period to 30 days
 	// cp := int64(2590000)
-	cp := int64(259200) // 3 days
+	cp := provutil.BLQuarantine // 3 days
 
 	// treshold value back in the time (default 30 days) after which the blacklisted ip address will be reviewed for cleaning
 	to := time.Now().Unix() - cp
 
-	iter := pder.client.Collection(pder.blacklist).Where("created", "<", time.Unix(to, 0)).Documents(context.TODO())
+	iter := pder.client.Collection(pder.blacklist).Where("created", "<", time.Unix(to, 0)).Documents(ctx)
 	for {
 
 		d, err := iter.Next()
@@ -133,27 +258,27 @@ func (pder *SessionProvider) BLClean() {
 			break
 		}
 		if err != nil {
-			fmt.Printf("ip address %s, raised an error: %s\n", d.Ref.ID, err)
+			pder.logger().ErrorContext(ctx, "error reading the blacklist", slog.Any("error", err))
 			continue
 		}
 
 		// send the IP address for verification for being good bot
-		if nativeReverseDNSLookup(d.Ref.ID) {
-			_, err = d.Ref.Delete(context.TODO())
+		if provutil.NativeReverseDNSLookup(d.Ref.ID) {
+			_, err = d.Ref.Delete(ctx)
 			if err != nil {
-				fmt.Printf("while deleting ip %s, an error raised: %v\n", d.Ref.ID, err)
+				pder.logger().ErrorContext(ctx, "error deleting ip from the blacklist", slog.String("ip", d.Ref.ID), slog.Any("error", err))
 				continue
 			}
 			del_docs_cnt++
 		}
 		docs_cnt++
 	}
-	fmt.Printf(" * blacklist clean summary: %d docs reviewed, %d deleted\n", docs_cnt, del_docs_cnt)
+	pder.logger().InfoContext(ctx, "blacklist clean summary", slog.Int("reviewed", docs_cnt), slog.Int("deleted", del_docs_cnt))
 }
 
-// UpdateTimeAccessed will update the time accessed value with now()
-func (pder *SessionProvider) UpdateTimeAccessed(sid string) error {
-	_, err := pder.client.Collection(pder.collection).Doc(sid).Update(context.TODO(),
+// UpdateTimeAccessedContext will update the time accessed value with now()
+func (pder *SessionProvider) UpdateTimeAccessedContext(ctx context.Context, sid string) error {
+	_, err := pder.client.Collection(pder.collection).Doc(sid).Update(ctx,
 		[]firestore.Update{
 			{
 				Path:  "TimeAccessed",
@@ -166,9 +291,25 @@ func (pder *SessionProvider) UpdateTimeAccessed(sid string) error {
 	return nil
 }
 
-// UpdateSessionState will update the state value with one provided
-func (pder *SessionProvider) UpdateSessionState(sid string, state string) error {
-	_, err := pder.client.Collection(pder.collection).Doc(sid).Update(context.TODO(),
+// updateValues writes the session values (firestore.Delete removes a value) and refreshes the time accessed
+// in a single update of an existing session
+func (pder *SessionProvider) updateValues(ctx context.Context, sid string, values map[string]interface{}) error {
+
+	updates := []firestore.Update{{Path: "TimeAccessed", Value: time.Now().Unix()}}
+	for k, v := range values {
+		updates = append(updates, firestore.Update{FieldPath: firestore.FieldPath{"Value", k}, Value: v})
+	}
+
+	_, err := pder.client.Collection(pder.collection).Doc(sid).Update(ctx, updates)
+	if err != nil {
+		return fmt.Errorf("err while updating the values of sessions id %v, err: %v", sid, err)
+	}
+	return nil
+}
+
+// UpdateSessionStateContext will update the state value with one provided
+func (pder *SessionProvider) UpdateSessionStateContext(ctx context.Context, sid string, state string) error {
+	_, err := pder.client.Collection(pder.collection).Doc(sid).Update(ctx,
 		[]firestore.Update{
 			{
 				Path:  "Value.state",
@@ -181,9 +322,9 @@ func (pder *SessionProvider) UpdateSessionState(sid string, state string) error
 	return nil
 }
 
-// UpdateCodeVerifier will update the code verifier (cove) value assigned to the session id
-func (pder *SessionProvider) UpdateCodeVerifier(sid, cove string) error {
-	_, err := pder.client.Collection(pder.collection).Doc(sid).Update(context.TODO(),
+// UpdateCodeVerifierContext will update the code verifier (cove) value assigned to the session id
+func (pder *SessionProvider) UpdateCodeVerifierContext(ctx context.Context, sid, cove string) error {
+	_, err := pder.client.Collection(pder.collection).Doc(sid).Update(ctx,
 		[]firestore.Update{
 			{
 				Path:  "Value.code_verifier",
@@ -196,14 +337,14 @@ func (pder *SessionProvider) UpdateCodeVerifier(sid, cove string) error {
 	return nil
 }
 
-// SaveCodeChallengeAndMethod - at step2 of AuthorizationCode flow
-func (pder *SessionProvider) SaveCodeChallengeAndMethod(
-	sid, coch, mth, code, ru string) error {
+// SaveCodeChallengeAndMethodContext - at step2 of AuthorizationCode flow
+func (pder *SessionProvider) SaveCodeChallengeAndMethodContext(
+	ctx context.Context, sid, coch, mth, code, ru string) error {
 
 	// set code expiration timestamp
 	ce := time.Now().Unix() + 60
 
-	_, err := pder.client.Collection(pder.collection).Doc(sid).Update(context.TODO(),
+	_, err := pder.client.Collection(pder.collection).Doc(sid).Update(ctx,
 		[]firestore.Update{
 			{
 				Path:  "Value.code_challenger",
@@ -236,20 +377,20 @@ func (pder *SessionProvider) SaveCodeChallengeAndMethod(
 	return nil
 }
 
-// GetAuthCode will return the authorization code for a session, if it is InAuth
-func (pder *SessionProvider) GetAuthCode(sid string) map[string]string {
+// GetAuthCodeContext will return the authorization code for a session, if it is InAuth
+func (pder *SessionProvider) GetAuthCodeContext(ctx context.Context, sid string) map[string]string {
 
 	now := time.Now().Unix()
 	var ac map[string]string = map[string]string{}
 
-	docses, err := pder.client.Collection(pder.collection).Doc(sid).Get(context.TODO())
+	docses, err := pder.client.Collection(pder.collection).Doc(sid).Get(ctx)
 	if err != nil || docses == nil {
 		return ac
 	}
 
 	var ss Session = Session{}
 	err = docses.DataTo(&ss)
-	if err != nil {
+	if err != nil || pder.expired(&ss) {
 		return ac
 	}
 	var value = ss.Value
@@ -262,13 +403,13 @@ func (pder *SessionProvider) GetAuthCode(sid string) map[string]string {
 	return ac
 }
 
-// ActiveSessions returns the number of currently active sessions in the session store
-func (pder *SessionProvider) ActiveSessions() int {
+// ActiveSessionsContext returns the number of currently active sessions in the session store
+func (pder *SessionProvider) ActiveSessionsContext(ctx context.Context) int {
 
 	var errcnt, cnt = 0, 0
 	var erritr error
 
-	iter := pder.client.Collection(pder.collection).Documents(context.TODO())
+	iter := pder.client.Collection(pder.collection).Documents(ctx)
 
 	for {
 		d, err := iter.Next()
@@ -282,27 +423,33 @@ func (pder *SessionProvider) ActiveSessions() int {
 		cnt++
 	}
 	if erritr != nil {
-		fmt.Printf("%d errors while counting %d active sessions, error stack: %v", errcnt, cnt, erritr)
+		pder.logger().ErrorContext(ctx, "errors while counting the active sessions",
+			slog.Int("errors", errcnt), slog.Int("count", cnt), slog.Any("error", erritr))
 	}
 	return cnt
 }
 
-// Exists check by sid if a session data exists in the session store
-func (pder *SessionProvider) Exists(sid string) bool {
+// ExistsContext check by sid if a session data exists in the session store
+func (pder *SessionProvider) ExistsContext(ctx context.Context, sid string) bool {
 
-	docses, err := pder.client.Collection(pder.collection).Doc(sid).Get(context.TODO())
+	docses, err := pder.client.Collection(pder.collection).Doc(sid).Get(ctx)
 	if err != nil || docses == nil {
 		return false
 	}
-	return true
+
+	var ss Session
+	if err = docses.DataTo(&ss); err != nil {
+		return false
+	}
+	return !pder.expired(&ss)
 }
 
-// Flush will delete all elements for sessions data
-func (pder *SessionProvider) Flush() error {
+// FlushContext will delete all elements for sessions data
+func (pder *SessionProvider) FlushContext(ctx context.Context) error {
 
 	var erritr error
 
-	iter := pder.client.Collection(pder.collection).Documents(context.TODO())
+	iter := pder.client.Collection(pder.collection).Documents(ctx)
 
 	for {
 		docses, err := iter.Next()
@@ -312,7 +459,7 @@ func (pder *SessionProvider) Flush() error {
 		if err != nil {
 			erritr = fmt.Errorf("error flushing sessions id: %v, err: %v", docses.Ref.ID, err)
 		}
-		_, err = docses.Ref.Delete(context.TODO())
+		_, err = docses.Ref.Delete(ctx)
 		if err != nil {
 			erritr = fmt.Errorf("while flushing sessions - delete session id: %v, err: %v", docses.Ref.ID, err)
 		}
@@ -320,10 +467,10 @@ func (pder *SessionProvider) Flush() error {
 	return erritr
 }
 
-// UpdateAuthSession - update state, access and refresh tokens values for auth session
-func (pder *SessionProvider) UpdateAuthSession(sid, at, rt, uid string) error {
+// UpdateAuthSessionContext - update state, access and refresh tokens values for auth session
+func (pder *SessionProvider) UpdateAuthSessionContext(ctx context.Context, sid, at, rt, uid string) error {
 
-	_, err := pder.client.Collection(pder.collection).Doc(sid).Update(context.TODO(),
+	_, err := pder.client.Collection(pder.collection).Doc(sid).Update(ctx,
 		[]firestore.Update{
 			{
 				Path:  "Value.at",
@@ -348,74 +495,67 @@ func (pder *SessionProvider) UpdateAuthSession(sid, at, rt, uid string) error {
 	return nil
 }
 
-// NewSession creates a new session value in the store with sid as a key
-func (pder *SessionProvider) NewSession(sid string) (ivmsesman.SessionStore, error) {
+// NewSessionContext creates a new session value in the store with sid as a key
+func (pder *SessionProvider) NewSessionContext(ctx context.Context, sid string) (ivmsesman.SessionStore, error) {
 
 	v := make(map[string]interface{})
 	v["state"] = "New"
 
-	newsess := Session{Sid: sid, TimeAccessed: time.Now().Unix(), Value: v}
+	now := time.Now().Unix()
+	newsess := &Session{Sid: sid, CreatedAt: now, TimeAccessed: now, Value: v}
 
-	_, err := pder.client.Collection(pder.collection).Doc(sid).Set(context.TODO(), newsess)
+	_, err := pder.client.Collection(pder.collection).Doc(sid).Set(ctx, newsess)
 	if err != nil {
 		return nil, fmt.Errorf("unable to save in session repository - error: %v", err)
 	}
 
-	return &newsess, nil
+	return newsess.bind(pder), nil
 }
 
-// Blacklisting adds the @ip to the blacklist with the @path and @data
-func (pder *SessionProvider) Blacklisting(ip, path string, data interface{}) {
+// BlacklistingContext adds the @ip to the blacklist with the @path and @data
+func (pder *SessionProvider) BlacklistingContext(ctx context.Context, ip, path string, data interface{}) {
 
 	v := make(map[string]interface{})
 	v["created"] = time.Now()
 	v["requestURI"] = path
 	v["details"] = data
 
-	_, err := pder.client.Collection(pder.blacklist).Doc(ip).Set(context.TODO(), v, firestore.MergeAll)
+	_, err := pder.client.Collection(pder.blacklist).Doc(ip).Set(ctx, v, firestore.MergeAll)
 	if err != nil {
-		fmt.Printf("error update ip %s in the blacklist\n", ip)
+		pder.logger().ErrorContext(ctx, "error adding ip in the blacklist", slog.String("ip", ip), slog.Any("error", err))
 		return
 	}
-	fmt.Printf("ip %s added in the blacklist\n", ip)
+	pder.logger().InfoContext(ctx, "ip added in the blacklist", slog.String("ip", ip), slog.String("path", path))
 }
 
-// IsIPExistInBL returns boolean result for the @ip being or not in the blacklist
-func (pder *SessionProvider) IsIPExistInBL(ip string) bool {
+// IsIPExistInBLContext returns boolean result for the @ip being or not in the blacklist
+func (pder *SessionProvider) IsIPExistInBLContext(ctx context.Context, ip string) bool {
 
-	_, err := pder.client.Collection(pder.blacklist).Doc(ip).Get(context.TODO())
+	_, err := pder.client.Collection(pder.blacklist).Doc(ip).Get(ctx)
 	return err == nil
 }
 
-// init - Initiates at run-time the following code
-func init() {
-	// Initialize the GCP project to be used
+// RegisterFromEnv creates the firestore client and registers the provider for ivmsesman.NewSesman.
+// The GCP project is read from the env variable FIRESTORE_PROJECT_ID and the collection names
+// from SESSION_COLLECTION_NAME and BLACKLIST_COLLECTION_NAME.
+func RegisterFromEnv(ctx context.Context) error {
+
 	projectID := os.Getenv("FIRESTORE_PROJECT_ID")
-	scn := os.Getenv("SESSION_COLLECTION_NAME")
-	blkl := os.Getenv("BLACKLIST_COLLECTION_NAME")
-	fslemh := os.Getenv("FIRESTORE_EMULATOR_HOST")
 
-	client, err := firestore.NewClient(context.TODO(), projectID)
+	client, err := firestore.NewClient(ctx, projectID)
 	if err != nil {
-		fmt.Printf("Error while creating firestore client: %v", err.Error())
-		if projectID == "" && fslemh != "" {
-			fmt.Printf("FATAL: firestore client init error %v", err.Error())
-			os.Exit(1)
-		}
+		return fmt.Errorf("error while creating firestore client: %v", err)
 	}
 
-	pder.client = client
-	if scn != "" {
-		pder.collection = scn
-	}
-	if blkl != "" {
-		pder.blacklist = blkl
+	pder, err := New(client, Options{
+		Collection: os.Getenv("SESSION_COLLECTION_NAME"),
+		Blacklist:  os.Getenv("BLACKLIST_COLLECTION_NAME"),
+	})
+	if err != nil {
+		return err
 	}
 
-	// initiates the required collections in the firestore with dummy data
-	pder.NewSession("init session")
-	pder.Blacklisting("0.0.0.0", "/", "init blacklist")
-
 	// Register the provider
 	ivmsesman.RegisterProvider(ivmsesman.Firestore, pder)
+	return nil
 }
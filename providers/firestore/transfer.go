@@ -0,0 +1,128 @@
+package firestoredb
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+
+	"github.com/dasiyes/ivmsesman"
+)
+
+// ExportSessions calls fn with every live session whose id is greater than after, in the order of the
+// document ids. The documents are streamed by a query on the sessions collection.
+func (pder *SessionProvider) ExportSessions(ctx context.Context, after string, fn func(ivmsesman.SessionRecord) error) error {
+
+	q := pder.client.Collection(pder.collection).OrderBy(firestore.DocumentID, firestore.Asc)
+	if after != "" {
+		q = q.StartAfter(after)
+	}
+
+	iter := q.Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("err while reading the sessions, err: %v", err)
+		}
+
+		var ss Session
+		if err := doc.DataTo(&ss); err != nil {
+			return fmt.Errorf("error while converting firstore doc %v to session object: %v", doc.Ref.ID, err)
+		}
+		if pder.expired(&ss) {
+			continue
+		}
+		rec := ivmsesman.SessionRecord{ID: doc.Ref.ID, CreatedAt: ss.CreatedAt, TimeAccessed: ss.TimeAccessed, Values: ss.Value}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// ExportBlacklist calls fn with every blacklisted ip
+func (pder *SessionProvider) ExportBlacklist(ctx context.Context, fn func(ivmsesman.BlacklistRecord) error) error {
+
+	iter := pder.client.Collection(pder.blacklist).Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("err while reading the blacklist, err: %v", err)
+		}
+
+		data := doc.Data()
+		e := ivmsesman.BlacklistRecord{IP: doc.Ref.ID, Details: data["details"]}
+		if created, ok := data["created"].(time.Time); ok {
+			e.Created = created.Unix()
+		}
+		e.RequestURI, _ = data["requestURI"].(string)
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+}
+
+// ImportSessions writes the session documents with a bulk writer, replacing the ones with the same id. The
+// sessions expired already are left out.
+func (pder *SessionProvider) ImportSessions(ctx context.Context, sessions []ivmsesman.SessionRecord) error {
+
+	bw := pder.client.BulkWriter(ctx)
+	jobs := make(map[string]*firestore.BulkWriterJob, len(sessions))
+	for _, s := range sessions {
+		ss := Session{Sid: s.ID, CreatedAt: s.CreatedAt, TimeAccessed: s.TimeAccessed, Value: s.Values}
+		if pder.expired(&ss) {
+			continue
+		}
+		job, err := bw.Set(pder.client.Collection(pder.collection).Doc(s.ID), &ss)
+		if err != nil {
+			bw.End()
+			return fmt.Errorf("err while importing session id %v, err: %v", s.ID, err)
+		}
+		jobs[s.ID] = job
+	}
+	bw.End()
+
+	for sid, job := range jobs {
+		if _, err := job.Results(); err != nil {
+			return fmt.Errorf("err while importing session id %v, err: %v", sid, err)
+		}
+	}
+	return nil
+}
+
+// ImportBlacklist writes the blacklist documents with a bulk writer, replacing the ones already in the blacklist
+func (pder *SessionProvider) ImportBlacklist(ctx context.Context, entries []ivmsesman.BlacklistRecord) error {
+
+	bw := pder.client.BulkWriter(ctx)
+	jobs := make(map[string]*firestore.BulkWriterJob, len(entries))
+	for _, e := range entries {
+		v := map[string]interface{}{
+			"created":    time.Unix(e.Created, 0),
+			"requestURI": e.RequestURI,
+			"details":    e.Details,
+		}
+		job, err := bw.Set(pder.client.Collection(pder.blacklist).Doc(e.IP), v)
+		if err != nil {
+			bw.End()
+			return fmt.Errorf("err while importing the blacklisted ip %v, err: %v", e.IP, err)
+		}
+		jobs[e.IP] = job
+	}
+	bw.End()
+
+	for ip, job := range jobs {
+		if _, err := job.Results(); err != nil {
+			return fmt.Errorf("err while importing the blacklisted ip %v, err: %v", ip, err)
+		}
+	}
+	return nil
+}
@@ -1,33 +1,50 @@
-// Package inmem should be dummy imported with _ "girhub.com/dasiyes/ivmsesman/inmem" in order to auto run init() method which will register the provider in the ivmsesman package by invoking method RegisterProvider
+// Package inmem implements the session store provider in the process memory.
+//
+// Use New to create an independent provider for ivmsesman.NewSesmanWithRepository. For compatibility
+// the package still registers a default instance for ivmsesman.NewSesman(ivmsesman.Memory, cfg)
+// when it is imported.
 package inmem
 
 import (
 	"container/list"
+	"context"
+	"fmt"
+	"log/slog"
 	"sync"
 	"time"
 
 	"github.com/dasiyes/ivmsesman"
+	"github.com/dasiyes/ivmsesman/internal/provutil"
 )
 
-var pder = &SessionStoreProvider{list: list.New()}
-
 // SessionStore defines the storage to store the session data in
 type SessionStore struct {
 	sid          string
+	createdAt    int64
 	timeAccessed int64
 	value        map[interface{}]interface{}
+	// size is the estimated memory used by the session
+	size int64
+	pder *SessionStoreProvider
 }
 
 // Set stores the key:value pair in the repository
 func (st *SessionStore) Set(key, value interface{}) error {
-	st.value[key] = value
-	_ = pder.UpdateTimeAccessed(st.sid)
+	st.pder.lock.Lock()
+	defer st.pder.unlock()
+
+	st.pder.setValue(st, key, value)
+	st.pder.touch(st.sid)
+	st.pder.reclaim(st)
 	return nil
 }
 
 // Get will retrieve the session value by the provided key
 func (st *SessionStore) Get(key interface{}) interface{} {
-	_ = pder.UpdateTimeAccessed(st.sid)
+	st.pder.lock.Lock()
+	defer st.pder.unlock()
+
+	st.pder.touch(st.sid)
 	if v, ok := st.value[key]; ok {
 		return v
 	}
@@ -36,8 +53,11 @@ func (st *SessionStore) Get(key interface{}) interface{} {
 
 // Delete will remove a session value by the provided key
 func (st *SessionStore) Delete(key interface{}) error {
-	delete(st.value, key)
-	_ = pder.UpdateTimeAccessed(st.sid)
+	st.pder.lock.Lock()
+	defer st.pder.unlock()
+
+	st.pder.deleteValue(st, key)
+	st.pder.touch(st.sid)
 	return nil
 }
 
@@ -48,52 +68,398 @@ func (st *SessionStore) SessionID() string {
 
 // GetLTA will return the LastTimeAccessedAt
 func (st *SessionStore) GetLTA() time.Time {
+	st.pder.lock.Lock()
+	defer st.pder.unlock()
+
 	return time.Unix(st.timeAccessed, 0)
 }
 
-// SessionStoreProvider ensures storing sessions data
+// GetCreatedAt will return the time the session was created
+func (st *SessionStore) GetCreatedAt() time.Time {
+	return time.Unix(st.createdAt, 0)
+}
+
+// blacklistEntry is a single ip record in the blacklist
+type blacklistEntry struct {
+	created    time.Time
+	requestURI string
+	details    interface{}
+}
+
+// FullPolicy is what the provider does with a new session when it is full
+type FullPolicy int
+
+const (
+	// EvictLRU evicts the least recently accessed sessions to make room for the new one
+	EvictLRU FullPolicy = iota
+
+	// RefuseNew refuses the new sessions with ivmsesman.ErrStoreFull and keeps the existing ones, so a
+	// flood of clients without a session cookie can not push out the sessions in use
+	RefuseNew
+)
+
+// Options configures the memory session provider
+type Options struct {
+	// MaxSessions bounds the number of the sessions kept. Zero is unbounded
+	MaxSessions int
+	// MaxBytes bounds the estimated memory used by the sessions and their values. Zero is unbounded
+	MaxBytes int64
+	// OnFull is what happens with a new session when one of the bounds is reached. Default EvictLRU
+	OnFull FullPolicy
+	// SnapshotPath is the file Snapshot saves the sessions to and Restore loads them from. Empty disables
+	// the snapshots
+	SnapshotPath string
+}
+
+// Stats reports the use of the provider
+type Stats struct {
+	Sessions  int
+	Bytes     int64
+	Evictions uint64
+	Refused   uint64
+}
+
+// SessionStoreProvider ensures storing sessions data. The sessions list is kept
+// ordered by the last time accessed - the most recent at the front.
 type SessionStoreProvider struct {
-	lock     sync.Mutex
-	sessions map[string]*list.Element
-	list     *list.List
+	lock      sync.Mutex
+	sessions  map[string]*list.Element
+	list      *list.List
+	blacklist map[string]*blacklistEntry
+	policy    ivmsesman.ExpiryPolicy
+	log       *slog.Logger
+	onExpired func(ctx context.Context, sid string)
+	onEvicted func(ctx context.Context, sid string)
+	// expired and evicted are the ids removed while the lock is held, reported once it is released
+	expired []string
+	evicted []string
+
+	opts      Options
+	bytes     int64
+	evictions uint64
+	refused   uint64
+}
+
+// New creates an empty memory session provider without bounds
+func New() *SessionStoreProvider {
+	return NewWithOptions(Options{})
+}
+
+// NewWithOptions creates an empty memory session provider bounded by the options
+func NewWithOptions(opts Options) *SessionStoreProvider {
+	return &SessionStoreProvider{
+		sessions:  make(map[string]*list.Element),
+		list:      list.New(),
+		blacklist: make(map[string]*blacklistEntry),
+		opts:      opts,
+	}
+}
+
+// Stats returns the use of the provider
+func (pder *SessionStoreProvider) Stats() Stats {
+
+	pder.lock.Lock()
+	defer pder.unlock()
+
+	return Stats{Sessions: len(pder.sessions), Bytes: pder.bytes, Evictions: pder.evictions, Refused: pder.refused}
+}
+
+// SetLogger sets the logger of the provider events
+func (pder *SessionStoreProvider) SetLogger(l *slog.Logger) {
+	pder.log = l
+}
+
+// logger returns the logger set or the slog default one
+func (pder *SessionStoreProvider) logger() *slog.Logger {
+	if pder.log != nil {
+		return pder.log
+	}
+	return slog.Default()
+}
+
+// SetExpiryPolicy sets the timeouts enforced when a session is read
+func (pder *SessionStoreProvider) SetExpiryPolicy(p ivmsesman.ExpiryPolicy) {
+
+	pder.lock.Lock()
+	defer pder.unlock()
+
+	pder.policy = p
+}
+
+// SetExpiryListener sets the func called with the id of every session removed as expired. It runs after
+// the lock of the provider is released, so it may call back into the provider.
+func (pder *SessionStoreProvider) SetExpiryListener(fn func(ctx context.Context, sid string)) {
+
+	pder.lock.Lock()
+	defer pder.unlock()
+
+	pder.onExpired = fn
+}
+
+// SetEvictionListener sets the func called with the id of every session evicted to make room for a new one.
+// It runs after the lock of the provider is released, so it may call back into the provider.
+func (pder *SessionStoreProvider) SetEvictionListener(fn func(ctx context.Context, sid string)) {
+
+	pder.lock.Lock()
+	defer pder.unlock()
+
+	pder.onEvicted = fn
+}
+
+// unlock releases the lock and then reports the sessions expired and evicted while it was held, so the
+// listeners may call back into the provider
+func (pder *SessionStoreProvider) unlock() {
+	report := pder.events()
+	pder.lock.Unlock()
+	report()
+}
+
+// events takes the ids of the sessions expired and evicted while the lock was held and returns the func
+// reporting them to the listeners. The caller holds the lock and runs the func once it released it.
+func (pder *SessionStoreProvider) events() func() {
+
+	expired, evicted := pder.expired, pder.evicted
+	onExpired, onEvicted := pder.onExpired, pder.onEvicted
+	pder.expired, pder.evicted = nil, nil
+	return func() {
+		for _, sid := range expired {
+			if onExpired != nil {
+				onExpired(context.Background(), sid)
+			}
+		}
+		for _, sid := range evicted {
+			if onEvicted != nil {
+				onEvicted(context.Background(), sid)
+			}
+		}
+	}
+}
+
+// expire removes an expired session, reported once the lock is released. The caller holds the lock.
+func (pder *SessionStoreProvider) expire(element *list.Element) {
+	pder.expired = append(pder.expired, pder.remove(element))
+}
+
+// remove drops the session of the list element and returns its id. The caller holds the lock.
+func (pder *SessionStoreProvider) remove(element *list.Element) string {
+
+	st := element.Value.(*SessionStore)
+	delete(pder.sessions, st.sid)
+	pder.list.Remove(element)
+	pder.bytes -= st.size
+	return st.sid
+}
+
+// add stores the session at the front of the list. The caller holds the lock.
+func (pder *SessionStoreProvider) add(st *SessionStore) {
+
+	if element, ok := pder.sessions[st.sid]; ok {
+		pder.remove(element)
+	}
+	pder.sessions[st.sid] = pder.list.PushFront(st)
+	pder.bytes += st.size
+}
+
+// live reports if the session store is the one kept by the provider and not one detached by
+// Regenerate or removed. The caller holds the lock.
+func (pder *SessionStoreProvider) live(st *SessionStore) bool {
+	element, ok := pder.sessions[st.sid]
+	return ok && element.Value == st
+}
+
+// setValue sets a value of the session, accounting for its size. The caller holds the lock.
+func (pder *SessionStoreProvider) setValue(st *SessionStore, key, value interface{}) {
+
+	delta := entrySize(key, value)
+	if old, ok := st.value[key]; ok {
+		delta -= entrySize(key, old)
+	}
+	st.value[key] = value
+	st.size += delta
+	if pder.live(st) {
+		pder.bytes += delta
+	}
+}
+
+// deleteValue removes a value of the session, accounting for its size. The caller holds the lock.
+func (pder *SessionStoreProvider) deleteValue(st *SessionStore, key interface{}) {
+
+	old, ok := st.value[key]
+	if !ok {
+		return
+	}
+	delete(st.value, key)
+	delta := entrySize(key, old)
+	st.size -= delta
+	if pder.live(st) {
+		pder.bytes -= delta
+	}
+}
+
+// full reports if the provider can not take a new session sid of the size without passing its bounds. The
+// session held under sid, if any, is to be replaced so it does not count. The caller holds the lock.
+func (pder *SessionStoreProvider) full(sid string, size int64) bool {
+	n, bytes := len(pder.sessions), pder.bytes
+	if element, ok := pder.sessions[sid]; ok {
+		n, bytes = n-1, bytes-element.Value.(*SessionStore).size
+	}
+	if pder.opts.MaxSessions > 0 && n >= pder.opts.MaxSessions {
+		return true
+	}
+	return pder.opts.MaxBytes > 0 && bytes+size > pder.opts.MaxBytes
+}
+
+// admit makes room for a new session sid of the size, evicting the least recently accessed sessions or
+// refusing it, as set by the options. The session held under sid is not evicted, the caller replaces it
+// once admitted. The caller holds the lock.
+func (pder *SessionStoreProvider) admit(sid string, size int64) error {
+
+	if !pder.full(sid, size) {
+		return nil
+	}
+	pder.dropExpired()
+	if !pder.full(sid, size) {
+		return nil
+	}
+	if pder.opts.OnFull == RefuseNew {
+		pder.refused++
+		return ivmsesman.ErrStoreFull
+	}
+	for element := pder.list.Back(); element != nil && pder.full(sid, size); element = pder.list.Back() {
+		if element.Value.(*SessionStore).sid == sid {
+			if element = element.Prev(); element == nil {
+				break
+			}
+		}
+		pder.evict(element)
+	}
+	return nil
+}
+
+// reclaim evicts the least recently accessed sessions, other than keep, while the sessions pass the
+// memory bound. With RefuseNew nothing is evicted and the new sessions are refused instead. The caller
+// holds the lock.
+func (pder *SessionStoreProvider) reclaim(keep *SessionStore) {
+
+	if pder.opts.MaxBytes <= 0 || pder.opts.OnFull == RefuseNew {
+		return
+	}
+	for pder.bytes > pder.opts.MaxBytes {
+		element := pder.list.Back()
+		if element == nil || element.Value == keep {
+			return
+		}
+		pder.evict(element)
+	}
+}
+
+// dropExpired removes the least recently accessed sessions which passed the idle timeout. The caller holds the lock.
+func (pder *SessionStoreProvider) dropExpired() {
+
+	now := time.Now().Unix()
+	for element := pder.list.Back(); element != nil; element = pder.list.Back() {
+		st := element.Value.(*SessionStore)
+		if !pder.policy.Expired(st.createdAt, st.timeAccessed, now) {
+			return
+		}
+		pder.expire(element)
+	}
+}
+
+// evict removes the session to make room, reported once the lock is released. The caller holds the lock.
+func (pder *SessionStoreProvider) evict(element *list.Element) {
+
+	sid := pder.remove(element)
+	pder.evictions++
+	pder.logger().Debug("session evicted from the full store", slog.Any("sid", ivmsesman.Sensitive(sid)))
+	pder.evicted = append(pder.evicted, sid)
+}
+
+// lookup returns the list element of a session which is not expired. An expired session is removed.
+// The caller holds the lock.
+func (pder *SessionStoreProvider) lookup(sid string) (*list.Element, bool) {
+
+	element, ok := pder.sessions[sid]
+	if !ok {
+		return nil, false
+	}
+	st := element.Value.(*SessionStore)
+	if pder.policy.Expired(st.createdAt, st.timeAccessed, time.Now().Unix()) {
+		pder.expire(element)
+		return nil, false
+	}
+	return element, true
 }
 
 // NewSession creates a new session value in the store with sid as a key
 func (pder *SessionStoreProvider) NewSession(sid string) (ivmsesman.SessionStore, error) {
 
 	pder.lock.Lock()
-	defer pder.lock.Unlock()
+	defer pder.unlock()
+
+	return pder.newSession(sid)
+}
+
+// newSession stores a new session, if the bounds of the provider allow it. The caller holds the lock.
+func (pder *SessionStoreProvider) newSession(sid string) (*SessionStore, error) {
 
 	v := make(map[interface{}]interface{})
-	v["state"] = "new"
-	newsess := SessionStore{sid: sid, timeAccessed: time.Now().Unix(), value: v}
-	element := pder.list.PushBack(&newsess)
-	pder.sessions[sid] = element
+	v["state"] = "New"
+	now := time.Now().Unix()
+	newsess := SessionStore{sid: sid, createdAt: now, timeAccessed: now, value: v, pder: pder}
+	newsess.size = sessionSize(&newsess)
+
+	// a refused session keeps the one it was to replace
+	if err := pder.admit(sid, newsess.size); err != nil {
+		return nil, err
+	}
+	if element, ok := pder.sessions[sid]; ok {
+		pder.remove(element)
+	}
+	pder.add(&newsess)
 	return &newsess, nil
 }
 
 // FindOrCreate will first search the store for a session value with provided sid. If not not found, a new session value will be created and stored in the session store
 func (pder *SessionStoreProvider) FindOrCreate(sid string) (ivmsesman.SessionStore, error) {
 
-	if element, ok := pder.sessions[sid]; ok {
-		sesel := element.Value.(*SessionStore)
-		sesel.timeAccessed = time.Now().Unix()
-		return sesel, nil
+	pder.lock.Lock()
+	defer pder.unlock()
+
+	if element, ok := pder.lookup(sid); ok {
+		pder.touch(sid)
+		return element.Value.(*SessionStore), nil
 	}
 
-	sess, err := pder.NewSession(sid)
-	return sess, err
+	return pder.newSession(sid)
+}
+
+// FindContext returns the session sid without creating it, ivmsesman.ErrInvalidSessionID when the store does not hold it
+func (pder *SessionStoreProvider) FindContext(ctx context.Context, sid string) (ivmsesman.SessionStore, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	pder.lock.Lock()
+	defer pder.unlock()
+
+	if element, ok := pder.lookup(sid); ok {
+		pder.touch(sid)
+		return element.Value.(*SessionStore), nil
+	}
+	return nil, ivmsesman.ErrInvalidSessionID
 }
 
 // Destroy will remove a session data from the storage
 func (pder *SessionStoreProvider) DestroySID(sid string) error {
 
+	pder.lock.Lock()
+	defer pder.unlock()
+
 	if element, ok := pder.sessions[sid]; ok {
-		delete(pder.sessions, sid)
-		pder.list.Remove(element)
-		return nil
+		pder.remove(element)
 	}
-	// TODO: return apropriet error
 	return nil
 }
 
@@ -101,7 +467,14 @@ func (pder *SessionStoreProvider) DestroySID(sid string) error {
 func (pder *SessionStoreProvider) SessionGC(maxlifetime int64) {
 
 	pder.lock.Lock()
-	defer pder.lock.Unlock()
+	defer pder.unlock()
+
+	// the list is not ordered by the creation time
+	if pder.policy.Absolute > 0 {
+		for sid := range pder.sessions {
+			pder.lookup(sid)
+		}
+	}
 
 	for {
 		element := pder.list.Back()
@@ -110,32 +483,107 @@ func (pder *SessionStoreProvider) SessionGC(maxlifetime int64) {
 		}
 
 		if (element.Value.(*SessionStore).timeAccessed + maxlifetime) < time.Now().Unix() {
-			pder.list.Remove(element)
-			delete(pder.sessions, element.Value.(*SessionStore).sid)
+			pder.expire(element)
 		} else {
 			break
 		}
 	}
 }
 
+// RegenerateContext moves the session data under the new session id newsid and removes oldsid.
+// The stores returned earlier for oldsid are detached from the provider.
+func (pder *SessionStoreProvider) RegenerateContext(ctx context.Context, oldsid, newsid string) (ivmsesman.SessionStore, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	pder.lock.Lock()
+	defer pder.unlock()
+
+	return pder.moveTo(pder, oldsid, newsid)
+}
+
+// moveTo moves the session oldsid under the id newsid into dst, which may be the provider itself.
+// A different dst must have room for the session. The caller holds the locks of both providers.
+func (pder *SessionStoreProvider) moveTo(dst *SessionStoreProvider, oldsid, newsid string) (*SessionStore, error) {
+
+	element, ok := pder.lookup(oldsid)
+	if !ok {
+		return nil, fmt.Errorf("session id %v not found", oldsid)
+	}
+	if _, ok := dst.sessions[newsid]; ok {
+		return nil, fmt.Errorf("session id %v already exists", newsid)
+	}
+
+	old := element.Value.(*SessionStore)
+	v := make(map[interface{}]interface{})
+	for k, val := range old.value {
+		v[k] = val
+	}
+	newsess := SessionStore{sid: newsid, createdAt: old.createdAt, timeAccessed: time.Now().Unix(), value: v, pder: dst}
+	newsess.size = sessionSize(&newsess)
+
+	if dst != pder {
+		if err := dst.admit(newsid, newsess.size); err != nil {
+			return nil, err
+		}
+	}
+	pder.remove(element)
+	dst.add(&newsess)
+	return &newsess, nil
+}
+
 // UpdateTimeAccessed will update the time accessed value with now()
 func (pder *SessionStoreProvider) UpdateTimeAccessed(sid string) error {
 
 	pder.lock.Lock()
-	defer pder.lock.Unlock()
+	defer pder.unlock()
 
-	if element, ok := pder.sessions[sid]; ok {
-		element.Value.(*SessionStore).timeAccessed = time.Now().Unix()
-		pder.list.MoveToFront(element)
-		return nil
+	if !pder.touch(sid) {
+		return fmt.Errorf("err while updating time accessed for sessions id %v, err: session not found", sid)
 	}
-	// TODO: return apropriet error
+	return nil
+}
+
+// touch updates the time accessed of the session and moves it to the front of the list.
+// The caller holds the lock.
+func (pder *SessionStoreProvider) touch(sid string) bool {
+
+	element, ok := pder.lookup(sid)
+	if !ok {
+		return false
+	}
+	element.Value.(*SessionStore).timeAccessed = time.Now().Unix()
+	pder.list.MoveToFront(element)
+	return true
+}
+
+// update sets the values of an existing session. The time accessed is not changed.
+func (pder *SessionStoreProvider) update(sid string, values map[string]interface{}) error {
+
+	pder.lock.Lock()
+	defer pder.unlock()
+
+	element, ok := pder.lookup(sid)
+	if !ok {
+		return fmt.Errorf("session id %v not found", sid)
+	}
+	st := element.Value.(*SessionStore)
+	for k, v := range values {
+		pder.setValue(st, k, v)
+	}
+	pder.reclaim(st)
 	return nil
 }
 
 // UpdateSessionState will update the state value with one provided
 func (pder *SessionStoreProvider) UpdateSessionState(sid string, state string) error {
-	// TODO: make the function work for the inmem provider
+
+	err := pder.update(sid, map[string]interface{}{"state": state})
+	if err != nil {
+		return fmt.Errorf("err while updating `Value.state` for sessions id %v, err: %v", sid, err)
+	}
 	return nil
 }
 
@@ -143,71 +591,161 @@ func (pder *SessionStoreProvider) UpdateSessionState(sid string, state string) e
 func (pder *SessionStoreProvider) ActiveSessions() int {
 
 	pder.lock.Lock()
-	defer pder.lock.Unlock()
-
-	return len(pder.sessions)
-
+	defer pder.unlock()
+
+	n := 0
+	now := time.Now().Unix()
+	for _, element := range pder.sessions {
+		st := element.Value.(*SessionStore)
+		if !pder.policy.Expired(st.createdAt, st.timeAccessed, now) {
+			n++
+		}
+	}
+	return n
 }
 
 // Exists check by sid if a session data exists in the session store
 func (pder *SessionStoreProvider) Exists(sid string) bool {
 
 	pder.lock.Lock()
-	defer pder.lock.Unlock()
+	defer pder.unlock()
 
-	if _, ok := pder.sessions[sid]; ok {
-		return true
-	}
-	return false
+	_, ok := pder.lookup(sid)
+	return ok
 }
 
 // Flush will delete all elements for sessions data
 func (pder *SessionStoreProvider) Flush() error {
 
 	pder.lock.Lock()
-	defer pder.lock.Unlock()
+	defer pder.unlock()
 
 	pder.list = pder.list.Init()
+	pder.sessions = make(map[string]*list.Element)
+	pder.bytes = 0
 	return nil
 }
 
 // UpdateCodeVerifier will update the code verifier (cove) value assigned to the session id
 func (pder *SessionStoreProvider) UpdateCodeVerifier(sid, cove string) error {
-	// TODO [dev]: implement
+
+	err := pder.update(sid, map[string]interface{}{"code_verifier": cove})
+	if err != nil {
+		return fmt.Errorf("err while updating `Value.code_verifier` for sessions id %v, err: %v", sid, err)
+	}
 	return nil
 }
 
 // SaveCodeChallengeAndMethod - at step2 of AuthorizationCode flow
 func (pder *SessionStoreProvider) SaveCodeChallengeAndMethod(
 	sid, coch, mth, code, ru string) error {
-	// TODO [dev]: implement
+
+	// set code expiration timestamp
+	ce := time.Now().Unix() + 60
+
+	err := pder.update(sid, map[string]interface{}{
+		"code_challenger":        coch,
+		"code_challenger_method": mth,
+		"auth_code":              code,
+		"code_expire":            ce,
+		"redirect_uri":           ru,
+		"state":                  "InAuth",
+	})
+	if err != nil {
+		return fmt.Errorf("err while updating `Value.code_verifier` for sessions id %v, err: %v", sid, err)
+	}
 	return nil
 }
 
-// GetAuthCode will return the authorization code for a session, if it is InAuth
+// GetAuthCode will return the authorization code for a session, if it is InAuth and the code did not expire
 func (pder *SessionStoreProvider) GetAuthCode(sid string) map[string]string {
-	// TODO [dev]: implement
+
+	pder.lock.Lock()
+	defer pder.unlock()
+
+	var ac map[string]string = map[string]string{}
+
+	element, ok := pder.lookup(sid)
+	if !ok {
+		return ac
+	}
+	value := element.Value.(*SessionStore).value
+
+	state, _ := value["state"].(string)
+	ce, _ := value["code_expire"].(int64)
+	if state == "InAuth" && ce > time.Now().Unix() {
+		ac["auth_code"], _ = value["auth_code"].(string)
+		ac["code_challenger"], _ = value["code_challenger"].(string)
+		ac["code_challenger_method"], _ = value["code_challenger_method"].(string)
+	}
+	return ac
+}
+
+// UpdateAuthSession - update state, access and refresh tokens values for auth session
+func (pder *SessionStoreProvider) UpdateAuthSession(sid, at, rt, uid string) error {
+
+	err := pder.update(sid, map[string]interface{}{
+		"at":    at,
+		"rt":    rt,
+		"uid":   uid,
+		"state": "Authed",
+	})
+	if err != nil {
+		return fmt.Errorf("err while updating new authenticated session id %v, err: %v", sid, err)
+	}
 	return nil
 }
 
-// NewSession creates a new session value in the store with sid as a key
+// Blacklisting adds the @ip to the blacklist with the @path and @data
 func (pder *SessionStoreProvider) Blacklisting(ip, path string, data interface{}) {
-	// TODO [dev]: implement
+
+	pder.lock.Lock()
+	defer pder.unlock()
+
+	pder.blacklist[ip] = &blacklistEntry{created: time.Now(), requestURI: path, details: data}
+	pder.logger().Info("ip added in the blacklist", slog.String("ip", ip), slog.String("path", path))
 }
 
+// IsIPExistInBL returns boolean result for the @ip being or not in the blacklist
 func (pder *SessionStoreProvider) IsIPExistInBL(ip string) bool {
-	// TODO [dev]: implement
-	return false
-}
-func (pder *SessionStoreProvider) UpdateAuthSession(sid, at, rt, uid string) error {
 
-	return nil
+	pder.lock.Lock()
+	defer pder.unlock()
+
+	_, ok := pder.blacklist[ip]
+	return ok
 }
+
+// BLClean - cleaning the blacklist from the ips which passed the quarantine period and are verified as good bots
 func (pder *SessionStoreProvider) BLClean() {
-	// TODO [dev]: implement
+	docs_cnt := 0
+	del_docs_cnt := 0
+
+	to := time.Unix(time.Now().Unix()-provutil.BLQuarantine, 0)
+
+	pder.lock.Lock()
+	var review []string
+	for ip, e := range pder.blacklist {
+		if e.created.Before(to) {
+			review = append(review, ip)
+		}
+	}
+	pder.unlock()
+
+	// the reverse dns lookups run without holding the lock
+	for _, ip := range review {
+		if provutil.NativeReverseDNSLookup(ip) {
+			pder.lock.Lock()
+			delete(pder.blacklist, ip)
+			pder.unlock()
+			del_docs_cnt++
+		}
+		docs_cnt++
+	}
+	pder.logger().Info("blacklist clean summary", slog.Int("reviewed", docs_cnt), slog.Int("deleted", del_docs_cnt))
 }
 
+// init registers the default memory provider. It holds no external resources.
 func init() {
-	pder.sessions = make(map[string]*list.Element)
-	ivmsesman.RegisterProvider(ivmsesman.Memory, pder)
+	ivmsesman.RegisterProvider(ivmsesman.Memory, New())
 }
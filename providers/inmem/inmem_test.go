@@ -0,0 +1,198 @@
+package inmem
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dasiyes/ivmsesman"
+	"github.com/dasiyes/ivmsesman/sesmantest"
+)
+
+func TestConformance(t *testing.T) {
+	sesmantest.RunConformance(t, func(t *testing.T) ivmsesman.SessionRepository {
+		return New()
+	})
+}
+
+func TestMaxSessions(t *testing.T) {
+	pder := NewWithOptions(Options{MaxSessions: 2})
+
+	var evicted []string
+	pder.SetEvictionListener(func(ctx context.Context, sid string) {
+		evicted = append(evicted, sid)
+	})
+
+	for _, sid := range []string{"a", "b"} {
+		if _, err := pder.NewSession(sid); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	// `a` read last, `b` is the least recently accessed
+	if _, err := pder.FindOrCreate("a"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := pder.NewSession("c"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if !reflect.DeepEqual(evicted, []string{"b"}) {
+		t.Errorf("expected session `b` evicted, got %v", evicted)
+	}
+	if pder.Exists("b") || !pder.Exists("a") || !pder.Exists("c") {
+		t.Errorf("expected sessions `a` and `c` kept")
+	}
+	if st := pder.Stats(); st.Sessions != 2 || st.Evictions != 1 || st.Refused != 0 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	pder := NewWithOptions(Options{MaxBytes: 2048})
+
+	empty := pder.Stats().Bytes
+	ss, err := pder.NewSession("a")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	base := pder.Stats().Bytes
+	if base <= empty {
+		t.Fatalf("expected the session accounted, got %d bytes", base)
+	}
+
+	_ = ss.Set("k", strings.Repeat("x", 100))
+	if n := pder.Stats().Bytes; n < base+100 {
+		t.Errorf("expected the value accounted, got %d bytes", n)
+	}
+	_ = ss.Delete("k")
+	if n := pder.Stats().Bytes; n != base {
+		t.Errorf("expected %d bytes after the value was deleted, got %d", base, n)
+	}
+
+	// a large value pushes out the least recently accessed sessions, never the session set
+	if _, err := pder.NewSession("b"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	_ = ss.Set("k", strings.Repeat("x", 1500))
+	if pder.Exists("b") || !pder.Exists("a") {
+		t.Errorf("expected session `b` evicted for the value of `a`")
+	}
+	if st := pder.Stats(); st.Bytes > 2048 || st.Evictions != 1 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+
+	if err := pder.Flush(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if st := pder.Stats(); st.Bytes != 0 || st.Sessions != 0 {
+		t.Errorf("expected an empty provider after Flush, got %+v", st)
+	}
+}
+
+func TestListenersCallBack(t *testing.T) {
+	pder := NewWithOptions(Options{MaxSessions: 1})
+	sm, err := ivmsesman.NewSesmanWithRepository(pder, &ivmsesman.SesCfg{CookieName: "ivmid", Maxlifetime: 3600})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer sm.Close()
+
+	// the sink reads the provider back while the event is reported
+	var mu sync.Mutex
+	seen := map[ivmsesman.EventType][]bool{}
+	sm.AddEventSink(ivmsesman.EventSinkFunc(func(ctx context.Context, e ivmsesman.Event) {
+		exists := pder.Exists(e.SessionID)
+		mu.Lock()
+		seen[e.Type] = append(seen[e.Type], exists)
+		mu.Unlock()
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = pder.NewSession("a")
+		_, _ = pder.NewSession("b")
+		pder.SessionGC(-1)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the listeners called back into the provider while its lock was held")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(seen[ivmsesman.SessionEvicted], []bool{false}) || !reflect.DeepEqual(seen[ivmsesman.SessionExpired], []bool{false}) {
+		t.Errorf("expected an eviction and an expiry of removed sessions, got %v", seen)
+	}
+}
+
+func TestRefuseNew(t *testing.T) {
+	pder := NewWithOptions(Options{MaxSessions: 1, OnFull: RefuseNew})
+
+	if _, err := pder.NewSession("a"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := pder.FindOrCreate("b"); err != ivmsesman.ErrStoreFull {
+		t.Errorf("expected ErrStoreFull, got %v", err)
+	}
+	if _, err := pder.FindOrCreate("a"); err != nil {
+		t.Errorf("expected the existing session served, got error %v", err)
+	}
+	if st := pder.Stats(); st.Sessions != 1 || st.Refused != 1 || st.Evictions != 0 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+
+	// the room freed is taken again
+	if err := pder.DestroySID("a"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := pder.NewSession("b"); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestRefuseReplace(t *testing.T) {
+	pder := NewWithOptions(Options{OnFull: RefuseNew})
+
+	ss, err := pder.NewSession("a")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := ss.Delete("state"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := ss.Set("k", "v"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// the store is full with a session smaller than a new one
+	pder.lock.Lock()
+	pder.opts.MaxBytes = pder.bytes
+	pder.lock.Unlock()
+
+	if _, err := pder.NewSession("a"); err != ivmsesman.ErrStoreFull {
+		t.Fatalf("expected ErrStoreFull, got %v", err)
+	}
+	now := time.Now().Unix()
+	err = pder.ImportSessions(context.Background(), []ivmsesman.SessionRecord{
+		{ID: "a", CreatedAt: now, TimeAccessed: now, Values: map[string]interface{}{"k": strings.Repeat("v", 64)}},
+	})
+	if err != ivmsesman.ErrStoreFull {
+		t.Fatalf("expected ErrStoreFull, got %v", err)
+	}
+
+	// the refused sessions keep the one they were to replace
+	found, err := pder.FindOrCreate("a")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if found.Get("k") != "v" || found.Get("state") != nil {
+		t.Errorf("expected the session kept, got %#v %#v", found.Get("k"), found.Get("state"))
+	}
+	if st := pder.Stats(); st.Sessions != 1 || st.Evictions != 0 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
@@ -0,0 +1,97 @@
+package inmem
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/dasiyes/ivmsesman"
+	"github.com/dasiyes/ivmsesman/internal/provutil"
+)
+
+// List returns up to limit live sessions selected by the filter, in the order of the ids. The cursor is the
+// id of the last session of the previous page. The sessions are scanned under the lock keeping only the
+// limit smallest ids after the cursor, so a page costs a pass over the sessions but no sort of all of them.
+func (pder *SessionStoreProvider) List(ctx context.Context, filter ivmsesman.SessionFilter, cursor string, limit int) ([]ivmsesman.SessionRecord, string, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	if limit <= 0 {
+		limit = ivmsesman.DefaultListLimit
+	}
+
+	pder.lock.Lock()
+	defer pder.unlock()
+
+	ids, next := pageOf(pder.selected(filter, cursor, limit+1), limit)
+	sessions := make([]ivmsesman.SessionRecord, 0, len(ids))
+	for _, sid := range ids {
+		if rec, ok := pder.record(sid); ok {
+			sessions = append(sessions, rec)
+		}
+	}
+	return sessions, next, nil
+}
+
+// selected returns the n smallest ids after the cursor of the live sessions selected by the filter, sorted.
+// The caller holds the lock.
+func (pder *SessionStoreProvider) selected(filter ivmsesman.SessionFilter, cursor string, n int) []string {
+
+	now := time.Now().Unix()
+	page := provutil.NewSmallestIDs(n)
+	for sid, element := range pder.sessions {
+		if sid <= cursor {
+			continue
+		}
+		st := element.Value.(*SessionStore)
+		state, _ := st.value["state"].(string)
+		uid, _ := st.value["uid"].(string)
+		if filter.Match(st.timeAccessed, state, uid) && !pder.policy.Expired(st.createdAt, st.timeAccessed, now) {
+			page.Add(sid)
+		}
+	}
+	return page.Sorted()
+}
+
+// List returns up to limit live sessions selected by the filter, in the order of the ids. Every shard
+// selects its first limit sessions after the cursor and the page is the first of them all.
+func (sp *ShardedProvider) List(ctx context.Context, filter ivmsesman.SessionFilter, cursor string, limit int) ([]ivmsesman.SessionRecord, string, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	if limit <= 0 {
+		limit = ivmsesman.DefaultListLimit
+	}
+
+	var all []string
+	for _, s := range sp.shards {
+		s.lock.Lock()
+		all = append(all, s.selected(filter, cursor, limit+1)...)
+		s.unlock()
+	}
+	sort.Strings(all)
+
+	ids, next := pageOf(all, limit)
+	sessions := make([]ivmsesman.SessionRecord, 0, len(ids))
+	for _, sid := range ids {
+		s := sp.of(sid)
+		s.lock.Lock()
+		rec, ok := s.record(sid)
+		s.unlock()
+		if ok {
+			sessions = append(sessions, rec)
+		}
+	}
+	return sessions, next, nil
+}
+
+// pageOf returns the first limit of the sorted ids and the cursor of the next page, empty when there are
+// no more ids
+func pageOf(ids []string, limit int) ([]string, string) {
+	if len(ids) <= limit {
+		return ids, ""
+	}
+	return ids[:limit], ids[limit-1]
+}
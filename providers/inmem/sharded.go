@@ -0,0 +1,224 @@
+package inmem
+
+import (
+	"context"
+	"log/slog"
+	"runtime"
+
+	"github.com/dasiyes/ivmsesman"
+)
+
+// ShardedProvider keeps the sessions in the process memory split over shards by the hash of the session
+// id. Every shard is a SessionStoreProvider with its own lock and expiry list, so the requests of
+// different sessions rarely wait for each other. The blacklist is kept by the first shard.
+type ShardedProvider struct {
+	shards       []*SessionStoreProvider
+	snapshotPath string
+}
+
+// NewSharded creates an empty memory session provider of n shards, four per CPU when n is not positive.
+// The bounds of the options are split evenly between the shards, so a shard evicts or refuses sessions
+// once it takes its part of them.
+func NewSharded(n int, opts Options) *ShardedProvider {
+
+	if n <= 0 {
+		n = 4 * runtime.GOMAXPROCS(0)
+	}
+	if opts.MaxSessions > 0 {
+		opts.MaxSessions = (opts.MaxSessions + n - 1) / n
+	}
+	if opts.MaxBytes > 0 {
+		opts.MaxBytes = (opts.MaxBytes + int64(n) - 1) / int64(n)
+	}
+
+	// the snapshot of all shards is written in one file
+	sp := &ShardedProvider{shards: make([]*SessionStoreProvider, n), snapshotPath: opts.SnapshotPath}
+	opts.SnapshotPath = ""
+	for k := range sp.shards {
+		sp.shards[k] = NewWithOptions(opts)
+	}
+	return sp
+}
+
+// shard returns the index of the shard of the session id (32-bit FNV-1a)
+func (sp *ShardedProvider) shard(sid string) int {
+	h := uint32(2166136261)
+	for k := 0; k < len(sid); k++ {
+		h ^= uint32(sid[k])
+		h *= 16777619
+	}
+	return int(h % uint32(len(sp.shards)))
+}
+
+// of returns the shard of the session id
+func (sp *ShardedProvider) of(sid string) *SessionStoreProvider {
+	return sp.shards[sp.shard(sid)]
+}
+
+// Stats returns the use of the provider, summed over the shards
+func (sp *ShardedProvider) Stats() Stats {
+	var st Stats
+	for _, s := range sp.shards {
+		ss := s.Stats()
+		st.Sessions += ss.Sessions
+		st.Bytes += ss.Bytes
+		st.Evictions += ss.Evictions
+		st.Refused += ss.Refused
+	}
+	return st
+}
+
+// SetLogger sets the logger of the provider events
+func (sp *ShardedProvider) SetLogger(l *slog.Logger) {
+	for _, s := range sp.shards {
+		s.SetLogger(l)
+	}
+}
+
+// SetExpiryPolicy sets the timeouts enforced when a session is read
+func (sp *ShardedProvider) SetExpiryPolicy(p ivmsesman.ExpiryPolicy) {
+	for _, s := range sp.shards {
+		s.SetExpiryPolicy(p)
+	}
+}
+
+// SetExpiryListener sets the func called with the id of every session removed as expired
+func (sp *ShardedProvider) SetExpiryListener(fn func(ctx context.Context, sid string)) {
+	for _, s := range sp.shards {
+		s.SetExpiryListener(fn)
+	}
+}
+
+// SetEvictionListener sets the func called with the id of every session evicted to make room for a new one
+func (sp *ShardedProvider) SetEvictionListener(fn func(ctx context.Context, sid string)) {
+	for _, s := range sp.shards {
+		s.SetEvictionListener(fn)
+	}
+}
+
+// NewSession creates a new session value in the store with sid as a key
+func (sp *ShardedProvider) NewSession(sid string) (ivmsesman.SessionStore, error) {
+	return sp.of(sid).NewSession(sid)
+}
+
+// FindOrCreate will first search the store for a session value with provided sid. If not found, a new session value will be created and stored in the session store
+func (sp *ShardedProvider) FindOrCreate(sid string) (ivmsesman.SessionStore, error) {
+	return sp.of(sid).FindOrCreate(sid)
+}
+
+// FindContext returns the session sid without creating it, ivmsesman.ErrInvalidSessionID when the store does not hold it
+func (sp *ShardedProvider) FindContext(ctx context.Context, sid string) (ivmsesman.SessionStore, error) {
+	return sp.of(sid).FindContext(ctx, sid)
+}
+
+// DestroySID will remove a session data from the storage
+func (sp *ShardedProvider) DestroySID(sid string) error {
+	return sp.of(sid).DestroySID(sid)
+}
+
+// SessionGC cleans all expired sessions, one shard at a time
+func (sp *ShardedProvider) SessionGC(maxlifetime int64) {
+	for _, s := range sp.shards {
+		s.SessionGC(maxlifetime)
+	}
+}
+
+// RegenerateContext moves the session data under the new session id newsid and removes oldsid. When the
+// ids fall in different shards both are locked, in the order of the shards.
+func (sp *ShardedProvider) RegenerateContext(ctx context.Context, oldsid, newsid string) (ivmsesman.SessionStore, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	from, to := sp.shard(oldsid), sp.shard(newsid)
+	if from == to {
+		return sp.shards[from].RegenerateContext(ctx, oldsid, newsid)
+	}
+
+	first, second := sp.shards[from], sp.shards[to]
+	if to < from {
+		first, second = second, first
+	}
+	first.lock.Lock()
+	second.lock.Lock()
+	defer func() {
+		// both locks are released before the listeners run
+		reportFirst, reportSecond := first.events(), second.events()
+		second.lock.Unlock()
+		first.lock.Unlock()
+		reportFirst()
+		reportSecond()
+	}()
+
+	return sp.shards[from].moveTo(sp.shards[to], oldsid, newsid)
+}
+
+// UpdateTimeAccessed will update the time accessed value with now()
+func (sp *ShardedProvider) UpdateTimeAccessed(sid string) error {
+	return sp.of(sid).UpdateTimeAccessed(sid)
+}
+
+// UpdateSessionState will update the state value with one provided
+func (sp *ShardedProvider) UpdateSessionState(sid string, state string) error {
+	return sp.of(sid).UpdateSessionState(sid, state)
+}
+
+// ActiveSessions returns the number of currently active sessions in the session store
+func (sp *ShardedProvider) ActiveSessions() int {
+	n := 0
+	for _, s := range sp.shards {
+		n += s.ActiveSessions()
+	}
+	return n
+}
+
+// Exists check by sid if a session data exists in the session store
+func (sp *ShardedProvider) Exists(sid string) bool {
+	return sp.of(sid).Exists(sid)
+}
+
+// Flush will delete all elements for sessions data
+func (sp *ShardedProvider) Flush() error {
+	for _, s := range sp.shards {
+		if err := s.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateCodeVerifier will update the code verifier (cove) value assigned to the session id
+func (sp *ShardedProvider) UpdateCodeVerifier(sid, cove string) error {
+	return sp.of(sid).UpdateCodeVerifier(sid, cove)
+}
+
+// SaveCodeChallengeAndMethod - at step2 of AuthorizationCode flow
+func (sp *ShardedProvider) SaveCodeChallengeAndMethod(sid, coch, mth, code, ru string) error {
+	return sp.of(sid).SaveCodeChallengeAndMethod(sid, coch, mth, code, ru)
+}
+
+// GetAuthCode will return the authorization code for a session, if it is InAuth and the code did not expire
+func (sp *ShardedProvider) GetAuthCode(sid string) map[string]string {
+	return sp.of(sid).GetAuthCode(sid)
+}
+
+// UpdateAuthSession - update state, access and refresh tokens values for auth session
+func (sp *ShardedProvider) UpdateAuthSession(sid, at, rt, uid string) error {
+	return sp.of(sid).UpdateAuthSession(sid, at, rt, uid)
+}
+
+// Blacklisting adds the @ip to the blacklist with the @path and @data
+func (sp *ShardedProvider) Blacklisting(ip, path string, data interface{}) {
+	sp.shards[0].Blacklisting(ip, path, data)
+}
+
+// IsIPExistInBL returns boolean result for the @ip being or not in the blacklist
+func (sp *ShardedProvider) IsIPExistInBL(ip string) bool {
+	return sp.shards[0].IsIPExistInBL(ip)
+}
+
+// BLClean - cleaning the blacklist from the ips which passed the quarantine period and are verified as good bots
+func (sp *ShardedProvider) BLClean() {
+	sp.shards[0].BLClean()
+}
@@ -0,0 +1,147 @@
+package inmem
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dasiyes/ivmsesman"
+	"github.com/dasiyes/ivmsesman/sesmantest"
+)
+
+func TestShardedConformance(t *testing.T) {
+	sesmantest.RunConformance(t, func(t *testing.T) ivmsesman.SessionRepository {
+		return NewSharded(8, Options{})
+	})
+}
+
+func TestShardedRegenerate(t *testing.T) {
+	sp := NewSharded(8, Options{})
+
+	// ids of different shards
+	oldsid, newsid := "a", "b"
+	for k := 0; sp.shard(oldsid) == sp.shard(newsid); k++ {
+		newsid = fmt.Sprintf("b%d", k)
+	}
+
+	ss, err := sp.NewSession(oldsid)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	_ = ss.Set("uid", "u-1")
+
+	ns, err := sp.RegenerateContext(context.Background(), oldsid, newsid)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if sp.Exists(oldsid) || !sp.Exists(newsid) {
+		t.Errorf("expected the session moved from %q to %q", oldsid, newsid)
+	}
+	if v := ns.Get("uid"); v != "u-1" {
+		t.Errorf("expected the session data moved, got %#v", v)
+	}
+
+	// the moved session belongs to its new shard
+	_ = ns.Set("k", "v")
+	found, _ := sp.FindOrCreate(newsid)
+	if v := found.Get("k"); v != "v" {
+		t.Errorf("expected the value set on the moved session, got %#v", v)
+	}
+	if st := sp.Stats(); st.Sessions != 1 {
+		t.Errorf("expected 1 session, got %+v", st)
+	}
+}
+
+func TestShardedBounds(t *testing.T) {
+	sp := NewSharded(4, Options{MaxSessions: 40, OnFull: RefuseNew})
+
+	refused := 0
+	for k := 0; k < 100; k++ {
+		if _, err := sp.NewSession(fmt.Sprintf("s%d", k)); err == ivmsesman.ErrStoreFull {
+			refused++
+		}
+	}
+	st := sp.Stats()
+	if st.Sessions > 40 || st.Sessions+refused != 100 || st.Refused != uint64(refused) {
+		t.Errorf("expected at most 10 sessions per shard, got %+v with %d refused", st, refused)
+	}
+}
+
+func TestShardedConcurrent(t *testing.T) {
+	sp := NewSharded(0, Options{MaxSessions: 500})
+
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for k := 0; k < 200; k++ {
+				sid := fmt.Sprintf("s%d", (g*7+k)%300)
+				ss, err := sp.FindOrCreate(sid)
+				if err != nil {
+					t.Errorf("unexpected error %v", err)
+					return
+				}
+				_ = ss.Set("n", k)
+				ss.Get("n")
+				switch k % 10 {
+				case 0:
+					_ = sp.DestroySID(sid)
+				case 1:
+					_, _ = sp.RegenerateContext(context.Background(), sid, fmt.Sprintf("r%d-%d", g, k))
+				case 2:
+					sp.SessionGC(3600)
+					sp.ActiveSessions()
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if st := sp.Stats(); st.Sessions != sp.ActiveSessions() || st.Sessions > 500 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+// BenchmarkProviderParallel compares the single lock provider with the sharded one, reading and
+// writing sessions from all CPUs
+func BenchmarkProviderParallel(b *testing.B) {
+
+	for _, bc := range []struct {
+		name string
+		pder ivmsesman.SessionRepository
+	}{
+		{"single", New()},
+		{"sharded", NewSharded(0, Options{})},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			sids := make([]string, 10000)
+			for k := range sids {
+				sids[k] = fmt.Sprintf("sid-%d", k)
+				if _, err := bc.pder.NewSession(sids[k]); err != nil {
+					b.Fatalf("unexpected error %v", err)
+				}
+			}
+
+			var next int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					n := atomic.AddInt64(&next, 1)
+					ss, err := bc.pder.FindOrCreate(sids[n%int64(len(sids))])
+					if err != nil {
+						b.Errorf("unexpected error %v", err)
+						return
+					}
+					if n%4 == 0 {
+						_ = ss.Set("n", n)
+					} else {
+						ss.Get("n")
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package inmem
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/dasiyes/ivmsesman"
+)
+
+// snapshotMagic starts every snapshot file
+const snapshotMagic = "IVMSESMAN-INMEM\n"
+
+// snapshotVersion is the version of the snapshot format written by Snapshot. Restore refuses other versions.
+const snapshotVersion = 1
+
+// snapshotHeader precedes the sessions in a snapshot file
+type snapshotHeader struct {
+	Version int
+	Taken   int64
+	Policy  ivmsesman.ExpiryPolicy
+}
+
+// snapshotSession is a session in a snapshot file. The values are gob encoded on their own, so a session
+// with a value of a type not registered with gob is left out of the snapshot alone.
+type snapshotSession struct {
+	ID           string
+	CreatedAt    int64
+	TimeAccessed int64
+	Values       []byte
+}
+
+// sessionValues is a copy of a session taken under the lock, encoded after it is released
+type sessionValues struct {
+	sid          string
+	createdAt    int64
+	timeAccessed int64
+	value        map[interface{}]interface{}
+}
+
+func init() {
+	// the sessions keep times, e.g. the expiry of tokens
+	gob.Register(time.Time{})
+}
+
+// Snapshot saves the sessions to the file of Options.SnapshotPath, replacing it atomically. The values of a
+// custom type must be registered with gob.Register, otherwise their sessions are left out. Without a path
+// Snapshot does nothing.
+func (pder *SessionStoreProvider) Snapshot(ctx context.Context) error {
+
+	if pder.opts.SnapshotPath == "" {
+		return nil
+	}
+	pder.lock.Lock()
+	sessions, policy := pder.copies(), pder.policy
+	pder.unlock()
+
+	return writeSnapshot(ctx, pder.opts.SnapshotPath, policy, sessions, pder.logger())
+}
+
+// Restore loads the sessions of the snapshot file of Options.SnapshotPath, leaving out the expired ones and
+// the ones already in the provider. A missing file restores nothing.
+func (pder *SessionStoreProvider) Restore(ctx context.Context) error {
+
+	if pder.opts.SnapshotPath == "" {
+		return nil
+	}
+	pder.lock.Lock()
+	policy := pder.policy
+	pder.unlock()
+
+	sessions, err := readSnapshot(ctx, pder.opts.SnapshotPath, policy)
+	if err != nil {
+		return err
+	}
+
+	pder.lock.Lock()
+	defer pder.unlock()
+
+	n := pder.restore(sessions)
+	pder.logger().InfoContext(ctx, "sessions restored from the snapshot", slog.String("path", pder.opts.SnapshotPath), slog.Int("sessions", n))
+	return nil
+}
+
+// copies returns a copy of the sessions, the least recently accessed first. The caller holds the lock.
+func (pder *SessionStoreProvider) copies() []sessionValues {
+
+	sessions := make([]sessionValues, 0, pder.list.Len())
+	for element := pder.list.Back(); element != nil; element = element.Prev() {
+		st := element.Value.(*SessionStore)
+		v := make(map[interface{}]interface{}, len(st.value))
+		for k, val := range st.value {
+			v[k] = val
+		}
+		sessions = append(sessions, sessionValues{sid: st.sid, createdAt: st.createdAt, timeAccessed: st.timeAccessed, value: v})
+	}
+	return sessions
+}
+
+// restore adds the sessions, the least recently accessed first, while the bounds admit them. It returns the
+// number of sessions added. The caller holds the lock.
+func (pder *SessionStoreProvider) restore(sessions []sessionValues) int {
+
+	n := 0
+	for _, s := range sessions {
+		if _, ok := pder.sessions[s.sid]; ok {
+			continue
+		}
+		st := &SessionStore{sid: s.sid, createdAt: s.createdAt, timeAccessed: s.timeAccessed, value: s.value, pder: pder}
+		st.size = sessionSize(st)
+		if err := pder.admit(st.sid, st.size); err != nil {
+			break
+		}
+		pder.add(st)
+		n++
+	}
+	return n
+}
+
+// writeSnapshot writes the sessions to a temporary file next to path and renames it over path
+func writeSnapshot(ctx context.Context, path string, policy ivmsesman.ExpiryPolicy, sessions []sessionValues, log *slog.Logger) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("err while creating the snapshot file, err: %v", err)
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	w := bufio.NewWriter(f)
+	enc := gob.NewEncoder(w)
+	_, err = io.WriteString(w, snapshotMagic)
+	if err == nil {
+		err = enc.Encode(snapshotHeader{Version: snapshotVersion, Taken: time.Now().Unix(), Policy: policy})
+	}
+
+	var values bytes.Buffer
+	for k := 0; err == nil && k < len(sessions); k++ {
+		s := sessions[k]
+		values.Reset()
+		if verr := gob.NewEncoder(&values).Encode(s.value); verr != nil {
+			log.WarnContext(ctx, "session left out of the snapshot", slog.Any("sid", ivmsesman.Sensitive(s.sid)), slog.Any("error", verr))
+			continue
+		}
+		err = enc.Encode(snapshotSession{ID: s.sid, CreatedAt: s.createdAt, TimeAccessed: s.timeAccessed, Values: values.Bytes()})
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("err while writing the snapshot file, err: %v", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("err while replacing the snapshot file, err: %v", err)
+	}
+	return nil
+}
+
+// readSnapshot reads the sessions of the snapshot file at path, the least recently accessed first. The
+// sessions expired by the policy, or by the one of the snapshot when it is zero, are left out.
+func readSnapshot(ctx context.Context, path string, policy ivmsesman.ExpiryPolicy) ([]sessionValues, error) {
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("err while opening the snapshot file, err: %v", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != snapshotMagic {
+		return nil, fmt.Errorf("%s is not a session snapshot file", path)
+	}
+
+	dec := gob.NewDecoder(r)
+	var h snapshotHeader
+	if err := dec.Decode(&h); err != nil {
+		return nil, fmt.Errorf("err while reading the snapshot header, err: %v", err)
+	}
+	if h.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", h.Version)
+	}
+	if policy == (ivmsesman.ExpiryPolicy{}) {
+		policy = h.Policy
+	}
+
+	var sessions []sessionValues
+	now := time.Now().Unix()
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var s snapshotSession
+		err := dec.Decode(&s)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("err while reading the snapshot sessions, err: %v", err)
+		}
+		if policy.Expired(s.CreatedAt, s.TimeAccessed, now) {
+			continue
+		}
+		var v map[interface{}]interface{}
+		if err := gob.NewDecoder(bytes.NewReader(s.Values)).Decode(&v); err != nil {
+			return nil, fmt.Errorf("err while reading the values of a snapshot session, err: %v", err)
+		}
+		sessions = append(sessions, sessionValues{sid: s.ID, createdAt: s.CreatedAt, timeAccessed: s.TimeAccessed, value: v})
+	}
+	sort.SliceStable(sessions, func(a, b int) bool { return sessions[a].timeAccessed < sessions[b].timeAccessed })
+	return sessions, nil
+}
+
+// Snapshot saves the sessions of all shards to the file of Options.SnapshotPath, replacing it atomically.
+// The shards are copied one at a time. Without a path Snapshot does nothing.
+func (sp *ShardedProvider) Snapshot(ctx context.Context) error {
+
+	if sp.snapshotPath == "" {
+		return nil
+	}
+	var sessions []sessionValues
+	var policy ivmsesman.ExpiryPolicy
+	for _, s := range sp.shards {
+		s.lock.Lock()
+		sessions, policy = append(sessions, s.copies()...), s.policy
+		s.unlock()
+	}
+	return writeSnapshot(ctx, sp.snapshotPath, policy, sessions, sp.shards[0].logger())
+}
+
+// Restore loads the sessions of the snapshot file of Options.SnapshotPath into their shards, leaving out
+// the expired ones and the ones already in the provider. A missing file restores nothing.
+func (sp *ShardedProvider) Restore(ctx context.Context) error {
+
+	if sp.snapshotPath == "" {
+		return nil
+	}
+	sp.shards[0].lock.Lock()
+	policy := sp.shards[0].policy
+	sp.shards[0].unlock()
+
+	sessions, err := readSnapshot(ctx, sp.snapshotPath, policy)
+	if err != nil {
+		return err
+	}
+	parts := make([][]sessionValues, len(sp.shards))
+	for _, s := range sessions {
+		k := sp.shard(s.sid)
+		parts[k] = append(parts[k], s)
+	}
+
+	n := 0
+	for k, s := range sp.shards {
+		s.lock.Lock()
+		n += s.restore(parts[k])
+		s.unlock()
+	}
+	sp.shards[0].logger().InfoContext(ctx, "sessions restored from the snapshot", slog.String("path", sp.snapshotPath), slog.Int("sessions", n))
+	return nil
+}
@@ -0,0 +1,128 @@
+package inmem
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dasiyes/ivmsesman"
+)
+
+// unregistered is a session value type not registered with gob
+type unregistered struct{ N int }
+
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "sessions.snap")
+
+	pder := NewWithOptions(Options{SnapshotPath: path})
+	pder.SetExpiryPolicy(ivmsesman.ExpiryPolicy{Idle: 60})
+
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	for _, sid := range []string{"a", "b", "c"} {
+		if _, err := pder.NewSession(sid); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if err := pder.SaveCodeChallengeAndMethod("a", "coch", "S256", "code", "/"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	ss, _ := pder.FindOrCreate("a")
+	_ = ss.Set("expires", expires)
+	ss, _ = pder.FindOrCreate("c")
+	_ = ss.Set("custom", unregistered{1})
+
+	// `b` idle past the timeout
+	pder.lock.Lock()
+	pder.sessions["b"].Value.(*SessionStore).timeAccessed -= 120
+	pder.lock.Unlock()
+
+	if err := pder.Snapshot(ctx); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if files, _ := os.ReadDir(filepath.Dir(path)); len(files) != 1 {
+		t.Errorf("expected only the snapshot file, got %v", files)
+	}
+
+	restored := NewWithOptions(Options{SnapshotPath: path})
+	restored.SetExpiryPolicy(ivmsesman.ExpiryPolicy{Idle: 60})
+	if err := restored.Restore(ctx); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if !restored.Exists("a") || restored.Exists("b") || restored.Exists("c") {
+		t.Errorf("expected only session `a` restored, got %d sessions", restored.Stats().Sessions)
+	}
+	if ac := restored.GetAuthCode("a"); ac["auth_code"] != "code" {
+		t.Errorf("expected the auth code restored, got %v", ac)
+	}
+	ss, _ = restored.FindOrCreate("a")
+	if v, _ := ss.Get("expires").(time.Time); !v.Equal(expires) {
+		t.Errorf("expected time %v restored, got %#v", expires, ss.Get("expires"))
+	}
+	if st := restored.Stats(); st.Bytes != pder.sessions["a"].Value.(*SessionStore).size {
+		t.Errorf("expected the restored session accounted, got %+v", st)
+	}
+
+	// a missing file restores nothing
+	if err := NewWithOptions(Options{SnapshotPath: path + ".missing"}).Restore(ctx); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestSnapshotVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.snap")
+
+	if err := os.WriteFile(path, []byte("sessions"), 0600); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := NewWithOptions(Options{SnapshotPath: path}).Restore(context.Background()); err == nil {
+		t.Errorf("expected an error for a file which is not a snapshot")
+	}
+
+	var b bytes.Buffer
+	b.WriteString(snapshotMagic)
+	if err := gob.NewEncoder(&b).Encode(snapshotHeader{Version: snapshotVersion + 1}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := os.WriteFile(path, b.Bytes(), 0600); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err := NewWithOptions(Options{SnapshotPath: path}).Restore(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "unsupported snapshot version") {
+		t.Errorf("expected an unsupported version error, got %v", err)
+	}
+}
+
+func TestShardedSnapshot(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "sessions.snap")
+
+	sp := NewSharded(8, Options{SnapshotPath: path})
+	for _, sid := range []string{"a", "b", "c", "d", "e"} {
+		if _, err := sp.NewSession(sid); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if err := sp.Snapshot(ctx); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	restored := NewSharded(3, Options{SnapshotPath: path})
+	if err := restored.Restore(ctx); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for _, sid := range []string{"a", "b", "c", "d", "e"} {
+		if !restored.Exists(sid) {
+			t.Errorf("expected session %q restored", sid)
+		}
+	}
+	if n := restored.Stats().Sessions; n != 5 {
+		t.Errorf("expected 5 sessions, got %d", n)
+	}
+}
@@ -0,0 +1,212 @@
+package inmem
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/dasiyes/ivmsesman"
+)
+
+// ExportSessions calls fn with every live session whose id is greater than after, in the order of the ids.
+// The sessions are copied one at a time, fn runs without holding the lock.
+func (pder *SessionStoreProvider) ExportSessions(ctx context.Context, after string, fn func(ivmsesman.SessionRecord) error) error {
+
+	pder.lock.Lock()
+	ids := pder.ids(after)
+	pder.unlock()
+
+	for _, sid := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		pder.lock.Lock()
+		rec, ok := pder.record(sid)
+		pder.unlock()
+		if !ok {
+			continue
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ids returns the sorted ids of the live sessions greater than after. The caller holds the lock.
+func (pder *SessionStoreProvider) ids(after string) []string {
+
+	now := time.Now().Unix()
+	ids := make([]string, 0, len(pder.sessions))
+	for sid, element := range pder.sessions {
+		st := element.Value.(*SessionStore)
+		if sid > after && !pder.policy.Expired(st.createdAt, st.timeAccessed, now) {
+			ids = append(ids, sid)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// record returns a copy of the live session. The caller holds the lock.
+func (pder *SessionStoreProvider) record(sid string) (ivmsesman.SessionRecord, bool) {
+
+	element, ok := pder.lookup(sid)
+	if !ok {
+		return ivmsesman.SessionRecord{}, false
+	}
+	st := element.Value.(*SessionStore)
+	values := make(map[string]interface{}, len(st.value))
+	for k, v := range st.value {
+		values[fmt.Sprint(k)] = v
+	}
+	return ivmsesman.SessionRecord{ID: sid, CreatedAt: st.createdAt, TimeAccessed: st.timeAccessed, Values: values}, true
+}
+
+// ExportBlacklist calls fn with every blacklisted ip
+func (pder *SessionStoreProvider) ExportBlacklist(ctx context.Context, fn func(ivmsesman.BlacklistRecord) error) error {
+
+	pder.lock.Lock()
+	entries := make([]ivmsesman.BlacklistRecord, 0, len(pder.blacklist))
+	for ip, e := range pder.blacklist {
+		entries = append(entries, ivmsesman.BlacklistRecord{IP: ip, Created: e.created.Unix(), RequestURI: e.requestURI, Details: e.details})
+	}
+	pder.unlock()
+
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportSessions adds the sessions, replacing the ones with the same id, at their place in the list by the
+// last time accessed. The sessions expired already are left out; the bounds of the provider apply as for
+// the new sessions.
+func (pder *SessionStoreProvider) ImportSessions(ctx context.Context, sessions []ivmsesman.SessionRecord) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// the most recently accessed first, so the list is walked once from the front
+	recs := make([]ivmsesman.SessionRecord, len(sessions))
+	copy(recs, sessions)
+	sort.SliceStable(recs, func(i, j int) bool { return recs[i].TimeAccessed > recs[j].TimeAccessed })
+
+	pder.lock.Lock()
+	defer pder.unlock()
+
+	now := time.Now().Unix()
+	var prev *SessionStore
+	for _, r := range recs {
+		if pder.policy.Expired(r.CreatedAt, r.TimeAccessed, now) {
+			continue
+		}
+		v := make(map[interface{}]interface{}, len(r.Values))
+		for k, val := range r.Values {
+			v[k] = val
+		}
+		st := &SessionStore{sid: r.ID, createdAt: r.CreatedAt, timeAccessed: r.TimeAccessed, value: v, pder: pder}
+		st.size = sessionSize(st)
+		if err := pder.admit(st.sid, st.size); err != nil {
+			return err
+		}
+		if element, ok := pder.sessions[st.sid]; ok {
+			pder.remove(element)
+		}
+
+		// the previous session may have been evicted to make room
+		element := pder.list.Front()
+		if prev != nil && pder.live(prev) {
+			element = pder.sessions[prev.sid]
+		}
+		for element != nil && element.Value.(*SessionStore).timeAccessed > st.timeAccessed {
+			element = element.Next()
+		}
+		if element == nil {
+			pder.sessions[st.sid] = pder.list.PushBack(st)
+		} else {
+			pder.sessions[st.sid] = pder.list.InsertBefore(st, element)
+		}
+		pder.bytes += st.size
+		prev = st
+	}
+	return nil
+}
+
+// ImportBlacklist adds the blacklisted ips, replacing the ones already in the blacklist
+func (pder *SessionStoreProvider) ImportBlacklist(ctx context.Context, entries []ivmsesman.BlacklistRecord) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	pder.lock.Lock()
+	defer pder.unlock()
+
+	for _, e := range entries {
+		pder.blacklist[e.IP] = &blacklistEntry{created: time.Unix(e.Created, 0), requestURI: e.RequestURI, details: e.Details}
+	}
+	return nil
+}
+
+// ExportSessions calls fn with every live session whose id is greater than after, in the order of the ids
+func (sp *ShardedProvider) ExportSessions(ctx context.Context, after string, fn func(ivmsesman.SessionRecord) error) error {
+
+	var ids []string
+	for _, s := range sp.shards {
+		s.lock.Lock()
+		ids = append(ids, s.ids(after)...)
+		s.unlock()
+	}
+	sort.Strings(ids)
+
+	for _, sid := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		s := sp.of(sid)
+		s.lock.Lock()
+		rec, ok := s.record(sid)
+		s.unlock()
+		if !ok {
+			continue
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportBlacklist calls fn with every blacklisted ip
+func (sp *ShardedProvider) ExportBlacklist(ctx context.Context, fn func(ivmsesman.BlacklistRecord) error) error {
+	return sp.shards[0].ExportBlacklist(ctx, fn)
+}
+
+// ImportSessions adds the sessions to their shards, replacing the ones with the same id
+func (sp *ShardedProvider) ImportSessions(ctx context.Context, sessions []ivmsesman.SessionRecord) error {
+
+	byShard := make(map[int][]ivmsesman.SessionRecord)
+	for _, r := range sessions {
+		k := sp.shard(r.ID)
+		byShard[k] = append(byShard[k], r)
+	}
+	for k, recs := range byShard {
+		if err := sp.shards[k].ImportSessions(ctx, recs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportBlacklist adds the blacklisted ips, replacing the ones already in the blacklist
+func (sp *ShardedProvider) ImportBlacklist(ctx context.Context, entries []ivmsesman.BlacklistRecord) error {
+	return sp.shards[0].ImportBlacklist(ctx, entries)
+}
@@ -0,0 +1,73 @@
+package inmem
+
+import (
+	"time"
+)
+
+// The estimated memory used by a session and by a value of unknown type, in bytes
+const (
+	sessionOverhead = 256
+	valueOverhead   = 64
+)
+
+// sessionSize estimates the memory used by the session
+func sessionSize(st *SessionStore) int64 {
+	n := int64(sessionOverhead + len(st.sid))
+	for k, v := range st.value {
+		n += entrySize(k, v)
+	}
+	return n
+}
+
+// entrySize estimates the memory used by a value of a session with its key
+func entrySize(key, value interface{}) int64 {
+	return sizeOf(key) + sizeOf(value)
+}
+
+// sizeOf estimates the memory used by a value
+func sizeOf(v interface{}) int64 {
+	switch v := v.(type) {
+	case nil:
+		return 0
+	case string:
+		return int64(16 + len(v))
+	case []byte:
+		return int64(24 + len(v))
+	case bool, int8, uint8:
+		return 1
+	case int16, uint16:
+		return 2
+	case int32, uint32, float32:
+		return 4
+	case int, int64, uint, uint64, float64, uintptr:
+		return 8
+	case time.Time:
+		return 24
+	case []string:
+		n := int64(24)
+		for _, s := range v {
+			n += sizeOf(s)
+		}
+		return n
+	case []interface{}:
+		n := int64(24)
+		for _, e := range v {
+			n += sizeOf(e)
+		}
+		return n
+	case map[string]string:
+		n := int64(48)
+		for k, e := range v {
+			n += sizeOf(k) + sizeOf(e)
+		}
+		return n
+	case map[string]interface{}:
+		n := int64(48)
+		for k, e := range v {
+			n += sizeOf(k) + sizeOf(e)
+		}
+		return n
+	default:
+		return valueOverhead
+	}
+}
@@ -0,0 +1,205 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/dasiyes/ivmsesman"
+)
+
+// The delays between the attempts to subscribe again after the subscription connection broke
+const (
+	minResubscribe = 100 * time.Millisecond
+	maxResubscribe = 5 * time.Second
+)
+
+// Bus is an ivmsesman.InvalidationBus over Redis pub/sub. The subscription runs on a dedicated connection,
+// dialed again when it breaks; the subscribers then get an invalidation of all sessions, as the invalidations
+// published meanwhile are lost.
+type Bus struct {
+	pool    *pool
+	channel string
+	log     *slog.Logger
+
+	mu     sync.Mutex
+	subs   map[int]func(ctx context.Context, inv ivmsesman.Invalidation)
+	next   int
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewBus creates the invalidation bus on the Redis server of the options. The invalidations are published
+// on the channel named by the key prefix followed by "invalidations".
+func NewBus(opts Options) *Bus {
+
+	pder := New(opts)
+	return &Bus{
+		pool:    pder.pool,
+		channel: pder.prefix + "invalidations",
+		subs:    make(map[int]func(ctx context.Context, inv ivmsesman.Invalidation)),
+	}
+}
+
+// SetLogger sets the logger of the subscription events
+func (b *Bus) SetLogger(l *slog.Logger) {
+	b.log = l
+}
+
+// logger returns the logger set or the slog default one
+func (b *Bus) logger() *slog.Logger {
+	if b.log != nil {
+		return b.log
+	}
+	return slog.Default()
+}
+
+// Publish sends the invalidation on the channel of the bus
+func (b *Bus) Publish(ctx context.Context, inv ivmsesman.Invalidation) error {
+
+	payload, err := json.Marshal(inv)
+	if err != nil {
+		return fmt.Errorf("err while encoding the invalidation, err: %v", err)
+	}
+	if _, err = b.pool.do(ctx, "PUBLISH", b.channel, string(payload)); err != nil {
+		return fmt.Errorf("err while publishing the invalidation, err: %v", err)
+	}
+	return nil
+}
+
+// Subscribe registers fn for the invalidations of the channel. The first subscriber starts the subscription
+// and the last one leaving stops it.
+func (b *Bus) Subscribe(fn func(ctx context.Context, inv ivmsesman.Invalidation)) (func(), error) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.next
+	b.next++
+	b.subs[id] = fn
+
+	if b.cancel == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		b.cancel, b.done = cancel, make(chan struct{})
+		go b.listen(ctx, b.done)
+	}
+
+	return func() {
+		b.mu.Lock()
+		delete(b.subs, id)
+		if len(b.subs) > 0 || b.cancel == nil {
+			b.mu.Unlock()
+			return
+		}
+		cancel, done := b.cancel, b.done
+		b.cancel, b.done = nil, nil
+		b.mu.Unlock()
+
+		cancel()
+		<-done
+	}, nil
+}
+
+// Close stops the subscription and releases the connections of the bus
+func (b *Bus) Close() error {
+
+	b.mu.Lock()
+	cancel, done := b.cancel, b.done
+	b.cancel, b.done = nil, nil
+	b.subs = make(map[int]func(ctx context.Context, inv ivmsesman.Invalidation))
+	b.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+	return b.pool.close()
+}
+
+// listen keeps the subscription until ctx is done
+func (b *Bus) listen(ctx context.Context, done chan struct{}) {
+
+	defer close(done)
+
+	delay := minResubscribe
+	lost := false
+	for {
+		subscribed, err := b.receive(ctx, lost)
+		if ctx.Err() != nil {
+			return
+		}
+		if subscribed {
+			delay = minResubscribe
+		}
+		lost = true
+		b.logger().WarnContext(ctx, "invalidation bus subscription lost", slog.String("channel", b.channel), slog.Any("error", err))
+
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		if delay *= 2; delay > maxResubscribe {
+			delay = maxResubscribe
+		}
+	}
+}
+
+// receive subscribes on a new connection and delivers the invalidations until the connection breaks or ctx
+// is done. After a lost subscription the subscribers first get an invalidation of all sessions.
+func (b *Bus) receive(ctx context.Context, lost bool) (bool, error) {
+
+	c, err := b.pool.get()
+	if err != nil {
+		return false, err
+	}
+	defer c.nc.Close()
+	release := c.watch(ctx)
+	defer release()
+
+	if _, err = c.do("SUBSCRIBE", b.channel); err != nil {
+		return false, err
+	}
+	if lost {
+		b.deliver(ctx, ivmsesman.Invalidation{All: true})
+	}
+
+	for {
+		r, err := c.read()
+		if err != nil {
+			return true, err
+		}
+		msg, ok := r.([]interface{})
+		if !ok || len(msg) != 3 || msg[0] != "message" {
+			continue
+		}
+		payload, _ := msg[2].(string)
+
+		var inv ivmsesman.Invalidation
+		if err := json.Unmarshal([]byte(payload), &inv); err != nil {
+			b.logger().WarnContext(ctx, "invalid invalidation message", slog.String("channel", b.channel), slog.Any("error", err))
+			continue
+		}
+		b.deliver(ctx, inv)
+	}
+}
+
+// deliver calls the subscribers with the invalidation
+func (b *Bus) deliver(ctx context.Context, inv ivmsesman.Invalidation) {
+
+	b.mu.Lock()
+	subs := make([]func(ctx context.Context, inv ivmsesman.Invalidation), 0, len(b.subs))
+	for _, fn := range b.subs {
+		subs = append(subs, fn)
+	}
+	b.mu.Unlock()
+
+	for _, fn := range subs {
+		fn(ctx, inv)
+	}
+}
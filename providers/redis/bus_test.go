@@ -0,0 +1,98 @@
+package redis
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dasiyes/ivmsesman"
+)
+
+// received collects the invalidations of a subscriber
+func received(t *testing.T, bus *Bus) (chan ivmsesman.Invalidation, func()) {
+	t.Helper()
+
+	ch := make(chan ivmsesman.Invalidation, 16)
+	unsubscribe, err := bus.Subscribe(func(ctx context.Context, inv ivmsesman.Invalidation) {
+		ch <- inv
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return ch, unsubscribe
+}
+
+func next(t *testing.T, ch chan ivmsesman.Invalidation) ivmsesman.Invalidation {
+	t.Helper()
+
+	select {
+	case inv := <-ch:
+		return inv
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected an invalidation")
+		return ivmsesman.Invalidation{}
+	}
+}
+
+// publish publishes the invalidation once the subscription of the bus is active
+func publish(t *testing.T, bus *Bus, f *fakeRedis, inv ivmsesman.Invalidation) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		f.mu.Lock()
+		n := len(f.subs[bus.channel])
+		f.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the bus subscribed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := bus.Publish(context.Background(), inv); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestBus(t *testing.T) {
+	f := newFakeRedis(t)
+	bus := NewBus(Options{Addr: f.addr()})
+	defer bus.Close()
+
+	ch, unsubscribe := received(t, bus)
+
+	want := ivmsesman.Invalidation{Origin: "a", SessionIDs: []string{"sid-1", "sid-0"}}
+	publish(t, bus, f, want)
+	if got := next(t, ch); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected invalidation %+v, got %+v", want, got)
+	}
+
+	// a lost subscription is restored and all sessions are invalidated
+	f.dropSubscribers()
+	if got := next(t, ch); !got.All {
+		t.Errorf("expected an invalidation of all sessions after the subscription was lost, got %+v", got)
+	}
+	publish(t, bus, f, want)
+	if got := next(t, ch); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected invalidation %+v, got %+v", want, got)
+	}
+
+	// the last subscriber leaving stops the subscription
+	unsubscribe()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		f.mu.Lock()
+		n := len(f.subs[bus.channel])
+		f.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the subscription stopped, got %d subscribers", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
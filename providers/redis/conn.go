@@ -0,0 +1,439 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Error is an error reply returned by the Redis server
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// errNilReply is returned by the typed helpers when the server replied with a null bulk string
+var errNilReply = errors.New("redis: nil reply")
+
+// errTxAborted is returned when a transaction was aborted by the server, as a watched key changed
+var errTxAborted = errors.New("redis: transaction aborted")
+
+// watchAttempts is the number of attempts of a watched transaction before it fails with errTxAborted
+const watchAttempts = 3
+
+// conn is a single RESP connection to the Redis server
+type conn struct {
+	nc net.Conn
+	br *bufio.Reader
+	bw *bufio.Writer
+}
+
+// pool keeps a small set of idle connections and dials new ones on demand
+type pool struct {
+	addr        string
+	password    string
+	db          int
+	dialTimeout time.Duration
+	maxIdle     int
+
+	mu   sync.Mutex
+	idle []*conn
+}
+
+// get returns an idle connection or dials a new one
+func (p *pool) get() (*conn, error) {
+	p.mu.Lock()
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return c, nil
+	}
+	p.mu.Unlock()
+
+	nc, err := net.DialTimeout("tcp", p.addr, p.dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("redis: dial %s: %v", p.addr, err)
+	}
+	c := &conn{nc: nc, br: bufio.NewReader(nc), bw: bufio.NewWriter(nc)}
+
+	if p.password != "" {
+		if _, err := c.do("AUTH", p.password); err != nil {
+			c.nc.Close()
+			return nil, err
+		}
+	}
+	if p.db != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(p.db)); err != nil {
+			c.nc.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// put returns a healthy connection to the pool. Broken connections must be closed instead.
+func (p *pool) put(c *conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.idle) >= p.maxIdle {
+		c.nc.Close()
+		return
+	}
+	p.idle = append(p.idle, c)
+}
+
+// close closes all idle connections
+func (p *pool) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var err error
+	for _, c := range p.idle {
+		if e := c.nc.Close(); e != nil {
+			err = e
+		}
+	}
+	p.idle = nil
+	return err
+}
+
+// do sends a single command and returns its reply
+func (p *pool) do(ctx context.Context, args ...string) (interface{}, error) {
+	replies, err := p.pipeline(ctx, [][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := replies[0].(Error); ok {
+		return nil, e
+	}
+	return replies[0], nil
+}
+
+// pipeline sends all commands in one round-trip and returns their replies in order.
+// Error replies are returned as values of type Error. The context deadline and
+// cancellation are applied to the connection for the whole round-trip.
+func (p *pool) pipeline(ctx context.Context, cmds [][]string) ([]interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+
+	release := c.watch(ctx)
+	replies, err := c.roundTrip(cmds)
+	release()
+
+	if err != nil {
+		c.nc.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if ctx.Err() != nil {
+		// the watcher may have already moved the deadline of the connection
+		c.nc.Close()
+	} else {
+		p.put(c)
+	}
+	return replies, nil
+}
+
+// tx runs the commands inside MULTI/EXEC and returns the replies of the queued commands
+func (p *pool) tx(ctx context.Context, cmds [][]string) ([]interface{}, error) {
+	all := make([][]string, 0, len(cmds)+2)
+	all = append(all, []string{"MULTI"})
+	all = append(all, cmds...)
+	all = append(all, []string{"EXEC"})
+
+	replies, err := p.pipeline(ctx, all)
+	if err != nil {
+		return nil, err
+	}
+	return execReplies(replies)
+}
+
+// watched runs a check-and-set transaction on one connection. The keys are watched and read with the read
+// command in one round-trip, then the commands decide returns for the reply of read run inside MULTI/EXEC.
+// When a watched key changed in between, the transaction is aborted by the server and retried from the
+// WATCH. No transaction runs, and nil replies are returned, when decide returns no commands.
+func (p *pool) watched(ctx context.Context, keys []string, read []string, decide func(interface{}) ([][]string, error)) ([]interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+
+	release := c.watch(ctx)
+	res, broken, err := c.checkAndSet(keys, read, decide)
+	release()
+
+	if broken || ctx.Err() != nil {
+		c.nc.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	} else {
+		p.put(c)
+	}
+	return res, err
+}
+
+// checkAndSet runs the attempts of a watched transaction. broken reports an I/O error that leaves the
+// connection unusable.
+func (c *conn) checkAndSet(keys []string, read []string, decide func(interface{}) ([][]string, error)) (res []interface{}, broken bool, err error) {
+
+	unwatch := func(err error) ([]interface{}, bool, error) {
+		if _, e := c.do("UNWATCH"); e != nil {
+			if _, ok := e.(Error); !ok {
+				return nil, true, e
+			}
+		}
+		return nil, false, err
+	}
+
+	watch := append([]string{"WATCH"}, keys...)
+	for attempt := 0; attempt < watchAttempts; attempt++ {
+		replies, err := c.roundTrip([][]string{watch, read})
+		if err != nil {
+			return nil, true, err
+		}
+		for _, r := range replies {
+			if e, ok := r.(Error); ok {
+				return unwatch(e)
+			}
+		}
+
+		cmds, err := decide(replies[1])
+		if err != nil || len(cmds) == 0 {
+			return unwatch(err)
+		}
+
+		all := make([][]string, 0, len(cmds)+2)
+		all = append(all, []string{"MULTI"})
+		all = append(all, cmds...)
+		all = append(all, []string{"EXEC"})
+		if replies, err = c.roundTrip(all); err != nil {
+			return nil, true, err
+		}
+		res, err := execReplies(replies)
+		if err == errTxAborted {
+			continue
+		}
+		return res, false, err
+	}
+	return nil, false, errTxAborted
+}
+
+// execReplies returns the replies of the commands queued by MULTI/EXEC, or the first error reply
+func execReplies(replies []interface{}) ([]interface{}, error) {
+	for _, r := range replies[:len(replies)-1] {
+		if e, ok := r.(Error); ok {
+			return nil, e
+		}
+	}
+	res, ok := replies[len(replies)-1].([]interface{})
+	if !ok {
+		if e, ok := replies[len(replies)-1].(Error); ok {
+			return nil, e
+		}
+		return nil, errTxAborted
+	}
+	for _, r := range res {
+		if e, ok := r.(Error); ok {
+			return nil, e
+		}
+	}
+	return res, nil
+}
+
+// watch applies the context deadline to the connection and interrupts the pending
+// I/O when the context is cancelled. The returned func must be called when the
+// round-trip is over and before the connection is reused.
+func (c *conn) watch(ctx context.Context) func() {
+	dl, _ := ctx.Deadline()
+	_ = c.nc.SetDeadline(dl)
+
+	done := ctx.Done()
+	if done == nil {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-done:
+			_ = c.nc.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-exited
+	}
+}
+
+// roundTrip writes all commands and reads one reply per command
+func (c *conn) roundTrip(cmds [][]string) ([]interface{}, error) {
+	for _, args := range cmds {
+		if err := c.write(args); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.bw.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]interface{}, 0, len(cmds))
+	for range cmds {
+		r, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, r)
+	}
+	return replies, nil
+}
+
+// do sends a single command on the connection and reads its reply
+func (c *conn) do(args ...string) (interface{}, error) {
+	if err := c.write(args); err != nil {
+		return nil, err
+	}
+	if err := c.bw.Flush(); err != nil {
+		return nil, err
+	}
+	r, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := r.(Error); ok {
+		return nil, e
+	}
+	return r, nil
+}
+
+// write encodes the command as a RESP array of bulk strings
+func (c *conn) write(args []string) error {
+	if _, err := fmt.Fprintf(c.bw, "*%d\r\n", len(args)); err != nil {
+		return err
+	}
+	for _, a := range args {
+		if _, err := fmt.Fprintf(c.bw, "$%d\r\n%s\r\n", len(a), a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read decodes a single RESP reply. Bulk strings are returned as string (nil for null),
+// integers as int64, arrays as []interface{} and error replies as Error.
+func (c *conn) read() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return Error(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid bulk length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.br, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid array length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		arr := make([]interface{}, n)
+		for i := range arr {
+			if arr[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
+
+// readLine reads a CRLF terminated line without the terminator
+func (c *conn) readLine() (string, error) {
+	line, err := c.br.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("redis: malformed line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+// toInt converts an integer reply
+func toInt(r interface{}) (int64, error) {
+	switch v := r.(type) {
+	case int64:
+		return v, nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	case nil:
+		return 0, errNilReply
+	default:
+		return 0, fmt.Errorf("redis: unexpected integer reply type %T", r)
+	}
+}
+
+// toStrings converts an array reply of bulk strings. Null elements become empty strings.
+func toStrings(r interface{}) ([]string, error) {
+	arr, ok := r.([]interface{})
+	if !ok {
+		if r == nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("redis: unexpected array reply type %T", r)
+	}
+	out := make([]string, len(arr))
+	for i, v := range arr {
+		if s, ok := v.(string); ok {
+			out[i] = s
+		}
+	}
+	return out, nil
+}
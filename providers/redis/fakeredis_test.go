@@ -0,0 +1,560 @@
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// status is a simple string reply
+type status string
+
+// fakeRedis is an in-process RESP stand-in implementing the subset of
+// commands used by the provider
+type fakeRedis struct {
+	ln net.Listener
+
+	mu     sync.Mutex
+	hashes map[string]map[string]string
+	zsets  map[string]map[string]float64
+	expire map[string]time.Time
+	// versions count the changes of the keys, for WATCH
+	versions map[string]uint64
+	// after, when set, runs after every command outside of a transaction, with the lock held
+	after func(args []string)
+	// subs are the subscribed connections by channel
+	subs map[string]map[*fakeConn]bool
+}
+
+// fakeConn is a client connection. The writes are locked, as a PUBLISH on another connection writes
+// the messages to the subscribed ones.
+type fakeConn struct {
+	nc net.Conn
+	mu sync.Mutex
+	bw *bufio.Writer
+}
+
+func (fc *fakeConn) reply(r interface{}, flush bool) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	writeReply(fc.bw, r)
+	if !flush {
+		return nil
+	}
+	return fc.bw.Flush()
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	f := &fakeRedis{
+		ln:       ln,
+		hashes:   make(map[string]map[string]string),
+		zsets:    make(map[string]map[string]float64),
+		expire:   make(map[string]time.Time),
+		versions: make(map[string]uint64),
+		subs:     make(map[string]map[*fakeConn]bool),
+	}
+	go f.serve()
+	t.Cleanup(func() { ln.Close() })
+	return f
+}
+
+func (f *fakeRedis) addr() string {
+	return f.ln.Addr().String()
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		c, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(c)
+	}
+}
+
+func (f *fakeRedis) handle(c net.Conn) {
+	fc := &fakeConn{nc: c, bw: bufio.NewWriter(c)}
+	defer func() {
+		f.mu.Lock()
+		for _, conns := range f.subs {
+			delete(conns, fc)
+		}
+		f.mu.Unlock()
+		c.Close()
+	}()
+
+	br := bufio.NewReader(c)
+	var queue [][]string
+	inMulti := false
+	watched := make(map[string]uint64)
+
+	for {
+		args, err := readCommand(br)
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(args[0])
+
+		var r interface{}
+		switch {
+		case cmd == "MULTI":
+			inMulti, queue = true, nil
+			r = status("OK")
+		case cmd == "EXEC":
+			f.mu.Lock()
+			aborted := false
+			for k, v := range watched {
+				f.expired(k)
+				aborted = aborted || f.versions[k] != v
+			}
+			if !aborted {
+				replies := make([]interface{}, len(queue))
+				for i, q := range queue {
+					replies[i] = f.exec(q)
+				}
+				r = replies
+			}
+			f.mu.Unlock()
+			inMulti, watched = false, make(map[string]uint64)
+		case inMulti:
+			queue = append(queue, args)
+			r = status("QUEUED")
+		case cmd == "WATCH":
+			f.mu.Lock()
+			for _, k := range args[1:] {
+				f.expired(k)
+				watched[k] = f.versions[k]
+			}
+			f.mu.Unlock()
+			r = status("OK")
+		case cmd == "UNWATCH":
+			watched = make(map[string]uint64)
+			r = status("OK")
+		case cmd == "SUBSCRIBE":
+			f.mu.Lock()
+			for i, ch := range args[1:] {
+				if f.subs[ch] == nil {
+					f.subs[ch] = make(map[*fakeConn]bool)
+				}
+				f.subs[ch][fc] = true
+				if i < len(args)-2 {
+					_ = fc.reply([]interface{}{"subscribe", ch, int64(i + 1)}, false)
+				} else {
+					r = []interface{}{"subscribe", ch, int64(i + 1)}
+				}
+			}
+			f.mu.Unlock()
+		case cmd == "PUBLISH" && len(args) == 3:
+			f.mu.Lock()
+			n := int64(0)
+			for sub := range f.subs[args[1]] {
+				_ = sub.reply([]interface{}{"message", args[1], args[2]}, true)
+				n++
+			}
+			f.mu.Unlock()
+			r = n
+		default:
+			f.mu.Lock()
+			r = f.exec(args)
+			if f.after != nil {
+				f.after(args)
+			}
+			f.mu.Unlock()
+		}
+		if err := fc.reply(r, br.Buffered() == 0); err != nil {
+			return
+		}
+	}
+}
+
+// dropSubscribers closes the subscribed connections
+func (f *fakeRedis) dropSubscribers() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, conns := range f.subs {
+		for fc := range conns {
+			fc.nc.Close()
+		}
+	}
+}
+
+// expired drops the key if its TTL elapsed
+func (f *fakeRedis) expired(key string) {
+	if at, ok := f.expire[key]; ok && !time.Now().Before(at) {
+		f.versions[key]++
+		delete(f.hashes, key)
+		delete(f.zsets, key)
+		delete(f.expire, key)
+	}
+}
+
+func (f *fakeRedis) exists(key string) bool {
+	f.expired(key)
+	_, h := f.hashes[key]
+	_, z := f.zsets[key]
+	return h || z
+}
+
+func (f *fakeRedis) del(key string) bool {
+	ok := f.exists(key)
+	delete(f.hashes, key)
+	delete(f.zsets, key)
+	delete(f.expire, key)
+	return ok
+}
+
+// writes are the commands changing their keys, with the number of keys they take (0 for all the arguments)
+var writes = map[string]int{"DEL": 0, "RENAME": 2, "EXPIRE": 1, "HSET": 1, "HDEL": 1, "ZADD": 1, "ZREM": 1, "ZREMRANGEBYSCORE": 1}
+
+// exec runs a single command. The caller holds the lock.
+func (f *fakeRedis) exec(args []string) interface{} {
+	cmd := strings.ToUpper(args[0])
+	if n, ok := writes[cmd]; ok {
+		keys := args[1:]
+		if n > 0 && len(keys) > n {
+			keys = keys[:n]
+		}
+		for _, k := range keys {
+			f.versions[k]++
+		}
+	}
+	switch cmd {
+	case "PING":
+		return status("PONG")
+	case "AUTH", "SELECT":
+		return status("OK")
+	case "DEL":
+		var n int64
+		for _, k := range args[1:] {
+			if f.del(k) {
+				n++
+			}
+		}
+		return n
+	case "EXISTS":
+		var n int64
+		for _, k := range args[1:] {
+			if f.exists(k) {
+				n++
+			}
+		}
+		return n
+	case "RENAME":
+		if !f.exists(args[1]) {
+			return errors.New("ERR no such key")
+		}
+		h, z, at := f.hashes[args[1]], f.zsets[args[1]], f.expire[args[1]]
+		f.del(args[1])
+		f.del(args[2])
+		if h != nil {
+			f.hashes[args[2]] = h
+		}
+		if z != nil {
+			f.zsets[args[2]] = z
+		}
+		if !at.IsZero() {
+			f.expire[args[2]] = at
+		}
+		return status("OK")
+	case "EXPIRE":
+		if !f.exists(args[1]) {
+			return int64(0)
+		}
+		sec, _ := strconv.ParseInt(args[2], 10, 64)
+		f.expire[args[1]] = time.Now().Add(time.Duration(sec) * time.Second)
+		return int64(1)
+	case "HSET":
+		f.expired(args[1])
+		h, ok := f.hashes[args[1]]
+		if !ok {
+			h = make(map[string]string)
+			f.hashes[args[1]] = h
+		}
+		var n int64
+		for i := 2; i+1 < len(args); i += 2 {
+			if _, ok := h[args[i]]; !ok {
+				n++
+			}
+			h[args[i]] = args[i+1]
+		}
+		return n
+	case "HDEL":
+		f.expired(args[1])
+		var n int64
+		if h, ok := f.hashes[args[1]]; ok {
+			for _, fl := range args[2:] {
+				if _, ok := h[fl]; ok {
+					delete(h, fl)
+					n++
+				}
+			}
+		}
+		return n
+	case "HGETALL":
+		f.expired(args[1])
+		out := []interface{}{}
+		for k, v := range f.hashes[args[1]] {
+			out = append(out, k, v)
+		}
+		return out
+	case "HMGET":
+		f.expired(args[1])
+		out := make([]interface{}, 0, len(args)-2)
+		h := f.hashes[args[1]]
+		for _, fl := range args[2:] {
+			if v, ok := h[fl]; ok {
+				out = append(out, v)
+			} else {
+				out = append(out, nil)
+			}
+		}
+		return out
+	case "ZADD":
+		f.expired(args[1])
+		z, ok := f.zsets[args[1]]
+		if !ok {
+			z = make(map[string]float64)
+			f.zsets[args[1]] = z
+		}
+		var n int64
+		for i := 2; i+1 < len(args); i += 2 {
+			sc, _ := strconv.ParseFloat(args[i], 64)
+			if _, ok := z[args[i+1]]; !ok {
+				n++
+			}
+			z[args[i+1]] = sc
+		}
+		return n
+	case "ZREM":
+		var n int64
+		if z, ok := f.zsets[args[1]]; ok {
+			for _, m := range args[2:] {
+				if _, ok := z[m]; ok {
+					delete(z, m)
+					n++
+				}
+			}
+		}
+		return n
+	case "ZCOUNT", "ZRANGEBYSCORE", "ZREMRANGEBYSCORE":
+		z := f.zsets[args[1]]
+		members := make([]string, 0)
+		for m, sc := range z {
+			if inRange(sc, args[2], args[3]) {
+				members = append(members, m)
+			}
+		}
+		sort.Slice(members, func(i, j int) bool {
+			if z[members[i]] != z[members[j]] {
+				return z[members[i]] < z[members[j]]
+			}
+			return members[i] < members[j]
+		})
+		switch cmd {
+		case "ZCOUNT":
+			return int64(len(members))
+		case "ZREMRANGEBYSCORE":
+			for _, m := range members {
+				delete(z, m)
+			}
+			return int64(len(members))
+		}
+		out := make([]interface{}, len(members))
+		for i, m := range members {
+			out[i] = m
+		}
+		return out
+	case "ZRANGEBYLEX":
+		// the members of the same score in the order of the names, with an optional LIMIT offset count
+		z := f.zsets[args[1]]
+		members := make([]string, 0)
+		for m := range z {
+			if inLexRange(m, args[2], args[3]) {
+				members = append(members, m)
+			}
+		}
+		sort.Strings(members)
+		if len(args) == 7 && strings.ToUpper(args[4]) == "LIMIT" {
+			off, _ := strconv.Atoi(args[5])
+			n, _ := strconv.Atoi(args[6])
+			if off > len(members) {
+				off = len(members)
+			}
+			members = members[off:]
+			if n >= 0 && n < len(members) {
+				members = members[:n]
+			}
+		}
+		out := make([]interface{}, len(members))
+		for i, m := range members {
+			out[i] = m
+		}
+		return out
+	case "ZSCAN":
+		// the cursor is the offset in the members sorted by name, COUNT members a page
+		f.expired(args[1])
+		z := f.zsets[args[1]]
+		members := make([]string, 0, len(z))
+		for m := range z {
+			members = append(members, m)
+		}
+		sort.Strings(members)
+		off, _ := strconv.Atoi(args[2])
+		count := 10
+		for i := 3; i+1 < len(args); i += 2 {
+			if strings.ToUpper(args[i]) == "COUNT" {
+				count, _ = strconv.Atoi(args[i+1])
+			}
+		}
+		if off > len(members) {
+			off = len(members)
+		}
+		end, next := off+count, "0"
+		if end < len(members) {
+			next = strconv.Itoa(end)
+		} else {
+			end = len(members)
+		}
+		page := []interface{}{}
+		for _, m := range members[off:end] {
+			page = append(page, m, strconv.FormatFloat(z[m], 'f', -1, 64))
+		}
+		return []interface{}{next, page}
+	case "SCAN":
+		pattern := "*"
+		for i := 2; i+1 < len(args); i += 2 {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				pattern = args[i+1]
+			}
+		}
+		keys := []interface{}{}
+		for k := range f.hashes {
+			if ok, _ := path.Match(pattern, k); ok && f.exists(k) {
+				keys = append(keys, k)
+			}
+		}
+		for k := range f.zsets {
+			if ok, _ := path.Match(pattern, k); ok && f.exists(k) {
+				keys = append(keys, k)
+			}
+		}
+		return []interface{}{"0", keys}
+	default:
+		return fmt.Errorf("ERR unknown command '%s'", args[0])
+	}
+}
+
+// inRange evaluates a ZRANGEBYSCORE min/max pair
+func inRange(sc float64, min, max string) bool {
+	bound := func(s string) (float64, bool) {
+		excl := strings.HasPrefix(s, "(")
+		s = strings.TrimPrefix(s, "(")
+		switch s {
+		case "-inf":
+			return -1e308, excl
+		case "+inf", "inf":
+			return 1e308, excl
+		}
+		v, _ := strconv.ParseFloat(s, 64)
+		return v, excl
+	}
+	lo, loEx := bound(min)
+	hi, hiEx := bound(max)
+	if sc < lo || (loEx && sc == lo) {
+		return false
+	}
+	if sc > hi || (hiEx && sc == hi) {
+		return false
+	}
+	return true
+}
+
+// inLexRange evaluates a ZRANGEBYLEX min/max pair
+func inLexRange(m, min, max string) bool {
+	above := func(b string) bool {
+		switch {
+		case b == "-":
+			return true
+		case b == "+":
+			return false
+		case strings.HasPrefix(b, "("):
+			return m > b[1:]
+		}
+		return m >= strings.TrimPrefix(b, "[")
+	}
+	below := func(b string) bool {
+		switch {
+		case b == "+":
+			return true
+		case b == "-":
+			return false
+		case strings.HasPrefix(b, "("):
+			return m < b[1:]
+		}
+		return m <= strings.TrimPrefix(b, "[")
+	}
+	return above(min) && below(max)
+}
+
+func readCommand(br *bufio.Reader) ([]string, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected command line %q", line)
+	}
+	n, _ := strconv.Atoi(line[1:])
+	args := make([]string, n)
+	for i := range args {
+		l, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSuffix(l, "\r\n")[1:])
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func writeReply(bw *bufio.Writer, r interface{}) {
+	switch v := r.(type) {
+	case nil:
+		bw.WriteString("$-1\r\n")
+	case error:
+		fmt.Fprintf(bw, "-%s\r\n", v.Error())
+	case int64:
+		fmt.Fprintf(bw, ":%d\r\n", v)
+	case status:
+		fmt.Fprintf(bw, "+%s\r\n", v)
+	case string:
+		fmt.Fprintf(bw, "$%d\r\n%s\r\n", len(v), v)
+	case []interface{}:
+		fmt.Fprintf(bw, "*%d\r\n", len(v))
+		for _, e := range v {
+			writeReply(bw, e)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/dasiyes/ivmsesman"
+)
+
+// List returns up to limit live sessions selected by the filter, in the order of the ids. The cursor is the
+// id of the last session of the previous page. The ids are read a page at a time from the id index, which
+// is ordered by the id, from the cursor on, and the session hashes of a page in one round-trip, until the
+// page of the sessions matching the filter is full. The first listing of the provider adds to the id index
+// the ids of the time index missing from it, as an export from the start does.
+func (pder *SessionProvider) List(ctx context.Context, filter ivmsesman.SessionFilter, cursor string, limit int) ([]ivmsesman.SessionRecord, string, error) {
+
+	if limit <= 0 {
+		limit = ivmsesman.DefaultListLimit
+	}
+	if !pder.idsIndexed.Load() {
+		if err := pder.indexIDs(ctx); err != nil {
+			return nil, "", fmt.Errorf("err while indexing the session ids, err: %v", err)
+		}
+	}
+
+	from := "-"
+	if cursor != "" {
+		from = "(" + cursor
+	}
+	live := time.Now().Unix() - pder.maxlifetime
+	sessions := make([]ivmsesman.SessionRecord, 0, limit)
+	for {
+		r, err := pder.pool.do(ctx, "ZRANGEBYLEX", pder.idsKey(), from, "+", "LIMIT", "0", strconv.Itoa(limit+1))
+		if err != nil {
+			return nil, "", fmt.Errorf("err while reading the sessions index, err: %v", err)
+		}
+		ids, err := toStrings(r)
+		if err != nil {
+			return nil, "", fmt.Errorf("err while reading the sessions index, err: %v", err)
+		}
+		if len(ids) == 0 {
+			return sessions, "", nil
+		}
+
+		page, err := pder.loadPage(ctx, ids)
+		if err != nil {
+			return nil, "", fmt.Errorf("err while reading the sessions, err: %v", err)
+		}
+		for i, ss := range page {
+			if ss == nil || ss.TimeAccessed < live {
+				continue
+			}
+			state, _ := ss.Value["state"].(string)
+			uid, _ := ss.Value["uid"].(string)
+			if !filter.Match(ss.TimeAccessed, state, uid) {
+				continue
+			}
+			if len(sessions) == limit {
+				return sessions, sessions[limit-1].ID, nil
+			}
+			sessions = append(sessions, ivmsesman.SessionRecord{ID: ids[i], CreatedAt: ss.CreatedAt, TimeAccessed: ss.TimeAccessed, Values: ss.Value})
+		}
+
+		if len(ids) <= limit {
+			return sessions, "", nil
+		}
+		from = "(" + ids[len(ids)-1]
+	}
+}
@@ -1 +1,820 @@
+// Package redis implements the session store provider on top of a Redis instance.
+// It speaks RESP over a plain TCP connection, stores every session as a hash and
+// relies on the native key TTLs for expiring idle sessions.
 package redis
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dasiyes/ivmsesman"
+	"github.com/dasiyes/ivmsesman/internal/provutil"
+)
+
+const (
+	// field holding the session id in the session hash
+	fieldSid = "Sid"
+	// field holding the last time accessed (seconds since epoch) in the session hash
+	fieldTimeAccessed = "TimeAccessed"
+	// field holding the creation time (seconds since epoch) in the session hash
+	fieldCreatedAt = "CreatedAt"
+	// prefix of the hash fields holding the session values
+	valuePrefix = "v:"
+)
+
+// Options configures the Redis session provider
+type Options struct {
+	// Addr is the host:port of the Redis server. Default "localhost:6379"
+	Addr string
+	// Password used with AUTH, if not empty
+	Password string
+	// DB is the database number selected on every new connection
+	DB int
+	// Prefix is prepended to every key written by the provider. Default "ivmsesman:"
+	Prefix string
+	// Maxlifetime is the idle time (in seconds) after which a session key expires. Default 3600
+	Maxlifetime int64
+	// DialTimeout for new connections. Default 5 seconds
+	DialTimeout time.Duration
+	// MaxIdle is the number of idle connections kept in the pool. Default 8
+	MaxIdle int
+}
+
+// SessionProvider is the DAL holding the methods for Redis operations for the SessionManager
+type SessionProvider struct {
+	// Background runs the operations without a context
+	ivmsesman.Background
+
+	pool        *pool
+	prefix      string
+	maxlifetime int64
+	absolute    int64
+	touch       int64
+	log         *slog.Logger
+	onExpired   func(ctx context.Context, sid string)
+	// idsIndexed is set once the ids of the time index were added to the id index
+	idsIndexed atomic.Bool
+}
+
+// New creates a Redis session provider. Connections are dialed lazily on the first operation.
+func New(opts Options) *SessionProvider {
+
+	if opts.Addr == "" {
+		opts.Addr = "localhost:6379"
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = "ivmsesman:"
+	}
+	if opts.Maxlifetime <= 0 {
+		opts.Maxlifetime = 3600
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	if opts.MaxIdle <= 0 {
+		opts.MaxIdle = 8
+	}
+
+	pder := &SessionProvider{
+		pool: &pool{
+			addr:        opts.Addr,
+			password:    opts.Password,
+			db:          opts.DB,
+			dialTimeout: opts.DialTimeout,
+			maxIdle:     opts.MaxIdle,
+		},
+		prefix:      opts.Prefix,
+		maxlifetime: opts.Maxlifetime,
+	}
+	pder.Background = ivmsesman.Background{Repo: pder}
+	return pder
+}
+
+// SetLogger sets the logger of the provider events
+func (pder *SessionProvider) SetLogger(l *slog.Logger) {
+	pder.log = l
+}
+
+// logger returns the logger set or the slog default one
+func (pder *SessionProvider) logger() *slog.Logger {
+	if pder.log != nil {
+		return pder.log
+	}
+	return slog.Default()
+}
+
+// SetExpiryPolicy sets the idle timeout as the key TTL and the absolute timeout checked when a session
+// is read. It is not safe to call it while the provider is in use.
+func (pder *SessionProvider) SetExpiryPolicy(p ivmsesman.ExpiryPolicy) {
+	if p.Idle > 0 {
+		pder.maxlifetime = p.Idle
+	}
+	pder.absolute = p.Absolute
+	pder.touch = p.Touch
+}
+
+// SetExpiryListener sets the func called with the id of every session removed as expired. The sessions
+// expired by their key TTL are reported by SessionGC. It is not safe to call it while the provider is in use.
+func (pder *SessionProvider) SetExpiryListener(fn func(ctx context.Context, sid string)) {
+	pder.onExpired = fn
+}
+
+// Close releases the idle connections of the provider
+func (pder *SessionProvider) Close() error {
+	return pder.pool.close()
+}
+
+// sessionKey is the key of the hash holding the session data
+func (pder *SessionProvider) sessionKey(sid string) string {
+	return pder.prefix + "session:" + sid
+}
+
+// indexKey is the key of the sorted set of session ids scored by their last time accessed
+func (pder *SessionProvider) indexKey() string {
+	return pder.prefix + "sessions"
+}
+
+// idsKey is the key of the sorted set of session ids with the same score, read in the order of the ids
+// with ZRANGEBYLEX
+func (pder *SessionProvider) idsKey() string {
+	return pder.prefix + "sessionids"
+}
+
+// blacklistKey is the key of the hash holding the blacklist entry of an ip
+func (pder *SessionProvider) blacklistKey(ip string) string {
+	return pder.prefix + "blacklist:" + ip
+}
+
+// blacklistIndexKey is the key of the sorted set of blacklisted ips scored by their creation time
+func (pder *SessionProvider) blacklistIndexKey() string {
+	return pder.prefix + "blacklist"
+}
+
+// NewSessionContext creates a new session value in the store with sid as a key
+func (pder *SessionProvider) NewSessionContext(ctx context.Context, sid string) (ivmsesman.SessionStore, error) {
+
+	v := make(map[string]interface{})
+	v["state"] = "New"
+
+	now := time.Now().Unix()
+	newsess := &Session{Sid: sid, CreatedAt: now, TimeAccessed: now, Value: v}
+
+	key := pder.sessionKey(sid)
+	hset := []string{"HSET", key, fieldSid, sid, fieldCreatedAt, strconv.FormatInt(now, 10),
+		fieldTimeAccessed, strconv.FormatInt(now, 10)}
+	for k, val := range v {
+		enc, err := encodeValue(val)
+		if err != nil {
+			return nil, err
+		}
+		hset = append(hset, valuePrefix+k, enc)
+	}
+
+	_, err := pder.pool.tx(ctx, [][]string{
+		{"DEL", key},
+		hset,
+		{"EXPIRE", key, strconv.FormatInt(pder.maxlifetime, 10)},
+		{"ZADD", pder.indexKey(), strconv.FormatInt(newsess.TimeAccessed, 10), sid},
+		{"ZADD", pder.idsKey(), "0", sid},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to save in session repository - error: %v", err)
+	}
+
+	return newsess.bind(pder), nil
+}
+
+// FindOrCreateContext will first search the store for a session value with provided sid. If not not found, a new session value will be created and stored in the session store
+func (pder *SessionProvider) FindOrCreateContext(ctx context.Context, sid string) (ivmsesman.SessionStore, error) {
+
+	ss, err := pder.FindContext(ctx, sid)
+	if err == ivmsesman.ErrInvalidSessionID {
+		return pder.NewSessionContext(ctx, sid)
+	}
+	return ss, err
+}
+
+// FindContext returns the session sid without creating it, ivmsesman.ErrInvalidSessionID when the store does not hold it
+func (pder *SessionProvider) FindContext(ctx context.Context, sid string) (ivmsesman.SessionStore, error) {
+
+	ss, err := pder.load(ctx, sid)
+	if err != nil {
+		return nil, fmt.Errorf("err while read session id: %v, err: %v", sid, err)
+	}
+	if ss == nil {
+		return nil, ivmsesman.ErrInvalidSessionID
+	}
+
+	if now := time.Now().Unix(); pder.touchDue(ss.TimeAccessed, now) {
+		if err := pder.UpdateTimeAccessedContext(ctx, sid); err != nil {
+			return nil, err
+		}
+		ss.TimeAccessed = now
+	}
+
+	return ss, nil
+}
+
+// load reads the session hash. It returns nil session when the key does not exist.
+func (pder *SessionProvider) load(ctx context.Context, sid string) (*Session, error) {
+
+	r, err := pder.pool.do(ctx, "HGETALL", pder.sessionKey(sid))
+	if err != nil {
+		return nil, err
+	}
+	fields, err := toStrings(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return pder.decodeHash(ctx, sid, fields)
+}
+
+// loadPage reads the session hashes of the ids in one round-trip. The sessions are returned in the order of
+// the ids, nil for the ones not found; the ids of the hashes found missing are pruned from the indexes.
+func (pder *SessionProvider) loadPage(ctx context.Context, ids []string) ([]*Session, error) {
+
+	cmds := make([][]string, len(ids))
+	for i, sid := range ids {
+		cmds[i] = []string{"HGETALL", pder.sessionKey(sid)}
+	}
+	replies, err := pder.pool.pipeline(ctx, cmds)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]*Session, len(ids))
+	var missing []string
+	for i, r := range replies {
+		if e, ok := r.(Error); ok {
+			return nil, e
+		}
+		fields, err := toStrings(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) == 0 {
+			missing = append(missing, ids[i])
+			continue
+		}
+		if sessions[i], err = pder.decodeHash(ctx, ids[i], fields); err != nil {
+			return nil, err
+		}
+	}
+	pder.prune(ctx, missing)
+	return sessions, nil
+}
+
+// prune removes from the indexes the ids of the sessions whose hashes expired with the key TTL, which
+// SessionGC would remove otherwise. The hashes are watched, so nothing is removed when a session of the
+// ids was created again meanwhile.
+func (pder *SessionProvider) prune(ctx context.Context, ids []string) {
+
+	if len(ids) == 0 {
+		return
+	}
+	keys := make([]string, len(ids))
+	for i, sid := range ids {
+		keys[i] = pder.sessionKey(sid)
+	}
+	_, err := pder.pool.watched(ctx, keys, append([]string{"EXISTS"}, keys...),
+		func(r interface{}) ([][]string, error) {
+			if n, _ := toInt(r); n != 0 {
+				return nil, nil
+			}
+			return [][]string{
+				append([]string{"ZREM", pder.indexKey()}, ids...),
+				append([]string{"ZREM", pder.idsKey()}, ids...),
+			}, nil
+		})
+	if err != nil {
+		pder.logger().ErrorContext(ctx, "error pruning the sessions indexes", slog.Any("error", err))
+	}
+}
+
+// decodeHash decodes the fields of a session hash. A session past the absolute timeout is removed and
+// returned nil.
+func (pder *SessionProvider) decodeHash(ctx context.Context, sid string, fields []string) (*Session, error) {
+
+	ss := &Session{Sid: sid, Value: make(map[string]interface{})}
+	for i := 0; i+1 < len(fields); i += 2 {
+		name, raw := fields[i], fields[i+1]
+		switch {
+		case name == fieldTimeAccessed:
+			ss.TimeAccessed, _ = strconv.ParseInt(raw, 10, 64)
+		case name == fieldCreatedAt:
+			ss.CreatedAt, _ = strconv.ParseInt(raw, 10, 64)
+		case strings.HasPrefix(name, valuePrefix):
+			val, err := decodeValue(raw)
+			if err != nil {
+				return nil, fmt.Errorf("error decoding session value %q: %v", name, err)
+			}
+			ss.Value[strings.TrimPrefix(name, valuePrefix)] = val
+		}
+	}
+
+	if pder.pastAbsolute(ss.CreatedAt) {
+		return nil, pder.expireSession(ctx, sid)
+	}
+	return ss.bind(pder), nil
+}
+
+// pastAbsolute reports if a session created at the unix time passed the absolute timeout
+func (pder *SessionProvider) pastAbsolute(createdAt int64) bool {
+	return ivmsesman.ExpiryPolicy{Absolute: pder.absolute}.Expired(createdAt, 0, time.Now().Unix())
+}
+
+// touchDue reports if the last access time of a session accessed at the unix time is to be rewritten
+func (pder *SessionProvider) touchDue(accessedAt, now int64) bool {
+	return ivmsesman.ExpiryPolicy{Touch: pder.touch}.TouchDue(accessedAt, now)
+}
+
+// alive reports if the session did not pass the absolute timeout, removing it otherwise.
+// The idle timeout is enforced by the key TTL.
+func (pder *SessionProvider) alive(ctx context.Context, sid string) (bool, error) {
+
+	if pder.absolute <= 0 {
+		return true, nil
+	}
+
+	r, err := pder.pool.do(ctx, "HMGET", pder.sessionKey(sid), fieldSid, fieldCreatedAt)
+	if err != nil {
+		return false, err
+	}
+	fields, err := toStrings(r)
+	if err != nil || len(fields) != 2 {
+		return false, err
+	}
+	if fields[0] == "" {
+		return false, nil
+	}
+
+	created, _ := strconv.ParseInt(fields[1], 10, 64)
+	if pder.pastAbsolute(created) {
+		return false, pder.expireSession(ctx, sid)
+	}
+	return true, nil
+}
+
+// setIfAlive runs the commands in a transaction if the session of sid exists and did not pass the absolute
+// timeout. The session hash is watched from the check to the transaction, so a session removed in between
+// is not recreated by the commands. It reports false when the session was not found; a session past the
+// absolute timeout is removed.
+func (pder *SessionProvider) setIfAlive(ctx context.Context, sid string, cmds [][]string) (bool, error) {
+
+	key := pder.sessionKey(sid)
+	found, expired := false, false
+	_, err := pder.pool.watched(ctx, []string{key}, []string{"HMGET", key, fieldSid, fieldCreatedAt},
+		func(r interface{}) ([][]string, error) {
+			fields, err := toStrings(r)
+			if err != nil || len(fields) != 2 {
+				return nil, err
+			}
+			created, _ := strconv.ParseInt(fields[1], 10, 64)
+			found = fields[0] != ""
+			expired = found && pder.pastAbsolute(created)
+			if !found || expired {
+				return nil, nil
+			}
+			return cmds, nil
+		})
+	if err != nil {
+		return false, err
+	}
+	if expired {
+		return false, pder.expireSession(ctx, sid)
+	}
+	return found, nil
+}
+
+// expireSession removes a session past the absolute timeout and reports it
+func (pder *SessionProvider) expireSession(ctx context.Context, sid string) error {
+
+	if err := pder.DestroySIDContext(ctx, sid); err != nil {
+		return err
+	}
+	if pder.onExpired != nil {
+		pder.onExpired(ctx, sid)
+	}
+	return nil
+}
+
+// DestroySIDContext will remove a session data from the storage
+func (pder *SessionProvider) DestroySIDContext(ctx context.Context, sid string) error {
+
+	_, err := pder.pool.tx(ctx, [][]string{
+		{"DEL", pder.sessionKey(sid)},
+		{"ZREM", pder.indexKey(), sid},
+		{"ZREM", pder.idsKey(), sid},
+	})
+	return err
+}
+
+// RegenerateContext renames the session hash of oldsid to newsid, keeping the session values
+func (pder *SessionProvider) RegenerateContext(ctx context.Context, oldsid, newsid string) (ivmsesman.SessionStore, error) {
+
+	oldkey, newkey := pder.sessionKey(oldsid), pder.sessionKey(newsid)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	// the old hash is watched, so the rename runs only if it still exists and the HSET cannot create newkey
+	ok, err := pder.setIfAlive(ctx, oldsid, [][]string{
+		{"RENAME", oldkey, newkey},
+		{"HSET", newkey, fieldSid, newsid, fieldTimeAccessed, now},
+		{"EXPIRE", newkey, strconv.FormatInt(pder.maxlifetime, 10)},
+		{"ZREM", pder.indexKey(), oldsid},
+		{"ZADD", pder.indexKey(), now, newsid},
+		{"ZREM", pder.idsKey(), oldsid},
+		{"ZADD", pder.idsKey(), "0", newsid},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("err while regenerating session id %v, err: %v", oldsid, err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("session id %v not found", oldsid)
+	}
+
+	ss, err := pder.load(ctx, newsid)
+	if err != nil {
+		return nil, fmt.Errorf("err while read session id: %v, err: %v", newsid, err)
+	}
+	if ss == nil {
+		return nil, fmt.Errorf("session id %v not found", newsid)
+	}
+	return ss, nil
+}
+
+// SessionGCContext removes from the sessions indexes the ids not accessed for maxlifetime seconds, by default
+// the idle timeout. The session hashes themselves are expired by Redis with the key TTL; the ones of a
+// maxlifetime shorter than the idle timeout are deleted with their ids. The expired ids are read and
+// removed from the time index in one transaction, so the ids removed from the id index are the same.
+func (pder *SessionProvider) SessionGCContext(ctx context.Context, maxlifetime int64) {
+
+	if maxlifetime <= 0 {
+		maxlifetime = pder.maxlifetime
+	}
+	to := strconv.FormatInt(time.Now().Unix()-maxlifetime, 10)
+
+	res, err := pder.pool.tx(ctx, [][]string{
+		{"ZRANGEBYSCORE", pder.indexKey(), "-inf", to},
+		{"ZREMRANGEBYSCORE", pder.indexKey(), "-inf", to},
+	})
+	var expired []string
+	if err == nil {
+		expired, err = toStrings(res[0])
+	}
+	if err != nil {
+		pder.logger().ErrorContext(ctx, "error cleaning the expired sessions index", slog.Any("error", err))
+		return
+	}
+	if len(expired) == 0 {
+		return
+	}
+
+	cmds := [][]string{append([]string{"ZREM", pder.idsKey()}, expired...)}
+	if maxlifetime < pder.maxlifetime {
+		del := []string{"DEL"}
+		for _, sid := range expired {
+			del = append(del, pder.sessionKey(sid))
+		}
+		cmds = append(cmds, del)
+	}
+	if _, err := pder.pool.tx(ctx, cmds); err != nil {
+		pder.logger().ErrorContext(ctx, "error cleaning the expired sessions", slog.Any("error", err))
+		return
+	}
+	if pder.onExpired == nil {
+		return
+	}
+	for _, sid := range expired {
+		pder.onExpired(ctx, sid)
+	}
+}
+
+// UpdateTimeAccessedContext will update the time accessed value with now() and extend the key TTL
+func (pder *SessionProvider) UpdateTimeAccessedContext(ctx context.Context, sid string) error {
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	key := pder.sessionKey(sid)
+
+	ok, err := pder.setIfAlive(ctx, sid, [][]string{
+		{"HSET", key, fieldTimeAccessed, now},
+		{"EXPIRE", key, strconv.FormatInt(pder.maxlifetime, 10)},
+		{"ZADD", pder.indexKey(), now, sid},
+		{"ZADD", pder.idsKey(), "0", sid},
+	})
+	if err != nil {
+		return fmt.Errorf("err while updating time accessed for sessions id %v, err: %v", sid, err)
+	}
+	if !ok {
+		return fmt.Errorf("err while updating time accessed for sessions id %v, err: session not found", sid)
+	}
+	return nil
+}
+
+// update writes the session values and removes the deletes values of an existing session, refreshing its
+// last time accessed and TTL
+func (pder *SessionProvider) update(ctx context.Context, sid string, values map[string]interface{}, deletes ...string) error {
+
+	key := pder.sessionKey(sid)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	hset := []string{"HSET", key, fieldTimeAccessed, now}
+	for k, v := range values {
+		enc, err := encodeValue(v)
+		if err != nil {
+			return err
+		}
+		hset = append(hset, valuePrefix+k, enc)
+	}
+
+	cmds := [][]string{hset}
+	if len(deletes) > 0 {
+		hdel := []string{"HDEL", key}
+		for _, n := range deletes {
+			hdel = append(hdel, valuePrefix+n)
+		}
+		cmds = append(cmds, hdel)
+	}
+	cmds = append(cmds,
+		[]string{"EXPIRE", key, strconv.FormatInt(pder.maxlifetime, 10)},
+		[]string{"ZADD", pder.indexKey(), now, sid},
+		[]string{"ZADD", pder.idsKey(), "0", sid})
+
+	ok, err := pder.setIfAlive(ctx, sid, cmds)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("session id %v not found", sid)
+	}
+	return nil
+}
+
+// UpdateSessionStateContext will update the state value with one provided
+func (pder *SessionProvider) UpdateSessionStateContext(ctx context.Context, sid string, state string) error {
+
+	err := pder.update(ctx, sid, map[string]interface{}{"state": state})
+	if err != nil {
+		return fmt.Errorf("err while updating `Value.state` for sessions id %v, err: %v", sid, err)
+	}
+	return nil
+}
+
+// UpdateCodeVerifierContext will update the code verifier (cove) value assigned to the session id
+func (pder *SessionProvider) UpdateCodeVerifierContext(ctx context.Context, sid, cove string) error {
+
+	err := pder.update(ctx, sid, map[string]interface{}{"code_verifier": cove})
+	if err != nil {
+		return fmt.Errorf("err while updating `Value.code_verifier` for sessions id %v, err: %v", sid, err)
+	}
+	return nil
+}
+
+// SaveCodeChallengeAndMethodContext - at step2 of AuthorizationCode flow
+func (pder *SessionProvider) SaveCodeChallengeAndMethodContext(
+	ctx context.Context, sid, coch, mth, code, ru string) error {
+
+	// set code expiration timestamp
+	ce := time.Now().Unix() + 60
+
+	err := pder.update(ctx, sid, map[string]interface{}{
+		"code_challenger":        coch,
+		"code_challenger_method": mth,
+		"auth_code":              code,
+		"code_expire":            ce,
+		"redirect_uri":           ru,
+		"state":                  "InAuth",
+	})
+	if err != nil {
+		return fmt.Errorf("err while updating `Value.code_verifier` for sessions id %v, err: %v", sid, err)
+	}
+	return nil
+}
+
+// GetAuthCodeContext will return the authorization code for a session, if it is InAuth and the code did not expire
+func (pder *SessionProvider) GetAuthCodeContext(ctx context.Context, sid string) map[string]string {
+
+	var ac map[string]string = map[string]string{}
+
+	if ok, err := pder.alive(ctx, sid); err != nil || !ok {
+		return ac
+	}
+
+	r, err := pder.pool.do(ctx, "HMGET", pder.sessionKey(sid),
+		valuePrefix+"state", valuePrefix+"code_expire", valuePrefix+"auth_code",
+		valuePrefix+"code_challenger", valuePrefix+"code_challenger_method")
+	if err != nil {
+		return ac
+	}
+	fields, err := toStrings(r)
+	if err != nil || len(fields) != 5 {
+		return ac
+	}
+
+	vals := make([]interface{}, len(fields))
+	for i, f := range fields {
+		if f == "" {
+			continue
+		}
+		if vals[i], err = decodeValue(f); err != nil {
+			return ac
+		}
+	}
+
+	state, _ := vals[0].(string)
+	ce, _ := vals[1].(int64)
+	if state == "InAuth" && ce > time.Now().Unix() {
+		ac["auth_code"], _ = vals[2].(string)
+		ac["code_challenger"], _ = vals[3].(string)
+		ac["code_challenger_method"], _ = vals[4].(string)
+	}
+	return ac
+}
+
+// ActiveSessionsContext returns the number of currently active sessions in the session store
+func (pder *SessionProvider) ActiveSessionsContext(ctx context.Context) int {
+
+	from := time.Now().Unix() - pder.maxlifetime
+	r, err := pder.pool.do(ctx, "ZCOUNT", pder.indexKey(), "("+strconv.FormatInt(from, 10), "+inf")
+	if err != nil {
+		pder.logger().ErrorContext(ctx, "error counting the active sessions", slog.Any("error", err))
+		return 0
+	}
+	n, _ := toInt(r)
+	return int(n)
+}
+
+// ExistsContext check by sid if a session data exists in the session store
+func (pder *SessionProvider) ExistsContext(ctx context.Context, sid string) bool {
+
+	if ok, err := pder.alive(ctx, sid); err != nil || !ok {
+		return false
+	}
+
+	r, err := pder.pool.do(ctx, "EXISTS", pder.sessionKey(sid))
+	if err != nil {
+		return false
+	}
+	n, _ := toInt(r)
+	return n == 1
+}
+
+// FlushContext will delete all elements for sessions data
+func (pder *SessionProvider) FlushContext(ctx context.Context) error {
+
+	var erritr error
+	cursor := "0"
+	for {
+		r, err := pder.pool.do(ctx, "SCAN", cursor, "MATCH", pder.sessionKey("*"), "COUNT", "100")
+		if err != nil {
+			return fmt.Errorf("error flushing sessions, err: %v", err)
+		}
+		arr, ok := r.([]interface{})
+		if !ok || len(arr) != 2 {
+			return errors.New("error flushing sessions, unexpected SCAN reply")
+		}
+		cursor, _ = arr[0].(string)
+		keys, _ := toStrings(arr[1])
+		if len(keys) > 0 {
+			if _, err := pder.pool.do(ctx, append([]string{"DEL"}, keys...)...); err != nil {
+				erritr = fmt.Errorf("while flushing sessions - delete keys, err: %v", err)
+			}
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+
+	if _, err := pder.pool.do(ctx, "DEL", pder.indexKey(), pder.idsKey()); err != nil {
+		erritr = fmt.Errorf("while flushing sessions - delete index, err: %v", err)
+	}
+	return erritr
+}
+
+// UpdateAuthSessionContext - update state, access and refresh tokens values for auth session
+func (pder *SessionProvider) UpdateAuthSessionContext(ctx context.Context, sid, at, rt, uid string) error {
+
+	err := pder.update(ctx, sid, map[string]interface{}{
+		"at":    at,
+		"rt":    rt,
+		"uid":   uid,
+		"state": "Authed",
+	})
+	if err != nil {
+		return fmt.Errorf("err while updating new authenticated session id %v, err: %v", sid, err)
+	}
+	return nil
+}
+
+// BlacklistingContext adds the @ip to the blacklist with the @path and @data
+func (pder *SessionProvider) BlacklistingContext(ctx context.Context, ip, path string, data interface{}) {
+
+	details, err := encodeValue(data)
+	if err != nil {
+		pder.logger().ErrorContext(ctx, "error adding ip in the blacklist", slog.String("ip", ip), slog.Any("error", err))
+		return
+	}
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	_, err = pder.pool.tx(ctx, [][]string{
+		{"HSET", pder.blacklistKey(ip), "created", now, "requestURI", path, "details", details},
+		{"ZADD", pder.blacklistIndexKey(), now, ip},
+	})
+	if err != nil {
+		pder.logger().ErrorContext(ctx, "error adding ip in the blacklist", slog.String("ip", ip), slog.Any("error", err))
+		return
+	}
+	pder.logger().InfoContext(ctx, "ip added in the blacklist", slog.String("ip", ip), slog.String("path", path))
+}
+
+// IsIPExistInBLContext returns boolean result for the @ip being or not in the blacklist
+func (pder *SessionProvider) IsIPExistInBLContext(ctx context.Context, ip string) bool {
+
+	r, err := pder.pool.do(ctx, "EXISTS", pder.blacklistKey(ip))
+	if err != nil {
+		return false
+	}
+	n, _ := toInt(r)
+	return n == 1
+}
+
+// BLCleanContext - cleaning the Redis blacklist
+func (pder *SessionProvider) BLCleanContext(ctx context.Context) {
+	docs_cnt := 0
+	del_docs_cnt := 0
+
+	to := time.Now().Unix() - provutil.BLQuarantine
+
+	r, err := pder.pool.do(ctx, "ZRANGEBYSCORE", pder.blacklistIndexKey(), "-inf", "("+strconv.FormatInt(to, 10))
+	if err != nil {
+		pder.logger().ErrorContext(ctx, "error reading the blacklist", slog.Any("error", err))
+		return
+	}
+	ips, _ := toStrings(r)
+
+	for _, ip := range ips {
+		// send the IP address for verification for being good bot
+		if provutil.NativeReverseDNSLookup(ip) {
+			_, err = pder.pool.tx(ctx, [][]string{
+				{"DEL", pder.blacklistKey(ip)},
+				{"ZREM", pder.blacklistIndexKey(), ip},
+			})
+			if err != nil {
+				pder.logger().ErrorContext(ctx, "error deleting ip from the blacklist", slog.String("ip", ip), slog.Any("error", err))
+				continue
+			}
+			del_docs_cnt++
+		}
+		docs_cnt++
+	}
+	pder.logger().InfoContext(ctx, "blacklist clean summary", slog.Int("reviewed", docs_cnt), slog.Int("deleted", del_docs_cnt))
+}
+
+// encodeValue serializes a session value for storing in a hash field
+func encodeValue(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("unable to encode session value: %v", err)
+	}
+	return string(b), nil
+}
+
+// decodeValue restores a session value. Integral numbers are returned as int64.
+func decodeValue(s string) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewBufferString(s))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return provutil.NormalizeNumbers(v), nil
+}
+
+// init registers the provider configured from the environment. No connection is made at import time.
+func init() {
+	opts := Options{
+		Addr:     os.Getenv("REDIS_ADDR"),
+		Password: os.Getenv("REDIS_PASSWORD"),
+		Prefix:   os.Getenv("REDIS_KEY_PREFIX"),
+	}
+	if db, err := strconv.Atoi(os.Getenv("REDIS_DB")); err == nil {
+		opts.DB = db
+	}
+	if ml, err := strconv.ParseInt(os.Getenv("SESSION_MAXLIFETIME"), 10, 64); err == nil {
+		opts.Maxlifetime = ml
+	}
+
+	// Register the provider
+	ivmsesman.RegisterProvider(ivmsesman.Redis, New(opts))
+}
@@ -0,0 +1,410 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dasiyes/ivmsesman"
+	"github.com/dasiyes/ivmsesman/sesmantest"
+)
+
+func newTestProvider(t *testing.T) *SessionProvider {
+	t.Helper()
+
+	f := newFakeRedis(t)
+	pder := New(Options{Addr: f.addr(), Maxlifetime: 60})
+	t.Cleanup(func() { pder.Close() })
+	return pder
+}
+
+func TestConformance(t *testing.T) {
+	sesmantest.RunConformance(t, func(t *testing.T) ivmsesman.SessionRepository {
+		f := newFakeRedis(t)
+		pder := New(Options{Addr: f.addr(), Maxlifetime: 1})
+		t.Cleanup(func() { pder.Close() })
+		return pder
+	})
+}
+
+func TestNewSessionAndFind(t *testing.T) {
+	pder := newTestProvider(t)
+
+	ss, err := pder.NewSession("sid-1")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if ss.Get("state").(string) != "New" {
+		t.Errorf("expected state `New`, got %v", ss.Get("state"))
+	}
+	if !pder.Exists("sid-1") {
+		t.Errorf("expected session sid-1 to exist")
+	}
+
+	if err := ss.Set("username", "alice"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	found, err := pder.FindOrCreate("sid-1")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if found.Get("username") != "alice" {
+		t.Errorf("expected persisted value `alice`, got %v", found.Get("username"))
+	}
+	if n := pder.ActiveSessions(); n != 1 {
+		t.Errorf("expected 1 active session, got %d", n)
+	}
+
+	if err := pder.DestroySID("sid-1"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if pder.Exists("sid-1") {
+		t.Errorf("expected session sid-1 to be destroyed")
+	}
+	if n := pder.ActiveSessions(); n != 0 {
+		t.Errorf("expected 0 active sessions, got %d", n)
+	}
+}
+
+func TestAuthCodeFlow(t *testing.T) {
+	pder := newTestProvider(t)
+
+	if _, err := pder.NewSession("sid-2"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := pder.SaveCodeChallengeAndMethod("sid-2", "coch", "S256", "code", "/cb"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	ac := pder.GetAuthCode("sid-2")
+	if ac["auth_code"] != "code" || ac["code_challenger"] != "coch" || ac["code_challenger_method"] != "S256" {
+		t.Errorf("unexpected auth code attributes %v", ac)
+	}
+
+	if err := pder.UpdateAuthSession("sid-2", "at", "rt", "uid"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	ss, _ := pder.FindOrCreate("sid-2")
+	if ss.Get("state") != "Authed" || ss.Get("uid") != "uid" {
+		t.Errorf("unexpected authed session values state=%v uid=%v", ss.Get("state"), ss.Get("uid"))
+	}
+	if ac := pder.GetAuthCode("sid-2"); len(ac) != 0 {
+		t.Errorf("expected no auth code for Authed session, got %v", ac)
+	}
+
+	if err := pder.UpdateSessionState("missing", "InAuth"); err == nil {
+		t.Errorf("expected error updating a missing session")
+	}
+}
+
+func TestBlacklistAndFlush(t *testing.T) {
+	pder := newTestProvider(t)
+
+	pder.Blacklisting("10.0.0.1", "/admin", map[string]string{"reason": "scan"})
+	if !pder.IsIPExistInBL("10.0.0.1") {
+		t.Errorf("expected ip to be blacklisted")
+	}
+	if pder.IsIPExistInBL("10.0.0.2") {
+		t.Errorf("unexpected blacklisted ip")
+	}
+
+	for _, sid := range []string{"a", "b", "c"} {
+		if _, err := pder.NewSession(sid); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if err := pder.Flush(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if n := pder.ActiveSessions(); n != 0 {
+		t.Errorf("expected 0 active sessions after Flush, got %d", n)
+	}
+	if pder.Exists("a") {
+		t.Errorf("expected session `a` to be flushed")
+	}
+}
+
+func TestKeyTTL(t *testing.T) {
+	f := newFakeRedis(t)
+	pder := New(Options{Addr: f.addr(), Maxlifetime: 1})
+	defer pder.Close()
+
+	if _, err := pder.NewSession("short"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+
+	if pder.Exists("short") {
+		t.Errorf("expected session to expire with the key TTL")
+	}
+	pder.SessionGC(1)
+	if n := pder.ActiveSessions(); n != 0 {
+		t.Errorf("expected 0 active sessions, got %d", n)
+	}
+}
+
+func TestSessionGCMaxlifetime(t *testing.T) {
+	f := newFakeRedis(t)
+	pder := New(Options{Addr: f.addr(), Maxlifetime: 60})
+	defer pder.Close()
+
+	for _, sid := range []string{"idle", "fresh"} {
+		if _, err := pder.NewSession(sid); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	f.mu.Lock()
+	f.zsets[pder.indexKey()]["idle"] = float64(time.Now().Unix() - 30)
+	f.mu.Unlock()
+
+	// the default idle timeout keeps both sessions
+	pder.SessionGC(0)
+	if n := pder.ActiveSessions(); n != 2 {
+		t.Errorf("expected 2 active sessions, got %d", n)
+	}
+
+	pder.SessionGC(10)
+	if pder.Exists("idle") {
+		t.Errorf("expected the session idle for longer than maxlifetime removed")
+	}
+	if !pder.Exists("fresh") {
+		t.Errorf("expected the fresh session kept")
+	}
+	if n := pder.ActiveSessions(); n != 1 {
+		t.Errorf("expected 1 active session, got %d", n)
+	}
+	f.mu.Lock()
+	_, idle := f.zsets[pder.idsKey()]["idle"]
+	f.mu.Unlock()
+	if idle {
+		t.Errorf("expected the removed session id dropped from the id index")
+	}
+}
+
+func TestExportSessionsPages(t *testing.T) {
+	f := newFakeRedis(t)
+	pder := New(Options{Addr: f.addr(), Maxlifetime: 60})
+	defer pder.Close()
+	ctx := context.Background()
+
+	now := time.Now().Unix()
+	sessions := make([]ivmsesman.SessionRecord, 2*exportBatch+1)
+	for i := range sessions {
+		sessions[i] = ivmsesman.SessionRecord{ID: fmt.Sprintf("s%04d", i), CreatedAt: now, TimeAccessed: now}
+	}
+	if err := pder.ImportSessions(ctx, sessions); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	export := func(after string) []string {
+		t.Helper()
+
+		var ids []string
+		err := pder.ExportSessions(ctx, after, func(rec ivmsesman.SessionRecord) error {
+			ids = append(ids, rec.ID)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		return ids
+	}
+
+	ids := export("")
+	if len(ids) != len(sessions) || !sort.StringsAreSorted(ids) {
+		t.Fatalf("expected the %d sessions in the order of the ids, got %d", len(sessions), len(ids))
+	}
+	if ids := export("s0999"); len(ids) != 1 || ids[0] != "s1000" {
+		t.Errorf("expected the sessions after s0999, got %v", ids)
+	}
+
+	// the sessions missing from the id index, e.g. stored before it, are added by an export from the start
+	f.mu.Lock()
+	delete(f.zsets, pder.idsKey())
+	f.mu.Unlock()
+	if ids := export(""); len(ids) != len(sessions) {
+		t.Errorf("expected the %d sessions of the time index exported, got %d", len(sessions), len(ids))
+	}
+}
+
+func TestTouchInterval(t *testing.T) {
+	f := newFakeRedis(t)
+	pder := New(Options{Addr: f.addr(), Maxlifetime: 60})
+	defer pder.Close()
+	pder.SetExpiryPolicy(ivmsesman.ExpiryPolicy{Touch: 10})
+
+	if _, err := pder.NewSession("touched"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	key := pder.sessionKey("touched")
+	accessed := func(at int64) int64 {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if at > 0 {
+			f.hashes[key][fieldTimeAccessed] = strconv.FormatInt(at, 10)
+		}
+		n, _ := strconv.ParseInt(f.hashes[key][fieldTimeAccessed], 10, 64)
+		return n
+	}
+
+	// the reads within the touch interval do not write
+	at := accessed(time.Now().Unix() - 5)
+	ss, err := pder.FindOrCreate("touched")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	ss.Get("state")
+	ss.Get("state")
+	if n := accessed(0); n != at {
+		t.Errorf("expected time accessed %d kept within the touch interval, got %d", at, n)
+	}
+
+	// past the interval the first read writes it
+	at = accessed(time.Now().Unix() - 20)
+	ss, err = pder.FindOrCreate("touched")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if n := accessed(0); n <= at {
+		t.Errorf("expected time accessed rewritten past the touch interval, got %d", n)
+	}
+
+	// a write refreshes it along with the value
+	at = accessed(time.Now().Unix() - 20)
+	if err := ss.Set("username", "alice"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if n := accessed(0); n <= at {
+		t.Errorf("expected time accessed rewritten by Set, got %d", n)
+	}
+}
+
+func TestUpdateRemovedSession(t *testing.T) {
+	f := newFakeRedis(t)
+	pder := New(Options{Addr: f.addr(), Maxlifetime: 60})
+	defer pder.Close()
+
+	// between runs fn once, right after the liveness check of the session reads its hash
+	between := func(sid string, fn func(key string)) {
+		key := pder.sessionKey(sid)
+		f.mu.Lock()
+		f.after = func(args []string) {
+			if args[0] == "HMGET" && args[1] == key {
+				f.after = nil
+				fn(key)
+			}
+		}
+		f.mu.Unlock()
+	}
+	hash := func(sid string) (map[string]string, bool) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		key := pder.sessionKey(sid)
+		_, ttl := f.expire[key]
+		return f.hashes[key], ttl
+	}
+
+	for _, sid := range []string{"removed", "touched"} {
+		if _, err := pder.NewSession(sid); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+
+	// a session destroyed by another replica is not recreated by the write
+	between("removed", func(key string) { f.exec([]string{"DEL", key}) })
+	if err := pder.UpdateSessionState("removed", "Auth"); err == nil {
+		t.Errorf("expected error updating a removed session")
+	}
+	between("removed", func(key string) { f.exec([]string{"DEL", key}) })
+	if err := pder.UpdateTimeAccessed("removed"); err == nil {
+		t.Errorf("expected error touching a removed session")
+	}
+	if h, _ := hash("removed"); h != nil {
+		t.Errorf("expected no hash for the removed session, got %v", h)
+	}
+	if pder.Exists("removed") {
+		t.Errorf("expected removed session not to exist")
+	}
+
+	// nor by the regeneration of its id
+	if _, err := pder.NewSession("removed"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	between("removed", func(key string) { f.exec([]string{"DEL", key}) })
+	if _, err := pder.RegenerateContext(context.Background(), "removed", "renamed"); err == nil {
+		t.Errorf("expected error regenerating a removed session")
+	}
+	if h, _ := hash("renamed"); h != nil {
+		t.Errorf("expected no hash for the new id of a removed session, got %v", h)
+	}
+
+	// a concurrent write retries the transaction
+	between("touched", func(key string) { f.exec([]string{"HSET", key, fieldTimeAccessed, "1"}) })
+	if err := pder.UpdateSessionState("touched", "Auth"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	h, ttl := hash("touched")
+	if h[valuePrefix+"state"] != `"Auth"` || !ttl {
+		t.Errorf("expected the state written with a key TTL, got %v, ttl %v", h, ttl)
+	}
+}
+
+func TestContextCancelled(t *testing.T) {
+	pder := newTestProvider(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := pder.NewSessionContext(ctx, "sid-ctx"); err == nil {
+		t.Errorf("expected error creating a session with a cancelled context")
+	}
+	if _, err := pder.pool.do(ctx, "PING"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if pder.Exists("sid-ctx") {
+		t.Errorf("unexpected session created with a cancelled context")
+	}
+}
+
+func TestPruneExpiredIDs(t *testing.T) {
+	f := newFakeRedis(t)
+	pder := New(Options{Addr: f.addr(), Maxlifetime: 60})
+	defer pder.Close()
+	ctx := context.Background()
+
+	now := time.Now().Unix()
+	if err := pder.ImportSessions(ctx, []ivmsesman.SessionRecord{
+		{ID: "a", CreatedAt: now, TimeAccessed: now},
+		{ID: "b", CreatedAt: now, TimeAccessed: now},
+		{ID: "c", CreatedAt: now, TimeAccessed: now},
+	}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// the hash of b expired with the key TTL, no SessionGC ran
+	f.mu.Lock()
+	f.del(pder.sessionKey("b"))
+	f.mu.Unlock()
+
+	recs, _, err := pder.List(ctx, ivmsesman.SessionFilter{}, "", 10)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(recs) != 2 || recs[0].ID != "a" || recs[1].ID != "c" {
+		t.Fatalf("expected the sessions a and c, got %v", recs)
+	}
+
+	f.mu.Lock()
+	_, inTime := f.zsets[pder.indexKey()]["b"]
+	_, inIDs := f.zsets[pder.idsKey()]["b"]
+	_, kept := f.zsets[pder.idsKey()]["a"]
+	f.mu.Unlock()
+	if inTime || inIDs || !kept {
+		t.Errorf("expected only the id of the expired session pruned from the indexes, got %v %v %v", inTime, inIDs, kept)
+	}
+}
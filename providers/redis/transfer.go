@@ -0,0 +1,209 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/dasiyes/ivmsesman"
+)
+
+// exportBatch is the number of ids read from the indexes at once by ExportSessions
+const exportBatch = 500
+
+// ExportSessions calls fn with every live session whose id is greater than after, in the order of the ids.
+// The ids are read a batch at a time from the id index, which is ordered by the id, and the session hashes
+// of a batch in one round-trip; the ids of the keys expired meanwhile are skipped and pruned from the indexes. An export from the start first adds
+// to the id index the ids of the time index missing from it, e.g. of the sessions not accessed since the
+// id index was introduced.
+func (pder *SessionProvider) ExportSessions(ctx context.Context, after string, fn func(ivmsesman.SessionRecord) error) error {
+
+	if after == "" {
+		if err := pder.indexIDs(ctx); err != nil {
+			return fmt.Errorf("err while indexing the session ids, err: %v", err)
+		}
+	}
+
+	from := "-"
+	if after != "" {
+		from = "(" + after
+	}
+	for {
+		r, err := pder.pool.do(ctx, "ZRANGEBYLEX", pder.idsKey(), from, "+", "LIMIT", "0", strconv.Itoa(exportBatch))
+		if err != nil {
+			return fmt.Errorf("err while reading the sessions index, err: %v", err)
+		}
+		ids, err := toStrings(r)
+		if err != nil {
+			return fmt.Errorf("err while reading the sessions index, err: %v", err)
+		}
+
+		page, err := pder.loadPage(ctx, ids)
+		if err != nil {
+			return fmt.Errorf("err while reading the sessions, err: %v", err)
+		}
+		for i, ss := range page {
+			if ss == nil {
+				continue
+			}
+			rec := ivmsesman.SessionRecord{ID: ids[i], CreatedAt: ss.CreatedAt, TimeAccessed: ss.TimeAccessed, Values: ss.Value}
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+
+		if len(ids) < exportBatch {
+			return nil
+		}
+		from = "(" + ids[len(ids)-1]
+	}
+}
+
+// indexIDs adds the ids of the time index to the id index, scanning the time index a batch at a time.
+// Once it completed, the ids written since by the provider are added as well.
+func (pder *SessionProvider) indexIDs(ctx context.Context) error {
+
+	cursor := "0"
+	for {
+		r, err := pder.pool.do(ctx, "ZSCAN", pder.indexKey(), cursor, "COUNT", strconv.Itoa(exportBatch))
+		if err != nil {
+			return err
+		}
+		arr, ok := r.([]interface{})
+		if !ok || len(arr) != 2 {
+			return errors.New("unexpected ZSCAN reply")
+		}
+		if cursor, ok = arr[0].(string); !ok {
+			return errors.New("unexpected ZSCAN cursor")
+		}
+		members, err := toStrings(arr[1])
+		if err != nil {
+			return err
+		}
+
+		// the reply holds the members with their scores
+		zadd := []string{"ZADD", pder.idsKey()}
+		for i := 0; i+1 < len(members); i += 2 {
+			zadd = append(zadd, "0", members[i])
+		}
+		if len(zadd) > 2 {
+			if _, err := pder.pool.do(ctx, zadd...); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			pder.idsIndexed.Store(true)
+			return nil
+		}
+	}
+}
+
+// ExportBlacklist calls fn with every blacklisted ip
+func (pder *SessionProvider) ExportBlacklist(ctx context.Context, fn func(ivmsesman.BlacklistRecord) error) error {
+
+	r, err := pder.pool.do(ctx, "ZRANGEBYSCORE", pder.blacklistIndexKey(), "-inf", "+inf")
+	if err != nil {
+		return fmt.Errorf("err while reading the blacklist, err: %v", err)
+	}
+	ips, err := toStrings(r)
+	if err != nil {
+		return fmt.Errorf("err while reading the blacklist, err: %v", err)
+	}
+
+	for _, ip := range ips {
+		r, err := pder.pool.do(ctx, "HGETALL", pder.blacklistKey(ip))
+		if err != nil {
+			return fmt.Errorf("err while reading the blacklisted ip %v, err: %v", ip, err)
+		}
+		fields, err := toStrings(r)
+		if err != nil {
+			return fmt.Errorf("err while reading the blacklisted ip %v, err: %v", ip, err)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		e := ivmsesman.BlacklistRecord{IP: ip}
+		for i := 0; i+1 < len(fields); i += 2 {
+			switch fields[i] {
+			case "created":
+				e.Created, _ = strconv.ParseInt(fields[i+1], 10, 64)
+			case "requestURI":
+				e.RequestURI = fields[i+1]
+			case "details":
+				e.Details, _ = decodeValue(fields[i+1])
+			}
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportSessions writes the sessions in a single transaction, replacing the ones with the same id. The key
+// TTL of every session is what is left of its idle timeout; the sessions expired already are left out.
+func (pder *SessionProvider) ImportSessions(ctx context.Context, sessions []ivmsesman.SessionRecord) error {
+
+	now := time.Now().Unix()
+	var cmds [][]string
+	for _, s := range sessions {
+		ttl := s.TimeAccessed + pder.maxlifetime - now
+		if ttl <= 0 || pder.pastAbsolute(s.CreatedAt) {
+			continue
+		}
+
+		key := pder.sessionKey(s.ID)
+		hset := []string{"HSET", key, fieldSid, s.ID, fieldCreatedAt, strconv.FormatInt(s.CreatedAt, 10),
+			fieldTimeAccessed, strconv.FormatInt(s.TimeAccessed, 10)}
+		for k, val := range s.Values {
+			enc, err := encodeValue(val)
+			if err != nil {
+				return fmt.Errorf("err while importing session id %v, err: %v", s.ID, err)
+			}
+			hset = append(hset, valuePrefix+k, enc)
+		}
+		cmds = append(cmds,
+			[]string{"DEL", key},
+			hset,
+			[]string{"EXPIRE", key, strconv.FormatInt(ttl, 10)},
+			[]string{"ZADD", pder.indexKey(), strconv.FormatInt(s.TimeAccessed, 10), s.ID},
+			[]string{"ZADD", pder.idsKey(), "0", s.ID},
+		)
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	if _, err := pder.pool.tx(ctx, cmds); err != nil {
+		return fmt.Errorf("err while importing sessions, err: %v", err)
+	}
+	return nil
+}
+
+// ImportBlacklist writes the blacklisted ips in a single transaction, replacing the ones already in the blacklist
+func (pder *SessionProvider) ImportBlacklist(ctx context.Context, entries []ivmsesman.BlacklistRecord) error {
+
+	var cmds [][]string
+	for _, e := range entries {
+		details, err := encodeValue(e.Details)
+		if err != nil {
+			return fmt.Errorf("err while importing the blacklisted ip %v, err: %v", e.IP, err)
+		}
+		created := strconv.FormatInt(e.Created, 10)
+		cmds = append(cmds,
+			[]string{"HSET", pder.blacklistKey(e.IP), "created", created, "requestURI", e.RequestURI, "details", details},
+			[]string{"ZADD", pder.blacklistIndexKey(), created, e.IP},
+		)
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	if _, err := pder.pool.tx(ctx, cmds); err != nil {
+		return fmt.Errorf("err while importing the blacklist, err: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/dasiyes/ivmsesman"
+	"github.com/dasiyes/ivmsesman/sesmantest"
+)
+
+// testDatabase runs the migrations and the conformance suite against a real database, so its engine parses
+// the statements of the dialect which the fake driver only matches
+func testDatabase(t *testing.T, db *sql.DB, d *Dialect, prefix string) {
+	ctx := context.Background()
+
+	newProvider := func(t *testing.T, maxlifetime int64) *SessionProvider {
+		t.Helper()
+
+		pder, err := New(db, Options{Dialect: d, TablePrefix: prefix, Maxlifetime: maxlifetime})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		return pder
+	}
+
+	pder := newProvider(t, 0)
+	if err := pder.Migrate(ctx); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// the applied migrations are not run again
+	if err := pder.Migrate(ctx); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	var n int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+prefix+"schema_migrations").Scan(&n); err != nil || n != 3 {
+		t.Errorf("expected 3 migrations recorded, got %d, %v", n, err)
+	}
+
+	t.Run("Conformance", func(t *testing.T) {
+		sesmantest.RunConformance(t, func(t *testing.T) ivmsesman.SessionRepository {
+			return newProvider(t, 1)
+		})
+	})
+}
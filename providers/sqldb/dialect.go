@@ -0,0 +1,142 @@
+package sqldb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Dialect holds the differences of the SQL databases supported by the provider
+type Dialect struct {
+	name string
+	// numbered placeholders ($1, $2...) instead of ?
+	numbered bool
+	// forUpdate locks the session row read before its values are written
+	forUpdate string
+	// writeFirst starts the transactions reading the session row before writing it with a write, as BEGIN
+	// IMMEDIATE does. A deferred SQLite transaction fails with SQLITE_BUSY when it upgrades its read lock
+	// while another one writes, instead of waiting on the busy timeout.
+	writeFirst bool
+	// jsonText is the expression of a text value of the session values, formatted with its key
+	jsonText string
+}
+
+var (
+	// Postgres is the dialect of PostgreSQL 9.5 and later
+	Postgres = &Dialect{name: "postgres", numbered: true, forUpdate: " FOR UPDATE", jsonText: "value->>'%s'"}
+	// SQLite is the dialect of SQLite 3.35 and later. SQLite serializes the writes, there is no row lock.
+	SQLite = &Dialect{name: "sqlite", writeFirst: true, jsonText: "json_extract(value, '$.%s')"}
+)
+
+// String returns the name of the dialect
+func (d *Dialect) String() string {
+	return d.name
+}
+
+// rebind rewrites the ? placeholders of the query in the dialect
+func (d *Dialect) rebind(query string) string {
+
+	if !d.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// queries are the statements of the provider, with the table names and the placeholders of the dialect
+type queries struct {
+	insertSession      string
+	selectSession      string
+	selectTimes        string
+	selectForUpdate    string
+	lockSession        string
+	updateValue        string
+	updateTimeAccessed string
+	regenerate         string
+	deleteSession      string
+	deleteExpired      string
+	countSessions      string
+	flushSessions      string
+	exportSessions     string
+	// listSessions are the queries of List by the filters set, listByState and listByUser
+	listSessions [4]string
+
+	upsertBlacklist string
+	existsBlacklist string
+	selectBlacklist string
+	deleteBlacklist string
+	exportBlacklist string
+
+	createMigrations string
+	selectMigrations string
+	insertMigration  string
+}
+
+// The filters of the listSessions queries
+const (
+	listByState = 1 << iota
+	listByUser
+)
+
+// buildQueries returns the statements of the dialect for the tables starting with prefix
+func buildQueries(d *Dialect, prefix string) queries {
+
+	sessions, blacklist := prefix+"sessions", prefix+"blacklist"
+	q := queries{
+		insertSession: "INSERT INTO " + sessions + " (sid, created_at, time_accessed, value) VALUES (?, ?, ?, ?)" +
+			" ON CONFLICT (sid) DO UPDATE SET created_at = excluded.created_at, time_accessed = excluded.time_accessed, value = excluded.value",
+		selectSession:      "SELECT created_at, time_accessed, value FROM " + sessions + " WHERE sid = ?",
+		selectTimes:        "SELECT created_at, time_accessed FROM " + sessions + " WHERE sid = ?",
+		selectForUpdate:    "SELECT created_at, time_accessed, value FROM " + sessions + " WHERE sid = ?" + d.forUpdate,
+		lockSession:        "UPDATE " + sessions + " SET sid = sid WHERE sid = ?",
+		updateValue:        "UPDATE " + sessions + " SET value = ?, time_accessed = ? WHERE sid = ?",
+		updateTimeAccessed: "UPDATE " + sessions + " SET time_accessed = ? WHERE sid = ?",
+		regenerate:         "UPDATE " + sessions + " SET sid = ?, time_accessed = ? WHERE sid = ?",
+		deleteSession:      "DELETE FROM " + sessions + " WHERE sid = ?",
+		deleteExpired:      "DELETE FROM " + sessions + " WHERE time_accessed < ? OR created_at < ? RETURNING sid",
+		countSessions:      "SELECT COUNT(*) FROM " + sessions + " WHERE time_accessed >= ? AND created_at >= ?",
+		flushSessions:      "DELETE FROM " + sessions,
+		exportSessions: "SELECT sid, created_at, time_accessed, value FROM " + sessions +
+			" WHERE sid > ? AND time_accessed >= ? AND created_at >= ? ORDER BY sid LIMIT ?",
+
+		upsertBlacklist: "INSERT INTO " + blacklist + " (ip, created, request_uri, details) VALUES (?, ?, ?, ?)" +
+			" ON CONFLICT (ip) DO UPDATE SET created = excluded.created, request_uri = excluded.request_uri, details = excluded.details",
+		existsBlacklist: "SELECT 1 FROM " + blacklist + " WHERE ip = ?",
+		selectBlacklist: "SELECT ip FROM " + blacklist + " WHERE created < ?",
+		deleteBlacklist: "DELETE FROM " + blacklist + " WHERE ip = ?",
+		exportBlacklist: "SELECT ip, created, request_uri, details FROM " + blacklist + " ORDER BY ip",
+
+		createMigrations: "CREATE TABLE IF NOT EXISTS " + prefix + "schema_migrations" +
+			" (version BIGINT PRIMARY KEY, name TEXT NOT NULL, applied_at BIGINT NOT NULL)",
+		selectMigrations: "SELECT version FROM " + prefix + "schema_migrations",
+		insertMigration:  "INSERT INTO " + prefix + "schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+	}
+
+	for by := range q.listSessions {
+		query := "SELECT sid, created_at, time_accessed, value FROM " + sessions +
+			" WHERE sid > ? AND time_accessed >= ? AND time_accessed < ? AND created_at >= ?"
+		if by&listByState != 0 {
+			query += " AND " + fmt.Sprintf(d.jsonText, "state") + " = ?"
+		}
+		if by&listByUser != 0 {
+			query += " AND " + fmt.Sprintf(d.jsonText, "uid") + " = ?"
+		}
+		q.listSessions[by] = d.rebind(query + " ORDER BY sid LIMIT ?")
+	}
+
+	for _, s := range []*string{&q.insertSession, &q.selectSession, &q.selectTimes, &q.selectForUpdate, &q.lockSession,
+		&q.updateValue, &q.updateTimeAccessed, &q.regenerate, &q.deleteSession, &q.deleteExpired, &q.countSessions, &q.exportSessions,
+		&q.upsertBlacklist, &q.existsBlacklist, &q.selectBlacklist, &q.deleteBlacklist, &q.insertMigration} {
+		*s = d.rebind(*s)
+	}
+	return q
+}
@@ -0,0 +1,377 @@
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSQL is an in-process database/sql stand-in answering the statements of the provider with the SQLite
+// dialect and the default table prefix. The transactions are not isolated.
+type fakeSQL struct {
+	mu         sync.Mutex
+	tables     map[string]bool
+	sessions   map[string]*fakeSession
+	blacklist  map[string]*fakeBlacklist
+	migrations map[int64]string
+	// statements counts the statements run by their text
+	statements map[string]int
+	handlers   map[string]func(args []driver.Value) (*fakeRows, int64, error)
+}
+
+type fakeSession struct {
+	created, accessed int64
+	value             string
+}
+
+type fakeBlacklist struct {
+	created    int64
+	requestURI string
+	details    string
+}
+
+// newFakeSQL returns the db of a new empty fake database
+func newFakeSQL(t *testing.T) (*sql.DB, *fakeSQL) {
+	t.Helper()
+
+	f := &fakeSQL{
+		tables:     make(map[string]bool),
+		sessions:   make(map[string]*fakeSession),
+		blacklist:  make(map[string]*fakeBlacklist),
+		migrations: make(map[int64]string),
+		statements: make(map[string]int),
+	}
+	f.handlers = f.buildHandlers(buildQueries(SQLite, "ivmsesman_"))
+
+	db := sql.OpenDB(f)
+	t.Cleanup(func() { db.Close() })
+	return db, f
+}
+
+// Connect implements driver.Connector
+func (f *fakeSQL) Connect(context.Context) (driver.Conn, error) {
+	return &fakeConn{f}, nil
+}
+
+// Driver implements driver.Connector
+func (f *fakeSQL) Driver() driver.Driver {
+	return fakeDriver{f}
+}
+
+type fakeDriver struct{ f *fakeSQL }
+
+func (d fakeDriver) Open(string) (driver.Conn, error) {
+	return &fakeConn{d.f}, nil
+}
+
+type fakeConn struct{ f *fakeSQL }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{f: c.f, query: query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	f     *fakeSQL
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	_, n, err := s.f.run(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(n), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows, _, err := s.f.run(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	if rows == nil {
+		rows = &fakeRows{}
+	}
+	return rows, nil
+}
+
+// fakeRows are the rows of a query result
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// run answers the statement. The CREATE statements of the migrations create the tables by name.
+func (f *fakeSQL) run(query string, args []driver.Value) (*fakeRows, int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.statements[query]++
+	if strings.HasPrefix(query, "CREATE ") {
+		return nil, 0, f.create(query)
+	}
+	h, ok := f.handlers[query]
+	if !ok {
+		return nil, 0, fmt.Errorf("fakesql: unexpected statement %q", query)
+	}
+	for _, table := range []string{"ivmsesman_sessions", "ivmsesman_blacklist", "ivmsesman_schema_migrations"} {
+		if strings.Contains(query, table+" ") || strings.HasSuffix(query, table) {
+			if !f.tables[table] {
+				return nil, 0, fmt.Errorf("fakesql: no such table: %s", table)
+			}
+			break
+		}
+	}
+	return h(args)
+}
+
+// create records the table of a CREATE TABLE statement
+func (f *fakeSQL) create(query string) error {
+
+	fields := strings.Fields(query)
+	if fields[1] != "TABLE" {
+		return nil
+	}
+	name, exists := fields[2], false
+	if name == "IF" {
+		name, exists = fields[5], true
+	}
+	if f.tables[name] && !exists {
+		return fmt.Errorf("fakesql: table %s already exists", name)
+	}
+	f.tables[name] = true
+	return nil
+}
+
+// buildHandlers returns the answers to the statements of the provider
+func (f *fakeSQL) buildHandlers(q queries) map[string]func(args []driver.Value) (*fakeRows, int64, error) {
+
+	one := func(columns []string, values ...driver.Value) *fakeRows {
+		return &fakeRows{columns: columns, values: [][]driver.Value{values}}
+	}
+
+	handlers := map[string]func(args []driver.Value) (*fakeRows, int64, error){
+		q.insertSession: func(a []driver.Value) (*fakeRows, int64, error) {
+			f.sessions[a[0].(string)] = &fakeSession{created: a[1].(int64), accessed: a[2].(int64), value: a[3].(string)}
+			return nil, 1, nil
+		},
+		q.selectSession: func(a []driver.Value) (*fakeRows, int64, error) {
+			s, ok := f.sessions[a[0].(string)]
+			if !ok {
+				return nil, 0, nil
+			}
+			return one([]string{"created_at", "time_accessed", "value"}, s.created, s.accessed, []byte(s.value)), 0, nil
+		},
+		q.selectTimes: func(a []driver.Value) (*fakeRows, int64, error) {
+			s, ok := f.sessions[a[0].(string)]
+			if !ok {
+				return nil, 0, nil
+			}
+			return one([]string{"created_at", "time_accessed"}, s.created, s.accessed), 0, nil
+		},
+		q.lockSession: func(a []driver.Value) (*fakeRows, int64, error) {
+			if _, ok := f.sessions[a[0].(string)]; !ok {
+				return nil, 0, nil
+			}
+			return nil, 1, nil
+		},
+		q.updateValue: func(a []driver.Value) (*fakeRows, int64, error) {
+			s, ok := f.sessions[a[2].(string)]
+			if !ok {
+				return nil, 0, nil
+			}
+			s.value, s.accessed = a[0].(string), a[1].(int64)
+			return nil, 1, nil
+		},
+		q.updateTimeAccessed: func(a []driver.Value) (*fakeRows, int64, error) {
+			s, ok := f.sessions[a[1].(string)]
+			if !ok {
+				return nil, 0, nil
+			}
+			s.accessed = a[0].(int64)
+			return nil, 1, nil
+		},
+		q.regenerate: func(a []driver.Value) (*fakeRows, int64, error) {
+			newsid, oldsid := a[0].(string), a[2].(string)
+			s, ok := f.sessions[oldsid]
+			if !ok {
+				return nil, 0, nil
+			}
+			if _, ok := f.sessions[newsid]; ok {
+				return nil, 0, errors.New("fakesql: UNIQUE constraint failed: ivmsesman_sessions.sid")
+			}
+			s.accessed = a[1].(int64)
+			f.sessions[newsid] = s
+			delete(f.sessions, oldsid)
+			return nil, 1, nil
+		},
+		q.deleteSession: func(a []driver.Value) (*fakeRows, int64, error) {
+			if _, ok := f.sessions[a[0].(string)]; !ok {
+				return nil, 0, nil
+			}
+			delete(f.sessions, a[0].(string))
+			return nil, 1, nil
+		},
+		q.deleteExpired: func(a []driver.Value) (*fakeRows, int64, error) {
+			rows := &fakeRows{columns: []string{"sid"}}
+			for sid, s := range f.sessions {
+				if s.accessed < a[0].(int64) || s.created < a[1].(int64) {
+					delete(f.sessions, sid)
+					rows.values = append(rows.values, []driver.Value{sid})
+				}
+			}
+			return rows, int64(len(rows.values)), nil
+		},
+		q.countSessions: func(a []driver.Value) (*fakeRows, int64, error) {
+			n := int64(0)
+			for _, s := range f.sessions {
+				if s.accessed >= a[0].(int64) && s.created >= a[1].(int64) {
+					n++
+				}
+			}
+			return one([]string{"count"}, n), 0, nil
+		},
+		q.flushSessions: func(a []driver.Value) (*fakeRows, int64, error) {
+			n := int64(len(f.sessions))
+			f.sessions = make(map[string]*fakeSession)
+			return nil, n, nil
+		},
+		q.upsertBlacklist: func(a []driver.Value) (*fakeRows, int64, error) {
+			f.blacklist[a[0].(string)] = &fakeBlacklist{created: a[1].(int64), requestURI: a[2].(string), details: a[3].(string)}
+			return nil, 1, nil
+		},
+		q.existsBlacklist: func(a []driver.Value) (*fakeRows, int64, error) {
+			if _, ok := f.blacklist[a[0].(string)]; !ok {
+				return nil, 0, nil
+			}
+			return one([]string{"1"}, int64(1)), 0, nil
+		},
+		q.selectBlacklist: func(a []driver.Value) (*fakeRows, int64, error) {
+			rows := &fakeRows{columns: []string{"ip"}}
+			for ip, b := range f.blacklist {
+				if b.created < a[0].(int64) {
+					rows.values = append(rows.values, []driver.Value{ip})
+				}
+			}
+			return rows, 0, nil
+		},
+		q.deleteBlacklist: func(a []driver.Value) (*fakeRows, int64, error) {
+			delete(f.blacklist, a[0].(string))
+			return nil, 1, nil
+		},
+		q.exportSessions: func(a []driver.Value) (*fakeRows, int64, error) {
+			rows := &fakeRows{columns: []string{"sid", "created_at", "time_accessed", "value"}}
+			var ids []string
+			for sid, s := range f.sessions {
+				if sid > a[0].(string) && s.accessed >= a[1].(int64) && s.created >= a[2].(int64) {
+					ids = append(ids, sid)
+				}
+			}
+			sort.Strings(ids)
+			if limit := int(a[3].(int64)); len(ids) > limit {
+				ids = ids[:limit]
+			}
+			for _, sid := range ids {
+				s := f.sessions[sid]
+				rows.values = append(rows.values, []driver.Value{sid, s.created, s.accessed, []byte(s.value)})
+			}
+			return rows, 0, nil
+		},
+		q.exportBlacklist: func(a []driver.Value) (*fakeRows, int64, error) {
+			rows := &fakeRows{columns: []string{"ip", "created", "request_uri", "details"}}
+			var ips []string
+			for ip := range f.blacklist {
+				ips = append(ips, ip)
+			}
+			sort.Strings(ips)
+			for _, ip := range ips {
+				b := f.blacklist[ip]
+				rows.values = append(rows.values, []driver.Value{ip, b.created, b.requestURI, b.details})
+			}
+			return rows, 0, nil
+		},
+		q.selectMigrations: func(a []driver.Value) (*fakeRows, int64, error) {
+			rows := &fakeRows{columns: []string{"version"}}
+			for v := range f.migrations {
+				rows.values = append(rows.values, []driver.Value{v})
+			}
+			return rows, 0, nil
+		},
+		q.insertMigration: func(a []driver.Value) (*fakeRows, int64, error) {
+			f.migrations[a[0].(int64)] = a[1].(string)
+			return nil, 1, nil
+		},
+	}
+
+	for by, query := range q.listSessions {
+		by := by
+		handlers[query] = func(a []driver.Value) (*fakeRows, int64, error) {
+			var state, uid string
+			i := 4
+			if by&listByState != 0 {
+				state, i = a[i].(string), i+1
+			}
+			if by&listByUser != 0 {
+				uid, i = a[i].(string), i+1
+			}
+
+			var ids []string
+			for sid, s := range f.sessions {
+				if sid <= a[0].(string) || s.accessed < a[1].(int64) || s.accessed >= a[2].(int64) || s.created < a[3].(int64) {
+					continue
+				}
+				var v map[string]interface{}
+				if err := json.Unmarshal([]byte(s.value), &v); err != nil {
+					return nil, 0, err
+				}
+				if (state != "" && v["state"] != state) || (uid != "" && v["uid"] != uid) {
+					continue
+				}
+				ids = append(ids, sid)
+			}
+			sort.Strings(ids)
+			if limit := int(a[i].(int64)); len(ids) > limit {
+				ids = ids[:limit]
+			}
+
+			rows := &fakeRows{columns: []string{"sid", "created_at", "time_accessed", "value"}}
+			for _, sid := range ids {
+				s := f.sessions[sid]
+				rows.values = append(rows.values, []driver.Value{sid, s.created, s.accessed, []byte(s.value)})
+			}
+			return rows, 0, nil
+		}
+	}
+	return handlers
+}
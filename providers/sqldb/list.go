@@ -0,0 +1,68 @@
+package sqldb
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/dasiyes/ivmsesman"
+)
+
+// List returns up to limit live sessions selected by the filter, in the order of the ids, with a single
+// query. The cursor is the id of the last session of the previous page. The state and the user id are
+// compared in the JSON of the session values; the user id is indexed.
+func (pder *SessionProvider) List(ctx context.Context, filter ivmsesman.SessionFilter, cursor string, limit int) ([]ivmsesman.SessionRecord, string, error) {
+
+	if limit <= 0 {
+		limit = ivmsesman.DefaultListLimit
+	}
+
+	now := time.Now().Unix()
+	from, to := now-pder.maxlifetime, int64(math.MaxInt64)
+	if filter.AccessedAfter > from {
+		from = filter.AccessedAfter
+	}
+	if filter.AccessedBefore > 0 {
+		to = filter.AccessedBefore
+	}
+
+	by, args := 0, []interface{}{cursor, from, to, pder.createdAfter(now)}
+	if filter.State != "" {
+		by |= listByState
+		args = append(args, filter.State)
+	}
+	if filter.UserID != "" {
+		by |= listByUser
+		args = append(args, filter.UserID)
+	}
+	// one more session tells if there is a next page
+	args = append(args, limit+1)
+
+	rows, err := pder.db.QueryContext(ctx, pder.q.listSessions[by], args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("err while listing the sessions, err: %v", err)
+	}
+	defer rows.Close()
+
+	sessions := make([]ivmsesman.SessionRecord, 0, limit)
+	for rows.Next() {
+		var rec ivmsesman.SessionRecord
+		var value []byte
+		if err := rows.Scan(&rec.ID, &rec.CreatedAt, &rec.TimeAccessed, &value); err != nil {
+			return nil, "", fmt.Errorf("err while listing the sessions, err: %v", err)
+		}
+		if rec.Values, err = decodeValues(value); err != nil {
+			return nil, "", fmt.Errorf("error decoding the values of session id %v: %v", rec.ID, err)
+		}
+		sessions = append(sessions, rec)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("err while listing the sessions, err: %v", err)
+	}
+
+	if len(sessions) > limit {
+		return sessions[:limit], sessions[limit-1].ID, nil
+	}
+	return sessions, "", nil
+}
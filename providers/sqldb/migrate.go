@@ -0,0 +1,145 @@
+package sqldb
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationsFS holds the schema migrations of every dialect, in migrations/<dialect>/<version>_<name>.sql.
+// The {{prefix}} in the statements is replaced by Options.TablePrefix.
+//
+//go:embed migrations
+var migrationsFS embed.FS
+
+// migration is a schema change of the tables of the provider
+type migration struct {
+	version    int64
+	name       string
+	statements []string
+}
+
+// migrations returns the schema migrations of the dialect ordered by version
+func migrations(d *Dialect, prefix string) ([]migration, error) {
+
+	dir := path.Join("migrations", d.name)
+	entries, err := fs.ReadDir(migrationsFS, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ms []migration
+	for _, e := range entries {
+		version, name, ok := strings.Cut(strings.TrimSuffix(e.Name(), ".sql"), "_")
+		if !ok || e.IsDir() || !strings.HasSuffix(e.Name(), ".sql") {
+			continue
+		}
+		v, err := strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration file name %s: %v", e.Name(), err)
+		}
+		src, err := fs.ReadFile(migrationsFS, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, migration{version: v, name: name, statements: statements(string(src), prefix)})
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].version < ms[j].version })
+	return ms, nil
+}
+
+// statements splits the source of a migration in its statements, leaving out the comments
+func statements(src, prefix string) []string {
+
+	var lines []string
+	for _, line := range strings.Split(src, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines = append(lines, line)
+		}
+	}
+
+	var stmts []string
+	for _, s := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if s = strings.TrimSpace(s); s != "" {
+			stmts = append(stmts, strings.ReplaceAll(s, "{{prefix}}", prefix))
+		}
+	}
+	return stmts
+}
+
+// Migrate creates or updates the tables of the provider, applying the schema migrations not applied yet.
+// Each migration runs in a transaction and is recorded in the <prefix>schema_migrations table. Run it
+// before the provider is used, from a single instance at a time.
+func (pder *SessionProvider) Migrate(ctx context.Context) error {
+
+	ms, err := migrations(pder.dialect, pder.prefix)
+	if err != nil {
+		return fmt.Errorf("err while reading the schema migrations, err: %v", err)
+	}
+
+	if _, err := pder.db.ExecContext(ctx, pder.q.createMigrations); err != nil {
+		return fmt.Errorf("err while creating the schema migrations table, err: %v", err)
+	}
+	applied, err := pder.appliedMigrations(ctx)
+	if err != nil {
+		return fmt.Errorf("err while reading the applied schema migrations, err: %v", err)
+	}
+
+	for _, m := range ms {
+		if applied[m.version] {
+			continue
+		}
+		if err := pder.apply(ctx, m); err != nil {
+			return fmt.Errorf("err while applying the schema migration %d_%s, err: %v", m.version, m.name, err)
+		}
+		pder.logger().InfoContext(ctx, "schema migration applied", slog.Int64("version", m.version), slog.String("name", m.name))
+	}
+	return nil
+}
+
+// appliedMigrations returns the versions of the migrations applied
+func (pder *SessionProvider) appliedMigrations(ctx context.Context) (map[int64]bool, error) {
+
+	rows, err := pder.db.QueryContext(ctx, pder.q.selectMigrations)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]bool)
+	for rows.Next() {
+		var v int64
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		applied[v] = true
+	}
+	return applied, rows.Err()
+}
+
+// apply runs the statements of the migration and records it, in a transaction
+func (pder *SessionProvider) apply(ctx context.Context, m migration) error {
+
+	tx, err := pder.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, s := range m.statements {
+		if _, err := tx.ExecContext(ctx, s); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, pder.q.insertMigration, m.version, m.name, time.Now().Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,12 @@
+-- sessions: the session values are a JSON object, the times are seconds since epoch
+CREATE TABLE {{prefix}}sessions (
+	-- the ids are ordered by their bytes, as by the other providers
+	sid TEXT COLLATE "C" PRIMARY KEY,
+	created_at BIGINT NOT NULL,
+	time_accessed BIGINT NOT NULL,
+	value JSONB NOT NULL
+);
+
+-- SessionGC deletes by the idle and the absolute timeouts
+CREATE INDEX {{prefix}}sessions_time_accessed ON {{prefix}}sessions (time_accessed);
+CREATE INDEX {{prefix}}sessions_created_at ON {{prefix}}sessions (created_at);
@@ -0,0 +1,10 @@
+-- blacklist: the ips blacklisted with the request uri and its details
+CREATE TABLE {{prefix}}blacklist (
+	ip TEXT PRIMARY KEY,
+	created BIGINT NOT NULL,
+	request_uri TEXT NOT NULL,
+	details JSONB
+);
+
+-- BLClean reviews the ips past the quarantine period
+CREATE INDEX {{prefix}}blacklist_created ON {{prefix}}blacklist (created);
@@ -0,0 +1,11 @@
+-- sessions: the session values are a JSON object, the times are seconds since epoch
+CREATE TABLE {{prefix}}sessions (
+	sid TEXT PRIMARY KEY,
+	created_at INTEGER NOT NULL,
+	time_accessed INTEGER NOT NULL,
+	value TEXT NOT NULL
+);
+
+-- SessionGC deletes by the idle and the absolute timeouts
+CREATE INDEX {{prefix}}sessions_time_accessed ON {{prefix}}sessions (time_accessed);
+CREATE INDEX {{prefix}}sessions_created_at ON {{prefix}}sessions (created_at);
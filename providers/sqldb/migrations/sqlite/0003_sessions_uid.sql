@@ -0,0 +1,2 @@
+-- List finds the sessions of a user by the uid of the session values
+CREATE INDEX {{prefix}}sessions_uid ON {{prefix}}sessions (json_extract(value, '$.uid'));
@@ -0,0 +1,121 @@
+package sqldb
+
+import (
+	"context"
+	"time"
+
+	"github.com/dasiyes/ivmsesman"
+)
+
+// Session is a session row read from the database. The values are a copy: Set and Delete change the copy and
+// write the change to the row, at once or, buffered, with the other changes of the request.
+type Session struct {
+	Sid          string
+	CreatedAt    int64
+	TimeAccessed int64
+	Value        map[string]interface{}
+
+	// wb is the write-behind state of the session and guards Value - the session is shared by the concurrent
+	// requests of the session
+	wb   ivmsesman.WriteBehind
+	pder *SessionProvider
+}
+
+// bind sets the provider writing the session
+func (st *Session) bind(pder *SessionProvider) *Session {
+	st.pder = pder
+	st.wb.Init(sessionWriter{st}, &st.TimeAccessed)
+	return st
+}
+
+// Set stores the key:value pair in the repository
+func (st *Session) Set(key, value interface{}) error {
+	return st.SetContext(context.Background(), key, value)
+}
+
+// SetContext stores the key:value pair in the repository
+func (st *Session) SetContext(ctx context.Context, key, value interface{}) error {
+	return st.wb.Set(ctx, key.(string), value, func() { st.Value[key.(string)] = value })
+}
+
+// Get will retrieve the session value by the provided key
+func (st *Session) Get(key interface{}) interface{} {
+	return st.GetContext(context.Background(), key)
+}
+
+// GetContext will retrieve the session value by the provided key
+func (st *Session) GetContext(ctx context.Context, key interface{}) interface{} {
+	st.wb.Touch(ctx)
+
+	st.wb.Lock()
+	defer st.wb.Unlock()
+	if v, ok := st.Value[key.(string)]; ok {
+		return v
+	}
+	return nil
+}
+
+// Delete will remove a session value by the provided key
+func (st *Session) Delete(key interface{}) error {
+	return st.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext will remove a session value by the provided key
+func (st *Session) DeleteContext(ctx context.Context, key interface{}) error {
+	return st.wb.Delete(ctx, key.(string), func() { delete(st.Value, key.(string)) })
+}
+
+// Buffer keeps the changes of the session in memory until Save or Release
+func (st *Session) Buffer(ctx context.Context) {
+	st.wb.Buffer(ctx)
+}
+
+// Save writes the changed values and the time accessed of the session in a single transaction
+func (st *Session) Save(ctx context.Context) error {
+	return st.wb.Save(ctx)
+}
+
+// Release saves the session and ends the buffering started by the matching Buffer call
+func (st *Session) Release(ctx context.Context) error {
+	return st.wb.Release(ctx)
+}
+
+// Discard drops the changes of the request not saved yet
+func (st *Session) Discard(ctx context.Context) {
+	st.wb.Discard(ctx)
+}
+
+// sessionWriter writes the session for its write-behind state
+type sessionWriter struct {
+	st *Session
+}
+
+func (w sessionWriter) WriteValues(ctx context.Context, values map[string]interface{}, deletes []string) error {
+	return w.st.pder.update(ctx, w.st.Sid, values, deletes...)
+}
+
+func (w sessionWriter) WriteAccess(ctx context.Context) error {
+	return w.st.pder.UpdateTimeAccessedContext(ctx, w.st.Sid)
+}
+
+func (w sessionWriter) TouchDue(accessed, now int64) bool {
+	return w.st.pder.touchDue(accessed, now)
+}
+
+// SessionID will retrieve the id of the current session
+func (st *Session) SessionID() string {
+	return st.Sid
+}
+
+// GetCreatedAt will return the time the session was created
+func (st *Session) GetCreatedAt() time.Time {
+	return time.Unix(st.CreatedAt, 0)
+}
+
+// GetLTA will return the LastTimeAccessedAt
+func (st *Session) GetLTA() time.Time {
+	st.wb.Lock()
+	defer st.wb.Unlock()
+
+	return time.Unix(st.TimeAccessed, 0)
+}
@@ -0,0 +1,538 @@
+// Package sqldb implements the session store provider on top of a SQL database through database/sql.
+//
+// PostgreSQL and SQLite are supported (see Dialect). The provider does not import a driver: open the
+// *sql.DB with the driver of your choice and create the tables with Migrate. Every session is a row of
+// the <prefix>sessions table with its values as a JSON object; the expired rows are deleted by SessionGC
+// with queries on the indexed time columns.
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"time"
+
+	"github.com/dasiyes/ivmsesman"
+	"github.com/dasiyes/ivmsesman/internal/provutil"
+)
+
+// validPrefix limits the table prefix to the characters of a plain SQL identifier
+var validPrefix = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Options configures the SQL session provider
+type Options struct {
+	// Dialect of the database, Postgres or SQLite. Required
+	Dialect *Dialect
+	// TablePrefix is prepended to the names of the tables of the provider. Default "ivmsesman_"
+	TablePrefix string
+	// Maxlifetime is the idle time (in seconds) after which a session expires. Default 3600
+	Maxlifetime int64
+}
+
+// SessionProvider is the DAL holding the methods for the SQL database operations for the SessionManager
+type SessionProvider struct {
+	// Background runs the operations without a context
+	ivmsesman.Background
+
+	db          *sql.DB
+	dialect     *Dialect
+	prefix      string
+	q           queries
+	maxlifetime int64
+	absolute    int64
+	touch       int64
+	log         *slog.Logger
+	onExpired   func(ctx context.Context, sid string)
+}
+
+// New creates a SQL session provider using the db. The db is owned by the caller and no query is run
+// until the first operation; call Migrate to create the tables.
+func New(db *sql.DB, opts Options) (*SessionProvider, error) {
+
+	if db == nil {
+		return nil, errors.New("sql session provider needs not-nil db")
+	}
+	if opts.Dialect == nil {
+		return nil, errors.New("sql session provider needs the dialect of the database")
+	}
+	if opts.TablePrefix == "" {
+		opts.TablePrefix = "ivmsesman_"
+	}
+	if !validPrefix.MatchString(opts.TablePrefix) {
+		return nil, fmt.Errorf("invalid table prefix %q", opts.TablePrefix)
+	}
+	if opts.Maxlifetime <= 0 {
+		opts.Maxlifetime = 3600
+	}
+
+	pder := &SessionProvider{
+		db:          db,
+		dialect:     opts.Dialect,
+		prefix:      opts.TablePrefix,
+		q:           buildQueries(opts.Dialect, opts.TablePrefix),
+		maxlifetime: opts.Maxlifetime,
+	}
+	pder.Background = ivmsesman.Background{Repo: pder}
+	return pder, nil
+}
+
+// SetLogger sets the logger of the provider events
+func (pder *SessionProvider) SetLogger(l *slog.Logger) {
+	pder.log = l
+}
+
+// logger returns the logger set or the slog default one
+func (pder *SessionProvider) logger() *slog.Logger {
+	if pder.log != nil {
+		return pder.log
+	}
+	return slog.Default()
+}
+
+// SetExpiryPolicy sets the timeouts enforced when a session is read and by SessionGC. A zero idle timeout
+// keeps Options.Maxlifetime. It is not safe to call it while the provider is in use.
+func (pder *SessionProvider) SetExpiryPolicy(p ivmsesman.ExpiryPolicy) {
+	if p.Idle > 0 {
+		pder.maxlifetime = p.Idle
+	}
+	pder.absolute = p.Absolute
+	pder.touch = p.Touch
+}
+
+// SetExpiryListener sets the func called with the id of every session removed as expired. It is not safe
+// to call it while the provider is in use.
+func (pder *SessionProvider) SetExpiryListener(fn func(ctx context.Context, sid string)) {
+	pder.onExpired = fn
+}
+
+// expired reports if a session created and last accessed at the unix times passed a timeout
+func (pder *SessionProvider) expired(createdAt, accessedAt int64) bool {
+	p := ivmsesman.ExpiryPolicy{Idle: pder.maxlifetime, Absolute: pder.absolute}
+	return p.Expired(createdAt, accessedAt, time.Now().Unix())
+}
+
+// createdAfter returns the creation time of the oldest session within the absolute timeout, zero when
+// there is no absolute timeout
+func (pder *SessionProvider) createdAfter(now int64) int64 {
+	if pder.absolute <= 0 {
+		return 0
+	}
+	return now - pder.absolute
+}
+
+// touchDue reports if the last access time of a session accessed at the unix time is to be rewritten
+func (pder *SessionProvider) touchDue(accessedAt, now int64) bool {
+	return ivmsesman.ExpiryPolicy{Touch: pder.touch}.TouchDue(accessedAt, now)
+}
+
+// NewSessionContext creates a new session value in the store with sid as a key
+func (pder *SessionProvider) NewSessionContext(ctx context.Context, sid string) (ivmsesman.SessionStore, error) {
+
+	v := make(map[string]interface{})
+	v["state"] = "New"
+
+	now := time.Now().Unix()
+	newsess := &Session{Sid: sid, CreatedAt: now, TimeAccessed: now, Value: v}
+
+	enc, err := encodeValues(v)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pder.db.ExecContext(ctx, pder.q.insertSession, sid, now, now, enc); err != nil {
+		return nil, fmt.Errorf("unable to save in session repository - error: %v", err)
+	}
+
+	return newsess.bind(pder), nil
+}
+
+// FindOrCreateContext will first search the store for a session value with provided sid. If not not found, a new session value will be created and stored in the session store
+func (pder *SessionProvider) FindOrCreateContext(ctx context.Context, sid string) (ivmsesman.SessionStore, error) {
+
+	ss, err := pder.FindContext(ctx, sid)
+	if err == ivmsesman.ErrInvalidSessionID {
+		return pder.NewSessionContext(ctx, sid)
+	}
+	return ss, err
+}
+
+// FindContext returns the session sid without creating it, ivmsesman.ErrInvalidSessionID when the store does not hold it
+func (pder *SessionProvider) FindContext(ctx context.Context, sid string) (ivmsesman.SessionStore, error) {
+
+	ss, err := pder.load(ctx, sid)
+	if err != nil {
+		return nil, fmt.Errorf("err while read session id: %v, err: %v", sid, err)
+	}
+	if ss == nil {
+		return nil, ivmsesman.ErrInvalidSessionID
+	}
+
+	if now := time.Now().Unix(); pder.touchDue(ss.TimeAccessed, now) {
+		if err := pder.UpdateTimeAccessedContext(ctx, sid); err != nil {
+			return nil, err
+		}
+		ss.TimeAccessed = now
+	}
+
+	return ss, nil
+}
+
+// load reads the session row. It returns nil session when the row does not exist or the session expired.
+func (pder *SessionProvider) load(ctx context.Context, sid string) (*Session, error) {
+
+	ss := &Session{Sid: sid}
+	var value []byte
+	err := pder.db.QueryRowContext(ctx, pder.q.selectSession, sid).Scan(&ss.CreatedAt, &ss.TimeAccessed, &value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if pder.expired(ss.CreatedAt, ss.TimeAccessed) {
+		return nil, pder.expireSession(ctx, sid)
+	}
+	if ss.Value, err = decodeValues(value); err != nil {
+		return nil, fmt.Errorf("error decoding session values: %v", err)
+	}
+	return ss.bind(pder), nil
+}
+
+// alive reports if the session exists and did not expire, removing it when expired
+func (pder *SessionProvider) alive(ctx context.Context, sid string) (bool, error) {
+
+	var created, accessed int64
+	err := pder.db.QueryRowContext(ctx, pder.q.selectTimes, sid).Scan(&created, &accessed)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if pder.expired(created, accessed) {
+		return false, pder.expireSession(ctx, sid)
+	}
+	return true, nil
+}
+
+// expireSession removes an expired session and reports it
+func (pder *SessionProvider) expireSession(ctx context.Context, sid string) error {
+
+	if err := pder.DestroySIDContext(ctx, sid); err != nil {
+		return err
+	}
+	if pder.onExpired != nil {
+		pder.onExpired(ctx, sid)
+	}
+	return nil
+}
+
+// DestroySIDContext will remove a session data from the storage
+func (pder *SessionProvider) DestroySIDContext(ctx context.Context, sid string) error {
+
+	_, err := pder.db.ExecContext(ctx, pder.q.deleteSession, sid)
+	return err
+}
+
+// RegenerateContext changes the id of the session row from oldsid to newsid, keeping the session values
+func (pder *SessionProvider) RegenerateContext(ctx context.Context, oldsid, newsid string) (ivmsesman.SessionStore, error) {
+
+	ok, err := pder.alive(ctx, oldsid)
+	if err != nil {
+		return nil, fmt.Errorf("err while regenerating session id %v, err: %v", oldsid, err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("session id %v not found", oldsid)
+	}
+
+	res, err := pder.db.ExecContext(ctx, pder.q.regenerate, newsid, time.Now().Unix(), oldsid)
+	if err != nil {
+		return nil, fmt.Errorf("err while regenerating session id %v, err: %v", oldsid, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return nil, fmt.Errorf("session id %v not found", oldsid)
+	}
+
+	ss, err := pder.load(ctx, newsid)
+	if err != nil {
+		return nil, fmt.Errorf("err while read session id: %v, err: %v", newsid, err)
+	}
+	if ss == nil {
+		return nil, fmt.Errorf("session id %v not found", newsid)
+	}
+	return ss, nil
+}
+
+// SessionGCContext deletes the sessions idle for more than maxlifetime seconds or past the absolute timeout
+func (pder *SessionProvider) SessionGCContext(ctx context.Context, maxlifetime int64) {
+
+	if maxlifetime <= 0 {
+		maxlifetime = pder.maxlifetime
+	}
+	now := time.Now().Unix()
+
+	rows, err := pder.db.QueryContext(ctx, pder.q.deleteExpired, now-maxlifetime, pder.createdAfter(now))
+	if err != nil {
+		pder.logger().ErrorContext(ctx, "error deleting the expired sessions", slog.Any("error", err))
+		return
+	}
+	var expired []string
+	for rows.Next() {
+		var sid string
+		if err := rows.Scan(&sid); err != nil {
+			break
+		}
+		expired = append(expired, sid)
+	}
+	if err := rows.Err(); err != nil {
+		pder.logger().ErrorContext(ctx, "error reading the expired sessions", slog.Any("error", err))
+	}
+	rows.Close()
+
+	if pder.onExpired != nil {
+		for _, sid := range expired {
+			pder.onExpired(ctx, sid)
+		}
+	}
+}
+
+// UpdateTimeAccessedContext will update the time accessed value with now()
+func (pder *SessionProvider) UpdateTimeAccessedContext(ctx context.Context, sid string) error {
+
+	ok, err := pder.alive(ctx, sid)
+	if err != nil {
+		return fmt.Errorf("err while updating time accessed for sessions id %v, err: %v", sid, err)
+	}
+	if !ok {
+		return fmt.Errorf("err while updating time accessed for sessions id %v, err: session not found", sid)
+	}
+
+	if _, err := pder.db.ExecContext(ctx, pder.q.updateTimeAccessed, time.Now().Unix(), sid); err != nil {
+		return fmt.Errorf("err while updating time accessed for sessions id %v, err: %v", sid, err)
+	}
+	return nil
+}
+
+// update writes the session values and removes the deletes values of an existing session, refreshing its
+// last time accessed. The row is read and written in a transaction.
+func (pder *SessionProvider) update(ctx context.Context, sid string, values map[string]interface{}, deletes ...string) error {
+
+	tx, err := pder.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if pder.dialect.writeFirst {
+		if _, err := tx.ExecContext(ctx, pder.q.lockSession, sid); err != nil {
+			return err
+		}
+	}
+
+	var created, accessed int64
+	var value []byte
+	err = tx.QueryRowContext(ctx, pder.q.selectForUpdate, sid).Scan(&created, &accessed, &value)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("session id %v not found", sid)
+	}
+	if err != nil {
+		return err
+	}
+	if pder.expired(created, accessed) {
+		tx.Rollback()
+		if err := pder.expireSession(ctx, sid); err != nil {
+			return err
+		}
+		return fmt.Errorf("session id %v not found", sid)
+	}
+
+	current, err := decodeValues(value)
+	if err != nil {
+		return fmt.Errorf("error decoding session values: %v", err)
+	}
+	for k, v := range values {
+		current[k] = v
+	}
+	for _, k := range deletes {
+		delete(current, k)
+	}
+	enc, err := encodeValues(current)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, pder.q.updateValue, enc, time.Now().Unix(), sid); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateSessionStateContext will update the state value with one provided
+func (pder *SessionProvider) UpdateSessionStateContext(ctx context.Context, sid string, state string) error {
+
+	err := pder.update(ctx, sid, map[string]interface{}{"state": state})
+	if err != nil {
+		return fmt.Errorf("err while updating `Value.state` for sessions id %v, err: %v", sid, err)
+	}
+	return nil
+}
+
+// UpdateCodeVerifierContext will update the code verifier (cove) value assigned to the session id
+func (pder *SessionProvider) UpdateCodeVerifierContext(ctx context.Context, sid, cove string) error {
+
+	err := pder.update(ctx, sid, map[string]interface{}{"code_verifier": cove})
+	if err != nil {
+		return fmt.Errorf("err while updating `Value.code_verifier` for sessions id %v, err: %v", sid, err)
+	}
+	return nil
+}
+
+// SaveCodeChallengeAndMethodContext - at step2 of AuthorizationCode flow
+func (pder *SessionProvider) SaveCodeChallengeAndMethodContext(
+	ctx context.Context, sid, coch, mth, code, ru string) error {
+
+	// set code expiration timestamp
+	ce := time.Now().Unix() + 60
+
+	err := pder.update(ctx, sid, map[string]interface{}{
+		"code_challenger":        coch,
+		"code_challenger_method": mth,
+		"auth_code":              code,
+		"code_expire":            ce,
+		"redirect_uri":           ru,
+		"state":                  "InAuth",
+	})
+	if err != nil {
+		return fmt.Errorf("err while updating `Value.code_verifier` for sessions id %v, err: %v", sid, err)
+	}
+	return nil
+}
+
+// GetAuthCodeContext will return the authorization code for a session, if it is InAuth and the code did not expire
+func (pder *SessionProvider) GetAuthCodeContext(ctx context.Context, sid string) map[string]string {
+
+	var ac map[string]string = map[string]string{}
+
+	ss, err := pder.load(ctx, sid)
+	if err != nil || ss == nil {
+		return ac
+	}
+
+	state, _ := ss.Value["state"].(string)
+	ce, _ := ss.Value["code_expire"].(int64)
+	if state == "InAuth" && ce > time.Now().Unix() {
+		ac["auth_code"], _ = ss.Value["auth_code"].(string)
+		ac["code_challenger"], _ = ss.Value["code_challenger"].(string)
+		ac["code_challenger_method"], _ = ss.Value["code_challenger_method"].(string)
+	}
+	return ac
+}
+
+// ActiveSessionsContext returns the number of currently active sessions in the session store
+func (pder *SessionProvider) ActiveSessionsContext(ctx context.Context) int {
+
+	now := time.Now().Unix()
+	var n int
+	err := pder.db.QueryRowContext(ctx, pder.q.countSessions, now-pder.maxlifetime, pder.createdAfter(now)).Scan(&n)
+	if err != nil {
+		pder.logger().ErrorContext(ctx, "error counting the active sessions", slog.Any("error", err))
+		return 0
+	}
+	return n
+}
+
+// ExistsContext check by sid if a session data exists in the session store
+func (pder *SessionProvider) ExistsContext(ctx context.Context, sid string) bool {
+
+	ok, err := pder.alive(ctx, sid)
+	return err == nil && ok
+}
+
+// FlushContext will delete all elements for sessions data
+func (pder *SessionProvider) FlushContext(ctx context.Context) error {
+
+	if _, err := pder.db.ExecContext(ctx, pder.q.flushSessions); err != nil {
+		return fmt.Errorf("error flushing sessions, err: %v", err)
+	}
+	return nil
+}
+
+// UpdateAuthSessionContext - update state, access and refresh tokens values for auth session
+func (pder *SessionProvider) UpdateAuthSessionContext(ctx context.Context, sid, at, rt, uid string) error {
+
+	err := pder.update(ctx, sid, map[string]interface{}{
+		"at":    at,
+		"rt":    rt,
+		"uid":   uid,
+		"state": "Authed",
+	})
+	if err != nil {
+		return fmt.Errorf("err while updating new authenticated session id %v, err: %v", sid, err)
+	}
+	return nil
+}
+
+// BlacklistingContext adds the @ip to the blacklist with the @path and @data
+func (pder *SessionProvider) BlacklistingContext(ctx context.Context, ip, path string, data interface{}) {
+
+	details, err := json.Marshal(data)
+	if err != nil {
+		pder.logger().ErrorContext(ctx, "error adding ip in the blacklist", slog.String("ip", ip), slog.Any("error", err))
+		return
+	}
+
+	_, err = pder.db.ExecContext(ctx, pder.q.upsertBlacklist, ip, time.Now().Unix(), path, string(details))
+	if err != nil {
+		pder.logger().ErrorContext(ctx, "error adding ip in the blacklist", slog.String("ip", ip), slog.Any("error", err))
+		return
+	}
+	pder.logger().InfoContext(ctx, "ip added in the blacklist", slog.String("ip", ip), slog.String("path", path))
+}
+
+// IsIPExistInBLContext returns boolean result for the @ip being or not in the blacklist
+func (pder *SessionProvider) IsIPExistInBLContext(ctx context.Context, ip string) bool {
+
+	var one int
+	err := pder.db.QueryRowContext(ctx, pder.q.existsBlacklist, ip).Scan(&one)
+	return err == nil
+}
+
+// BLCleanContext - cleaning the blacklist from the ips which passed the quarantine period and are verified as good bots
+func (pder *SessionProvider) BLCleanContext(ctx context.Context) {
+	docs_cnt := 0
+	del_docs_cnt := 0
+
+	to := time.Now().Unix() - provutil.BLQuarantine
+
+	rows, err := pder.db.QueryContext(ctx, pder.q.selectBlacklist, to)
+	if err != nil {
+		pder.logger().ErrorContext(ctx, "error reading the blacklist", slog.Any("error", err))
+		return
+	}
+	var review []string
+	for rows.Next() {
+		var ip string
+		if err := rows.Scan(&ip); err != nil {
+			break
+		}
+		review = append(review, ip)
+	}
+	rows.Close()
+
+	for _, ip := range review {
+		if provutil.NativeReverseDNSLookup(ip) {
+			if _, err := pder.db.ExecContext(ctx, pder.q.deleteBlacklist, ip); err != nil {
+				pder.logger().ErrorContext(ctx, "error deleting ip from the blacklist", slog.String("ip", ip), slog.Any("error", err))
+				continue
+			}
+			del_docs_cnt++
+		}
+		docs_cnt++
+	}
+	pder.logger().InfoContext(ctx, "blacklist clean summary", slog.Int("reviewed", docs_cnt), slog.Int("deleted", del_docs_cnt))
+}
@@ -0,0 +1,198 @@
+package sqldb
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/dasiyes/ivmsesman"
+	"github.com/dasiyes/ivmsesman/internal/provutil"
+	"github.com/dasiyes/ivmsesman/sesmantest"
+)
+
+func newTestProvider(t *testing.T, maxlifetime int64) (*SessionProvider, *fakeSQL) {
+	t.Helper()
+
+	db, f := newFakeSQL(t)
+	pder, err := New(db, Options{Dialect: SQLite, Maxlifetime: maxlifetime})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := pder.Migrate(context.Background()); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return pder, f
+}
+
+func TestConformance(t *testing.T) {
+	sesmantest.RunConformance(t, func(t *testing.T) ivmsesman.SessionRepository {
+		pder, _ := newTestProvider(t, 1)
+		return pder
+	})
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	db, f := newFakeSQL(t)
+	pder, _ := New(db, Options{Dialect: SQLite})
+
+	if _, err := pder.NewSession("a"); err == nil {
+		t.Errorf("expected an error before the tables are created")
+	}
+
+	if err := pder.Migrate(ctx); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !f.tables["ivmsesman_sessions"] || !f.tables["ivmsesman_blacklist"] {
+		t.Errorf("expected the tables created, got %v", f.tables)
+	}
+	if f.migrations[1] != "sessions" || f.migrations[2] != "blacklist" || f.migrations[3] != "sessions_uid" {
+		t.Errorf("expected the migrations recorded, got %v", f.migrations)
+	}
+
+	// the applied migrations are not run again
+	if err := pder.Migrate(ctx); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for stmt, n := range f.statements {
+		if strings.HasPrefix(stmt, "CREATE TABLE ivmsesman_sessions") && n != 1 {
+			t.Errorf("expected the sessions table created once, got %d times", n)
+		}
+	}
+
+	if _, err := pder.NewSession("a"); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestDialects(t *testing.T) {
+
+	q := buildQueries(Postgres, "app_")
+	if !strings.Contains(q.insertSession, "VALUES ($1, $2, $3, $4)") || !strings.HasPrefix(q.insertSession, "INSERT INTO app_sessions ") {
+		t.Errorf("expected the numbered placeholders and the prefixed table, got %q", q.insertSession)
+	}
+	if !strings.HasSuffix(q.selectForUpdate, "WHERE sid = $1 FOR UPDATE") {
+		t.Errorf("expected the row locked, got %q", q.selectForUpdate)
+	}
+	if q := buildQueries(SQLite, "app_"); strings.Contains(q.selectForUpdate, "FOR UPDATE") || strings.Contains(q.insertSession, "$1") {
+		t.Errorf("expected the SQLite statements, got %q", q.selectForUpdate)
+	}
+	if list := q.listSessions[listByState|listByUser]; !strings.Contains(list, "value->>'state' = $5 AND value->>'uid' = $6 ORDER BY sid LIMIT $7") {
+		t.Errorf("expected the JSON values compared, got %q", list)
+	}
+	if list := buildQueries(SQLite, "app_").listSessions[listByUser]; !strings.Contains(list, "json_extract(value, '$.uid') = ?") {
+		t.Errorf("expected the SQLite JSON values compared, got %q", list)
+	}
+
+	for _, d := range []*Dialect{Postgres, SQLite} {
+		ms, err := migrations(d, "app_")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if len(ms) != 3 || ms[0].version != 1 || ms[1].version != 2 || ms[2].version != 3 {
+			t.Fatalf("%s: expected 3 migrations in order, got %+v", d, ms)
+		}
+		all := ""
+		for _, m := range ms {
+			all += strings.Join(m.statements, "\n")
+		}
+		if strings.Contains(all, "{{prefix}}") || strings.Contains(all, "--") || !strings.Contains(all, "CREATE TABLE app_sessions") {
+			t.Errorf("%s: unexpected statements %s", d, all)
+		}
+		if strings.Contains(all, "JSONB") != (d == Postgres) {
+			t.Errorf("%s: unexpected value column type in %s", d, all)
+		}
+	}
+
+	if _, err := New(nil, Options{Dialect: SQLite}); err == nil {
+		t.Errorf("expected an error for a nil db")
+	}
+	db, _ := newFakeSQL(t)
+	if _, err := New(db, Options{}); err == nil {
+		t.Errorf("expected an error for a missing dialect")
+	}
+	if _, err := New(db, Options{Dialect: SQLite, TablePrefix: "app; DROP"}); err == nil {
+		t.Errorf("expected an error for an invalid table prefix")
+	}
+}
+
+func TestJSONValues(t *testing.T) {
+	pder, f := newTestProvider(t, 60)
+
+	ss, _ := pder.NewSession("a")
+	_ = ss.Set("visits", 3)
+	_ = ss.Set("ratio", 0.5)
+	_ = ss.Set("profile", map[string]interface{}{"id": 7, "tags": []string{"x"}})
+
+	var stored map[string]interface{}
+	if err := json.Unmarshal([]byte(f.sessions["a"].value), &stored); err != nil || stored["state"] != "New" {
+		t.Errorf("expected the values stored as a JSON object, got %q", f.sessions["a"].value)
+	}
+
+	ss, _ = pder.FindOrCreate("a")
+	if v := ss.Get("visits"); v != int64(3) {
+		t.Errorf("expected int64 3, got %#v", v)
+	}
+	if v := ss.Get("ratio"); v != 0.5 {
+		t.Errorf("expected 0.5, got %#v", v)
+	}
+	profile, _ := ss.Get("profile").(map[string]interface{})
+	if profile["id"] != int64(7) {
+		t.Errorf("expected the nested values decoded, got %#v", ss.Get("profile"))
+	}
+
+	_ = ss.Delete("ratio")
+	ss, _ = pder.FindOrCreate("a")
+	if v := ss.Get("ratio"); v != nil {
+		t.Errorf("expected the value deleted, got %#v", v)
+	}
+}
+
+func TestSessionGC(t *testing.T) {
+	pder, f := newTestProvider(t, 60)
+	pder.SetExpiryPolicy(ivmsesman.ExpiryPolicy{Idle: 60, Absolute: 3600})
+
+	var expired []string
+	pder.SetExpiryListener(func(_ context.Context, sid string) { expired = append(expired, sid) })
+
+	for _, sid := range []string{"idle", "old", "live"} {
+		_, _ = pder.NewSession(sid)
+	}
+	f.mu.Lock()
+	f.sessions["idle"].accessed -= 120
+	f.sessions["old"].created -= 7200
+	f.mu.Unlock()
+
+	if n := pder.ActiveSessions(); n != 1 {
+		t.Errorf("expected 1 active session, got %d", n)
+	}
+	pder.SessionGC(60)
+	if len(expired) != 2 || !pder.Exists("live") {
+		t.Errorf("expected the idle and the old sessions expired, got %v", expired)
+	}
+	if len(f.sessions) != 1 {
+		t.Errorf("expected the expired rows deleted, got %d rows", len(f.sessions))
+	}
+}
+
+func TestBlacklist(t *testing.T) {
+	pder, f := newTestProvider(t, 60)
+
+	pder.Blacklisting("10.0.0.1", "/wp-admin", map[string]interface{}{"ua": "bot"})
+	if !pder.IsIPExistInBL("10.0.0.1") || pder.IsIPExistInBL("10.0.0.2") {
+		t.Errorf("expected only 10.0.0.1 in the blacklist")
+	}
+	if b := f.blacklist["10.0.0.1"]; b.requestURI != "/wp-admin" || b.details != `{"ua":"bot"}` {
+		t.Errorf("unexpected blacklist row %+v", b)
+	}
+
+	// past the quarantine, an address without a reverse dns name stays
+	f.mu.Lock()
+	f.blacklist["10.0.0.1"].created -= provutil.BLQuarantine + 1
+	f.mu.Unlock()
+	pder.BLClean()
+	if !pder.IsIPExistInBL("10.0.0.1") {
+		t.Errorf("expected 10.0.0.1 kept in the blacklist")
+	}
+}
@@ -0,0 +1,24 @@
+//go:build cgo
+
+package sqldb
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestSQLite runs against a SQLite database file. The driver needs cgo, the test is left out without it.
+func TestSQLite(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatalf("unable to open the database: %v", err)
+	}
+	defer db.Close()
+
+	testDatabase(t, db, SQLite, "ivmsesman_")
+}
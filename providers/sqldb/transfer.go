@@ -0,0 +1,152 @@
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/dasiyes/ivmsesman"
+)
+
+// exportPage is the number of session rows read by a query of ExportSessions
+const exportPage = 500
+
+// ExportSessions calls fn with every live session whose id is greater than after, in the order of the ids.
+// The rows are read in pages, fn runs between the queries.
+func (pder *SessionProvider) ExportSessions(ctx context.Context, after string, fn func(ivmsesman.SessionRecord) error) error {
+
+	for {
+		page, err := pder.exportPage(ctx, after)
+		if err != nil {
+			return fmt.Errorf("err while reading the sessions, err: %v", err)
+		}
+		for _, rec := range page {
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+		if len(page) < exportPage {
+			return nil
+		}
+		after = page[len(page)-1].ID
+	}
+}
+
+// exportPage reads the next page of live sessions after the id
+func (pder *SessionProvider) exportPage(ctx context.Context, after string) ([]ivmsesman.SessionRecord, error) {
+
+	now := time.Now().Unix()
+	rows, err := pder.db.QueryContext(ctx, pder.q.exportSessions, after, now-pder.maxlifetime, pder.createdAfter(now), exportPage)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := make([]ivmsesman.SessionRecord, 0, exportPage)
+	for rows.Next() {
+		var rec ivmsesman.SessionRecord
+		var value []byte
+		if err := rows.Scan(&rec.ID, &rec.CreatedAt, &rec.TimeAccessed, &value); err != nil {
+			return nil, err
+		}
+		if rec.Values, err = decodeValues(value); err != nil {
+			return nil, fmt.Errorf("error decoding the values of session id %v: %v", rec.ID, err)
+		}
+		page = append(page, rec)
+	}
+	return page, rows.Err()
+}
+
+// ExportBlacklist calls fn with every blacklisted ip
+func (pder *SessionProvider) ExportBlacklist(ctx context.Context, fn func(ivmsesman.BlacklistRecord) error) error {
+
+	rows, err := pder.db.QueryContext(ctx, pder.q.exportBlacklist)
+	if err != nil {
+		return fmt.Errorf("err while reading the blacklist, err: %v", err)
+	}
+	var entries []ivmsesman.BlacklistRecord
+	for rows.Next() {
+		var e ivmsesman.BlacklistRecord
+		var details sql.NullString
+		if err := rows.Scan(&e.IP, &e.Created, &e.RequestURI, &details); err != nil {
+			rows.Close()
+			return fmt.Errorf("err while reading the blacklist, err: %v", err)
+		}
+		if details.Valid {
+			e.Details, _ = decodeValue([]byte(details.String))
+		}
+		entries = append(entries, e)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return fmt.Errorf("err while reading the blacklist, err: %v", err)
+	}
+
+	for _, e := range entries {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportSessions writes the sessions in a transaction, replacing the ones with the same id. The sessions
+// expired already are left out.
+func (pder *SessionProvider) ImportSessions(ctx context.Context, sessions []ivmsesman.SessionRecord) error {
+
+	tx, err := pder.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("err while importing sessions, err: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, s := range sessions {
+		if pder.expired(s.CreatedAt, s.TimeAccessed) {
+			continue
+		}
+		values := s.Values
+		if values == nil {
+			values = make(map[string]interface{})
+		}
+		enc, err := encodeValues(values)
+		if err != nil {
+			return fmt.Errorf("err while importing session id %v, err: %v", s.ID, err)
+		}
+		if _, err := tx.ExecContext(ctx, pder.q.insertSession, s.ID, s.CreatedAt, s.TimeAccessed, enc); err != nil {
+			return fmt.Errorf("err while importing session id %v, err: %v", s.ID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("err while importing sessions, err: %v", err)
+	}
+	return nil
+}
+
+// ImportBlacklist writes the blacklisted ips in a transaction, replacing the ones already in the blacklist
+func (pder *SessionProvider) ImportBlacklist(ctx context.Context, entries []ivmsesman.BlacklistRecord) error {
+
+	tx, err := pder.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("err while importing the blacklist, err: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, e := range entries {
+		details, err := json.Marshal(e.Details)
+		if err != nil {
+			return fmt.Errorf("err while importing the blacklisted ip %v, err: %v", e.IP, err)
+		}
+		if _, err := tx.ExecContext(ctx, pder.q.upsertBlacklist, e.IP, e.Created, e.RequestURI, string(details)); err != nil {
+			return fmt.Errorf("err while importing the blacklisted ip %v, err: %v", e.IP, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("err while importing the blacklist, err: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package sqldb
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/dasiyes/ivmsesman/internal/provutil"
+)
+
+// encodeValues encodes the session values as a JSON object
+func encodeValues(values map[string]interface{}) (string, error) {
+	b, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// decodeValues decodes the JSON object of the session values. The whole numbers are decoded as int64.
+func decodeValues(data []byte) (map[string]interface{}, error) {
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var values map[string]interface{}
+	if err := dec.Decode(&values); err != nil {
+		return nil, err
+	}
+	if values == nil {
+		values = make(map[string]interface{})
+	}
+	for k, v := range values {
+		values[k] = provutil.NormalizeNumbers(v)
+	}
+	return values, nil
+}
+
+// decodeValue decodes a JSON value. The whole numbers are decoded as int64.
+func decodeValue(data []byte) (interface{}, error) {
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return provutil.NormalizeNumbers(v), nil
+}
@@ -0,0 +1,233 @@
+package ivmsesman
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// The names of the background jobs, as reported by SchedulerStats
+const (
+	JobGC      = "gc"
+	JobBLClean = "blacklist_clean"
+)
+
+// defaultJitter is the fraction of the interval the job runs are spread by, when SesCfg.SchedulerJitter is zero
+const defaultJitter = 0.1
+
+// ErrClosed will be returned when the session manager is used after Close
+var ErrClosed = errors.New("session manager is closed")
+
+// JobStats reports the runs of a background job
+type JobStats struct {
+	// Scheduled is true while the job is running on its interval
+	Scheduled    bool
+	Runs         uint64
+	Panics       uint64
+	LastRun      time.Time
+	LastDuration time.Duration
+	// LastPanic is the value of the last panic recovered from the job
+	LastPanic string
+}
+
+// job is a background task run on an interval
+type job struct {
+	name     string
+	interval time.Duration
+	run      func(ctx context.Context)
+}
+
+// scheduler runs the background jobs of the session manager until their context is done or Close
+type scheduler struct {
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	cancels []context.CancelFunc
+	stats   map[string]*JobStats
+	closed  bool
+}
+
+// Start runs the session GC, the blacklist cleaning and the snapshots of a Snapshotter repository in the
+// background, at the SesCfg.GCInterval, SesCfg.BLCleanInterval and SesCfg.SnapshotInterval intervals,
+// until ctx is done or Close is called. A zero BLCleanInterval disables the blacklist cleaning and a zero
+// SnapshotInterval the periodic snapshots.
+func (sm *Sesman) Start(ctx context.Context) error {
+
+	jobs := []job{sm.gcJob()}
+	if sm.cfg.BLCleanInterval > 0 {
+		jobs = append(jobs, sm.blcJob())
+	}
+	if _, ok := underlying(sm.sessions).(Snapshotter); ok && sm.cfg.SnapshotInterval > 0 {
+		jobs = append(jobs, sm.snapshotJob())
+	}
+	return sm.schedule(ctx, false, jobs...)
+}
+
+// Close stops the background jobs, waits for the running ones to return, leaves the invalidation bus and
+// saves the sessions of a Snapshotter repository, returning the error of the snapshot. The session manager
+// can not be started again.
+func (sm *Sesman) Close() error {
+
+	sm.sched.mu.Lock()
+	if sm.sched.closed {
+		sm.sched.mu.Unlock()
+		return nil
+	}
+	sm.sched.closed = true
+	for _, cancel := range sm.sched.cancels {
+		cancel()
+	}
+	sm.sched.cancels = nil
+	sm.sched.mu.Unlock()
+
+	if sm.unsubscribe != nil {
+		sm.unsubscribe()
+	}
+
+	sm.sched.wg.Wait()
+	return sm.snapshot(context.Background())
+}
+
+// SchedulerStats returns the stats of the background jobs by their name
+func (sm *Sesman) SchedulerStats() map[string]JobStats {
+
+	sm.sched.mu.Lock()
+	defer sm.sched.mu.Unlock()
+
+	stats := make(map[string]JobStats, len(sm.sched.stats))
+	for name, st := range sm.sched.stats {
+		stats[name] = *st
+	}
+	return stats
+}
+
+// gcJob is the session GC job
+func (sm *Sesman) gcJob() job {
+
+	interval := sm.cfg.GCInterval
+	if interval <= 0 {
+		interval = sm.cfg.Maxlifetime
+	}
+	if interval <= 0 {
+		interval = 1
+	}
+	return job{name: JobGC, interval: time.Duration(interval) * time.Second, run: func(ctx context.Context) {
+		sm.sessions.SessionGCContext(ctx, sm.cfg.Maxlifetime)
+	}}
+}
+
+// blcJob is the blacklist cleaning job
+func (sm *Sesman) blcJob() job {
+	return job{name: JobBLClean, interval: time.Duration(sm.cfg.BLCleanInterval) * time.Second, run: sm.sessions.BLCleanContext}
+}
+
+// schedule starts the jobs. With now set the jobs run right away, otherwise after their first interval.
+func (sm *Sesman) schedule(ctx context.Context, now bool, jobs ...job) error {
+
+	s := &sm.sched
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	if s.stats == nil {
+		s.stats = make(map[string]*JobStats)
+	}
+	for _, j := range jobs {
+		if st, ok := s.stats[j.name]; ok && st.Scheduled {
+			return fmt.Errorf("Sesman: job %s is already running", j.name)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	s.cancels = append(s.cancels, cancel)
+	for _, j := range jobs {
+		st, ok := s.stats[j.name]
+		if !ok {
+			st = &JobStats{}
+			s.stats[j.name] = st
+		}
+		st.Scheduled = true
+		s.wg.Add(1)
+		go sm.loop(ctx, j, now)
+	}
+	return nil
+}
+
+// loop runs the job on its interval until the context is done
+func (sm *Sesman) loop(ctx context.Context, j job, now bool) {
+
+	defer sm.sched.wg.Done()
+	defer func() {
+		sm.sched.mu.Lock()
+		sm.sched.stats[j.name].Scheduled = false
+		sm.sched.mu.Unlock()
+	}()
+
+	if now {
+		sm.runJob(ctx, j)
+	}
+	for {
+		t := time.NewTimer(jitter(j.interval, sm.cfg.SchedulerJitter))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		sm.runJob(ctx, j)
+	}
+}
+
+// runJob runs the job once, recovering a panic
+func (sm *Sesman) runJob(ctx context.Context, j job) {
+
+	start := time.Now()
+	var panicked interface{}
+
+	func() {
+		defer func() {
+			panicked = recover()
+		}()
+		j.run(ctx)
+	}()
+
+	d := time.Since(start)
+
+	sm.sched.mu.Lock()
+	st := sm.sched.stats[j.name]
+	st.Runs++
+	st.LastRun = start
+	st.LastDuration = d
+	if panicked != nil {
+		st.Panics++
+		st.LastPanic = fmt.Sprint(panicked)
+	}
+	sm.sched.mu.Unlock()
+
+	if panicked != nil {
+		sm.logger().ErrorContext(ctx, "background job panicked", slog.String("job", j.name), slog.Any("panic", panicked))
+		return
+	}
+	sm.logger().DebugContext(ctx, "background job done", slog.String("job", j.name), slog.Duration("duration", d))
+}
+
+// jitter spreads the interval d by up to the fraction f (at most a half) in both directions. Zero f
+// uses the default jitter and a negative one disables it.
+func jitter(d time.Duration, f float64) time.Duration {
+
+	if f == 0 {
+		f = defaultJitter
+	}
+	if f < 0 {
+		return d
+	}
+	if f > 0.5 {
+		f = 0.5
+	}
+	return d + time.Duration((rand.Float64()*2-1)*f*float64(d))
+}
@@ -0,0 +1,30 @@
+package ivmsesman
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJitter(t *testing.T) {
+
+	const d = 10 * time.Second
+	cases := []struct {
+		name     string
+		f        float64
+		min, max time.Duration
+	}{
+		{"default", 0, 9 * time.Second, 11 * time.Second},
+		{"disabled", -1, d, d},
+		{"custom", 0.3, 7 * time.Second, 13 * time.Second},
+		{"capped", 2, 5 * time.Second, 15 * time.Second},
+	}
+
+	for _, c := range cases {
+		for n := 0; n < 100; n++ {
+			if j := jitter(d, c.f); j < c.min || j > c.max {
+				t.Errorf("%s: expected a value in [%v, %v], got %v", c.name, c.min, c.max, j)
+				break
+			}
+		}
+	}
+}
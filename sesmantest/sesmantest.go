@@ -0,0 +1,833 @@
+// Package sesmantest provides the conformance test suite for the session store providers.
+// Every provider, including third-party ones, can prove it implements the ivmsesman.SessionRepository
+// contract by running RunConformance from its own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		sesmantest.RunConformance(t, func(t *testing.T) ivmsesman.SessionRepository {
+//			return myprovider.New(...)
+//		})
+//	}
+package sesmantest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dasiyes/ivmsesman"
+)
+
+// Factory returns the repository under test. It is called once per test case and the
+// suite flushes the returned repository before using it, so factories may return a
+// shared instance.
+type Factory func(t *testing.T) ivmsesman.SessionRepository
+
+// RunConformance drives the repository returned by the factory through the full SessionRepository contract.
+// The expiry case waits a couple of seconds, so the repository must expire idle sessions by SessionGC(1)
+// or by a native TTL of at most one second.
+func RunConformance(t *testing.T, factory Factory) {
+	t.Helper()
+
+	cases := []struct {
+		name string
+		fn   func(t *testing.T, repo ivmsesman.SessionRepository)
+	}{
+		{"NewSession", testNewSession},
+		{"FindOrCreate", testFindOrCreate},
+		{"Find", testFind},
+		{"Exists", testExists},
+		{"DestroySID", testDestroySID},
+		{"ActiveSessions", testActiveSessions},
+		{"UpdateTimeAccessed", testUpdateTimeAccessed},
+		{"StateTransitions", testStateTransitions},
+		{"AuthCodeLifecycle", testAuthCodeLifecycle},
+		{"Blacklist", testBlacklist},
+		{"Flush", testFlush},
+		{"SessionGC", testSessionGC},
+		{"Concurrency", testConcurrency},
+		{"Regenerate", testRegenerate},
+		{"ExpiryPolicy", testExpiryPolicy},
+		{"ExpiryListener", testExpiryListener},
+		{"WriteBehind", testWriteBehind},
+		{"Transfer", testTransfer},
+		{"List", testList},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			repo := factory(t)
+			if repo == nil {
+				t.Fatalf("factory returned nil repository")
+			}
+			if err := repo.Flush(); err != nil {
+				t.Fatalf("Flush: unexpected error %v", err)
+			}
+			c.fn(t, repo)
+		})
+	}
+}
+
+// run makes the session ids unique between test runs against persistent stores
+var run = time.Now().UnixNano()
+
+// sid returns the n-th session id of the test case
+func sid(t *testing.T, n int) string {
+	return fmt.Sprintf("sesmantest-%d-%s-%d", run, strings.ReplaceAll(t.Name(), "/", "_"), n)
+}
+
+func mustNewSession(t *testing.T, repo ivmsesman.SessionRepository, id string) ivmsesman.SessionStore {
+	t.Helper()
+
+	ss, err := repo.NewSession(id)
+	if err != nil {
+		t.Fatalf("NewSession(%q): unexpected error %v", id, err)
+	}
+	if ss == nil {
+		t.Fatalf("NewSession(%q): returned nil session", id)
+	}
+	return ss
+}
+
+func testNewSession(t *testing.T, repo ivmsesman.SessionRepository) {
+	id := sid(t, 1)
+	before := time.Now().Add(-2 * time.Second)
+
+	ss := mustNewSession(t, repo, id)
+
+	if ss.SessionID() != id {
+		t.Errorf("SessionID: want %q, got %q", id, ss.SessionID())
+	}
+	if state, _ := ss.Get("state").(string); state != "New" {
+		t.Errorf("new session state: want `New`, got %#v", ss.Get("state"))
+	}
+	if lta := ss.GetLTA(); lta.Before(before) || lta.After(time.Now().Add(2*time.Second)) {
+		t.Errorf("GetLTA: want about now, got %v", lta)
+	}
+	if ss.Get("missing") != nil {
+		t.Errorf("Get of a missing key: want nil, got %#v", ss.Get("missing"))
+	}
+}
+
+func testFindOrCreate(t *testing.T, repo ivmsesman.SessionRepository) {
+	id := sid(t, 1)
+	mustNewSession(t, repo, id)
+	if err := repo.UpdateSessionState(id, "Visited"); err != nil {
+		t.Fatalf("UpdateSessionState: unexpected error %v", err)
+	}
+
+	ss, err := repo.FindOrCreate(id)
+	if err != nil {
+		t.Fatalf("FindOrCreate(existing): unexpected error %v", err)
+	}
+	if ss.SessionID() != id {
+		t.Errorf("FindOrCreate(existing) SessionID: want %q, got %q", id, ss.SessionID())
+	}
+	if state, _ := ss.Get("state").(string); state != "Visited" {
+		t.Errorf("FindOrCreate(existing) state: want `Visited`, got %#v", ss.Get("state"))
+	}
+
+	unknown := sid(t, 2)
+	ss, err = repo.FindOrCreate(unknown)
+	if err != nil {
+		t.Fatalf("FindOrCreate(unknown): unexpected error %v", err)
+	}
+	if ss.SessionID() != unknown {
+		t.Errorf("FindOrCreate(unknown) SessionID: want %q, got %q", unknown, ss.SessionID())
+	}
+	if state, _ := ss.Get("state").(string); state != "New" {
+		t.Errorf("FindOrCreate(unknown) state: want `New`, got %#v", ss.Get("state"))
+	}
+	if !repo.Exists(unknown) {
+		t.Errorf("FindOrCreate(unknown) did not store the session")
+	}
+}
+
+// testFind runs only for the repositories implementing ivmsesman.SessionFinder
+func testFind(t *testing.T, repo ivmsesman.SessionRepository) {
+	f, ok := repo.(ivmsesman.SessionFinder)
+	if !ok {
+		t.Skip("repository does not implement ivmsesman.SessionFinder")
+	}
+	ctx := context.Background()
+
+	id := sid(t, 1)
+	mustNewSession(t, repo, id)
+	if err := repo.UpdateSessionState(id, "Visited"); err != nil {
+		t.Fatalf("UpdateSessionState: unexpected error %v", err)
+	}
+	ss, err := f.FindContext(ctx, id)
+	if err != nil {
+		t.Fatalf("FindContext(existing): unexpected error %v", err)
+	}
+	if ss.SessionID() != id {
+		t.Errorf("FindContext(existing) SessionID: want %q, got %q", id, ss.SessionID())
+	}
+	if state, _ := ss.Get("state").(string); state != "Visited" {
+		t.Errorf("FindContext(existing) state: want `Visited`, got %#v", ss.Get("state"))
+	}
+
+	unknown := sid(t, 2)
+	if _, err := f.FindContext(ctx, unknown); err != ivmsesman.ErrInvalidSessionID {
+		t.Errorf("FindContext(unknown): want ErrInvalidSessionID, got %v", err)
+	}
+	if repo.Exists(unknown) {
+		t.Errorf("FindContext(unknown) created the session")
+	}
+
+	if err := repo.DestroySID(id); err != nil {
+		t.Fatalf("DestroySID: unexpected error %v", err)
+	}
+	if _, err := f.FindContext(ctx, id); err != ivmsesman.ErrInvalidSessionID {
+		t.Errorf("FindContext(destroyed): want ErrInvalidSessionID, got %v", err)
+	}
+}
+
+func testExists(t *testing.T, repo ivmsesman.SessionRepository) {
+	id := sid(t, 1)
+	if repo.Exists(id) {
+		t.Errorf("Exists(unknown): want false")
+	}
+	mustNewSession(t, repo, id)
+	if !repo.Exists(id) {
+		t.Errorf("Exists(existing): want true")
+	}
+}
+
+func testDestroySID(t *testing.T, repo ivmsesman.SessionRepository) {
+	id := sid(t, 1)
+	mustNewSession(t, repo, id)
+
+	if err := repo.DestroySID(id); err != nil {
+		t.Fatalf("DestroySID: unexpected error %v", err)
+	}
+	if repo.Exists(id) {
+		t.Errorf("Exists after DestroySID: want false")
+	}
+	if err := repo.DestroySID(id); err != nil {
+		t.Errorf("DestroySID(unknown): want nil error, got %v", err)
+	}
+}
+
+func testActiveSessions(t *testing.T, repo ivmsesman.SessionRepository) {
+	if n := repo.ActiveSessions(); n != 0 {
+		t.Fatalf("ActiveSessions after Flush: want 0, got %d", n)
+	}
+	for i := 0; i < 3; i++ {
+		mustNewSession(t, repo, sid(t, i))
+	}
+	if n := repo.ActiveSessions(); n != 3 {
+		t.Errorf("ActiveSessions: want 3, got %d", n)
+	}
+	if err := repo.DestroySID(sid(t, 0)); err != nil {
+		t.Fatalf("DestroySID: unexpected error %v", err)
+	}
+	if n := repo.ActiveSessions(); n != 2 {
+		t.Errorf("ActiveSessions after DestroySID: want 2, got %d", n)
+	}
+}
+
+func testUpdateTimeAccessed(t *testing.T, repo ivmsesman.SessionRepository) {
+	id := sid(t, 1)
+	mustNewSession(t, repo, id)
+
+	if err := repo.UpdateTimeAccessed(id); err != nil {
+		t.Errorf("UpdateTimeAccessed(existing): unexpected error %v", err)
+	}
+	if err := repo.UpdateTimeAccessed(sid(t, 2)); err == nil {
+		t.Errorf("UpdateTimeAccessed(unknown): want error")
+	}
+}
+
+func testStateTransitions(t *testing.T, repo ivmsesman.SessionRepository) {
+	id := sid(t, 1)
+	mustNewSession(t, repo, id)
+
+	for _, state := range []string{"Visited", "InAuth", "Authed"} {
+		if err := repo.UpdateSessionState(id, state); err != nil {
+			t.Fatalf("UpdateSessionState(%q): unexpected error %v", state, err)
+		}
+		ss, err := repo.FindOrCreate(id)
+		if err != nil {
+			t.Fatalf("FindOrCreate: unexpected error %v", err)
+		}
+		if got, _ := ss.Get("state").(string); got != state {
+			t.Errorf("state: want %q, got %#v", state, ss.Get("state"))
+		}
+	}
+
+	unknown := sid(t, 2)
+	if err := repo.UpdateSessionState(unknown, "Authed"); err == nil {
+		t.Errorf("UpdateSessionState(unknown): want error")
+	}
+	if repo.Exists(unknown) {
+		t.Errorf("UpdateSessionState(unknown) must not create the session")
+	}
+}
+
+func testAuthCodeLifecycle(t *testing.T, repo ivmsesman.SessionRepository) {
+	id := sid(t, 1)
+	mustNewSession(t, repo, id)
+
+	if ac := repo.GetAuthCode(id); ac == nil || len(ac) != 0 {
+		t.Errorf("GetAuthCode(New session): want empty map, got %#v", ac)
+	}
+
+	if err := repo.SaveCodeChallengeAndMethod(id, "coch", "S256", "code", "https://example.com/cb"); err != nil {
+		t.Fatalf("SaveCodeChallengeAndMethod: unexpected error %v", err)
+	}
+	ss, err := repo.FindOrCreate(id)
+	if err != nil {
+		t.Fatalf("FindOrCreate: unexpected error %v", err)
+	}
+	if state, _ := ss.Get("state").(string); state != "InAuth" {
+		t.Errorf("state after SaveCodeChallengeAndMethod: want `InAuth`, got %#v", ss.Get("state"))
+	}
+	if ru, _ := ss.Get("redirect_uri").(string); ru != "https://example.com/cb" {
+		t.Errorf("redirect_uri: want `https://example.com/cb`, got %#v", ss.Get("redirect_uri"))
+	}
+
+	ac := repo.GetAuthCode(id)
+	want := map[string]string{"auth_code": "code", "code_challenger": "coch", "code_challenger_method": "S256"}
+	for k, v := range want {
+		if ac[k] != v {
+			t.Errorf("GetAuthCode[%q]: want %q, got %q", k, v, ac[k])
+		}
+	}
+
+	if err := repo.UpdateCodeVerifier(id, "cove"); err != nil {
+		t.Fatalf("UpdateCodeVerifier: unexpected error %v", err)
+	}
+	ss, _ = repo.FindOrCreate(id)
+	if cove, _ := ss.Get("code_verifier").(string); cove != "cove" {
+		t.Errorf("code_verifier: want `cove`, got %#v", ss.Get("code_verifier"))
+	}
+
+	if err := repo.UpdateAuthSession(id, "at", "rt", "uid"); err != nil {
+		t.Fatalf("UpdateAuthSession: unexpected error %v", err)
+	}
+	ss, _ = repo.FindOrCreate(id)
+	for k, v := range map[string]string{"state": "Authed", "at": "at", "rt": "rt", "uid": "uid"} {
+		if got, _ := ss.Get(k).(string); got != v {
+			t.Errorf("authed session %q: want %q, got %#v", k, v, ss.Get(k))
+		}
+	}
+	if ac := repo.GetAuthCode(id); len(ac) != 0 {
+		t.Errorf("GetAuthCode(Authed session): want empty map, got %#v", ac)
+	}
+
+	unknown := sid(t, 2)
+	if ac := repo.GetAuthCode(unknown); ac == nil || len(ac) != 0 {
+		t.Errorf("GetAuthCode(unknown): want empty map, got %#v", ac)
+	}
+	if err := repo.SaveCodeChallengeAndMethod(unknown, "coch", "S256", "code", "/"); err == nil {
+		t.Errorf("SaveCodeChallengeAndMethod(unknown): want error")
+	}
+	if err := repo.UpdateCodeVerifier(unknown, "cove"); err == nil {
+		t.Errorf("UpdateCodeVerifier(unknown): want error")
+	}
+	if err := repo.UpdateAuthSession(unknown, "at", "rt", "uid"); err == nil {
+		t.Errorf("UpdateAuthSession(unknown): want error")
+	}
+}
+
+func testBlacklist(t *testing.T, repo ivmsesman.SessionRepository) {
+	ip := fmt.Sprintf("192.0.2.%d", time.Now().UnixNano()%250+1)
+
+	repo.Blacklisting(ip, "/wp-login.php", map[string]interface{}{"reason": "sesmantest"})
+	if !repo.IsIPExistInBL(ip) {
+		t.Errorf("IsIPExistInBL(%s): want true", ip)
+	}
+	if repo.IsIPExistInBL("198.51.100.255") {
+		t.Errorf("IsIPExistInBL(unknown): want false")
+	}
+
+	// entries within the quarantine period are never cleaned
+	repo.BLClean()
+	if !repo.IsIPExistInBL(ip) {
+		t.Errorf("IsIPExistInBL after BLClean: want true for an ip in quarantine")
+	}
+}
+
+func testFlush(t *testing.T, repo ivmsesman.SessionRepository) {
+	for i := 0; i < 5; i++ {
+		mustNewSession(t, repo, sid(t, i))
+	}
+	if err := repo.Flush(); err != nil {
+		t.Fatalf("Flush: unexpected error %v", err)
+	}
+	if n := repo.ActiveSessions(); n != 0 {
+		t.Errorf("ActiveSessions after Flush: want 0, got %d", n)
+	}
+	if repo.Exists(sid(t, 0)) {
+		t.Errorf("Exists after Flush: want false")
+	}
+}
+
+func testSessionGC(t *testing.T, repo ivmsesman.SessionRepository) {
+	idle := sid(t, 1)
+	mustNewSession(t, repo, idle)
+
+	time.Sleep(2100 * time.Millisecond)
+
+	fresh := sid(t, 2)
+	mustNewSession(t, repo, fresh)
+
+	repo.SessionGC(1)
+
+	if repo.Exists(idle) {
+		t.Errorf("Exists(idle) after SessionGC: want false")
+	}
+	if !repo.Exists(fresh) {
+		t.Errorf("Exists(fresh) after SessionGC: want true")
+	}
+	if n := repo.ActiveSessions(); n != 1 {
+		t.Errorf("ActiveSessions after SessionGC: want 1, got %d", n)
+	}
+}
+
+// testRegenerate runs only for the repositories implementing ivmsesman.SessionRegenerator
+func testRegenerate(t *testing.T, repo ivmsesman.SessionRepository) {
+	rg, ok := repo.(ivmsesman.SessionRegenerator)
+	if !ok {
+		t.Skip("repository does not implement ivmsesman.SessionRegenerator")
+	}
+
+	oldsid, newsid := sid(t, 1), sid(t, 2)
+	ss := mustNewSession(t, repo, oldsid)
+	if err := ss.Set("username", "alice"); err != nil {
+		t.Fatalf("Set: unexpected error %v", err)
+	}
+	if err := repo.UpdateSessionState(oldsid, "Visited"); err != nil {
+		t.Fatalf("UpdateSessionState: unexpected error %v", err)
+	}
+
+	ns, err := rg.RegenerateContext(context.Background(), oldsid, newsid)
+	if err != nil {
+		t.Fatalf("RegenerateContext: unexpected error %v", err)
+	}
+	if ns.SessionID() != newsid {
+		t.Errorf("SessionID: want %q, got %q", newsid, ns.SessionID())
+	}
+	if repo.Exists(oldsid) {
+		t.Errorf("Exists(old) after RegenerateContext: want false")
+	}
+	if !repo.Exists(newsid) {
+		t.Errorf("Exists(new) after RegenerateContext: want true")
+	}
+	if n := repo.ActiveSessions(); n != 1 {
+		t.Errorf("ActiveSessions after RegenerateContext: want 1, got %d", n)
+	}
+
+	found, err := repo.FindOrCreate(newsid)
+	if err != nil {
+		t.Fatalf("FindOrCreate: unexpected error %v", err)
+	}
+	if found.Get("username") != "alice" || found.Get("state") != "Visited" {
+		t.Errorf("values after RegenerateContext: want alice/Visited, got %#v/%#v", found.Get("username"), found.Get("state"))
+	}
+
+	if _, err := rg.RegenerateContext(context.Background(), sid(t, 3), sid(t, 4)); err == nil {
+		t.Errorf("RegenerateContext of a missing session: want error")
+	}
+	if repo.Exists(sid(t, 4)) {
+		t.Errorf("Exists after a failed RegenerateContext: want false")
+	}
+}
+
+// testExpiryPolicy runs only for the repositories implementing ivmsesman.ExpiryPolicySetter
+func testExpiryPolicy(t *testing.T, repo ivmsesman.SessionRepository) {
+	eps, ok := repo.(ivmsesman.ExpiryPolicySetter)
+	if !ok {
+		t.Skip("repository does not implement ivmsesman.ExpiryPolicySetter")
+	}
+	eps.SetExpiryPolicy(ivmsesman.ExpiryPolicy{Idle: 1, Absolute: 1})
+	t.Cleanup(func() { eps.SetExpiryPolicy(ivmsesman.ExpiryPolicy{}) })
+
+	idle, busy := sid(t, 1), sid(t, 2)
+	mustNewSession(t, repo, idle)
+	ss := mustNewSession(t, repo, busy)
+	if c, ok := ss.(ivmsesman.SessionCreatedAt); ok && time.Since(c.GetCreatedAt()) > time.Minute {
+		t.Errorf("GetCreatedAt: want the creation time, got %v", c.GetCreatedAt())
+	}
+	if err := ss.Set("username", "alice"); err != nil {
+		t.Fatalf("Set: unexpected error %v", err)
+	}
+
+	// busy is accessed all along, so it is only subject to the absolute timeout
+	deadline := time.Now().Add(2100 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		_ = repo.UpdateTimeAccessed(busy)
+		time.Sleep(300 * time.Millisecond)
+	}
+
+	// the timeouts are enforced on read, without SessionGC, and an expired session is not created again
+	if f, ok := repo.(ivmsesman.SessionFinder); ok {
+		if _, err := f.FindContext(context.Background(), idle); err != ivmsesman.ErrInvalidSessionID {
+			t.Errorf("FindContext(idle) past the idle timeout: want ErrInvalidSessionID, got %v", err)
+		}
+	}
+	if repo.Exists(idle) {
+		t.Errorf("Exists(idle) past the idle timeout: want false")
+	}
+	if repo.Exists(busy) {
+		t.Errorf("Exists(busy) past the absolute timeout: want false")
+	}
+	if err := repo.UpdateSessionState(busy, "Visited"); err == nil {
+		t.Errorf("UpdateSessionState past the absolute timeout: want error")
+	}
+	found, err := repo.FindOrCreate(busy)
+	if err != nil {
+		t.Fatalf("FindOrCreate: unexpected error %v", err)
+	}
+	if found.Get("username") != nil || found.Get("state") != "New" {
+		t.Errorf("FindOrCreate past the absolute timeout: want a new session, got %#v/%#v", found.Get("username"), found.Get("state"))
+	}
+}
+
+// testExpiryListener runs only for the repositories implementing ivmsesman.ExpiryPolicySetter and
+// ivmsesman.ExpiryListenerSetter
+func testExpiryListener(t *testing.T, repo ivmsesman.SessionRepository) {
+	eps, ok := repo.(ivmsesman.ExpiryPolicySetter)
+	if !ok {
+		t.Skip("repository does not implement ivmsesman.ExpiryPolicySetter")
+	}
+	els, ok := repo.(ivmsesman.ExpiryListenerSetter)
+	if !ok {
+		t.Skip("repository does not implement ivmsesman.ExpiryListenerSetter")
+	}
+
+	var mu sync.Mutex
+	reported := make(map[string]int)
+	els.SetExpiryListener(func(ctx context.Context, sid string) {
+		mu.Lock()
+		defer mu.Unlock()
+		reported[sid]++
+	})
+	eps.SetExpiryPolicy(ivmsesman.ExpiryPolicy{Idle: 1})
+	t.Cleanup(func() {
+		els.SetExpiryListener(nil)
+		eps.SetExpiryPolicy(ivmsesman.ExpiryPolicy{})
+	})
+
+	idle := sid(t, 1)
+	mustNewSession(t, repo, idle)
+
+	time.Sleep(2100 * time.Millisecond)
+
+	fresh := sid(t, 2)
+	mustNewSession(t, repo, fresh)
+
+	// the expired session is reported either when it is read or by SessionGC
+	if repo.Exists(idle) {
+		t.Errorf("Exists(idle) past the idle timeout: want false")
+	}
+	repo.SessionGC(1)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if reported[idle] == 0 {
+		t.Errorf("expired session %q not reported, got %v", idle, reported)
+	}
+	if reported[fresh] != 0 {
+		t.Errorf("fresh session %q reported as expired", fresh)
+	}
+}
+
+// testWriteBehind runs only for the repositories whose sessions implement ivmsesman.SessionBuffer
+func testWriteBehind(t *testing.T, repo ivmsesman.SessionRepository) {
+	id := sid(t, 1)
+	ss := mustNewSession(t, repo, id)
+	sb, ok := ss.(ivmsesman.SessionBuffer)
+	if !ok {
+		t.Skip("session store does not implement ivmsesman.SessionBuffer")
+	}
+	ctx := context.Background()
+
+	if err := ss.Set("kept", "a"); err != nil {
+		t.Fatalf("Set: unexpected error %v", err)
+	}
+
+	sb.Buffer(ctx)
+	if err := ss.Set("username", "alice"); err != nil {
+		t.Fatalf("Set: unexpected error %v", err)
+	}
+	if ss.Get("username") != "alice" {
+		t.Errorf("Get of a buffered value: want alice, got %#v", ss.Get("username"))
+	}
+	found, err := repo.FindOrCreate(id)
+	if err != nil {
+		t.Fatalf("FindOrCreate: unexpected error %v", err)
+	}
+	if v := found.Get("username"); v != nil {
+		t.Errorf("value before Save: want nil, got %#v", v)
+	}
+
+	if err := sb.Save(ctx); err != nil {
+		t.Fatalf("Save: unexpected error %v", err)
+	}
+	found, err = repo.FindOrCreate(id)
+	if err != nil {
+		t.Fatalf("FindOrCreate: unexpected error %v", err)
+	}
+	if v := found.Get("username"); v != "alice" {
+		t.Errorf("value after Save: want alice, got %#v", v)
+	}
+
+	if err := ss.Delete("kept"); err != nil {
+		t.Fatalf("Delete: unexpected error %v", err)
+	}
+	if err := sb.Release(ctx); err != nil {
+		t.Fatalf("Release: unexpected error %v", err)
+	}
+	found, err = repo.FindOrCreate(id)
+	if err != nil {
+		t.Fatalf("FindOrCreate: unexpected error %v", err)
+	}
+	if v := found.Get("kept"); v != nil {
+		t.Errorf("value deleted before Release: want nil, got %#v", v)
+	}
+
+	// after Release the changes are written right away
+	if err := ss.Set("role", "admin"); err != nil {
+		t.Fatalf("Set: unexpected error %v", err)
+	}
+	found, err = repo.FindOrCreate(id)
+	if err != nil {
+		t.Fatalf("FindOrCreate: unexpected error %v", err)
+	}
+	if v := found.Get("role"); v != "admin" {
+		t.Errorf("value set after Release: want admin, got %#v", v)
+	}
+
+	// saving a destroyed session must not bring it back
+	sb.Buffer(ctx)
+	if err := ss.Set("username", "bob"); err != nil {
+		t.Fatalf("Set: unexpected error %v", err)
+	}
+	if err := repo.DestroySID(id); err != nil {
+		t.Fatalf("DestroySID: unexpected error %v", err)
+	}
+	if err := sb.Release(ctx); err == nil {
+		t.Errorf("Release of a destroyed session: want error")
+	}
+	if repo.Exists(id) {
+		t.Errorf("Exists after the Release of a destroyed session: want false")
+	}
+}
+
+func testConcurrency(t *testing.T, repo ivmsesman.SessionRepository) {
+	const workers = 32
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+
+			id := sid(t, n)
+			ss, err := repo.NewSession(id)
+			if err != nil {
+				errs <- fmt.Errorf("NewSession: %v", err)
+				return
+			}
+			if err := ss.Set("n", n); err != nil {
+				errs <- fmt.Errorf("Set: %v", err)
+				return
+			}
+			if err := repo.UpdateSessionState(id, "Visited"); err != nil {
+				errs <- fmt.Errorf("UpdateSessionState: %v", err)
+				return
+			}
+			found, err := repo.FindOrCreate(id)
+			if err != nil {
+				errs <- fmt.Errorf("FindOrCreate: %v", err)
+				return
+			}
+			if state, _ := found.Get("state").(string); state != "Visited" {
+				errs <- fmt.Errorf("state: want `Visited`, got %#v", found.Get("state"))
+				return
+			}
+			_ = repo.Exists(id)
+			_ = repo.ActiveSessions()
+			if n%2 == 0 {
+				if err := repo.DestroySID(id); err != nil {
+					errs <- fmt.Errorf("DestroySID: %v", err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if n := repo.ActiveSessions(); n != workers/2 {
+		t.Errorf("ActiveSessions: want %d, got %d", workers/2, n)
+	}
+}
+
+// testTransfer runs only for the repositories implementing ivmsesman.SessionExporter and
+// ivmsesman.SessionImporter
+func testTransfer(t *testing.T, repo ivmsesman.SessionRepository) {
+	exp, ok := repo.(ivmsesman.SessionExporter)
+	if !ok {
+		t.Skip("repository does not implement ivmsesman.SessionExporter")
+	}
+	imp, ok := repo.(ivmsesman.SessionImporter)
+	if !ok {
+		t.Skip("repository does not implement ivmsesman.SessionImporter")
+	}
+	ctx := context.Background()
+
+	// the sessions are accessed now, as the suite may run with an idle timeout of one second
+	now := time.Now().Unix()
+	first, second := sid(t, 1), sid(t, 2)
+	err := imp.ImportSessions(ctx, []ivmsesman.SessionRecord{
+		{ID: second, CreatedAt: now - 100, TimeAccessed: now, Values: map[string]interface{}{"state": "New"}},
+		{ID: first, CreatedAt: now - 200, TimeAccessed: now, Values: map[string]interface{}{"state": "Visited", "n": int64(7)}},
+	})
+	if err != nil {
+		t.Fatalf("ImportSessions: unexpected error %v", err)
+	}
+
+	var got []ivmsesman.SessionRecord
+	collect := func(rec ivmsesman.SessionRecord) error {
+		if rec.ID == first || rec.ID == second {
+			got = append(got, rec)
+		}
+		return nil
+	}
+	if err := exp.ExportSessions(ctx, "", collect); err != nil {
+		t.Fatalf("ExportSessions: unexpected error %v", err)
+	}
+	if len(got) != 2 || got[0].ID != first || got[1].ID != second {
+		t.Fatalf("ExportSessions: want %q and %q in the order of the ids, got %+v", first, second, got)
+	}
+	rec := got[0]
+	if rec.CreatedAt != now-200 || rec.TimeAccessed != now {
+		t.Errorf("ExportSessions: want the imported times %d/%d, got %d/%d", now-200, now, rec.CreatedAt, rec.TimeAccessed)
+	}
+	if rec.Values["state"] != "Visited" || fmt.Sprint(rec.Values["n"]) != "7" {
+		t.Errorf("ExportSessions: want the imported values, got %#v", rec.Values)
+	}
+
+	got = nil
+	if err := exp.ExportSessions(ctx, first, collect); err != nil {
+		t.Fatalf("ExportSessions: unexpected error %v", err)
+	}
+	if len(got) != 1 || got[0].ID != second {
+		t.Errorf("ExportSessions after %q: want only %q, got %+v", first, second, got)
+	}
+
+	found, err := repo.FindOrCreate(first)
+	if err != nil {
+		t.Fatalf("FindOrCreate: unexpected error %v", err)
+	}
+	if found.Get("state") != "Visited" {
+		t.Errorf("FindOrCreate: want the imported session, got state %#v", found.Get("state"))
+	}
+
+	ip := "192.0.2.24"
+	if err := imp.ImportBlacklist(ctx, []ivmsesman.BlacklistRecord{{IP: ip, Created: now, RequestURI: "/login"}}); err != nil {
+		t.Fatalf("ImportBlacklist: unexpected error %v", err)
+	}
+	if !repo.IsIPExistInBL(ip) {
+		t.Errorf("IsIPExistInBL(%q) after ImportBlacklist: want true", ip)
+	}
+	var entry *ivmsesman.BlacklistRecord
+	if err := exp.ExportBlacklist(ctx, func(e ivmsesman.BlacklistRecord) error {
+		if e.IP == ip {
+			entry = &e
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("ExportBlacklist: unexpected error %v", err)
+	}
+	if entry == nil || entry.Created != now || entry.RequestURI != "/login" {
+		t.Errorf("ExportBlacklist: want the imported ip, got %+v", entry)
+	}
+}
+
+// testList runs only for the repositories implementing ivmsesman.SessionLister
+func testList(t *testing.T, repo ivmsesman.SessionRepository) {
+	l, ok := repo.(ivmsesman.SessionLister)
+	if !ok {
+		t.Skip("repository does not implement ivmsesman.SessionLister")
+	}
+	ctx := context.Background()
+
+	ids := make(map[string]bool)
+	for n := 1; n <= 5; n++ {
+		id := sid(t, n)
+		mustNewSession(t, repo, id)
+		ids[id] = true
+	}
+	if err := repo.UpdateSessionState(sid(t, 2), "Visited"); err != nil {
+		t.Fatalf("UpdateSessionState: unexpected error %v", err)
+	}
+	if err := repo.UpdateSessionState(sid(t, 4), "Visited"); err != nil {
+		t.Fatalf("UpdateSessionState: unexpected error %v", err)
+	}
+	uid := fmt.Sprintf("sesmantest-%d", run)
+	if err := repo.UpdateAuthSession(sid(t, 5), "at", "rt", uid); err != nil {
+		t.Fatalf("UpdateAuthSession: unexpected error %v", err)
+	}
+
+	// list returns the ids of all the pages of the filter
+	list := func(filter ivmsesman.SessionFilter, limit int) map[string]int {
+		t.Helper()
+
+		seen := make(map[string]int)
+		cursor := ""
+		for pages := 0; pages < 10; pages++ {
+			page, next, err := l.List(ctx, filter, cursor, limit)
+			if err != nil {
+				t.Fatalf("List(%+v): unexpected error %v", filter, err)
+			}
+			if len(page) > limit {
+				t.Errorf("List(%+v): want at most %d sessions, got %d", filter, limit, len(page))
+			}
+			for _, rec := range page {
+				seen[rec.ID]++
+			}
+			if next == "" {
+				return seen
+			}
+			cursor = next
+		}
+		t.Fatalf("List(%+v): the cursor does not end", filter)
+		return nil
+	}
+
+	seen := list(ivmsesman.SessionFilter{}, 2)
+	for id := range ids {
+		if seen[id] != 1 {
+			t.Errorf("List: want %q listed once, got %d times", id, seen[id])
+		}
+	}
+
+	seen = list(ivmsesman.SessionFilter{State: "Visited"}, 1)
+	if len(seen) != 2 || seen[sid(t, 2)] != 1 || seen[sid(t, 4)] != 1 {
+		t.Errorf("List(State: Visited): want %q and %q, got %v", sid(t, 2), sid(t, 4), seen)
+	}
+
+	seen = list(ivmsesman.SessionFilter{UserID: uid, State: "Authed"}, 10)
+	if len(seen) != 1 || seen[sid(t, 5)] != 1 {
+		t.Errorf("List(UserID: %s): want %q, got %v", uid, sid(t, 5), seen)
+	}
+
+	now := time.Now().Unix()
+	if seen = list(ivmsesman.SessionFilter{AccessedBefore: now - 60}, 10); len(seen) != 0 {
+		t.Errorf("List(AccessedBefore: a minute ago): want no sessions, got %v", seen)
+	}
+	if seen = list(ivmsesman.SessionFilter{AccessedAfter: now - 60, AccessedBefore: now + 60}, 10); len(seen) != len(ids) {
+		t.Errorf("List(accessed within a minute): want %d sessions, got %v", len(ids), seen)
+	}
+}
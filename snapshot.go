@@ -0,0 +1,54 @@
+package ivmsesman
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// JobSnapshot is the name of the background job saving the sessions of a Snapshotter repository
+const JobSnapshot = "snapshot"
+
+// Snapshotter is implemented by the repositories keeping the sessions in the process memory, which can save
+// them to a durable place and load them again after a restart
+type Snapshotter interface {
+	// Snapshot saves the sessions
+	Snapshot(ctx context.Context) error
+
+	// Restore loads the sessions of the last snapshot, leaving out the expired ones
+	Restore(ctx context.Context) error
+}
+
+// restore loads the sessions of the repository snapshot, if it implements Snapshotter. A failed restore is
+// logged and the session manager starts with the sessions the repository has.
+func (sm *Sesman) restore(repo SessionRepository) {
+
+	s, ok := repo.(Snapshotter)
+	if !ok {
+		return
+	}
+	if err := s.Restore(context.Background()); err != nil {
+		sm.logger().Error("unable to restore the sessions snapshot", slog.Any("error", err))
+	}
+}
+
+// snapshot saves the sessions of the repository, if it implements Snapshotter
+func (sm *Sesman) snapshot(ctx context.Context) error {
+
+	s, ok := underlying(sm.sessions).(Snapshotter)
+	if !ok {
+		return nil
+	}
+	if err := s.Snapshot(ctx); err != nil {
+		sm.logger().ErrorContext(ctx, "unable to save the sessions snapshot", slog.Any("error", err))
+		return err
+	}
+	return nil
+}
+
+// snapshotJob is the job saving the sessions every SesCfg.SnapshotInterval seconds
+func (sm *Sesman) snapshotJob() job {
+	return job{name: JobSnapshot, interval: time.Duration(sm.cfg.SnapshotInterval) * time.Second, run: func(ctx context.Context) {
+		_ = sm.snapshot(ctx)
+	}}
+}
@@ -2,16 +2,26 @@
 package test
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"cloud.google.com/go/firestore"
+
 	i "github.com/dasiyes/ivmsesman"
-	_ "github.com/dasiyes/ivmsesman/providers/firestore"
-	_ "github.com/dasiyes/ivmsesman/providers/inmem"
+	"github.com/dasiyes/ivmsesman/providers/cache"
+	"github.com/dasiyes/ivmsesman/providers/disk"
+	firestoredb "github.com/dasiyes/ivmsesman/providers/firestore"
+	"github.com/dasiyes/ivmsesman/providers/inmem"
+	"github.com/dasiyes/ivmsesman/sesmantest"
 )
 
 // Creates new Session Configuration
@@ -206,14 +216,1160 @@ func TestActiveSessions(t *testing.T) {
 	}
 }
 
+// Test the AuthorizationCode flow attributes and the blacklist - memory provider
+func TestAuthCodeFlow(t *testing.T) {
+
+	var err error
+	gsm, err = i.NewSesman(i.Memory, cfg)
+	if err != nil {
+		t.Errorf("[Memory] Unexpected error %#v", err.Error())
+	}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	rr := httptest.NewRecorder()
+	ss, _ = gsm.SessionManager(rr, req)
+	sid = ss.SessionID()
+
+	t.Run("[Memory] Save code challenge and get the auth code",
+		func(t *testing.T) {
+			if err := gsm.SaveACA(sid, "coch", "S256", "code", "/cb"); err != nil {
+				t.Errorf("Unexpected error %#v", err.Error())
+			}
+			if state := ss.Get("state").(string); state != "InAuth" {
+				t.Errorf("Expected value `InAuth` - actual value %v\n", state)
+			}
+			ac := gsm.GetAuthCode(sid)
+			if ac["auth_code"] != "code" || ac["code_challenger"] != "coch" || ac["code_challenger_method"] != "S256" {
+				t.Errorf("Unexpected auth code attributes %#v\n", ac)
+			}
+			if err := gsm.UpdateCodeVerifier(sid, "cove"); err != nil {
+				t.Errorf("Unexpected error %#v", err.Error())
+			}
+		})
+
+	t.Run("[Memory] Auth code of unknown session",
+		func(t *testing.T) {
+			if ac := gsm.GetAuthCode("...xxx..."); ac == nil || len(ac) != 0 {
+				t.Errorf("Expected empty auth code attributes, got %#v\n", ac)
+			}
+			if err := gsm.SaveACA("...xxx...", "coch", "S256", "code", "/cb"); err == nil {
+				t.Errorf("Expected error saving the code challenge of unknown session")
+			}
+		})
+
+	t.Run("[Memory] Blacklisting",
+		func(t *testing.T) {
+			gsm.AddBlacklisting("10.0.0.1", "/wp-admin", "test")
+			if !gsm.IsBlackListed("10.0.0.1") {
+				t.Errorf("Expected ip 10.0.0.1 to be blacklisted")
+			}
+			if gsm.IsBlackListed("10.0.0.2") {
+				t.Errorf("Unexpected blacklisted ip 10.0.0.2")
+			}
+		})
+}
+
+// Test two session managers with their own repositories do not share sessions
+func TestNewSesmanWithRepository(t *testing.T) {
+
+	sm1, err := i.NewSesmanWithRepository(inmem.New(), cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	sm2, err := i.NewSesmanWithRepository(inmem.New(), cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	rr := httptest.NewRecorder()
+	s1, err := sm1.SessionManager(rr, req)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: cfg.CookieName, Value: s1.SessionID()})
+	if ok, _ := sm1.Exists(httptest.NewRecorder(), req); !ok {
+		t.Errorf("Expected the session to exist in its own session manager")
+	}
+	if ok, _ := sm2.Exists(httptest.NewRecorder(), req); ok {
+		t.Errorf("Unexpected session found in another session manager")
+	}
+
+	if _, err := i.NewSesmanWithRepository(nil, cfg); err == nil {
+		t.Errorf("Expected error for nil repository")
+	}
+	if _, err := i.NewSesmanWithRepository(inmem.New(), &i.SesCfg{}); err == nil {
+		t.Errorf("Expected error for empty configuration")
+	}
+}
+
+func TestSignedCookie(t *testing.T) {
+
+	scfg := *cfg
+	scfg.CookieKeys = [][]byte{[]byte("0123456789abcdef0123456789abcdef")}
+	scfg.CookieEncryptionKeys = [][]byte{[]byte("0123456789abcdef")}
+
+	sm, err := i.NewSesmanWithRepository(inmem.New(), &scfg)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	rr := httptest.NewRecorder()
+	s1, err := sm.SessionManager(rr, req)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	cookie := rr.Result().Cookies()[0]
+	if strings.Contains(cookie.Value, s1.SessionID()) {
+		t.Errorf("Unexpected plain session id in the encrypted cookie %v", cookie.Value)
+	}
+
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	s2, err := sm.SessionManager(httptest.NewRecorder(), req)
+	if err != nil || s2.SessionID() != s1.SessionID() {
+		t.Errorf("Expected session %v from the signed cookie, got %v, %v", s1.SessionID(), s2, err)
+	}
+
+	// a forged cookie carrying a known session id gets a fresh session
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: scfg.CookieName, Value: s1.SessionID()})
+	if ok, err := sm.Exists(httptest.NewRecorder(), req); ok || err != i.ErrInvalidCookie {
+		t.Errorf("Expected ErrInvalidCookie for a forged cookie, got %v, %v", ok, err)
+	}
+	rr = httptest.NewRecorder()
+	s3, err := sm.SessionManager(rr, req)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	if s3.SessionID() == s1.SessionID() || len(rr.Result().Cookies()) != 1 {
+		t.Errorf("Expected a new session and cookie for a forged cookie")
+	}
+
+	bad := scfg
+	bad.CookieKeys = nil
+	if _, err := i.NewSesmanWithRepository(inmem.New(), &bad); err == nil {
+		t.Errorf("Expected error for encryption keys without signing keys")
+	}
+}
+
+func TestStrictSessionID(t *testing.T) {
+
+	scfg := *cfg
+	scfg.StrictSessionID = true
+
+	sm, err := i.NewSesmanWithRepository(inmem.New(), &scfg)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: scfg.CookieName, Value: "attacker-chosen-sid"})
+	rr := httptest.NewRecorder()
+	s1, err := sm.SessionManager(rr, req)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	if s1.SessionID() == "attacker-chosen-sid" {
+		t.Errorf("Unexpected session created with the client supplied id")
+	}
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != s1.SessionID() {
+		t.Errorf("Expected a cookie with the new session id %v, got %v", s1.SessionID(), cookies)
+	}
+
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[0])
+	rr = httptest.NewRecorder()
+	s2, err := sm.SessionManager(rr, req)
+	if err != nil || s2.SessionID() != s1.SessionID() {
+		t.Errorf("Expected the known session %v, got %v, %v", s1.SessionID(), s2, err)
+	}
+	if len(rr.Result().Cookies()) != 0 {
+		t.Errorf("Unexpected cookie for a known session id")
+	}
+
+	// a session expiring between the check and the lookup is not created again under the client supplied id
+	racing := &expiringStore{SessionStoreProvider: inmem.New()}
+	sm, err = i.NewSesmanWithRepository(racing, &scfg)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: scfg.CookieName, Value: "attacker-chosen-sid"})
+	s3, err := sm.SessionManager(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	if s3.SessionID() == "attacker-chosen-sid" || racing.SessionStoreProvider.Exists("attacker-chosen-sid") {
+		t.Errorf("Unexpected session created with the client supplied id")
+	}
+}
+
+// expiringStore is a memory provider whose sessions all exist when checked and expire right after
+type expiringStore struct {
+	*inmem.SessionStoreProvider
+}
+
+func (p *expiringStore) Exists(sid string) bool {
+	return true
+}
+
+func TestRegenerate(t *testing.T) {
+
+	sm, err := i.NewSesmanWithRepository(inmem.New(), cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	rr := httptest.NewRecorder()
+	s1, _ := sm.SessionManager(rr, req)
+	if err := s1.Set("cart", "3 items"); err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(rr.Result().Cookies()[0])
+	rr = httptest.NewRecorder()
+	s2, err := sm.Regenerate(rr, req)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	if s2.SessionID() == s1.SessionID() || s2.Get("cart") != "3 items" {
+		t.Errorf("Expected a new session id keeping the data, got %v %v", s2.SessionID(), s2.Get("cart"))
+	}
+	if ok, _ := sm.Exists(httptest.NewRecorder(), req); ok {
+		t.Errorf("Expected the old session id to be removed")
+	}
+
+	// SessionAuth rotates the id and keeps the data as well
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(rr.Result().Cookies()[0])
+	rr = httptest.NewRecorder()
+	if err := sm.SessionAuth(rr, req, "at", "rt", "uid"); err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(rr.Result().Cookies()[0])
+	s3, err := sm.SessionManager(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	if s3.SessionID() == s2.SessionID() || s3.Get("cart") != "3 items" || s3.Get("state") != "Authed" {
+		t.Errorf("Unexpected authed session %v cart=%v state=%v", s3.SessionID(), s3.Get("cart"), s3.Get("state"))
+	}
+
+	req, _ = http.NewRequest("GET", "/", nil)
+	if _, err := sm.Regenerate(httptest.NewRecorder(), req); err != i.ErrUnknownSessionID {
+		t.Errorf("Expected ErrUnknownSessionID, got %v", err)
+	}
+}
+
+// newRequest returns a request carrying the session cookie set in the response, if any, or the cookie
+func newRequest(rr *httptest.ResponseRecorder, cookie *http.Cookie) (*http.Request, *http.Cookie) {
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == cfg.CookieName {
+			cookie = c
+		}
+	}
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	return req, cookie
+}
+
+func TestAbsoluteTimeout(t *testing.T) {
+
+	scfg := *cfg
+	scfg.AbsoluteTimeout = 1
+	scfg.StrictSessionID = true
+
+	sm, err := i.NewSesmanWithRepository(inmem.New(), &scfg)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	rr := httptest.NewRecorder()
+	s1, _ := sm.SessionManager(rr, req)
+	_ = s1.Set("cart", "3 items")
+	req, cookie := newRequest(rr, nil)
+
+	// the session is used all along, but not past the absolute timeout
+	deadline := time.Now().Add(2100 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		req, cookie = newRequest(rr, cookie)
+		rr = httptest.NewRecorder()
+		if _, err := sm.SessionManager(rr, req); err != nil {
+			t.Fatalf("Unexpected error %#v", err.Error())
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+
+	req, _ = newRequest(rr, cookie)
+	s2, err := sm.SessionManager(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	if s2.SessionID() == s1.SessionID() || s2.Get("cart") != nil {
+		t.Errorf("Expected a new session past the absolute timeout, got %v with cart %v", s2.SessionID(), s2.Get("cart"))
+	}
+}
+
+func TestRenewalTimeout(t *testing.T) {
+
+	scfg := *cfg
+	scfg.RenewalTimeout = 1
+
+	sm, err := i.NewSesmanWithRepository(inmem.New(), &scfg)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	rr := httptest.NewRecorder()
+	s1, _ := sm.SessionManager(rr, req)
+	_ = s1.Set("cart", "3 items")
+	req, cookie := newRequest(rr, nil)
+
+	rr = httptest.NewRecorder()
+	s2, _ := sm.SessionManager(rr, req)
+	if s2.SessionID() != s1.SessionID() || len(rr.Result().Cookies()) != 0 {
+		t.Errorf("Unexpected renewal before the renewal timeout")
+	}
+
+	time.Sleep(2100 * time.Millisecond)
+
+	req, _ = newRequest(rr, cookie)
+	rr = httptest.NewRecorder()
+	s3, err := sm.SessionManager(rr, req)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	if s3.SessionID() == s1.SessionID() || s3.Get("cart") != "3 items" {
+		t.Errorf("Expected the session id renewed keeping the data, got %v with cart %v", s3.SessionID(), s3.Get("cart"))
+	}
+	req, _ = newRequest(rr, cookie)
+	if s4, _ := sm.SessionManager(httptest.NewRecorder(), req); s4.SessionID() != s3.SessionID() {
+		t.Errorf("Expected the renewed session %v, got %v", s3.SessionID(), s4.SessionID())
+	}
+}
+
+func TestMetrics(t *testing.T) {
+
+	sm, err := i.NewSesmanWithRepository(inmem.New(), cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	if _, err := sm.SessionManager(rr, req); err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	req, cookie := newRequest(rr, nil)
+
+	req.Header.Set("X-Session-State", "InAuth")
+	if _, err := sm.ChangeState(httptest.NewRecorder(), req); err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	rr = httptest.NewRecorder()
+	if _, err := sm.Regenerate(rr, req); err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	req, _ = newRequest(rr, cookie)
+	sm.Destroy(httptest.NewRecorder(), req)
+
+	sm.AddBlacklisting("10.0.0.1", "/", nil)
+	sm.IsBlackListed("10.0.0.1")
+	sm.IsBlackListed("10.0.0.2")
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	sm.MetricsHandler().ServeHTTP(rr, req)
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %v", ct)
+	}
+
+	body := rr.Body.String()
+	for _, line := range []string{
+		"ivmsesman_sessions_created_total 1",
+		"ivmsesman_sessions_regenerated_total 1",
+		"ivmsesman_sessions_destroyed_total 1",
+		"ivmsesman_blacklist_hits_total 1",
+		`ivmsesman_session_state_transitions_total{state="InAuth"} 1`,
+		`ivmsesman_store_operation_duration_seconds_count{method="NewSession"} 1`,
+		`ivmsesman_store_operation_duration_seconds_count{method="Regenerate"} 1`,
+		`ivmsesman_store_operation_errors_total{method="DestroySID"} 0`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected line %q in\n%s", line, body)
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+
+	scfg := *cfg
+	scfg.Maxlifetime = 1
+
+	pder := inmem.New()
+	sm, err := i.NewSesmanWithRepository(pder, &scfg)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+
+	var events []i.Event
+	sm.AddEventSink(i.EventSinkFunc(func(ctx context.Context, e i.Event) {
+		events = append(events, e)
+	}))
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	s1, _ := sm.SessionManager(rr, req)
+	req, cookie := newRequest(rr, nil)
+
+	req.Header.Set("X-Session-State", "InAuth")
+	if _, err := sm.ChangeState(httptest.NewRecorder(), req); err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	rr = httptest.NewRecorder()
+	if err := sm.SessionAuth(rr, req, "at", "rt", "uid-1"); err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	req, cookie = newRequest(rr, cookie)
+	sm.Destroy(httptest.NewRecorder(), req)
+
+	// an idle session removed by the repository GC
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/", nil)
+	s2, _ := sm.SessionManager(rr, req)
+	time.Sleep(2100 * time.Millisecond)
+	pder.SessionGC(1)
+
+	want := []i.Event{
+		{Type: i.SessionCreated, SessionID: s1.SessionID(), NewState: "New"},
+		{Type: i.SessionStateChanged, SessionID: s1.SessionID(), OldState: "New", NewState: "InAuth"},
+		{Type: i.SessionAuthenticated, OldSessionID: s1.SessionID(), OldState: "InAuth", NewState: "Authed", UserID: "uid-1"},
+		{Type: i.SessionDestroyed, OldState: "Authed", Reason: i.ReasonDestroyed},
+		{Type: i.SessionCreated, SessionID: s2.SessionID(), NewState: "New"},
+		{Type: i.SessionExpired, SessionID: s2.SessionID(), Reason: i.ReasonTimeout},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("Expected %d events, got %d: %+v", len(want), len(events), events)
+	}
+	authed := events[2].SessionID
+	want[2].SessionID, want[3].SessionID = authed, authed
+	for n, e := range events {
+		if e.Time.IsZero() {
+			t.Errorf("Event %d: missing time", n)
+		}
+		e.Time = time.Time{}
+		if e != want[n] {
+			t.Errorf("Event %d: expected %+v, got %+v", n, want[n], e)
+		}
+	}
+	if authed == "" || authed == s1.SessionID() {
+		t.Errorf("Expected the authenticated session under a new id, got %q", authed)
+	}
+}
+
+// panickingGC is a memory provider whose SessionGC panics on the first run
+type panickingGC struct {
+	*inmem.SessionStoreProvider
+	runs int32
+}
+
+func (p *panickingGC) SessionGC(maxlifetime int64) {
+	if atomic.AddInt32(&p.runs, 1) == 1 {
+		panic("store unavailable")
+	}
+	p.SessionStoreProvider.SessionGC(maxlifetime)
+}
+
+func TestScheduler(t *testing.T) {
+
+	scfg := *cfg
+	scfg.Maxlifetime = 1
+	scfg.SchedulerJitter = -1
+
+	pder := &panickingGC{SessionStoreProvider: inmem.New()}
+	sm, err := i.NewSesmanWithRepository(pder, &scfg)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := sm.Start(ctx); err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	if err := sm.Start(ctx); err == nil {
+		t.Errorf("Expected error starting the scheduler twice")
+	}
+
+	time.Sleep(2500 * time.Millisecond)
+
+	st := sm.SchedulerStats()[i.JobGC]
+	if !st.Scheduled || st.Runs != 2 || st.Panics != 1 || st.LastPanic != "store unavailable" {
+		t.Errorf("Unexpected GC stats %+v", st)
+	}
+	if _, ok := sm.SchedulerStats()[i.JobBLClean]; ok {
+		t.Errorf("Unexpected blacklist cleaning without BLCleanInterval")
+	}
+
+	// the jobs stop with the context and can be started again
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for sm.SchedulerStats()[i.JobGC].Scheduled && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sm.SchedulerStats()[i.JobGC].Scheduled {
+		t.Fatalf("Expected the GC stopped with the context")
+	}
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+
+	if err := sm.Close(); err != nil {
+		t.Errorf("Unexpected error %#v", err.Error())
+	}
+	if sm.SchedulerStats()[i.JobGC].Scheduled {
+		t.Errorf("Expected the GC stopped by Close")
+	}
+	if err := sm.Start(context.Background()); err != i.ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
+
+// slowStore is a memory provider with the latency of a network store on the session lookups
+type slowStore struct {
+	*inmem.SessionStoreProvider
+	delay   time.Duration
+	lookups int32
+}
+
+func (p *slowStore) FindOrCreate(sid string) (i.SessionStore, error) {
+	atomic.AddInt32(&p.lookups, 1)
+	time.Sleep(p.delay)
+	return p.SessionStoreProvider.FindOrCreate(sid)
+}
+
+// newSessions creates n sessions and returns their cookies
+func newSessions(t testing.TB, sm *i.Sesman, n int) []*http.Cookie {
+	cookies := make([]*http.Cookie, n)
+	for k := range cookies {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		if _, err := sm.SessionManager(rr, req); err != nil {
+			t.Fatalf("Unexpected error %#v", err.Error())
+		}
+		_, cookies[k] = newRequest(rr, nil)
+	}
+	return cookies
+}
+
+func TestConcurrentSessions(t *testing.T) {
+
+	pder := &slowStore{SessionStoreProvider: inmem.New(), delay: 50 * time.Millisecond}
+	sm, err := i.NewSesmanWithRepository(pder, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	cookies := newSessions(t, sm, 20)
+
+	// the requests of different sessions do not wait for each other
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, c := range cookies {
+		wg.Add(1)
+		go func(c *http.Cookie) {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.AddCookie(c)
+			if ss, err := sm.SessionManager(httptest.NewRecorder(), req); err != nil || ss.SessionID() != c.Value {
+				t.Errorf("Unexpected session %v, error %v", ss, err)
+			}
+		}(c)
+	}
+	wg.Wait()
+	if d := time.Since(start); d > 10*pder.delay {
+		t.Errorf("Expected the sessions served in parallel, took %v", d)
+	}
+
+	// the concurrent requests of a session share the lookup
+	atomic.StoreInt32(&pder.lookups, 0)
+	for k := 0; k < 20; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.AddCookie(cookies[0])
+			if ss, err := sm.SessionManager(httptest.NewRecorder(), req); err != nil || ss.SessionID() != cookies[0].Value {
+				t.Errorf("Unexpected session %v, error %v", ss, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&pder.lookups); n >= 20 {
+		t.Errorf("Expected the lookups shared, got %d for 20 requests", n)
+	}
+}
+
+// bufferedStore is a memory provider whose sessions write their changes behind, counting the saves
+type bufferedStore struct {
+	*inmem.SessionStoreProvider
+	saves int32
+}
+
+func (p *bufferedStore) NewSession(sid string) (i.SessionStore, error) {
+	ss, err := p.SessionStoreProvider.NewSession(sid)
+	return &bufferedSession{SessionStore: ss, pder: p}, err
+}
+
+func (p *bufferedStore) FindOrCreate(sid string) (i.SessionStore, error) {
+	ss, err := p.SessionStoreProvider.FindOrCreate(sid)
+	return &bufferedSession{SessionStore: ss, pder: p}, err
+}
+
+type bufferedSession struct {
+	i.SessionStore
+	pder     *bufferedStore
+	mu       sync.Mutex
+	buffered int
+	dirty    map[interface{}]interface{}
+}
+
+func (s *bufferedSession) Set(key, value interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buffered > 0 {
+		s.dirty[key] = value
+		return nil
+	}
+	return s.SessionStore.Set(key, value)
+}
+
+func (s *bufferedSession) Buffer(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dirty == nil {
+		s.dirty = make(map[interface{}]interface{})
+	}
+	s.buffered++
+}
+
+func (s *bufferedSession) Save(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.dirty) == 0 {
+		return nil
+	}
+	atomic.AddInt32(&s.pder.saves, 1)
+	for k, v := range s.dirty {
+		if err := s.SessionStore.Set(k, v); err != nil {
+			return err
+		}
+	}
+	s.dirty = make(map[interface{}]interface{})
+	return nil
+}
+
+func (s *bufferedSession) Release(ctx context.Context) error {
+	err := s.Save(ctx)
+	s.mu.Lock()
+	s.buffered--
+	s.mu.Unlock()
+	return err
+}
+
+func (s *bufferedSession) Discard(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dirty = make(map[interface{}]interface{})
+}
+
+func TestWriteBehind(t *testing.T) {
+
+	pder := &bufferedStore{SessionStoreProvider: inmem.New()}
+	sm, err := i.NewSesmanWithRepository(pder, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	c := newSessions(t, sm, 1)[0]
+
+	stored := func(key string) interface{} {
+		ss, _ := pder.SessionStoreProvider.FindOrCreate(c.Value)
+		return ss.Get(key)
+	}
+
+	h := sm.MWManager(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ss, _ := r.Context().Value(i.SessionObjKey).(i.SessionStore)
+		for _, k := range []string{"a", "b", "c"} {
+			_ = ss.Set(k, "v")
+		}
+		if v := stored("a"); v != nil {
+			t.Errorf("Expected the changes buffered during the request, got %#v", v)
+		}
+
+		// a handler can write the changes before the response
+		_ = ss.Set("redirect", "/login")
+		if err := sm.Save(r.Context(), ss); err != nil {
+			t.Errorf("Unexpected error %#v", err.Error())
+		}
+		if v := stored("redirect"); v != "/login" {
+			t.Errorf("Expected the changes saved by Save, got %#v", v)
+		}
+		_ = ss.Set("d", "v")
+	}))
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.AddCookie(c)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if v := stored("d"); v != "v" {
+		t.Errorf("Expected the changes saved after the request, got %#v", v)
+	}
+	if n := atomic.LoadInt32(&pder.saves); n != 2 {
+		t.Errorf("Expected 2 saves, got %d", n)
+	}
+
+	// the stores writing every change have nothing to save
+	ss, _ := pder.SessionStoreProvider.FindOrCreate(c.Value)
+	if err := sm.Save(context.Background(), ss); err != nil {
+		t.Errorf("Unexpected error %#v", err.Error())
+	}
+}
+
+func TestWriteBehindRegenerate(t *testing.T) {
+
+	pder := &bufferedStore{SessionStoreProvider: inmem.New()}
+	sm, err := i.NewSesmanWithRepository(pder, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	c := newSessions(t, sm, 1)[0]
+
+	var newsid string
+	h := sm.MWManager(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ss, _ := r.Context().Value(i.SessionObjKey).(i.SessionStore)
+		_ = ss.Set("cart", "3 items")
+
+		ns, err := sm.Regenerate(w, r)
+		if err != nil {
+			t.Fatalf("Unexpected error %#v", err.Error())
+		}
+		newsid = ns.SessionID()
+
+		// the session of the request context is left under the old id
+		_ = ss.Set("late", "v")
+	}))
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.AddCookie(c)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if n := atomic.LoadInt32(&pder.saves); n != 1 {
+		t.Errorf("Expected only the save before the regeneration, got %d saves", n)
+	}
+	if pder.SessionStoreProvider.Exists(c.Value) {
+		t.Errorf("Expected the old session id written no more after the regeneration")
+	}
+	ss, _ := pder.SessionStoreProvider.FindOrCreate(newsid)
+	if ss.Get("cart") != "3 items" || ss.Get("late") != nil {
+		t.Errorf("Expected the changes before the regeneration only, got %#v %#v", ss.Get("cart"), ss.Get("late"))
+	}
+}
+
+func TestCachedRepository(t *testing.T) {
+
+	// the memory provider hidden behind the interface does not regenerate session ids
+	repo := cache.New(struct{ i.SessionRepository }{inmem.New()}, cache.Options{})
+	sm, err := i.NewSesmanWithRepository(repo, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	c := newSessions(t, sm, 1)[0]
+
+	for k := 0; k < 3; k++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.AddCookie(c)
+		if ss, err := sm.SessionManager(httptest.NewRecorder(), req); err != nil || ss.SessionID() != c.Value {
+			t.Errorf("Unexpected session %v, error %v", ss, err)
+		}
+	}
+	if st := repo.Stats(); st.Hits == 0 {
+		t.Errorf("Expected the session served from the cache, got %+v", st)
+	}
+
+	// SessionAuth falls back to a new session when the cached repository can not regenerate
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.AddCookie(c)
+	if err := sm.SessionAuth(rr, req, "at", "rt", "uid"); err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	_, nc := newRequest(rr, nil)
+	if nc == nil || nc.Value == c.Value {
+		t.Fatalf("Expected a new session cookie, got %v", nc)
+	}
+	if repo.Exists(c.Value) {
+		t.Errorf("Expected the old session destroyed")
+	}
+	ss, _ := repo.FindOrCreate(nc.Value)
+	if state, _ := ss.Get("state").(string); state != "Authed" {
+		t.Errorf("Expected state `Authed`, got %#v", ss.Get("state"))
+	}
+
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(nc)
+	if _, err := sm.Regenerate(httptest.NewRecorder(), req); err != i.ErrRegenerateNotSupported {
+		t.Errorf("Expected ErrRegenerateNotSupported, got %v", err)
+	}
+}
+
+func TestBoundedMemory(t *testing.T) {
+
+	pder := inmem.NewWithOptions(inmem.Options{MaxSessions: 2})
+	sm, err := i.NewSesmanWithRepository(pder, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	var evicted []string
+	sm.AddEventSink(i.EventSinkFunc(func(ctx context.Context, e i.Event) {
+		if e.Type == i.SessionEvicted {
+			evicted = append(evicted, e.SessionID)
+		}
+	}))
+
+	c := newSessions(t, sm, 3)
+	if len(evicted) != 1 || evicted[0] != c[0].Value {
+		t.Errorf("Expected the first session evicted, got %v", evicted)
+	}
+
+	// a full store refusing new sessions fails the requests without one
+	pder = inmem.NewWithOptions(inmem.Options{MaxSessions: 1, OnFull: inmem.RefuseNew})
+	sm, err = i.NewSesmanWithRepository(pder, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	c = newSessions(t, sm, 1)
+	h := sm.MWManager(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 503 with Retry-After, got %d %v", rr.Code, rr.Header())
+	}
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(c[0])
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected the request of the existing session served, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	sm.MetricsHandler().ServeHTTP(rr, req)
+	if body := rr.Body.String(); !strings.Contains(body, "ivmsesman_sessions_refused_total 1\n") {
+		t.Errorf("Expected a refused session in\n%s", body)
+	}
+}
+
+func TestSnapshotRestart(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "sessions.snap")
+	scfg := *cfg
+	scfg.SnapshotInterval = 3600
+
+	sm, err := i.NewSesmanWithRepository(inmem.NewWithOptions(inmem.Options{SnapshotPath: path}), &scfg)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	if st := sm.SchedulerStats()[i.JobSnapshot]; !st.Scheduled {
+		t.Errorf("Expected the snapshot job scheduled, got %+v", st)
+	}
+	c := newSessions(t, sm, 1)[0]
+
+	// Close takes the final snapshot, the next session manager restores it
+	if err := sm.Close(); err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	sm, err = i.NewSesmanWithRepository(inmem.NewWithOptions(inmem.Options{SnapshotPath: path}), &scfg)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	defer sm.Close()
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.AddCookie(c)
+	if ok, err := sm.Exists(httptest.NewRecorder(), req); !ok {
+		t.Errorf("Expected the session restored after the restart, error %v", err)
+	}
+}
+
+func TestDiskRestart(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "sessions.log")
+
+	repo, err := disk.New(disk.Options{Path: path})
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	sm, err := i.NewSesmanWithRepository(repo, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	c := newSessions(t, sm, 1)[0]
+	sm.Close()
+	repo.Close()
+
+	// the next process reads the sessions from the log
+	repo, err = disk.New(disk.Options{Path: path})
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	defer repo.Close()
+	sm, err = i.NewSesmanWithRepository(repo, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	defer sm.Close()
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.AddCookie(c)
+	if ok, err := sm.Exists(httptest.NewRecorder(), req); !ok {
+		t.Errorf("Expected the session kept after the restart, error %v", err)
+	}
+}
+
+func TestListSessions(t *testing.T) {
+
+	sm, err := i.NewSesmanWithRepository(cache.New(inmem.New(), cache.Options{}), cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	defer sm.Close()
+	newSessions(t, sm, 3)
+
+	ctx := context.Background()
+	seen, cursor := 0, ""
+	for pages := 1; ; pages++ {
+		page, next, err := sm.ListSessions(ctx, i.SessionFilter{State: "New"}, cursor, 2)
+		if err != nil {
+			t.Fatalf("Unexpected error %#v", err.Error())
+		}
+		seen += len(page)
+		if next == "" {
+			if pages != 2 {
+				t.Errorf("Expected 2 pages, got %d", pages)
+			}
+			break
+		}
+		cursor = next
+	}
+	if seen != 3 {
+		t.Errorf("Expected the 3 sessions listed, got %d", seen)
+	}
+
+	// a repository not implementing SessionLister
+	sm, err = i.NewSesmanWithRepository(struct{ i.SessionRepository }{inmem.New()}, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	defer sm.Close()
+	if _, _, err := sm.ListSessions(ctx, i.SessionFilter{}, "", 0); err != i.ErrListNotSupported {
+		t.Errorf("Expected ErrListNotSupported, got %v", err)
+	}
+}
+
+func TestInvalidationBus(t *testing.T) {
+
+	// two replicas with their own cache over a shared store
+	store, bus := inmem.New(), i.NewLocalBus()
+	cfgBus := *cfg
+	cfgBus.InvalidationBus = bus
+
+	replica := func() (*i.Sesman, *cache.SessionProvider) {
+		repo := cache.New(store, cache.Options{TTL: time.Hour})
+		sm, err := i.NewSesmanWithRepository(repo, &cfgBus)
+		if err != nil {
+			t.Fatalf("Unexpected error %#v", err.Error())
+		}
+		return sm, repo
+	}
+	a, _ := replica()
+	b, cb := replica()
+	defer a.Close()
+	defer b.Close()
+
+	c := newSessions(t, a, 1)[0]
+	serve := func(sm *i.Sesman) i.SessionStore {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.AddCookie(c)
+		ss, err := sm.SessionManager(httptest.NewRecorder(), req)
+		if err != nil {
+			t.Fatalf("Unexpected error %#v", err.Error())
+		}
+		return ss
+	}
+
+	// the session changed on a replica is read again from the store by the other one
+	serve(b)
+	misses := cb.Stats().Misses
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.AddCookie(c)
+	req.Header.Set("X-Session-State", "Visited")
+	if _, err := a.ChangeState(httptest.NewRecorder(), req); err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	if state := serve(b).Get("state"); state != "Visited" || cb.Stats().Misses != misses+1 {
+		t.Errorf("Expected the state changed on the other replica read from the store, got %#v", state)
+	}
+
+	// the session destroyed on a replica is dropped by the other one
+	a.Destroy(httptest.NewRecorder(), req)
+	if cb.Exists(c.Value) {
+		t.Errorf("Expected the session destroyed on the other replica dropped from its cache")
+	}
+
+	// a replica closed leaves the bus
+	a.Close()
+	serve(b)
+	misses = cb.Stats().Misses
+	if err := bus.Publish(context.Background(), i.Invalidation{Origin: "other", SessionIDs: []string{c.Value}}); err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	serve(b)
+	if cb.Stats().Misses != misses+1 {
+		t.Errorf("Expected the published session read again from the store")
+	}
+}
+
+func TestInvalidationBusSharedStore(t *testing.T) {
+
+	// two session managers of a process over one memory store
+	for name, store := range map[string]i.SessionRepository{"inmem": inmem.New(), "sharded": inmem.NewSharded(4, inmem.Options{})} {
+		t.Run(name, func(t *testing.T) {
+			cfgBus := *cfg
+			cfgBus.InvalidationBus = i.NewLocalBus()
+			a, err := i.NewSesmanWithRepository(store, &cfgBus)
+			if err != nil {
+				t.Fatalf("Unexpected error %#v", err.Error())
+			}
+			defer a.Close()
+			b, err := i.NewSesmanWithRepository(store, &cfgBus)
+			if err != nil {
+				t.Fatalf("Unexpected error %#v", err.Error())
+			}
+			defer b.Close()
+
+			c := newSessions(t, a, 1)[0]
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.AddCookie(c)
+			req.Header.Set("X-Session-State", "Visited")
+			if _, err := a.ChangeState(httptest.NewRecorder(), req); err != nil {
+				t.Fatalf("Unexpected error %#v", err.Error())
+			}
+
+			// the invalidation published by a does not drop the only copy of the session
+			if !store.Exists(c.Value) {
+				t.Fatalf("Expected the changed session kept in the shared store")
+			}
+			req, _ = http.NewRequest("GET", "/", nil)
+			req.AddCookie(c)
+			ss, err := b.SessionManager(httptest.NewRecorder(), req)
+			if err != nil {
+				t.Fatalf("Unexpected error %#v", err.Error())
+			}
+			if ss.SessionID() != c.Value || ss.Get("state") != "Visited" {
+				t.Errorf("Expected the changed session served by the other manager, got %v in state %#v", ss.SessionID(), ss.Get("state"))
+			}
+		})
+	}
+}
+
+// BenchmarkSessionManagerParallel reports the requests served per second against a store with 1ms lookups,
+// for requests spread over many sessions and for requests of a single session
+func BenchmarkSessionManagerParallel(b *testing.B) {
+
+	for _, bc := range []struct {
+		name     string
+		sessions int
+	}{
+		{"distinct", 1000},
+		{"same", 1},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			pder := &slowStore{SessionStoreProvider: inmem.New(), delay: time.Millisecond}
+			sm, err := i.NewSesmanWithRepository(pder, cfg)
+			if err != nil {
+				b.Fatalf("Unexpected error %#v", err.Error())
+			}
+			cookies := newSessions(b, sm, bc.sessions)
+
+			var next int64
+			b.SetParallelism(64)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					req, _ := http.NewRequest("GET", "/", nil)
+					req.AddCookie(cookies[atomic.AddInt64(&next, 1)%int64(len(cookies))])
+					if _, err := sm.SessionManager(httptest.NewRecorder(), req); err != nil {
+						b.Errorf("Unexpected error %#v", err.Error())
+					}
+				}
+			})
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "req/s")
+		})
+	}
+}
+
 // ############# Testing Firestore Provider ###############
+
+// newFirestoreProvider creates the provider against the Firestore emulator.
+// The test is skipped when FIRESTORE_EMULATOR_HOST is not set.
+func newFirestoreProvider(t *testing.T) *firestoredb.SessionProvider {
+	t.Helper()
+
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST is not set")
+	}
+	client, err := firestore.NewClient(context.Background(), cfg.ProjectID)
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	t.Cleanup(func() { client.Close() })
+
+	pder, err := firestoredb.New(client, firestoredb.Options{})
+	if err != nil {
+		t.Fatalf("Unexpected error %#v", err.Error())
+	}
+	return pder
+}
+
+func TestFirestoreConformance(t *testing.T) {
+	sesmantest.RunConformance(t, func(t *testing.T) i.SessionRepository {
+		return newFirestoreProvider(t)
+	})
+}
+
 // Testing create a New Session - firestore
 func TestFirestoreNewSession(t *testing.T) {
 
 	var err error
 	sid = ""
 
-	gsm, err = i.NewSesman(i.Firestore, cfg)
+	gsm, err = i.NewSesmanWithRepository(newFirestoreProvider(t), cfg)
 	if err != nil {
 		t.Errorf("Unexpected error %#v", err.Error())
 	}
@@ -0,0 +1,40 @@
+package ivmsesman
+
+import "context"
+
+// SessionRecord is a session with its times, as copied from a repository to another
+type SessionRecord struct {
+	ID           string                 `json:"id"`
+	CreatedAt    int64                  `json:"created_at"`
+	TimeAccessed int64                  `json:"time_accessed"`
+	Values       map[string]interface{} `json:"values"`
+}
+
+// BlacklistRecord is a blacklisted ip, as copied from a repository to another
+type BlacklistRecord struct {
+	IP         string      `json:"ip"`
+	Created    int64       `json:"created"`
+	RequestURI string      `json:"request_uri"`
+	Details    interface{} `json:"details,omitempty"`
+}
+
+// SessionExporter is implemented by the repositories which can read all their sessions, the source of a
+// migration to another repository
+type SessionExporter interface {
+	// ExportSessions calls fn with every live session whose id is greater than after, in the order of the
+	// ids, until fn returns an error. An empty after starts from the first session.
+	ExportSessions(ctx context.Context, after string, fn func(SessionRecord) error) error
+
+	// ExportBlacklist calls fn with every blacklisted ip until fn returns an error
+	ExportBlacklist(ctx context.Context, fn func(BlacklistRecord) error) error
+}
+
+// SessionImporter is implemented by the repositories which can write sessions keeping their ids and times,
+// the target of a migration from another repository
+type SessionImporter interface {
+	// ImportSessions writes the sessions, replacing the ones with the same id
+	ImportSessions(ctx context.Context, sessions []SessionRecord) error
+
+	// ImportBlacklist writes the blacklisted ips, replacing the ones already in the blacklist
+	ImportBlacklist(ctx context.Context, entries []BlacklistRecord) error
+}